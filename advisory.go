@@ -0,0 +1,79 @@
+package httpseverywhere
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Advisory flags a rewrite as less certain to work than a plain upgrade of
+// the same URL. Flags are combined with bitwise or.
+type Advisory uint
+
+const (
+	// AdvisoryExclusions means the rule set has exclusions, so upstream knows
+	// of parts of the site that break over HTTPS.
+	AdvisoryExclusions Advisory = 1 << iota
+	// AdvisoryHostMoved means the rewrite moves the request to a different
+	// host.
+	AdvisoryHostMoved
+	// AdvisoryWildcardTarget means the host is only covered by a wildcard
+	// target, which may include hosts upstream never tested.
+	AdvisoryWildcardTarget
+	// AdvisoryAlias means the host isn't covered by any rule set itself and
+	// was rewritten by the rule set of its www or apex alias.
+	AdvisoryAlias
+)
+
+var advisoryNames = []string{"exclusions", "host-moved", "wildcard-target", "alias"}
+
+func (a Advisory) String() string {
+	var names []string
+	for i, name := range advisoryNames {
+		if a&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// WithSoftLaunch only applies rewrites whose advisories are all included in
+// accept, so that upgrades can be rolled out starting with the most certain
+// ones, for example WithSoftLaunch(0) for plain upgrades only, and expanded
+// gradually. Evaluate still reports rewrites that were held back, with their
+// advisories.
+func WithSoftLaunch(accept Advisory) Option {
+	return func(h *Engine) {
+		h.softLaunch = true
+		h.acceptAdvisories = accept
+	}
+}
+
+// advisories returns the advisories for the given ruleset rewriting the given
+// URL to rewritten. The ruleset is nil if the URL was only changed by a
+// Normalizer.
+func advisories(u *url.URL, rewritten string, rs *ruleset) Advisory {
+	var a Advisory
+	if parsed, err := url.Parse(rewritten); err != nil || !strings.EqualFold(parsed.Hostname(), u.Hostname()) {
+		a |= AdvisoryHostMoved
+	}
+	if rs == nil {
+		return a
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case !rs.matchesHost(host) && rs.matchesHost(aliasHost(host)):
+		a |= AdvisoryAlias
+	case !containsString(rs.target, host):
+		a |= AdvisoryWildcardTarget
+	}
+	if len(rs.compiled().exclusion) > 0 {
+		a |= AdvisoryExclusions
+	}
+	return a
+}
+
+// heldBack returns whether or not soft launch mode holds back a rewrite with
+// the given advisories.
+func (h *Engine) heldBack(a Advisory) bool {
+	return h.softLaunch && a&^h.acceptAdvisories != 0
+}
@@ -0,0 +1,65 @@
+package httpseverywhere
+
+import (
+	"net/url"
+	"strings"
+)
+
+// WithAliasFolding makes a URL whose host isn't covered by any rule set use
+// the rule sets covering the host's www or apex variant instead, so
+// "example.com" uses the rule sets for "www.example.com" and vice versa, since
+// many upstream rule sets only list one of the two. The rules are still
+// matched against the URL as is, so only rules that allow for either form
+// apply. It has no effect with WithStrictTargets.
+func WithAliasFolding() Option {
+	return func(h *Engine) {
+		h.foldAliases = true
+	}
+}
+
+// aliasHost returns the www or apex variant of the given host, or an empty
+// string if it doesn't have one.
+func aliasHost(host string) string {
+	if strings.HasPrefix(host, "www.") {
+		apex := host[len("www."):]
+		if !strings.Contains(apex, ".") {
+			return ""
+		}
+		return apex
+	}
+	if !strings.Contains(host, ".") {
+		return ""
+	}
+	return "www." + host
+}
+
+// rewriteAlias rewrites the given URL, whose host isn't covered by any rule
+// set, using the rule sets covering the alias of its host if alias folding is
+// enabled.
+func (h *Engine) rewriteAlias(u *url.URL, t *Tenant) (string, bool, *ruleset) {
+	if !h.foldAliases {
+		return "", false, nil
+	}
+	alias := aliasHost(u.Host)
+	if alias == "" {
+		return "", false, nil
+	}
+	aliasURL := *u
+	aliasURL.Host = alias
+	var cached *candidates
+	if h.cache != nil {
+		cached = h.cache.candidates(h, &aliasURL)
+	}
+	var first *ruleset
+	for _, idx := range h.lookupOrder {
+		if rs := h.candidate(idx, &aliasURL, cached); rs != nil {
+			if first == nil {
+				first = rs
+			}
+			if r, hit := h.rewriteWithRuleset(u, rs, t); hit || h.earlyExit {
+				return r, hit, decided(rs, hit, first)
+			}
+		}
+	}
+	return "", false, first
+}
@@ -0,0 +1,92 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// BenchmarkReport summarizes a run of BenchmarkSelf.
+type BenchmarkReport struct {
+	// Hit covers URLs whose hosts are targeted by a loaded rule set.
+	Hit BenchmarkResult `json:"hit"`
+	// Miss covers URLs whose hosts no rule set targets.
+	Miss BenchmarkResult `json:"miss"`
+}
+
+// BenchmarkResult summarizes the rewrites of one workload.
+type BenchmarkResult struct {
+	Requests  int           `json:"requests"`
+	Rewritten int           `json:"rewritten"`
+	Elapsed   time.Duration `json:"elapsed"`
+	// PerSecond is the number of rewrites per second.
+	PerSecond float64       `json:"per_second"`
+	P50       time.Duration `json:"p50"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+}
+
+// maxBenchmarkHosts caps the number of distinct hosts used for the hit workload.
+const maxBenchmarkHosts = 1000
+
+// BenchmarkSelf runs n rewrites of URLs with targeted hosts and n rewrites of
+// URLs with untargeted hosts against the loaded rules and reports throughput
+// and latency for each, so that embedders can check at startup how the rules
+// perform on the hardware they run on. The rewrites go through the Engine as
+// usual, so they're included in its timing stats and lookup cache. The hit
+// workload is empty if no rule sets with plain targets are loaded.
+func (h *Engine) BenchmarkSelf(n int) *BenchmarkReport {
+	var hits []*url.URL
+	for _, host := range h.benchmarkHosts() {
+		hits = append(hits, &url.URL{Scheme: "http", Host: host, Path: "/"})
+	}
+	misses := make([]*url.URL, 0, maxBenchmarkHosts)
+	for i := 0; i < maxBenchmarkHosts; i++ {
+		misses = append(misses, &url.URL{Scheme: "http", Host: fmt.Sprintf("benchmark-%d.invalid", i), Path: "/"})
+	}
+	return &BenchmarkReport{
+		Hit:  h.benchmark(hits, n),
+		Miss: h.benchmark(misses, n),
+	}
+}
+
+// benchmarkHosts returns up to maxBenchmarkHosts plain target hosts, in order.
+func (h *Engine) benchmarkHosts() []string {
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	hosts := make([]string, 0, len(plains))
+	for host := range plains {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	if len(hosts) > maxBenchmarkHosts {
+		hosts = hosts[:maxBenchmarkHosts]
+	}
+	return hosts
+}
+
+// benchmark rewrites n of the given URLs, cycling through them.
+func (h *Engine) benchmark(urls []*url.URL, n int) BenchmarkResult {
+	if len(urls) == 0 || n <= 0 {
+		return BenchmarkResult{}
+	}
+	result := BenchmarkResult{Requests: n}
+	durations := make([]time.Duration, 0, n)
+	start := h.clock.Now()
+	for i := 0; i < n; i++ {
+		before := h.clock.Now()
+		if _, hit := h.Rewrite(urls[i%len(urls)]); hit {
+			result.Rewritten++
+		}
+		durations = append(durations, h.clock.Now().Sub(before))
+	}
+	result.Elapsed = h.clock.Now().Sub(start)
+	if result.Elapsed > 0 {
+		result.PerSecond = float64(n) / result.Elapsed.Seconds()
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	result.P50 = durations[(n-1)*50/100]
+	result.P99 = durations[(n-1)*99/100]
+	result.Max = durations[n-1]
+	return result
+}
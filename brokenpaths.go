@@ -0,0 +1,185 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BrokenPath is a URL path reported as broken when upgraded to HTTPS, for
+// example a login page on a specific host. It acts as an exclusion on the rule
+// set covering the host, so that the rest of the host is still upgraded rather
+// than having to disable the whole rule set.
+type BrokenPath struct {
+	// Host is the host the path is broken on. It's lowercased and stripped of
+	// any port and trailing dot when reported.
+	Host string
+	// Path is the prefix of the broken paths, like "/login". If empty, the
+	// whole host is excluded.
+	Path string
+	// Reason records why the path was reported.
+	Reason string
+	// At records when the path was reported. It's set automatically if zero.
+	At time.Time
+}
+
+// PreferencesStore persists settings changed at runtime so that they survive
+// restarts.
+type PreferencesStore interface {
+	// LoadBrokenPaths returns the previously saved broken paths.
+	LoadBrokenPaths() ([]BrokenPath, error)
+	// SaveBrokenPaths replaces the saved broken paths with the given ones.
+	SaveBrokenPaths(paths []BrokenPath) error
+}
+
+// WithPreferencesStore loads broken paths from the given store when the Engine
+// is created and saves them to it whenever they change.
+func WithPreferencesStore(store PreferencesStore) Option {
+	return func(h *Engine) {
+		h.prefs = store
+	}
+}
+
+// brokenPaths holds broken paths keyed by host.
+type brokenPaths struct {
+	byHost hostMap // host -> []*BrokenPath
+	// mx serializes changes so that they're saved in order.
+	mx  sync.Mutex
+	all []*BrokenPath
+	// closed is set once the Engine is closed, after which nothing is saved.
+	closed bool
+}
+
+// loadBrokenPaths loads the broken paths saved in the preferences store, if
+// any.
+func (h *Engine) loadBrokenPaths() {
+	if h.prefs == nil {
+		return
+	}
+	paths, err := h.prefs.LoadBrokenPaths()
+	if err != nil {
+		h.log.Errorf("Unable to load broken paths: %v", err)
+		return
+	}
+	bp := &h.brokenPaths
+	bp.mx.Lock()
+	defer bp.mx.Unlock()
+	for i := range paths {
+		paths[i].Host = hostKey(paths[i].Host)
+		bp.add(&paths[i])
+	}
+}
+
+// ReportBrokenPath excludes URLs on the given host whose paths start with the
+// given path from being upgraded. It returns an error if no rule set covers
+// the host, since then nothing would be upgraded anyway, or if the broken
+// paths couldn't be saved to the preferences store, in which case the path
+// isn't excluded either. After Close, it returns ErrClosed.
+func (h *Engine) ReportBrokenPath(p BrokenPath) error {
+	p.Host = hostKey(p.Host)
+	if p.At.IsZero() {
+		p.At = h.clock.Now()
+	}
+	bp := &h.brokenPaths
+	bp.mx.Lock()
+	defer bp.mx.Unlock()
+	if bp.closed {
+		return ErrClosed
+	}
+	if h.rulesetFor(p.Host) == nil {
+		return fmt.Errorf("no rule set covers %v", p.Host)
+	}
+	if err := h.saveBrokenPaths(append(bp.all[:len(bp.all):len(bp.all)], &p)); err != nil {
+		return err
+	}
+	bp.add(&p)
+	return nil
+}
+
+// RemoveBrokenPaths removes all broken paths reported for the given host. If
+// the remaining paths couldn't be saved to the preferences store, they're all
+// kept.
+func (h *Engine) RemoveBrokenPaths(host string) error {
+	host = hostKey(host)
+	bp := &h.brokenPaths
+	bp.mx.Lock()
+	defer bp.mx.Unlock()
+	if bp.closed {
+		return ErrClosed
+	}
+	remaining := make([]*BrokenPath, 0, len(bp.all))
+	for _, p := range bp.all {
+		if p.Host != host {
+			remaining = append(remaining, p)
+		}
+	}
+	if err := h.saveBrokenPaths(remaining); err != nil {
+		return err
+	}
+	bp.byHost.update(host, func(old interface{}) interface{} {
+		return nil
+	})
+	bp.all = remaining
+	return nil
+}
+
+// BrokenPaths returns all broken paths in the order they were reported.
+func (h *Engine) BrokenPaths() []BrokenPath {
+	bp := &h.brokenPaths
+	bp.mx.Lock()
+	defer bp.mx.Unlock()
+	paths := make([]BrokenPath, 0, len(bp.all))
+	for _, p := range bp.all {
+		paths = append(paths, *p)
+	}
+	return paths
+}
+
+// close waits for any save in progress and stops further changes.
+func (bp *brokenPaths) close() {
+	bp.mx.Lock()
+	bp.closed = true
+	bp.mx.Unlock()
+}
+
+// add adds the given broken path. The caller must hold bp.mx.
+func (bp *brokenPaths) add(p *BrokenPath) {
+	bp.byHost.update(p.Host, func(old interface{}) interface{} {
+		existing, _ := old.([]*BrokenPath)
+		return append(existing[:len(existing):len(existing)], p)
+	})
+	bp.all = append(bp.all, p)
+}
+
+// saveBrokenPaths saves the given broken paths to the preferences store, if
+// any. The caller must hold h.brokenPaths.mx.
+func (h *Engine) saveBrokenPaths(all []*BrokenPath) error {
+	if h.prefs == nil {
+		return nil
+	}
+	paths := make([]BrokenPath, 0, len(all))
+	for _, p := range all {
+		paths = append(paths, *p)
+	}
+	return h.prefs.SaveBrokenPaths(paths)
+}
+
+// pathBroken returns whether or not the given URL has been reported broken.
+func (h *Engine) pathBroken(u *url.URL) bool {
+	if h.brokenPaths.byHost.len() == 0 {
+		return false
+	}
+	v, ok := h.brokenPaths.byHost.get(hostKey(u.Host))
+	if !ok {
+		return false
+	}
+	path := u.EscapedPath()
+	for _, p := range v.([]*BrokenPath) {
+		if strings.HasPrefix(path, p.Path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package httpseverywhere
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestFile is the name of the manifest written alongside preprocessed
+// bundles.
+const ManifestFile = "manifest.json"
+
+// Bundle is a named set of rule directories that are preprocessed together
+// into a single gob file called <Name>.gob, for example "eff" or "corp". The
+// name must be a plain file name, without path separators.
+type Bundle struct {
+	Name string
+	Dirs []string
+}
+
+// Manifest describes a set of preprocessed bundles.
+type Manifest struct {
+	// Source is where the rules came from, as given with WithSource.
+	Source  string           `json:"source,omitempty"`
+	Bundles []*ManifestEntry `json:"bundles"`
+}
+
+// ManifestEntry describes a single preprocessed bundle.
+type ManifestEntry struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	Rulesets int    `json:"rulesets"`
+	Errors   int    `json:"errors"`
+	SHA256   string `json:"sha256"`
+}
+
+// PreprocessBundles preprocesses each of the given bundles into its own gob
+// file in outDir and writes a manifest describing all of them to
+// outDir/manifest.json.
+func (p *preprocessor) PreprocessBundles(outDir string, bundles []Bundle, opts ...PreprocessOption) (*Manifest, error) {
+	seen := make(map[string]bool, len(bundles))
+	for _, bundle := range bundles {
+		if !validBundleName(bundle.Name) {
+			return nil, fmt.Errorf("bundle names must be non-empty file names, got %q", bundle.Name)
+		}
+		if seen[bundle.Name] {
+			return nil, fmt.Errorf("bundle names must be unique, got %q twice", bundle.Name)
+		}
+		seen[bundle.Name] = true
+	}
+
+	options := newPreprocessOptions(opts)
+	manifest := &Manifest{Source: options.source}
+	for _, bundle := range bundles {
+		entry := &ManifestEntry{
+			Name: bundle.Name,
+			File: bundle.Name + options.extension(),
+		}
+		rules := make([]*Ruleset, 0)
+		for _, dir := range bundle.Dirs {
+			rs, errors, err := p.loadDir(dir, options)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load rules for bundle %v: %v", bundle.Name, err)
+			}
+			rules = append(rules, rs...)
+			entry.Errors += errors
+		}
+		entry.Rulesets = len(rules)
+
+		data, err := options.encode(rules)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode bundle %v: %v", bundle.Name, err)
+		}
+		sum := sha256.Sum256(data)
+		entry.SHA256 = hex.EncodeToString(sum[:])
+		if err := ioutil.WriteFile(filepath.Join(outDir, entry.File), data, 0644); err != nil {
+			return nil, err
+		}
+		options.logger().Debugf("Wrote bundle %v with %v rulesets and %v errors", bundle.Name, entry.Rulesets, entry.Errors)
+		manifest.Bundles = append(manifest.Bundles, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, ManifestFile), data, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// validBundleName returns whether name can be used as a file name in the
+// output directory without escaping it.
+func validBundleName(name string) bool {
+	return name != "" && !strings.Contains(name, "..") && !strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
@@ -0,0 +1,254 @@
+package httpseverywhere
+
+import (
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookupCache caches the candidate rulesets for recently seen hosts in two
+// LRU caches, one for hosts with candidates (positive) and one for hosts
+// without any (negative). The host lists can be checkpointed to disk and used
+// to warm the caches after a restart.
+type lookupCache struct {
+	positive *lru
+	negative *lru
+	path     string
+	interval time.Duration
+	// mx and epoch keep candidates looked up in indices that have since been
+	// replaced from being added.
+	mx     sync.Mutex
+	epoch  int64
+	hits   int64
+	misses int64
+}
+
+// cacheCheckpoint is the on-disk format of a lookup cache checkpoint. Hosts
+// are ordered from least to most recently used.
+type cacheCheckpoint struct {
+	Positive []string `json:"positive"`
+	Negative []string `json:"negative"`
+}
+
+// WithLookupCache caches index lookups for up to positiveSize hosts that have
+// candidate rule sets and negativeSize hosts that don't, so that repeated
+// requests to the same hosts skip the index lookups.
+func WithLookupCache(positiveSize, negativeSize int) Option {
+	return func(h *Engine) {
+		h.cache = &lookupCache{
+			positive: newLRU(positiveSize),
+			negative: newLRU(negativeSize),
+		}
+	}
+}
+
+// WithCacheCheckpoint checkpoints the hosts in the lookup cache to the file at
+// path every interval, and warms the cache from that file once the rules have
+// first loaded, so that a restarted proxy immediately benefits from the hot set of
+// hosts it saw before. It has no effect without WithLookupCache.
+func WithCacheCheckpoint(path string, interval time.Duration) Option {
+	return func(h *Engine) {
+		if h.cache == nil {
+			return
+		}
+		h.cache.path = path
+		h.cache.interval = interval
+	}
+}
+
+// checkpointCachePeriodically checkpoints the lookup cache every checkpoint
+// interval.
+func (h *Engine) checkpointCachePeriodically() {
+	for {
+		select {
+		case <-h.clock.After(h.cache.interval):
+		case <-h.closed():
+			return
+		}
+		if err := h.CheckpointCache(); err != nil {
+			h.log.Errorf("Unable to checkpoint lookup cache: %v", err)
+		}
+	}
+}
+
+// CheckpointCache writes the hosts in the lookup cache to the file configured
+// with WithCacheCheckpoint.
+func (h *Engine) CheckpointCache() error {
+	if h.cache == nil || h.cache.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&cacheCheckpoint{
+		Positive: h.cache.positive.keys(),
+		Negative: h.cache.negative.keys(),
+	})
+	if err != nil {
+		return err
+	}
+	tmp := h.cache.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.cache.path)
+}
+
+func (c *lookupCache) candidates(h *Engine, u *url.URL) *candidates {
+	if v, ok := c.positive.get(u.Host); ok {
+		atomic.AddInt64(&c.hits, 1)
+		return v.(*candidates)
+	}
+	if v, ok := c.negative.get(u.Host); ok {
+		atomic.AddInt64(&c.hits, 1)
+		return v.(*candidates)
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return c.lookup(h, u)
+}
+
+// lookup looks up the candidates for the given URL and caches them unless the
+// indices were replaced in the meantime.
+func (c *lookupCache) lookup(h *Engine, u *url.URL) *candidates {
+	epoch := atomic.LoadInt64(&c.epoch)
+	v := h.allCandidates(u)
+	c.mx.Lock()
+	if atomic.LoadInt64(&c.epoch) == epoch {
+		if v.empty() {
+			c.negative.add(u.Host, v)
+		} else {
+			c.positive.add(u.Host, v)
+		}
+	}
+	c.mx.Unlock()
+	return v
+}
+
+// reset clears the cache because the indices changed.
+func (c *lookupCache) reset() {
+	c.mx.Lock()
+	atomic.AddInt64(&c.epoch, 1)
+	c.positive.clear()
+	c.negative.clear()
+	c.mx.Unlock()
+}
+
+// warm warms the cache from the checkpoint, if any, once the rules have first
+// loaded.
+func (c *lookupCache) warm(h *Engine) {
+	if c.path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.log.Errorf("Unable to read lookup cache checkpoint: %v", err)
+		}
+		return
+	}
+	var checkpoint cacheCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		h.log.Errorf("Unable to parse lookup cache checkpoint: %v", err)
+		return
+	}
+	for _, hosts := range [][]string{checkpoint.Negative, checkpoint.Positive} {
+		for _, host := range hosts {
+			c.lookup(h, hostURL(host))
+		}
+	}
+}
+
+// lru is a simple size-limited least recently used cache.
+type lru struct {
+	size  int
+	mx    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+	return nil, false
+}
+
+func (c *lru) add(key string, value interface{}) {
+	if c.size <= 0 {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry).value = value
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key, value})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// peek returns the value for the given key without marking it as used.
+func (c *lru) peek(key string) (interface{}, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if e, ok := c.items[key]; ok {
+		return e.Value.(*lruEntry).value, true
+	}
+	return nil, false
+}
+
+func (c *lru) remove(key string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+func (c *lru) len() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.ll.Len()
+}
+
+func (c *lru) clear() {
+	c.mx.Lock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.mx.Unlock()
+}
+
+// keys returns the keys from least to most recently used.
+func (c *lru) keys() []string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	keys := make([]string, 0, c.ll.Len())
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		keys = append(keys, e.Value.(*lruEntry).key)
+	}
+	return keys
+}
@@ -0,0 +1,47 @@
+package httpseverywhere
+
+import (
+	"net/url"
+	"strings"
+)
+
+// WithRewriteChaining applies up to maxHops more rule sets after a rewrite
+// that moves the URL to a different host, for as long as the new host's rule
+// set moves it on again, for example from a redirector domain to the actual
+// site. The browser extension gets the same effect through the resulting
+// navigation, whereas callers of Rewrite only get one shot. Each further
+// rewrite is applied to the http version of the previous result.
+func WithRewriteChaining(maxHops int) Option {
+	return func(h *Engine) {
+		h.maxChainHops = maxHops
+	}
+}
+
+// rewriteChained rewrites the given URL, chaining rewrites across hosts, and
+// returns each successive rewrite along with the result and the ruleset that
+// rewrote the URL first.
+func (h *Engine) rewriteChained(u *url.URL, t *Tenant) (string, bool, *ruleset, []string) {
+	r, ok, rs := h.rewriteOnce(u, t)
+	if !ok {
+		return "", false, rs, nil
+	}
+	chain := []string{r}
+	host := u.Hostname()
+	for hop := 0; hop < h.maxChainHops; hop++ {
+		next, err := url.Parse(r)
+		if err != nil || next.Scheme != "https" || strings.EqualFold(next.Hostname(), host) {
+			break
+		}
+		host = next.Hostname()
+		next.Scheme = "http"
+		nextR, nextOK, _ := h.rewriteOnce(next, t)
+		// Stop unless the rule set did more than upgrade the URL again, and
+		// guard against loops.
+		if !nextOK || nextR == r || containsString(chain, nextR) {
+			break
+		}
+		r = nextR
+		chain = append(chain, r)
+	}
+	return r, true, rs, chain
+}
@@ -0,0 +1,41 @@
+package httpseverywhere
+
+import "time"
+
+// Clock is a source of time. Everything time-dependent in an Engine uses its
+// Clock, so tests and simulations can control time with their own
+// implementation.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep pauses the current goroutine for at least the given duration.
+	Sleep(d time.Duration)
+	// After waits for the given duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock backed by the time package. Times returned by
+// time.Now carry a monotonic clock reading that Sub and Since use, so measured
+// durations aren't affected by changes to the wall clock and no separate
+// monotonic clock is needed.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// WithClock makes the Engine use the given Clock instead of the system clock.
+func WithClock(clock Clock) Option {
+	return func(h *Engine) {
+		h.clock = clock
+	}
+}
@@ -0,0 +1,98 @@
+package httpseverywhere
+
+import (
+	"errors"
+
+	"github.com/armon/go-radix"
+)
+
+// ErrClosed is returned when loading or updating rules is attempted on, or
+// interrupted by closing, a closed Engine.
+var ErrClosed = errors.New("engine closed")
+
+// Close stops the Engine's background goroutines, like those prefetching
+// hosts, checkpointing the lookup cache and checking for updates, cancels
+// loading the rules and any updates in progress and releases the rules, along
+// with any file they were mapped from and the RulesetStore if it's an
+// io.Closer. URLs aren't rewritten and broken paths aren't saved to the
+// PreferencesStore afterwards. It waits for loads, updates, rewrites and
+// saves in progress to stop, but not for the goroutines to exit. Batchers
+// created with NewBatcher need to be closed separately. Closing an Engine more
+// than once has no effect.
+func (h *Engine) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		h.stop()
+		unpublishExpvar(h)
+		// Wait for loads and updates to notice.
+		h.updateMx.Lock()
+		defer h.updateMx.Unlock()
+		h.ready.done(ErrClosed)
+		h.publish(make(map[string]*ruleset), radix.New(), 0)
+		h.updatedData.Store([]byte{})
+		h.brokenPaths.close()
+		err = h.release()
+	})
+	return err
+}
+
+// withRelease calls release on Close to free a resource backing the rules.
+func withRelease(release func() error) Option {
+	return func(h *Engine) {
+		h.releases = append(h.releases, release)
+	}
+}
+
+// release waits for the rules to be unused and frees the resources backing
+// them, returning the first error.
+func (h *Engine) release() error {
+	if len(h.releases) == 0 {
+		return nil
+	}
+	h.rulesMx.Lock()
+	defer h.rulesMx.Unlock()
+	var firstErr error
+	for _, release := range h.releases {
+		if err := release(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// holdRules keeps the resources backing the rules from being released by
+// Close until unholdRules is called. It returns false, without holding them,
+// if they may have been released already.
+func (h *Engine) holdRules() bool {
+	if len(h.releases) == 0 {
+		return !h.isClosed()
+	}
+	h.rulesMx.RLock()
+	if h.isClosed() {
+		h.rulesMx.RUnlock()
+		return false
+	}
+	return true
+}
+
+// unholdRules lets the resources held by holdRules be released.
+func (h *Engine) unholdRules() {
+	if len(h.releases) > 0 {
+		h.rulesMx.RUnlock()
+	}
+}
+
+// closed returns a channel that's closed once Close is called.
+func (h *Engine) closed() <-chan struct{} {
+	return h.lifetime.Done()
+}
+
+// isClosed returns whether or not Close has been called.
+func (h *Engine) isClosed() bool {
+	select {
+	case <-h.closed():
+		return true
+	default:
+		return false
+	}
+}
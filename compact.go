@@ -0,0 +1,72 @@
+package httpseverywhere
+
+import (
+	"runtime/debug"
+
+	"github.com/armon/go-radix"
+)
+
+// WithCompaction compacts the indices and compiled rule sets once the rules
+// have been fully loaded, trimming memory that was over-allocated while
+// loading. If freeOSMemory is true, memory freed by loading is returned to the
+// operating system right away rather than whenever the runtime gets around to
+// it, which reduces resident memory on memory-constrained clients.
+func WithCompaction(freeOSMemory bool) Option {
+	return func(h *Engine) {
+		h.compact = true
+		h.freeOSMemory = freeOSMemory
+	}
+}
+
+// compactIndices returns copies of the given indices that are sized for what
+// they contain, trimming the slices of all of the rule sets in them along the
+// way. It must only be called on indices that haven't been published yet.
+func compactIndices(plains map[string]*ruleset, wildcards *radix.Tree) (map[string]*ruleset, *radix.Tree) {
+	for _, rs := range plains {
+		rs.trim()
+	}
+	wildcards.Walk(func(key string, rs interface{}) bool {
+		rs.(*ruleset).trim()
+		return false
+	})
+	return resizeIndices(plains, wildcards)
+}
+
+// resizeIndices returns copies of the given indices that are sized for what
+// they contain, leaving the rule sets in them as they are.
+func resizeIndices(plains map[string]*ruleset, wildcards *radix.Tree) (map[string]*ruleset, *radix.Tree) {
+	resized := make(map[string]*ruleset, len(plains))
+	for host, rs := range plains {
+		resized[host] = rs
+	}
+	return resized, radix.NewFromMap(wildcards.ToMap())
+}
+
+// trim reallocates the ruleset's slices to fit their contents.
+func (r *ruleset) trim() {
+	if cap(r.target) > len(r.target) {
+		r.target = append([]string(nil), r.target...)
+	}
+	if cap(r.exclusion) > len(r.exclusion) {
+		r.exclusion = append([]exclusion(nil), r.exclusion...)
+	}
+	if cap(r.rule) > len(r.rule) {
+		r.rule = append([]rule(nil), r.rule...)
+	}
+}
+
+// finishLoad compacts the given fully loaded indices if configured to do so.
+func (h *Engine) finishLoad(plains map[string]*ruleset, wildcards *radix.Tree) (map[string]*ruleset, *radix.Tree) {
+	if !h.compact {
+		return plains, wildcards
+	}
+	return compactIndices(plains, wildcards)
+}
+
+// afterLoad frees memory that became garbage while loading, if configured
+// to do so.
+func (h *Engine) afterLoad() {
+	if h.freeOSMemory {
+		debug.FreeOSMemory()
+	}
+}
@@ -0,0 +1,62 @@
+package httpseverywhere
+
+import "net/url"
+
+// maxComparisonExamples is the maximum number of example divergences kept in
+// a Comparison.
+const maxComparisonExamples = 20
+
+// Comparison reports how two rewriters' decisions differ for the same URLs.
+type Comparison struct {
+	// Total is the number of URLs compared.
+	Total int
+	// OnlyThis is the number of URLs only upgraded by the Engine Compare was
+	// called on.
+	OnlyThis int
+	// OnlyOther is the number of URLs only upgraded by the other rewriter.
+	OnlyOther int
+	// Different is the number of URLs both upgraded, but to different URLs.
+	Different int
+	// Examples holds up to 20 divergent decisions.
+	Examples []Divergence
+}
+
+// Divergent returns the total number of URLs with divergent decisions.
+func (c *Comparison) Divergent() int {
+	return c.OnlyThis + c.OnlyOther + c.Different
+}
+
+// Divergence is a single URL for which two rewriters made different
+// decisions. This and Other are empty when the respective rewriter didn't
+// rewrite the URL.
+type Divergence struct {
+	URL   string
+	This  string
+	Other string
+}
+
+// Compare runs every URL received from urls through both this Engine and
+// other, for example an Engine using a newer bundle, and reports where their
+// decisions diverge. It returns once urls is closed.
+func (h *Engine) Compare(other Rewrite, urls <-chan *url.URL) *Comparison {
+	c := &Comparison{}
+	for u := range urls {
+		c.Total++
+		this, thisOK := h.Rewrite(u)
+		that, thatOK := other(u)
+		switch {
+		case thisOK && !thatOK:
+			c.OnlyThis++
+		case !thisOK && thatOK:
+			c.OnlyOther++
+		case thisOK && thatOK && this != that:
+			c.Different++
+		default:
+			continue
+		}
+		if len(c.Examples) < maxComparisonExamples {
+			c.Examples = append(c.Examples, Divergence{URL: u.String(), This: this, Other: that})
+		}
+	}
+	return c
+}
@@ -0,0 +1,95 @@
+package httpseverywhere
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Decompressor returns a reader of the decompressed data read from r.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// ZstdMagic is the header that zstd compressed data starts with, for
+// registering a zstd Decompressor.
+var ZstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// gzipMagic is the header that gzipped data starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+type compression struct {
+	magic      []byte
+	decompress Decompressor
+}
+
+var (
+	compressionsMx sync.RWMutex
+	compressions   = []compression{{gzipMagic, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}}}
+)
+
+// RegisterDecompressor makes rules data that starts with the given magic
+// bytes be decompressed with the given Decompressor wherever rules data is
+// accepted, including WithRulesData, updates and the rules cache. Gzip is
+// supported out of the box. This lets applications use better compression
+// like zstd, which cuts the size of bundles shipped with mobile builds further,
+// without this package depending on an implementation of it. For example, with
+// github.com/klauspost/compress/zstd:
+//
+//	httpseverywhere.RegisterDecompressor(httpseverywhere.ZstdMagic, func(r io.Reader) (io.ReadCloser, error) {
+//		dec, err := zstd.NewReader(r)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return dec.IOReadCloser(), nil
+//	})
+func RegisterDecompressor(magic []byte, decompress Decompressor) {
+	compressionsMx.Lock()
+	defer compressionsMx.Unlock()
+	compressions = append(compressions, compression{append([]byte(nil), magic...), decompress})
+}
+
+// decompressorFor returns the Decompressor for data starting with the given
+// header, if any.
+func decompressorFor(header []byte) Decompressor {
+	compressionsMx.RLock()
+	defer compressionsMx.RUnlock()
+	for _, c := range compressions {
+		if bytes.HasPrefix(header, c.magic) {
+			return c.decompress
+		}
+	}
+	return nil
+}
+
+// maxMagic is the most header bytes peeked at to detect compression.
+const maxMagic = 16
+
+// decompressingReader returns a reader for the data read from r, decompressing
+// it if it's compressed in a known format.
+func decompressingReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(maxMagic)
+	if decompress := decompressorFor(header); decompress != nil {
+		return decompress(br)
+	}
+	return br, nil
+}
+
+// decompressed returns the given data, decompressed if it's compressed in a
+// known format.
+func decompressed(data []byte) ([]byte, error) {
+	decompress := decompressorFor(data)
+	if decompress == nil {
+		return data, nil
+	}
+	r, err := decompress(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,98 @@
+package httpseverywhere
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Modes supported in the second column of rules CSV files.
+const (
+	// CSVModeUpgrade rewrites http to https for the host.
+	CSVModeUpgrade = "upgrade"
+	// CSVModeWWW rewrites http to https for the host, also moving requests for
+	// the bare host to its www subdomain.
+	CSVModeWWW = "www"
+	// CSVModeNever never rewrites the host, shadowing any built-in rule set
+	// with the same target.
+	CSVModeNever = "never"
+)
+
+// ParseRulesCSV reads site-specific rules from a CSV file and compiles them to
+// rule sets that can be loaded with WithRulesets. This lets people who don't
+// write HTTPS Everywhere rules maintain upgrade behaviors in a spreadsheet.
+//
+// Each record has the form "host,mode[,exclusion-regex]", where host is a
+// target host as in a rule set (wildcards allowed), mode is one of "upgrade",
+// "www" or "never", and the optional exclusion is a regular expression for
+// URLs that shouldn't be upgraded. Blank lines, lines starting with '#' and a
+// leading "host,mode" header are ignored.
+func ParseRulesCSV(r io.Reader) ([]*Ruleset, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var rulesets []*Ruleset
+	for n := 1; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rulesets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 && len(record) >= 2 && strings.EqualFold(record[0], "host") && strings.EqualFold(record[1], "mode") {
+			continue
+		}
+		rs, err := csvRuleset(record)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %v", n, err)
+		}
+		rulesets = append(rulesets, rs)
+	}
+}
+
+func csvRuleset(record []string) (*Ruleset, error) {
+	if len(record) < 2 || len(record) > 3 {
+		return nil, fmt.Errorf("expected host, mode and optional exclusion but got %d fields", len(record))
+	}
+	host := strings.ToLower(strings.TrimSpace(record[0]))
+	if msg := checkTarget(host); msg != "" {
+		return nil, fmt.Errorf("%v: %q", msg, host)
+	}
+	rs := &Ruleset{Target: []*Target{{Host: host}}}
+
+	mode := strings.ToLower(strings.TrimSpace(record[1]))
+	switch mode {
+	case CSVModeUpgrade:
+		rs.Rule = []*Rule{{From: "^http:", To: "https:"}}
+	case CSVModeWWW:
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("mode %v can't be used with wildcard host %q", mode, host)
+		}
+		rs.Target = append(rs.Target, &Target{Host: "www." + host})
+		rs.Rule = []*Rule{{
+			From: "^http://(?:www\\.)?" + regexp.QuoteMeta(host) + "/",
+			To:   "https://www." + host + "/",
+		}}
+	case CSVModeNever:
+		if len(record) == 3 {
+			return nil, fmt.Errorf("mode %v doesn't take an exclusion", mode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown mode %q", record[1])
+	}
+
+	if len(record) == 3 {
+		if pattern := strings.TrimSpace(record[2]); pattern != "" {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("bad exclusion: %v", err)
+			}
+			rs.Exclusion = []*Exclusion{{Pattern: pattern}}
+		}
+	}
+	return rs, nil
+}
@@ -0,0 +1,52 @@
+package httpseverywhere
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRulesCSV(t *testing.T) {
+	rulesets, err := ParseRulesCSV(strings.NewReader(`host,mode,exclusion
+# Support requests
+upgrade.example.com, upgrade
+*.wild.example.com,upgrade,^http://old\.wild\.example\.com/
+example.org,www
+never.example.com,never
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, rulesets, 4)
+
+	h := newEmpty(WithRulesets(rulesets...))
+	d := h.deserializer()
+	plains, wildcards := d.index(h.customRulesets)
+	h.publish(plains, wildcards, len(rulesets))
+
+	for in, expected := range map[string]string{
+		"http://upgrade.example.com/a":   "https://upgrade.example.com/a",
+		"http://new.wild.example.com/":   "https://new.wild.example.com/",
+		"http://old.wild.example.com/":   "",
+		"http://example.org/x?y":         "https://www.example.org/x?y",
+		"http://www.example.org/":        "https://www.example.org/",
+		"http://never.example.com/":      "",
+		"http://notlisted.example.com/a": "",
+	} {
+		r, _ := h.Rewrite(toURL(in))
+		assert.Equal(t, expected, r, in)
+	}
+
+	for _, bad := range []string{
+		"example.com",
+		"example.com,sometimes",
+		"http://example.com/,upgrade",
+		"*.example.com,www",
+		"example.com,upgrade,(",
+		"example.com,never,^http://example.com/a",
+	} {
+		_, err := ParseRulesCSV(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,39 @@
+package httpseverywhere
+
+import (
+	"net/url"
+	"sync/atomic"
+)
+
+// decisionLog logs a sample of rewrite decisions.
+type decisionLog struct {
+	every uint64
+	n     uint64
+}
+
+// WithDecisionLogging logs one in every n rewrite decisions at debug level to
+// the logger set with WithLogger, to see what the Engine is doing in
+// production without paying for logging every decision. Decisions aren't
+// logged by default, and with n less than 1.
+func WithDecisionLogging(n int) Option {
+	return func(h *Engine) {
+		if n < 1 {
+			h.decisionLog = nil
+			return
+		}
+		h.decisionLog = &decisionLog{every: uint64(n)}
+	}
+}
+
+// log logs the decision to rewrite u to result, or not to rewrite it, if it's
+// sampled.
+func (l *decisionLog) log(h *Engine, u *url.URL, result string, rewritten bool) {
+	if (atomic.AddUint64(&l.n, 1)-1)%l.every != 0 {
+		return
+	}
+	if rewritten {
+		h.log.Debugf("Rewrote %v to %v", u, result)
+	} else {
+		h.log.Debugf("Not rewriting %v", u)
+	}
+}
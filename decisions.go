@@ -0,0 +1,242 @@
+package httpseverywhere
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxDecisionPrefix caps the length of the path prefixes that rewrite
+// decisions are cached by.
+const maxDecisionPrefix = 128
+
+// decisionCache caches which rule set decides the rewrites of URLs by host and
+// path prefix. Only the choice of rule set is cached, which is the same for
+// all URLs with the same host and path prefix when the candidates checked
+// before it can't apply to any of them, so the rule set itself is still
+// evaluated for each URL. Entries are dropped when the candidates for their
+// host change in a way that affects the decision.
+type decisionCache struct {
+	entries  *lru
+	segments int
+	// mx and epoch keep decisions made with indices that have since been
+	// replaced from being added.
+	mx     sync.Mutex
+	epoch  int64
+	hits   int64
+	misses int64
+}
+
+// decision is a cached rewrite decision.
+type decision struct {
+	// idx is the index of the candidate that decides the rewrite, or
+	// noDecision if nothing is rewritten.
+	idx Index
+	// candidates are the candidates for the host the decision was made with.
+	candidates candidates
+}
+
+// noDecision is the index of decisions that nothing is rewritten.
+const noDecision Index = -1
+
+// ruleset returns the rule set that decides the rewrite, or nil if nothing is
+// rewritten.
+func (d *decision) ruleset() *ruleset {
+	if d.idx == noDecision {
+		return nil
+	}
+	return d.candidates[d.idx]
+}
+
+// WithDecisionCache caches which rule set decides the rewrites for up to size
+// combinations of host and path prefix, where the prefix is made up of the
+// first segments segments of the path. Unlike a cache of rewritten URLs, this
+// stays correct for URLs the rules treat differently, since the chosen rule
+// set is still evaluated for each URL and decisions are only cached where
+// the rule sets that would be tried first can't match any URL with that path
+// prefix, for example because of their path scope. It gives high hit rates for
+// sites with many assets under a few paths. Decisions for a host are dropped
+// when the rules change in a way that affects them, and kept otherwise. It
+// only applies with the FirstMatch policy.
+func WithDecisionCache(size int, segments int) Option {
+	return func(h *Engine) {
+		h.decisions = &decisionCache{
+			entries:  newLRU(size),
+			segments: segments,
+		}
+	}
+}
+
+// decisionKey returns the key the decision for the given URL is cached under,
+// along with the path prefix in it.
+func (c *decisionCache) decisionKey(u *url.URL) (string, string) {
+	prefix := pathPrefix(u.EscapedPath(), c.segments)
+	return u.Host + " " + prefix, prefix
+}
+
+// pathPrefix returns the given path up to and including the slash ending the
+// given number of segments, or the whole path if it has no more segments,
+// capped at maxDecisionPrefix.
+func pathPrefix(path string, segments int) string {
+	end := 0
+	for i := 0; i < segments && end < len(path); i++ {
+		next := strings.IndexByte(path[end+1:], '/')
+		if next < 0 {
+			end = len(path)
+			break
+		}
+		end += next + 1
+	}
+	if end < len(path) {
+		// Include the slash.
+		end++
+	}
+	if end > maxDecisionPrefix {
+		end = maxDecisionPrefix
+	}
+	return path[:end]
+}
+
+// rewriteDecided rewrites the given URL with the cached decision for it, if
+// there is one. It returns whether or not the URL was handled. If it wasn't,
+// the returned rule set, if any, was evaluated without rewriting the URL, so
+// the other candidates are left to try.
+func (h *Engine) rewriteDecided(u *url.URL, t *Tenant) (string, bool, *ruleset, bool) {
+	c := h.decisions
+	key, prefix := c.decisionKey(u)
+	if v, ok := c.entries.get(key); ok {
+		atomic.AddInt64(&c.hits, 1)
+		rs := v.(*decision).ruleset()
+		if rs == nil {
+			return "", false, nil, true
+		}
+		if r, hit := h.rewriteWithRuleset(u, rs, t); hit {
+			return r, true, rs, true
+		}
+		// Other candidates may still apply.
+		return "", false, rs, false
+	}
+	atomic.AddInt64(&c.misses, 1)
+	epoch := atomic.LoadInt64(&c.epoch)
+	d, ok := h.decide(u, prefix)
+	if !ok {
+		return "", false, nil, false
+	}
+	c.mx.Lock()
+	if atomic.LoadInt64(&c.epoch) == epoch {
+		c.entries.add(key, d)
+	}
+	c.mx.Unlock()
+	rs := d.ruleset()
+	if rs == nil {
+		return "", false, nil, true
+	}
+	r, hit := h.rewriteWithRuleset(u, rs, t)
+	return r, hit, rs, hit
+}
+
+// decide returns the decision for URLs on the given URL's host whose paths
+// start with the given prefix, if one can be made. That's the first candidate
+// that may rewrite some of those URLs, as long as the ones before it can't
+// rewrite any of them.
+func (h *Engine) decide(u *url.URL, prefix string) (*decision, bool) {
+	d := &decision{idx: noDecision, candidates: *h.allCandidates(u)}
+	if d.candidates.empty() {
+		// Aliases may apply.
+		return nil, false
+	}
+	for _, idx := range h.lookupOrder {
+		rs := d.candidates[idx]
+		if rs == nil {
+			continue
+		}
+		if h.cannotApply(rs, u, prefix) {
+			if h.earlyExit || rs.exclusive {
+				// Nothing after it is tried.
+				return d, true
+			}
+			continue
+		}
+		// If it doesn't rewrite a URL, later candidates are tried as usual.
+		d.idx = idx
+		return d, true
+	}
+	// None of the candidates can apply.
+	return d, true
+}
+
+// cannotApply returns whether or not the given rule set can't rewrite any URL
+// on the given URL's host whose path starts with the given prefix.
+func (h *Engine) cannotApply(rs *ruleset, u *url.URL, prefix string) bool {
+	if h.strictTargets && !rs.matchesHost(u.Hostname()) {
+		return true
+	}
+	for _, scope := range rs.pathScope {
+		if strings.HasPrefix(prefix, scope) || strings.HasPrefix(scope, prefix) {
+			return false
+		}
+	}
+	return len(rs.pathScope) > 0
+}
+
+// invalidate drops the decisions for hosts whose candidates changed in the
+// current indices in a way that affects them, and moves the others over to
+// the current candidates. It must be called after the indices have been
+// replaced.
+func (c *decisionCache) invalidate(h *Engine) {
+	c.mx.Lock()
+	atomic.AddInt64(&c.epoch, 1)
+	c.mx.Unlock()
+	current := make(map[string]candidates)
+	// Keys are listed from least to most recently used, so re-adding them in
+	// that order keeps their order.
+	for _, key := range c.entries.keys() {
+		v, ok := c.entries.peek(key)
+		if !ok {
+			continue
+		}
+		host := key[:strings.IndexByte(key, ' ')]
+		cands, ok := current[host]
+		if !ok {
+			cands = *h.allCandidates(hostURL(host))
+			current[host] = cands
+		}
+		old := v.(*decision)
+		if !sameCandidates(&old.candidates, &cands) {
+			c.entries.remove(key)
+			continue
+		}
+		c.entries.add(key, &decision{idx: old.idx, candidates: cands})
+	}
+}
+
+// sameCandidates returns whether or not the given candidates lead to the same
+// decisions, which only depend on which indices have candidates and on their
+// targets, path scopes and exclusivity, since the deciding rule set itself is
+// evaluated for each URL anyway.
+func sameCandidates(a *candidates, b *candidates) bool {
+	for i := range a {
+		x, y := a[i], b[i]
+		if x == y {
+			continue
+		}
+		if x == nil || y == nil || x.exclusive != y.exclusive ||
+			!equalStrings(x.target, y.target) || !equalStrings(x.pathScope, y.pathScope) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
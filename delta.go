@@ -0,0 +1,232 @@
+package httpseverywhere
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// RulesVersionHeader is the request header in which the updater sends the
+// version of the rules it has, so that the server can respond with a delta
+// from that version instead of the full rules.
+const RulesVersionHeader = "X-Rules-Version"
+
+// DeltaContentType is the content type of a response containing a delta
+// rather than full rules data.
+const DeltaContentType = "application/vnd.httpse-delta+gob"
+
+// RulesDelta describes how to build one version of rules data from another,
+// where a version is the hex encoded SHA-256 of the uncompressed gob data.
+// The new rule sets are built by applying the operations in order, starting at
+// the first of the old rule sets.
+type RulesDelta struct {
+	From string
+	To   string
+	Ops  []DeltaOp
+}
+
+// DeltaOp skips Skip of the old rule sets, copies the next Copy of them and
+// then inserts the rule sets in Insert.
+type DeltaOp struct {
+	Skip   int
+	Copy   int
+	Insert []*Ruleset
+}
+
+// rulesVersion returns the version of the given uncompressed rules data, which
+// is the checksum of the encoded rule sets, not including any header.
+func rulesVersion(data []byte) string {
+	sum := sha256.Sum256(rulesPayload(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// RulesVersion returns the version of the rules data currently in use, or an
+// empty string if it couldn't be read.
+func (h *Engine) RulesVersion() string {
+	if !h.holdRules() {
+		return ""
+	}
+	defer h.unholdRules()
+	data, err := h.deserializer().rulesData()
+	if err != nil {
+		return ""
+	}
+	return rulesVersion(data)
+}
+
+// DiffRulesData returns a gob encoded RulesDelta for building the rules data
+// to from the rules data from, for serving to updaters that have from. Both
+// may be gzipped. Rule sets are compared by content, so changed ones are sent
+// in full.
+func DiffRulesData(from, to []byte) ([]byte, error) {
+	fromData, err := decompressed(from)
+	if err != nil {
+		return nil, err
+	}
+	toData, err := decompressed(to)
+	if err != nil {
+		return nil, err
+	}
+	old, err := decodeRulesData(fromData)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := decodeRulesData(toData)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make(map[string][]int, len(old))
+	for i, rs := range old {
+		id, err := rulesetDigest(rs)
+		if err != nil {
+			return nil, err
+		}
+		positions[id] = append(positions[id], i)
+	}
+	delta := &RulesDelta{From: rulesVersion(fromData), To: rulesVersion(toData)}
+	op := &DeltaOp{}
+	cursor := 0
+	for _, rs := range updated {
+		id, err := rulesetDigest(rs)
+		if err != nil {
+			return nil, err
+		}
+		pos := nextPosition(positions[id], cursor)
+		switch {
+		case pos < 0:
+			op.Insert = append(op.Insert, rs)
+			continue
+		case pos == cursor && len(op.Insert) == 0:
+			op.Copy++
+		default:
+			delta.Ops = append(delta.Ops, *op)
+			op = &DeltaOp{Skip: pos - cursor, Copy: 1}
+		}
+		cursor = pos + 1
+	}
+	delta.Ops = append(delta.Ops, *op)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(delta); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nextPosition returns the first of the given ascending positions that's at
+// least cursor, or -1 if there is none.
+func nextPosition(positions []int, cursor int) int {
+	for _, pos := range positions {
+		if pos >= cursor {
+			return pos
+		}
+	}
+	return -1
+}
+
+// rulesetDigest identifies a rule set by its content.
+func rulesetDigest(rs *Ruleset) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rs); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return string(sum[:]), nil
+}
+
+// ApplyRulesDelta updates the rules by applying the given gob encoded
+// RulesDelta, optionally gzipped, to the rules data currently in use, like
+// UpdateRulesData does with full rules data. It fails if the delta isn't from
+// the current version or doesn't result in the version it's to. The returned
+// channel receives the outcome.
+func (h *Engine) ApplyRulesDelta(delta []byte) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.applyRulesDelta(delta)
+	}()
+	return errCh
+}
+
+func (h *Engine) applyRulesDelta(deltaData []byte) error {
+	deltaData, err := decompressed(deltaData)
+	if err != nil {
+		return err
+	}
+	var delta RulesDelta
+	if err := gob.NewDecoder(bytes.NewReader(deltaData)).Decode(&delta); err != nil {
+		return fmt.Errorf("decoding delta: %v", err)
+	}
+
+	h.updateMx.Lock()
+	defer h.updateMx.Unlock()
+	if h.isClosed() {
+		return ErrClosed
+	}
+	current, err := h.deserializer().rulesData()
+	if err != nil {
+		return err
+	}
+	if version := rulesVersion(current); version != delta.From {
+		return fmt.Errorf("delta is from version %v but rules are at version %v", delta.From, version)
+	}
+	old, err := decodeRulesData(current)
+	if err != nil {
+		return err
+	}
+	updated := make([]*Ruleset, 0, len(old))
+	cursor := 0
+	for _, op := range delta.Ops {
+		cursor += op.Skip
+		if op.Skip < 0 || op.Copy < 0 || cursor+op.Copy > len(old) {
+			return errors.New("delta doesn't fit the current rules")
+		}
+		updated = append(updated, old[cursor:cursor+op.Copy]...)
+		cursor += op.Copy
+		updated = append(updated, op.Insert...)
+	}
+	data, err := encodeRulesets(updated)
+	if err != nil {
+		return err
+	}
+	if version := rulesVersion(data); version != delta.To {
+		return fmt.Errorf("delta resulted in version %v instead of %v", version, delta.To)
+	}
+	return h.swapRulesData(data)
+}
+
+// DecodeRulesData decodes the rule sets in the given rules data, in any of the
+// formats accepted by WithRulesData, verifying the header if there is one.
+func DecodeRulesData(data []byte) ([]*Ruleset, error) {
+	uncompressed, err := decompressed(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRulesData(uncompressed)
+}
+
+// decodeRulesData decodes the given uncompressed rules data.
+func decodeRulesData(data []byte) ([]*Ruleset, error) {
+	_, data, err := splitRulesHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if isProtoRules(data) {
+		return decodeRulesetsProto(data)
+	}
+	if isIndexedRules(data) {
+		return decodeRulesetsIndexed(data, true)
+	}
+	var rulesets []*Ruleset
+	err = decodeGob(bufio.NewReader(bytes.NewReader(data)), func(rs *Ruleset) {
+		rulesets = append(rulesets, rs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rulesets, nil
+}
@@ -1,81 +1,359 @@
 package httpseverywhere
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/gob"
+	"crypto/sha256"
+	_ "embed"
+	"io"
+	"io/ioutil"
 	"regexp"
 	"strings"
 	"time"
 
 	radix "github.com/armon/go-radix"
-	"github.com/getlantern/golog"
 )
 
-// Constant for the name of the rulesets serialized in Go's gob encoding and
-// embedded using byte exec
+// Constant for the name of the file the preprocessor writes the rulesets
+// serialized in Go's gob encoding to
 const gobrules = "rulesets.gob"
 
+// embeddedRules holds the built-in rules, the preprocessor's rulesets.gob
+// gzipped. As a string it stays in the binary's read-only data, so decoding
+// streams from it without keeping a copy of the raw bytes on the heap.
+//
+//go:embed rulesets.gob.gz
+var embeddedRules string
+
 type deserializer struct {
-	log golog.Logger
+	log            Logger
+	maxProgramSize int
+	quota          *compileQuota
+	clock          Clock
+	// stats, if set, records what was dropped because of compile errors.
+	stats *loadStats
+	// data, if set, is decoded instead of the embedded rulesets.
+	data []byte
+	// keepNotes keeps the notes of rulesets.
+	keepNotes bool
+	// lazy defers compiling the rules and exclusions of rulesets until they're
+	// first used.
+	lazy bool
+	// done, if set, stops decoding into indices when closed.
+	done <-chan struct{}
+	// lastSource is the last rule set source seen, which is shared by the
+	// rulesets with the same source rather than kept once for each.
+	lastSource string
+}
+
+// intern returns the last source seen if it's the same as the given one, so
+// that rulesets from the same source share it. Like indexing, it's not safe
+// for concurrent use.
+func (d *deserializer) intern(source string) string {
+	if source != d.lastSource {
+		d.lastSource = source
+	}
+	return d.lastSource
 }
 
 func newDeserializer() *deserializer {
 	return &deserializer{
-		log: golog.LoggerFor("httpseverywhere-deserializer"),
+		log:   noopLogger{},
+		clock: systemClock{},
+	}
+}
+
+// decode decodes the configured or else the embedded rulesets, streaming
+// them from the compressed data rather than decompressing it all up front.
+// Rulesets may be gob encoded, in the protobuf format of rulesets.proto or in
+// the indexed format, and preceded by a header whose schema version and
+// checksum are verified.
+func (d *deserializer) decode() ([]*Ruleset, error) {
+	rulesets := make([]*Ruleset, 0)
+	if err := d.decodeEach(func(rs *Ruleset) {
+		rulesets = append(rulesets, rs)
+	}); err != nil {
+		return nil, err
 	}
+	return rulesets, nil
 }
 
-func (d *deserializer) newRulesets() (map[string]*ruleset, *radix.Tree, error) {
-	start := time.Now()
-	data, err := Asset(gobrules)
+// decodeInto decodes the configured or else the embedded rulesets like decode
+// does, but compiles and adds each to the given indices as soon as it's
+// decoded, so that gob streams are never held in memory all at once. Rulesets
+// for which keep returns false are skipped. If indexed is set, it's called
+// with the number of rulesets kept so far after each is indexed. It returns
+// the number of rulesets decoded and the number of those kept.
+func (d *deserializer) decodeInto(keep func(*Ruleset) bool, indexed func(int), plains map[string]*ruleset, wildcards *radix.Tree) (int, int, error) {
+	decoded, kept := 0, 0
+	var indexing time.Duration
+	var compiling time.Duration
+	if d.stats != nil {
+		compiling = d.stats.phase(phaseCompile)
+	}
+	canceled := false
+	err := d.decodeEach(func(rs *Ruleset) {
+		if canceled {
+			return
+		}
+		select {
+		case <-d.done:
+			canceled = true
+			return
+		default:
+		}
+		decoded++
+		if !keep(rs) {
+			return
+		}
+		kept++
+		start := d.clock.Now()
+		d.addRuleset(rs, plains, wildcards)
+		indexing += d.clock.Now().Sub(start)
+		if indexed != nil {
+			indexed(kept)
+		}
+	})
+	if d.stats != nil {
+		// Compiling is timed separately.
+		compiled := d.stats.phase(phaseCompile) - compiling
+		d.stats.addTime(phaseIndex, indexing-compiled)
+	}
+	if err == nil && canceled {
+		err = ErrClosed
+	}
+	return decoded, kept, err
+}
+
+// decodeEach decodes the configured or else the embedded rulesets, calling fn
+// with each as it's decoded. Time spent in fn isn't counted as decoding.
+func (d *deserializer) decodeEach(fn func(*Ruleset)) error {
+	start := d.clock.Now()
+	r, err := d.rulesReader()
 	if err != nil {
 		d.log.Errorf("Could not parse assets: %v", err)
-		return nil, nil, err
+		return err
 	}
-	buf := bytes.NewBuffer(data)
+	decodeStart := d.clock.Now()
+	d.stats.addTime(phaseAssetRead, decodeStart.Sub(start))
 
-	dec := gob.NewDecoder(buf)
-	rulesets := make([]*Ruleset, 0)
-	err = dec.Decode(&rulesets)
+	var inFn time.Duration
+	timedFn := func(rs *Ruleset) {
+		fnStart := d.clock.Now()
+		fn(rs)
+		inFn += d.clock.Now().Sub(fnStart)
+	}
+	br := bufio.NewReader(r)
+	payload := br
+	var header *rulesHeader
+	checksum := sha256.New()
+	if prefix, _ := br.Peek(rulesHeaderLen); hasRulesHeader(prefix) {
+		if len(prefix) < rulesHeaderLen {
+			return io.ErrUnexpectedEOF
+		}
+		if header, err = parseRulesHeader(prefix); err != nil {
+			d.log.Errorf("Could not decode: %v", err)
+			return err
+		}
+		br.Discard(rulesHeaderLen)
+		payload = bufio.NewReader(io.TeeReader(br, checksum))
+	}
+	err = d.decodePayload(payload, timedFn)
+	if header != nil {
+		// Check the checksum even if decoding failed, since a mismatch explains
+		// why.
+		if _, cerr := io.Copy(checksum, br); cerr != nil && err == nil {
+			err = cerr
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], checksum.Sum(nil))
+		if verr := header.verify(sum); verr != nil {
+			err = verr
+		}
+	}
 	if err != nil {
 		d.log.Errorf("Could not decode: %v", err)
-		return nil, nil, err
+		return err
 	}
+	d.stats.addTime(phaseDecode, d.clock.Now().Sub(decodeStart)-inFn)
+	return nil
+}
 
+// decodePayload decodes the rulesets read from r, in whichever format they're
+// in, calling fn with each. Gob streams are decoded one ruleset at a time,
+// while the other formats are decoded in full first.
+func (d *deserializer) decodePayload(r *bufio.Reader, fn func(*Ruleset)) error {
+	magic, _ := r.Peek(len(protoMagic))
+	var rulesets []*Ruleset
+	var err error
+	switch {
+	case isIndexedRules(magic):
+		rulesets, err = d.decodeIndexed(r)
+	case isProtoRules(magic):
+		// Protobuf messages aren't delimited, so they're decoded in one go.
+		var data []byte
+		if data, err = ioutil.ReadAll(r); err == nil {
+			rulesets, err = decodeRulesetsProto(data)
+		}
+	default:
+		return decodeGob(r, fn)
+	}
+	if err != nil {
+		return err
+	}
+	for _, rs := range rulesets {
+		fn(rs)
+	}
+	return nil
+}
+
+// decodeIndexed decodes rulesets in the indexed format read from r, leaving
+// their rules and exclusions to be decoded on first use. Uncompressed data is
+// used in place, so that rules in a memory mapped file stay there.
+func (d *deserializer) decodeIndexed(r io.Reader) ([]*Ruleset, error) {
+	if data := rulesPayload(d.data); isIndexedRules(data) {
+		// Read through the rest anyway so that the checksum gets verified.
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return nil, err
+		}
+		return decodeRulesetsIndexed(data, false)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRulesetsIndexed(data, false)
+}
+
+// rulesReader returns a reader for the encoded rulesets to decode,
+// decompressing them if they're compressed.
+func (d *deserializer) rulesReader() (io.Reader, error) {
+	if d.data == nil {
+		return decompressingReader(strings.NewReader(embeddedRules))
+	}
+	return decompressingReader(bytes.NewReader(d.data))
+}
+
+// rulesData returns the encoded rulesets to decode, decompressing them if
+// they're compressed.
+func (d *deserializer) rulesData() ([]byte, error) {
+	if d.data == nil {
+		r, err := d.rulesReader()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return decompressed(d.data)
+}
+
+// index compiles the given rulesets and indexes them by target.
+func (d *deserializer) index(rulesets []*Ruleset) (map[string]*ruleset, *radix.Tree) {
 	// The compiled regular expressions aren't serialized, so we have to manually
 	// compile them.
 	plains := make(map[string]*ruleset)
 	wildcards := radix.New()
+	d.indexInto(rulesets, plains, wildcards)
+	return plains, wildcards
+}
 
+// indexInto compiles the given rulesets and adds them to the given indices.
+func (d *deserializer) indexInto(rulesets []*Ruleset, plains map[string]*ruleset, wildcards *radix.Tree) {
+	start := d.clock.Now()
+	var compiling time.Duration
+	if d.stats != nil {
+		compiling = d.stats.phase(phaseCompile)
+	}
 	for _, rs := range rulesets {
 		d.addRuleset(rs, plains, wildcards)
 	}
-
-	d.log.Debugf("Loaded HTTPS Everywhere in %v", time.Now().Sub(start).String())
-	return plains, wildcards, nil
+	if d.stats != nil {
+		// Compiling is timed separately.
+		compiled := d.stats.phase(phaseCompile) - compiling
+		d.stats.addTime(phaseIndex, d.clock.Now().Sub(start)-compiled)
+	}
 }
 
 func (d *deserializer) addRuleset(rs *Ruleset, plains map[string]*ruleset, wildcards *radix.Tree) {
+	rsCopy := d.newRuleset(rs)
+	if rsCopy == nil {
+		return
+	}
+	rsCopy.source = d.intern(rsCopy.source)
+
+	for _, target := range rs.Target {
+		if isSuffixTarget(target) || isPrefixTarget(target) {
+			key := target.Key
+			if key == "" {
+				key = indexKey(target.Host)
+			}
+			wildcards.Insert(key, rsCopy)
+		} else {
+			plains[target.Host] = rsCopy
+		}
+	}
+}
+
+// newRuleset makes a simpler in memory version of the given Ruleset, compiling
+// its rules and exclusions unless they're to be compiled on first use. It
+// returns nil if the Ruleset can't be used.
+func (d *deserializer) newRuleset(rs *Ruleset) *ruleset {
 	// If the rule is turned off, ignore it. This should be handled in
 	// preprocessing, but better to be sure.
 	if len(rs.Off) > 0 {
-		return
+		return nil
 	}
 	// ignore any rule that is mixedcontent-only.
 	if rs.Platform == "mixedcontent" {
-		return
+		return nil
 	}
 
-	// Make a simpler in memory version.
 	rsCopy := &ruleset{
+		name:      rs.Name,
+		file:      rs.File,
+		source:    rs.Source,
+		target:    make([]string, 0, len(rs.Target)),
 		exclusion: make([]exclusion, 0),
 		rule:      make([]rule, 0),
+		pathScope: rs.PathScope,
+		exclusive: rs.Exclusive,
 	}
+	for _, target := range rs.Target {
+		rsCopy.target = append(rsCopy.target, target.Host)
+	}
+	if d.keepNotes {
+		rsCopy.notes = rs.Notes
+	}
+	switch {
+	case rs.body != nil:
+		// The rules and exclusions are compiled on first use.
+		rsCopy.lazy = &lazyRules{body: rs.body, d: d.lazyCompiler()}
+	case d.lazy:
+		// Only keep what's needed to compile them.
+		rsCopy.lazy = &lazyRules{
+			rules: &Ruleset{Exclusion: rs.Exclusion, Rule: rs.Rule},
+			d:     d.lazyCompiler(),
+		}
+	case !d.compileRules(rs, rsCopy):
+		return nil
+	}
+	return rsCopy
+}
+
+// compileRules compiles the rules and exclusions of rs into rsCopy, returning
+// false if none of its rules are left to apply.
+func (d *deserializer) compileRules(rs *Ruleset, rsCopy *ruleset) bool {
+	// Salvage as much of the ruleset as we safely can if some of its patterns
+	// don't compile.
 	for _, e := range rs.Exclusion {
-		pat, err := regexp.Compile(e.Pattern)
+		pat, err := d.compile(e.Pattern)
 		if err != nil {
-			d.log.Debugf("Compile failed?? %v", err)
-			return
+			// Fail closed by excluding at least everything the exclusion would
+			// have.
+			failClosed := failClosedExclusion(e.Pattern)
+			d.log.Debugf("Compile failed, excluding %v instead: %v", failClosed, err)
+			d.drop(0, 0, 1)
+			pat = regexp.MustCompile(failClosed)
 		}
 		rsCopy.exclusion = append(rsCopy.exclusion, exclusion{
 			pattern: pat,
@@ -83,29 +361,60 @@ func (d *deserializer) addRuleset(rs *Ruleset, plains map[string]*ruleset, wildc
 	}
 
 	for _, r := range rs.Rule {
-		from, err := regexp.Compile(r.From)
+		from, err := d.compile(r.From)
 		if err != nil {
-			d.log.Debugf("Compile failed?? %v", err)
-			return
+			d.log.Debugf("Compile failed, dropping rule: %v", err)
+			d.drop(0, 1, 0)
+			continue
 		}
 		rsCopy.rule = append(rsCopy.rule, rule{
 			from: from,
 			to:   r.To,
 		})
 	}
+	if len(rsCopy.rule) == 0 && len(rs.Rule) > 0 {
+		// Nothing left to apply.
+		d.drop(1, 0, len(rs.Exclusion))
+		return false
+	}
+	return true
+}
 
-	for _, target := range rs.Target {
-		//h.log.Debugf("Adding target host %v", target.Host)
-		if isSuffixTarget(target) {
-			//h.log.Debug("Adding suffix target")
-			wildcards.Insert(strings.TrimSuffix(target.Host, "*"), rsCopy)
-		} else if isPrefixTarget(target) {
-			input := reverse(strings.TrimPrefix(target.Host, "*"))
-			wildcards.Insert(input, rsCopy)
-		} else {
-			plains[target.Host] = rsCopy
-		}
+// drop records that the given numbers of rulesets, rules and exclusions were
+// dropped.
+func (d *deserializer) drop(rulesets int, rules int, exclusions int) {
+	if d.stats != nil {
+		d.stats.drop(rulesets, rules, exclusions)
+	}
+}
+
+// compile compiles the given pattern, waiting for the compile quota if there
+// is one.
+func (d *deserializer) compile(pattern string) (*regexp.Regexp, error) {
+	if d.quota != nil {
+		d.quota.wait(d.clock)
+	}
+	if d.stats == nil {
+		return compileRegexp(pattern, d.maxProgramSize)
+	}
+	start := d.clock.Now()
+	defer func() {
+		d.stats.addTime(phaseCompile, d.clock.Now().Sub(start))
+	}()
+	return compileRegexp(pattern, d.maxProgramSize)
+}
+
+// indexKey returns the key the given target host is indexed under. Suffix
+// targets are stored without the wildcard and prefix targets reversed, so that
+// both can be found with a longest prefix lookup in the same radix tree.
+func indexKey(host string) string {
+	if strings.HasSuffix(host, "*") {
+		return strings.TrimSuffix(host, "*")
+	}
+	if strings.HasPrefix(host, "*") {
+		return reverse(strings.TrimPrefix(host, "*"))
 	}
+	return host
 }
 
 func isPrefixTarget(target *Target) bool {
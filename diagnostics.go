@@ -0,0 +1,117 @@
+package httpseverywhere
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-radix"
+)
+
+// slowRulesetsInDiagnostics is the number of slowest rule sets included in
+// diagnostics.
+const slowRulesetsInDiagnostics = 10
+
+// Diagnostics is a snapshot of an Engine's state for troubleshooting.
+type Diagnostics struct {
+	At time.Time `json:"at"`
+	// BundleSHA256 is the SHA-256 of the decoded rules, either the built-in
+	// ones or those given with WithRulesData, or empty if neither is used.
+	BundleSHA256   string               `json:"bundle_sha256,omitempty"`
+	Generation     int64                `json:"generation"`
+	CustomRulesets int                  `json:"custom_rulesets"`
+	Load           LoadStats            `json:"load"`
+	PlainTargets   int                  `json:"plain_targets"`
+	WildcardKeys   int                  `json:"wildcard_keys"`
+	Cache          *CacheDiagnostics    `json:"cache,omitempty"`
+	Decisions      *DecisionDiagnostics `json:"decisions,omitempty"`
+	Stats          StatsSnapshot        `json:"stats"`
+	Quarantined    []QuarantinedRuleset `json:"quarantined,omitempty"`
+	Slowest        []SlowRuleset        `json:"slowest,omitempty"`
+	Overrides      []ExclusionOverride  `json:"overrides,omitempty"`
+	// InvalidRewrites counts the rewrites discarded by WithRewriteValidation
+	// and RecentInvalidRewrites lists the most recent of them.
+	InvalidRewrites       int64            `json:"invalid_rewrites"`
+	RecentInvalidRewrites []InvalidRewrite `json:"recent_invalid_rewrites,omitempty"`
+}
+
+// CacheDiagnostics describes the state of the lookup cache.
+type CacheDiagnostics struct {
+	Positive int     `json:"positive"`
+	Negative int     `json:"negative"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+// DecisionDiagnostics describes the state of the decision cache.
+type DecisionDiagnostics struct {
+	Entries int     `json:"entries"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// SlowRuleset is a rule set along with its slowest recent evaluation time.
+// Evaluation times are only tracked with WithSlowRulesetQuarantine.
+type SlowRuleset struct {
+	Targets []string      `json:"targets"`
+	Max     time.Duration `json:"max"`
+}
+
+// Diagnostics returns a snapshot of the Engine's state.
+func (h *Engine) Diagnostics() *Diagnostics {
+	d := &Diagnostics{
+		At:             h.clock.Now(),
+		Generation:     h.Generation(),
+		CustomRulesets: len(h.customRulesets),
+		Load:           h.LoadStats(),
+		PlainTargets:   len(h.plainTargets.Load().(map[string]*ruleset)),
+		WildcardKeys:   h.wildcardTargets.Load().(*radix.Tree).Len(),
+		Stats:          h.Stats(),
+		Quarantined:    h.Quarantined(),
+		Overrides:      h.ExclusionOverrides(),
+
+		InvalidRewrites:       atomic.LoadInt64(&h.invalidRewrites.count),
+		RecentInvalidRewrites: h.invalidRewrites.list(),
+	}
+	if !h.skipBuiltin {
+		d.BundleSHA256 = h.RulesVersion()
+	}
+	if h.cache != nil {
+		c := &CacheDiagnostics{
+			Positive: h.cache.positive.len(),
+			Negative: h.cache.negative.len(),
+			Hits:     atomic.LoadInt64(&h.cache.hits),
+			Misses:   atomic.LoadInt64(&h.cache.misses),
+		}
+		if total := c.Hits + c.Misses; total > 0 {
+			c.HitRate = float64(c.Hits) / float64(total)
+		}
+		d.Cache = c
+	}
+	if h.decisions != nil {
+		c := &DecisionDiagnostics{
+			Entries: h.decisions.entries.len(),
+			Hits:    atomic.LoadInt64(&h.decisions.hits),
+			Misses:  atomic.LoadInt64(&h.decisions.misses),
+		}
+		if total := c.Hits + c.Misses; total > 0 {
+			c.HitRate = float64(c.Hits) / float64(total)
+		}
+		d.Decisions = c
+	}
+	if h.quarantine != nil {
+		d.Slowest = h.quarantine.slowest(slowRulesetsInDiagnostics)
+	}
+	return d
+}
+
+// DumpDiagnostics writes the Engine's Diagnostics to the given writer as
+// JSON, for example to attach to a support ticket.
+func (h *Engine) DumpDiagnostics(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(h.Diagnostics())
+}
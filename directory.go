@@ -0,0 +1,77 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// FileError describes why a rule set file was skipped by NewFromDirectory.
+type FileError struct {
+	// File is the path of the rule set file.
+	File string
+	// Issues lists the problems found with the rule set, or is empty if the
+	// file couldn't be read.
+	Issues []ValidationIssue
+	// Err is the error reading the file, if any.
+	Err error
+}
+
+func (e *FileError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %v", e.File, e.Err)
+	}
+	issues := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		issues = append(issues, issue.String())
+	}
+	return fmt.Sprintf("%v: %v", e.File, strings.Join(issues, "; "))
+}
+
+// NewFromDirectory returns a new rewrite function that uses the rule sets in
+// the XML files in dir instead of the built-in ones, parsing and vetting them
+// the way the preprocessor does. This lets rule authors iterate on rules
+// without regenerating the embedded rules. Files whose rule sets can't be used
+// are skipped and reported, along with any warnings for the ones that can.
+// The error is only set if dir itself couldn't be read.
+func NewFromDirectory(dir string) (Rewrite, []*FileError, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rulesets []*Ruleset
+	var fileErrors []*FileError
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".xml" {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			fileErrors = append(fileErrors, &FileError{File: path, Err: err})
+			continue
+		}
+		rs, issues := ValidateRulesetXML(b)
+		if len(issues) > 0 {
+			fileErrors = append(fileErrors, &FileError{File: path, Issues: issues})
+		}
+		if hasErrors(issues) {
+			continue
+		}
+		precomputeKeys(rs)
+		rs.PathScope = pathScope(rs.Rule)
+		rulesets = append(rulesets, rs)
+	}
+	return New(WithoutBuiltinRules(), WithRulesets(rulesets...)).Rewrite, fileErrors, nil
+}
+
+func hasErrors(issues []ValidationIssue) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
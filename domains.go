@@ -0,0 +1,61 @@
+package httpseverywhere
+
+import "strings"
+
+// WithTargetDomains only loads the built-in rule sets with a target that
+// intersects one of the given domains, meaning that the target is the domain
+// or one of its subdomains or that the target's wildcard covers the domain.
+// This saves a lot of memory and load time for deployments that only ever see
+// traffic for a known set of domains. Rule sets given with WithRulesets are
+// always loaded.
+func WithTargetDomains(domains ...string) Option {
+	return func(h *Engine) {
+		for _, domain := range domains {
+			h.targetDomains = append(h.targetDomains, strings.ToLower(strings.Trim(domain, ".")))
+		}
+	}
+}
+
+// filterByTargetDomains returns the given rulesets that have a target
+// intersecting the target domains, if any were configured.
+func (h *Engine) filterByTargetDomains(rulesets []*Ruleset) []*Ruleset {
+	if len(h.targetDomains) == 0 {
+		return rulesets
+	}
+	filtered := make([]*Ruleset, 0, len(rulesets))
+	for _, rs := range rulesets {
+		if h.inTargetDomains(rs) {
+			filtered = append(filtered, rs)
+		}
+	}
+	return filtered
+}
+
+// inTargetDomains returns whether or not the given ruleset has a target
+// intersecting the target domains, or true if none were configured.
+func (h *Engine) inTargetDomains(rs *Ruleset) bool {
+	return len(h.targetDomains) == 0 || h.intersectsTargetDomains(rs)
+}
+
+func (h *Engine) intersectsTargetDomains(rs *Ruleset) bool {
+	for _, target := range rs.Target {
+		for _, domain := range h.targetDomains {
+			if targetInDomain(target.Host, domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// targetInDomain returns whether or not the given target intersects the given
+// domain.
+func targetInDomain(target string, domain string) bool {
+	base := strings.TrimPrefix(target, "*.")
+	if base == domain || strings.HasSuffix(base, "."+domain) {
+		// The target is within the domain.
+		return true
+	}
+	// The target's wildcard covers the domain.
+	return targetMatches(domain, target)
+}
@@ -0,0 +1,98 @@
+package httpseverywhere
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// OtherDomains is the domain that DomainHits counts the rewrites for domains
+// beyond the limit set with WithDomainStats under.
+const OtherDomains = "other"
+
+// domainStats counts rewrites by root domain.
+type domainStats struct {
+	max  int
+	mx   sync.RWMutex
+	hits map[string]*int64
+}
+
+// WithDomainStats counts rewritten URLs by root domain, like example.com for
+// www.example.com, for up to maxDomains domains, which DomainHits reports.
+// Rewrites for further domains are counted under OtherDomains. Root domains
+// are approximated as the last two labels of the host, or three for hosts
+// under common second-level domains of country code top-level domains like
+// co.uk.
+func WithDomainStats(maxDomains int) Option {
+	return func(h *Engine) {
+		h.domainStats = &domainStats{
+			max:  maxDomains,
+			hits: make(map[string]*int64),
+		}
+	}
+}
+
+// DomainHits returns the number of rewritten URLs by root domain, if counted
+// with WithDomainStats, or nil otherwise.
+func (h *Engine) DomainHits() map[string]int64 {
+	s := h.domainStats
+	if s == nil {
+		return nil
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	hits := make(map[string]int64, len(s.hits))
+	for domain, count := range s.hits {
+		hits[domain] = atomic.LoadInt64(count)
+	}
+	return hits
+}
+
+// count counts a rewrite of a URL on the given host.
+func (s *domainStats) count(host string) {
+	domain := rootDomain(host)
+	s.mx.RLock()
+	count := s.hits[domain]
+	s.mx.RUnlock()
+	if count == nil {
+		s.mx.Lock()
+		count = s.hits[domain]
+		if count == nil {
+			if len(s.hits) >= s.max {
+				domain = OtherDomains
+				count = s.hits[domain]
+			}
+			if count == nil {
+				count = new(int64)
+				s.hits[domain] = count
+			}
+		}
+		s.mx.Unlock()
+	}
+	atomic.AddInt64(count, 1)
+}
+
+// secondLevelDomains are second-level domains commonly used under country code
+// top-level domains, like co.uk.
+var secondLevelDomains = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "gov": true,
+	"net": true, "or": true, "org": true, "ne": true, "go": true,
+}
+
+// rootDomain approximates the root domain of the given host.
+func rootDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	n := 2
+	if len(labels) > 2 && len(labels[len(labels)-1]) == 2 && secondLevelDomains[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return host
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
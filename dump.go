@@ -0,0 +1,89 @@
+package httpseverywhere
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/armon/go-radix"
+)
+
+// Format is a format that Dump writes rule sets in.
+type Format int
+
+const (
+	// FormatXML writes the rule sets as ruleset elements in a rulesetlibrary
+	// element, like HTTPS Everywhere's combined rules file.
+	FormatXML Format = iota
+	// FormatJSON writes the rule sets as a JSON array of Ruleset objects.
+	FormatJSON
+)
+
+// rulesetLibrary is the root element of rule sets dumped as XML.
+type rulesetLibrary struct {
+	XMLName  xml.Name   `xml:"rulesetlibrary"`
+	Rulesets []*Ruleset `xml:"ruleset"`
+}
+
+// Dump writes the rule sets in use, built-in ones as well as those given with
+// WithRulesets or loaded by updates, to w in the given format, so that
+// operators can audit what a running Engine enforces. Rules that failed to
+// compile are left out, except for rule sets compiled on first use that
+// haven't been yet, whose rules are written as loaded. Rule sets in a
+// RulesetStore and those of tenants aren't included, and neither are file
+// and source in XML, which has no place for them.
+func (h *Engine) Dump(w io.Writer, format Format) error {
+	rulesets := h.loadedRulesets()
+	dumped := make([]*Ruleset, 0, len(rulesets))
+	for _, rs := range rulesets {
+		dumped = append(dumped, rs.export(false))
+	}
+	switch format {
+	case FormatXML:
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(&rulesetLibrary{Rulesets: dumped}); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dumped)
+	}
+	return fmt.Errorf("unknown format %d", format)
+}
+
+// loadedRulesets returns the distinct rulesets in the indices, in the order
+// of their first plain target and then of their first wildcard key.
+func (h *Engine) loadedRulesets() []*ruleset {
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	wildcards := h.wildcardTargets.Load().(*radix.Tree)
+	seen := make(map[*ruleset]bool)
+	var rulesets []*ruleset
+	add := func(rs *ruleset) {
+		if !seen[rs] {
+			seen[rs] = true
+			rulesets = append(rulesets, rs)
+		}
+	}
+	hosts := make([]string, 0, len(plains))
+	for host := range plains {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		add(plains[host])
+	}
+	wildcards.Walk(func(key string, v interface{}) bool {
+		add(v.(*ruleset))
+		return false
+	})
+	return rulesets
+}
@@ -0,0 +1,52 @@
+// Command proxy is an example forward proxy that upgrades plain HTTP requests
+// to HTTPS using the rule engine:
+//
+//	proxy [-addr localhost:8080] [-bundle rules.gob] [-prefs prefs.json]
+//
+// Requests are fetched through the Engine's Transport, so those for http URLs
+// that the rules rewrite are fetched from the HTTPS URL instead. If that fails
+// because of TLS, for example because the site's certificate is broken, the
+// request is fetched over plain HTTP after all and the path is reported broken
+// with ReportBrokenPath, so that it isn't upgraded again. The broken paths are
+// kept in the preferences file across restarts. HTTPS traffic is tunneled
+// without being intercepted.
+//
+// Requests made to the proxy itself rather than through it serve the
+// Engine's state:
+//
+//	/diagnostics   the Engine's Diagnostics as JSON
+//	/debug/vars    the Engine's stats, published with WithExpvar
+//	/broken        the broken paths as JSON
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address to listen on")
+	bundle := flag.String("bundle", "", "bundle to load instead of the built-in rules")
+	prefs := flag.String("prefs", "prefs.json", "file to keep broken paths in")
+	flag.Parse()
+
+	opts := []httpseverywhere.Option{
+		httpseverywhere.WithPreferencesStore(&fileStore{path: *prefs}),
+		httpseverywhere.WithLookupCache(10000, 10000),
+		httpseverywhere.WithExpvar(),
+	}
+	if *bundle != "" {
+		data, err := ioutil.ReadFile(*bundle)
+		if err != nil {
+			log.Fatalf("Unable to read bundle: %v", err)
+		}
+		opts = append(opts, httpseverywhere.WithRulesData(data))
+	}
+	p := newProxy(httpseverywhere.New(opts...), nil)
+	log.Printf("Listening on %v", *addr)
+	log.Fatal(http.ListenAndServe(*addr, p))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+// UpgradedHeader is set on responses to requests that were upgraded, to the
+// URL that was fetched.
+const UpgradedHeader = "X-Httpse-Upgraded"
+
+// hopHeaders are the headers that only apply to a single connection and
+// mustn't be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxy is a forward proxy that upgrades requests using an Engine.
+type proxy struct {
+	h      *httpseverywhere.Engine
+	client *http.Client
+}
+
+// newProxy returns a proxy that upgrades requests with h and fetches them with
+// client, or with a default client if it's nil. The client's Transport is
+// wrapped with the Engine's, which does the upgrading.
+func newProxy(h *httpseverywhere.Engine, client *http.Client) *proxy {
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	// Redirects are passed on to the client rather than followed.
+	c := *client
+	c.Transport = h.NewTransport(client.Transport)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &proxy{h: h, client: &c}
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodConnect:
+		p.tunnel(w, req)
+	case !req.URL.IsAbs():
+		p.serveState(w, req)
+	default:
+		p.forward(w, req)
+	}
+}
+
+// forward fetches the requested URL. The client's Transport upgrades it to
+// HTTPS if the rules rewrite it.
+func (p *proxy) forward(w http.ResponseWriter, req *http.Request) {
+	resp, err := p.fetch(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.Request != nil && resp.Request.URL.Scheme != req.URL.Scheme {
+		w.Header().Set(UpgradedHeader, resp.Request.URL.String())
+	}
+	p.respond(w, resp)
+}
+
+// fetch sends a copy of the given request upstream.
+func (p *proxy) fetch(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	for _, header := range hopHeaders {
+		out.Header.Del(header)
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		// The body is kept so that the Transport can send it again if the
+		// upgraded request fails.
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		out.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		out.ContentLength = int64(len(body))
+	}
+	return p.client.Do(out)
+}
+
+// respond copies the given response to w.
+func (p *proxy) respond(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for _, header := range hopHeaders {
+		resp.Header.Del(header)
+	}
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects the client to the requested host without intercepting the
+// traffic.
+func (p *proxy) tunnel(w http.ResponseWriter, req *http.Request) {
+	upstream, err := net.DialTimeout("tcp", req.Host, 30*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	rw.Flush()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, rw)
+		upstream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}()
+	wg.Wait()
+}
+
+// serveState serves requests made to the proxy itself.
+func (p *proxy) serveState(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/diagnostics":
+		w.Header().Set("Content-Type", "application/json")
+		p.h.DumpDiagnostics(w)
+	case "/debug/vars":
+		expvar.Handler().ServeHTTP(w, req)
+	case "/broken":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.h.BrokenPaths())
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// fileStore is a PreferencesStore keeping the preferences in a JSON file.
+type fileStore struct {
+	path string
+}
+
+type preferences struct {
+	BrokenPaths []httpseverywhere.BrokenPath `json:"broken_paths"`
+}
+
+func (s *fileStore) LoadBrokenPaths() ([]httpseverywhere.BrokenPath, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var prefs preferences
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		return nil, err
+	}
+	return prefs.BrokenPaths, nil
+}
+
+func (s *fileStore) SaveBrokenPaths(paths []httpseverywhere.BrokenPath) error {
+	data, err := json.Marshal(&preferences{BrokenPaths: paths})
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
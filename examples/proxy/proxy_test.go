@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/httpseverywhere"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRules = `<rulesets>
+	<ruleset name="Secure">
+		<target host="secure.example" />
+		<rule from="^http:" to="https:" />
+	</ruleset>
+	<ruleset name="Slow">
+		<target host="slow.example" />
+		<rule from="^http:" to="https:" />
+	</ruleset>
+	<ruleset name="Broken">
+		<target host="broken.example" />
+		<rule from="^http:" to="https:" />
+	</ruleset>
+</rulesets>`
+
+func TestProxy(t *testing.T) {
+	var rulesets struct {
+		Ruleset []*httpseverywhere.Ruleset `xml:"ruleset"`
+	}
+	require.NoError(t, xml.Unmarshal([]byte(testRules), &rulesets))
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host == "slow.example" && req.TLS != nil {
+			// Never answers, so that requests time out.
+			<-req.Context().Done()
+			return
+		}
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		fmt.Fprintf(w, "%v %v%v", scheme, req.Host, req.URL.Path)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	// All hosts resolve to the test servers. broken.example serves plain HTTP
+	// on the HTTPS port, so upgraded requests to it fail.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, _ := net.SplitHostPort(addr)
+		target := plain.Listener.Addr().String()
+		if port == "443" && host != "broken.example" {
+			target = secure.Listener.Addr().String()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}
+	upstream := &http.Client{Transport: &http.Transport{
+		DialContext:     dial,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	store := &fileStore{path: filepath.Join(t.TempDir(), "prefs.json")}
+	h := httpseverywhere.New(
+		httpseverywhere.WithoutBuiltinRules(),
+		httpseverywhere.WithRulesets(rulesets.Ruleset...),
+		httpseverywhere.WithPreferencesStore(store),
+		httpseverywhere.WithExpvar(),
+	)
+	p := httptest.NewServer(newProxy(h, upstream))
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(u string) (string, string) {
+		resp, err := client.Get(u)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), resp.Header.Get(UpgradedHeader)
+	}
+
+	body, upgraded := get("http://secure.example/page")
+	assert.Equal(t, "https secure.example/page", body)
+	assert.Equal(t, "https://secure.example/page", upgraded)
+
+	body, upgraded = get("http://other.example/page")
+	assert.Equal(t, "http other.example/page", body, "hosts without rules shouldn't be upgraded")
+	assert.Empty(t, upgraded)
+
+	body, upgraded = get("http://broken.example/login")
+	assert.Equal(t, "http broken.example/login", body, "should fall back to HTTP")
+	assert.Empty(t, upgraded)
+	paths := h.BrokenPaths()
+	require.Len(t, paths, 1)
+	assert.Equal(t, "broken.example", paths[0].Host)
+	assert.Equal(t, "/login", paths[0].Path)
+
+	saved, err := store.LoadBrokenPaths()
+	require.NoError(t, err)
+	assert.Len(t, saved, 1, "broken paths should be saved")
+	_, ok := h.Rewrite(&url.URL{Scheme: "http", Host: "broken.example", Path: "/login"})
+	assert.False(t, ok, "broken paths shouldn't be upgraded again")
+
+	timeoutClient := *client
+	timeoutClient.Timeout = 100 * time.Millisecond
+	_, err = timeoutClient.Get("http://slow.example/page")
+	assert.Error(t, err)
+	assert.Never(t, func() bool { return len(h.BrokenPaths()) > 1 }, 200*time.Millisecond, 10*time.Millisecond,
+		"timeouts shouldn't be reported as broken")
+
+	resp, err := http.Get(p.URL + "/broken")
+	require.NoError(t, err)
+	var served []httpseverywhere.BrokenPath
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&served))
+	resp.Body.Close()
+	assert.Len(t, served, 1)
+
+	resp, err = http.Get(p.URL + "/diagnostics")
+	require.NoError(t, err)
+	var diagnostics map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&diagnostics))
+	resp.Body.Close()
+	assert.NotEmpty(t, diagnostics)
+
+	resp, err = http.Get(p.URL + "/debug/vars")
+	require.NoError(t, err)
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&vars))
+	resp.Body.Close()
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal(vars[httpseverywhere.ExpvarName], &stats))
+	assert.EqualValues(t, 3, stats["rewritten"], "stats should be exported")
+}
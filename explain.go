@@ -0,0 +1,162 @@
+package httpseverywhere
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Outcome is what became of a URL in a candidate rule set.
+type Outcome string
+
+const (
+	// OutcomeRewritten means that a rule rewrote the URL.
+	OutcomeRewritten Outcome = "rewritten"
+	// OutcomeExcluded means that an exclusion matched the URL.
+	OutcomeExcluded Outcome = "excluded"
+	// OutcomeNoRuleMatched means that none of the rules matched the URL.
+	OutcomeNoRuleMatched Outcome = "no rule matched"
+	// OutcomeOutOfScope means that the URL's path is outside of the path
+	// scope of the rules, so they weren't evaluated.
+	OutcomeOutOfScope Outcome = "out of scope"
+	// OutcomeTargetMismatch means that the host doesn't match any of the
+	// targets, with WithStrictTargets.
+	OutcomeTargetMismatch Outcome = "target mismatch"
+	// OutcomeQuarantined means that the rule set was quarantined for being
+	// too slow.
+	OutcomeQuarantined Outcome = "quarantined"
+	// OutcomeBrokenPath means that the URL's path was reported broken over
+	// HTTPS.
+	OutcomeBrokenPath Outcome = "broken path"
+	// OutcomeInvalidRewrite means that a rule rewrote the URL to one that
+	// was discarded by WithRewriteValidation.
+	OutcomeInvalidRewrite Outcome = "invalid rewrite"
+)
+
+// Explanation describes how the rewrite of a URL was decided, as returned by
+// Explain.
+type Explanation struct {
+	// URL is the URL that was explained.
+	URL string `json:"url"`
+	// Result is the URL as rewritten by Rewrite, or empty if it isn't
+	// rewritten.
+	Result    string `json:"result,omitempty"`
+	Rewritten bool   `json:"rewritten"`
+	// Alias is the host whose rule sets were evaluated for the URL with
+	// WithAliasFolding, because none cover its own host.
+	Alias string `json:"alias,omitempty"`
+	// Candidates are the candidate rule sets that were evaluated for the URL,
+	// in order.
+	Candidates []*CandidateExplanation `json:"candidates,omitempty"`
+}
+
+// CandidateExplanation describes what a candidate rule set made of a URL.
+type CandidateExplanation struct {
+	// Index is the index the rule set was found in, and Key the key it was
+	// found under: the host for PlainIndex, and the index key of Target, which
+	// is reversed for PrefixIndex, for the wildcard indices.
+	Index Index  `json:"index"`
+	Key   string `json:"key"`
+	// Ruleset is the name of the rule set, and File and Source the file and
+	// source it was preprocessed from.
+	Ruleset string `json:"ruleset,omitempty"`
+	File    string `json:"file,omitempty"`
+	Source  string `json:"source,omitempty"`
+	// Target is the target of the rule set that covers the host.
+	Target string `json:"target,omitempty"`
+	// Targets are all of the rule set's targets.
+	Targets []string `json:"targets"`
+	// Outcome is what became of the URL.
+	Outcome Outcome `json:"outcome"`
+	// Exclusion is the pattern of the exclusion that matched, if excluded.
+	Exclusion string `json:"exclusion,omitempty"`
+	// Rule and To are the pattern and replacement of the rule that matched,
+	// if any, and Result the URL it was rewritten to.
+	Rule   string `json:"rule,omitempty"`
+	To     string `json:"to,omitempty"`
+	Result string `json:"result,omitempty"`
+}
+
+// setOutcome sets the outcome if ex is set.
+func (ex *CandidateExplanation) setOutcome(outcome Outcome) {
+	if ex != nil {
+		ex.Outcome = outcome
+	}
+}
+
+// Explain describes how the rewrite of the given URL is decided: which rule
+// sets were candidates for its host and through which targets, and which of
+// their exclusions or rules matched. Unlike Rewrite, it always looks the
+// candidates up in the indices rather than in any caches. Normalizers and
+// chained rewrites are reflected in the Result but not in the Candidates,
+// which are for the URL as given.
+func (h *Engine) Explain(u *url.URL) *Explanation {
+	ev := h.Evaluate(u)
+	ex := &Explanation{URL: u.String(), Result: ev.URL, Rewritten: ev.Rewritten}
+	if u.Scheme != "http" || !h.holdRules() {
+		return ex
+	}
+	defer h.unholdRules()
+	ex.Candidates = h.explainCandidates(u, u)
+	if len(ex.Candidates) == 0 && h.foldAliases {
+		if alias := aliasHost(u.Host); alias != "" {
+			aliasURL := *u
+			aliasURL.Host = alias
+			ex.Alias = alias
+			ex.Candidates = h.explainCandidates(u, &aliasURL)
+		}
+	}
+	return ex
+}
+
+// explainCandidates explains the candidate rule sets for lookupURL when
+// rewriting u, stopping where the match policy stops evaluating them.
+func (h *Engine) explainCandidates(u *url.URL, lookupURL *url.URL) []*CandidateExplanation {
+	var explained []*CandidateExplanation
+	var seen []*ruleset
+	for _, idx := range h.lookupOrder {
+		rs := h.lookup(idx, lookupURL)
+		if rs == nil || containsRuleset(seen, rs) {
+			continue
+		}
+		seen = append(seen, rs)
+		c := &CandidateExplanation{
+			Index:   idx,
+			Ruleset: rs.name,
+			File:    rs.file,
+			Source:  rs.source,
+			Targets: rs.target,
+		}
+		c.Key, c.Target = explainTarget(idx, lookupURL.Host, rs)
+		r, hit := h.applyRuleset(u, rs, nil, c)
+		explained = append(explained, c)
+		if rs.exclusive || h.earlyExit && !hit {
+			break
+		}
+		if hit && (h.matchPolicy != BestMatch || rewriteScore(u, r) == 0) {
+			break
+		}
+	}
+	return explained
+}
+
+// explainTarget returns the index key the given rule set is found under for
+// host in the given index and the target it comes from.
+func explainTarget(idx Index, host string, rs *ruleset) (string, string) {
+	if idx == PlainIndex {
+		return host, host
+	}
+	search := host
+	if idx == PrefixIndex {
+		search = reverse(host)
+	}
+	var key, target string
+	for _, t := range rs.target {
+		if idx == PrefixIndex && !strings.HasPrefix(t, "*") || idx == SuffixIndex && !strings.HasSuffix(t, "*") {
+			continue
+		}
+		if k := indexKey(t); strings.HasPrefix(search, k) && len(k) >= len(key) {
+			key, target = k, t
+		}
+	}
+	return key, target
+}
@@ -0,0 +1,129 @@
+package httpseverywhere
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+)
+
+// HostMapping maps a plain HTTP host to the host it is served from over
+// HTTPS, which is the same host for simple upgrades.
+type HostMapping struct {
+	Host      string `json:"host"`
+	HTTPSHost string `json:"https_host"`
+}
+
+// HostMappings returns a static table of plain target hosts whose rule sets
+// rewrite every URL on the host to HTTPS on a single host, leaving the path
+// and query untouched. Hosts only covered by wildcard targets, hosts whose
+// rule sets have exclusions and hosts whose rules depend on the path are left
+// out, since those can't be upgraded without evaluating the full URL. This is
+// suitable for DNS or SNI based upgrade systems that can't run regular
+// expressions per request. Mappings are sorted by host.
+func (h *Engine) HostMappings() []HostMapping {
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	mappings := make([]HostMapping, 0, len(plains))
+	for host, rs := range plains {
+		if httpsHost, ok := h.hostMapping(host, rs); ok {
+			mappings = append(mappings, HostMapping{Host: host, HTTPSHost: httpsHost})
+		}
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Host < mappings[j].Host })
+	return mappings
+}
+
+// hostMapping determines whether the given ruleset upgrades every URL on the
+// given host to the same HTTPS host, by probing it with a bare URL and one
+// with a path and query. The probes are evaluated against the ruleset's rules
+// directly, so they don't count as rewrites or trip the quarantine.
+func (h *Engine) hostMapping(host string, rs *ruleset) (string, bool) {
+	if len(rs.compiled().exclusion) > 0 {
+		return "", false
+	}
+	var httpsHost string
+	for _, probe := range []*url.URL{
+		{Scheme: "http", Host: host, Path: "/"},
+		{Scheme: "http", Host: host, Path: "/a/b.html", RawQuery: "c=d"},
+	} {
+		r, ok := rs.apply(probe)
+		if !ok {
+			return "", false
+		}
+		rewritten, err := url.Parse(r)
+		if err != nil || rewritten.Scheme != "https" || rewritten.Path != probe.Path || rewritten.RawQuery != probe.RawQuery {
+			return "", false
+		}
+		if httpsHost != "" && rewritten.Host != httpsHost {
+			return "", false
+		}
+		httpsHost = rewritten.Host
+	}
+	return httpsHost, true
+}
+
+// WriteHostMappingsJSON writes the given host mappings as a JSON array.
+func WriteHostMappingsJSON(w io.Writer, mappings []HostMapping) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(mappings)
+}
+
+// WriteHostMappingsCSV writes the given host mappings as CSV with a header
+// row.
+func WriteHostMappingsCSV(w io.Writer, mappings []HostMapping) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"host", "https_host"}); err != nil {
+		return err
+	}
+	for _, m := range mappings {
+		if err := cw.Write([]string{m.Host, m.HTTPSHost}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// SimpleUpgradeHosts returns the sorted hosts from HostMappings that are
+// upgraded to HTTPS on the same host, which DNS level components can treat as
+// HTTPS capable without knowing anything about the URL.
+func (h *Engine) SimpleUpgradeHosts() []string {
+	mappings := h.HostMappings()
+	hosts := make([]string, 0, len(mappings))
+	for _, m := range mappings {
+		if m.Host == m.HTTPSHost {
+			hosts = append(hosts, m.Host)
+		}
+	}
+	return hosts
+}
+
+// WriteHostsFile writes the given hosts in hosts file format, one line per
+// host mapping it to the given address, like "0.0.0.0 example.com", which is
+// how many DNS components import domain lists.
+func WriteHostsFile(w io.Writer, hosts []string, addr string) error {
+	bw := bufio.NewWriter(w)
+	for _, host := range hosts {
+		fmt.Fprintf(bw, "%v %v\n", addr, host)
+	}
+	return bw.Flush()
+}
+
+// WriteRPZ writes the given hosts as a DNS Response Policy Zone with the given
+// SOA serial. Each host gets the "rpz-passthru." action, which leaves answers
+// untouched but lets the resolver log and count queries for hosts that will be
+// upgraded, so policies can be layered on top as needed.
+func WriteRPZ(w io.Writer, hosts []string, serial uint32) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$TTL 300\n")
+	fmt.Fprintf(bw, "@ IN SOA localhost. root.localhost. %d 3600 600 86400 300\n", serial)
+	fmt.Fprintf(bw, "@ IN NS localhost.\n")
+	for _, host := range hosts {
+		fmt.Fprintf(bw, "%v CNAME rpz-passthru.\n", host)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,71 @@
+package httpseverywhere
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostMappings(t *testing.T) {
+	h := newRawHTTPS(`<ruleset name="Simple">
+		<target host="simple.com" />
+		<target host="*.simple.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	addRuleset(`<ruleset name="Moved">
+		<target host="moved.com" />
+		<rule from="^http://moved\.com/" to="https://www.moved.net/" />
+	</ruleset>`, h)
+	addRuleset(`<ruleset name="Partial">
+		<target host="partial.com" />
+		<rule from="^http://partial\.com/a/" to="https://partial.com/a/" />
+	</ruleset>`, h)
+	addRuleset(`<ruleset name="Excluded">
+		<target host="excluded.com" />
+		<exclusion pattern="^http://excluded\.com/login" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, h)
+
+	mappings := h.HostMappings()
+	assert.Equal(t, []HostMapping{
+		{Host: "moved.com", HTTPSHost: "www.moved.net"},
+		{Host: "simple.com", HTTPSHost: "simple.com"},
+	}, mappings)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteHostMappingsCSV(&buf, mappings))
+	assert.Equal(t, "host,https_host\nmoved.com,www.moved.net\nsimple.com,simple.com\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, WriteHostMappingsJSON(&buf, mappings[:1]))
+	assert.JSONEq(t, `[{"host": "moved.com", "https_host": "www.moved.net"}]`, buf.String())
+
+	assert.Equal(t, []string{"simple.com"}, h.SimpleUpgradeHosts())
+
+	buf.Reset()
+	assert.NoError(t, WriteHostsFile(&buf, []string{"a.com", "b.com"}, "0.0.0.0"))
+	assert.Equal(t, "0.0.0.0 a.com\n0.0.0.0 b.com\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, WriteRPZ(&buf, []string{"a.com"}, 7))
+	assert.Equal(t, "$TTL 300\n@ IN SOA localhost. root.localhost. 7 3600 600 86400 300\n@ IN NS localhost.\na.com CNAME rpz-passthru.\n", buf.String())
+}
+
+func TestHostMappingsHaveNoSideEffects(t *testing.T) {
+	h := newEmpty(WithSlowRulesetQuarantine(-1, 100))
+	addRuleset(`<ruleset name="Simple">
+		<target host="simple.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, h)
+
+	// Each call probes the rule set twice, which would fill the quarantine
+	// window if the probes were recorded.
+	for i := 0; i < 60; i++ {
+		assert.Equal(t, []HostMapping{{Host: "simple.com", HTTPSHost: "simple.com"}}, h.HostMappings())
+	}
+	assert.Empty(t, h.Quarantined())
+	assert.Empty(t, h.quarantine.slowest(10), "the probes shouldn't be timed")
+	_, mod := h.Rewrite(toURL("http://simple.com/"))
+	assert.True(t, mod)
+}
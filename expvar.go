@@ -0,0 +1,115 @@
+package httpseverywhere
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// ExpvarName is the name of the expvar map that WithExpvar publishes to.
+const ExpvarName = "httpseverywhere"
+
+var (
+	expvarOnce sync.Once
+	expvarMx   sync.Mutex
+	// expvarEngine is the Engine whose stats are published, if any.
+	expvarEngine *Engine
+)
+
+// WithExpvar publishes the Engine's stats with expvar, in a map named
+// ExpvarName, so that they show up on /debug/vars for applications serving
+// net/http's debug endpoints:
+//
+//	requests           URLs given to be rewritten
+//	rewritten          those of them that were rewritten
+//	not_rewritten      those of them that weren't
+//	cache_hits         lookup cache hits, with WithLookupCache
+//	cache_misses       lookup cache misses, with WithLookupCache
+//	init_seconds       the time taken to load the rules
+//	rulesets           the number of rule sets in the rules
+//	loaded_rulesets    the number of rule sets in use
+//	dropped_rulesets   rule sets dropped because none of their rules compiled
+//	dropped_rules      rules dropped because they didn't compile
+//	invalid_rewrites   rewrites discarded by WithRewriteValidation
+//	update_failures    failed automatic updates
+//
+// Since expvar names are global, only one Engine's stats are published at a
+// time, those of the last one created with this option, until it's closed.
+// The rewrite counts aren't collected with WithStats(false).
+func WithExpvar() Option {
+	return func(h *Engine) {
+		h.expvar = true
+	}
+}
+
+// publishExpvar makes h the Engine whose stats are published with expvar.
+func publishExpvar(h *Engine) {
+	expvarMx.Lock()
+	expvarEngine = h
+	expvarMx.Unlock()
+	expvarOnce.Do(func() {
+		m := expvar.NewMap(ExpvarName)
+		set := func(name string, fn func(h *Engine) interface{}) {
+			m.Set(name, expvar.Func(func() interface{} {
+				expvarMx.Lock()
+				h := expvarEngine
+				expvarMx.Unlock()
+				if h == nil {
+					return nil
+				}
+				return fn(h)
+			}))
+		}
+		set("requests", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.stats.requests)
+		})
+		set("rewritten", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.stats.rewritten)
+		})
+		set("not_rewritten", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.stats.requests) - atomic.LoadInt64(&h.stats.rewritten)
+		})
+		set("cache_hits", func(h *Engine) interface{} {
+			if h.cache == nil {
+				return 0
+			}
+			return atomic.LoadInt64(&h.cache.hits)
+		})
+		set("cache_misses", func(h *Engine) interface{} {
+			if h.cache == nil {
+				return 0
+			}
+			return atomic.LoadInt64(&h.cache.misses)
+		})
+		set("init_seconds", func(h *Engine) interface{} {
+			return h.load.phase(phaseTotal).Seconds()
+		})
+		set("rulesets", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.load.rulesets)
+		})
+		set("loaded_rulesets", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.load.loaded)
+		})
+		set("dropped_rulesets", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.load.droppedRulesets)
+		})
+		set("dropped_rules", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.load.droppedRules)
+		})
+		set("invalid_rewrites", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.invalidRewrites.count)
+		})
+		set("update_failures", func(h *Engine) interface{} {
+			return atomic.LoadInt64(&h.stats.updateFailures)
+		})
+	})
+}
+
+// unpublishExpvar stops publishing h's stats, if they are.
+func unpublishExpvar(h *Engine) {
+	expvarMx.Lock()
+	if expvarEngine == h {
+		expvarEngine = nil
+	}
+	expvarMx.Unlock()
+}
@@ -1,10 +1,10 @@
 module github.com/getlantern/httpseverywhere
 
-go 1.15
+go 1.16
 
 require (
 	github.com/armon/go-radix v1.0.0
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/getlantern/golog v0.0.0-20201105130739-9586b8bde3a9
-	github.com/getlantern/mtime v0.0.0-20200417132445-23682092d1f7
 	github.com/stretchr/testify v1.6.1
 )
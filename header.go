@@ -0,0 +1,129 @@
+package httpseverywhere
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RulesSchemaVersion is the version of the layout of Ruleset and the types it
+// contains that this package writes and reads. It's increased whenever the
+// layout changes in a way that older or newer code would mis-decode.
+const RulesSchemaVersion = 1
+
+// rulesHeaderMagic starts the header that the preprocessor writes in front of
+// the encoded rule sets. It's followed by the schema version as a big endian
+// uint16, the time the rules were generated in Unix nanoseconds as a big
+// endian int64 and the SHA-256 checksum of the encoded rule sets that follow,
+// which is also their version.
+var rulesHeaderMagic = []byte("HTTPSEhd")
+
+const rulesHeaderLen = 8 + 2 + 8 + sha256.Size
+
+// rulesHeader is the decoded header of rules data.
+type rulesHeader struct {
+	schemaVersion uint16
+	generated     time.Time
+	checksum      [sha256.Size]byte
+}
+
+// SchemaVersionError is returned when loading rules written for a different
+// RulesSchemaVersion.
+type SchemaVersionError struct {
+	// Version is the schema version of the rules.
+	Version int
+}
+
+func (e *SchemaVersionError) Error() string {
+	return fmt.Sprintf("rules have schema version %d but version %d is required", e.Version, RulesSchemaVersion)
+}
+
+// ChecksumError is returned when loading rules whose contents don't match the
+// checksum in their header, for example because they were truncated.
+type ChecksumError struct {
+	// Expected is the checksum in the header, in hex.
+	Expected string
+	// Actual is the checksum of the contents, in hex.
+	Actual string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("rules checksum is %v but the header says %v", e.Actual, e.Expected)
+}
+
+// withRulesHeader returns the given encoded rule sets preceded by a header.
+func withRulesHeader(payload []byte, generated time.Time) []byte {
+	buf := make([]byte, rulesHeaderLen, rulesHeaderLen+len(payload))
+	copy(buf, rulesHeaderMagic)
+	binary.BigEndian.PutUint16(buf[8:], RulesSchemaVersion)
+	binary.BigEndian.PutUint64(buf[10:], uint64(generated.UnixNano()))
+	sum := sha256.Sum256(payload)
+	copy(buf[18:], sum[:])
+	return append(buf, payload...)
+}
+
+// parseRulesHeader parses the header at the start of the given data, which
+// must be at least rulesHeaderLen long, returning an error if the schema
+// version isn't supported.
+func parseRulesHeader(data []byte) (*rulesHeader, error) {
+	header := &rulesHeader{
+		schemaVersion: binary.BigEndian.Uint16(data[8:]),
+		generated:     time.Unix(0, int64(binary.BigEndian.Uint64(data[10:]))),
+	}
+	copy(header.checksum[:], data[18:rulesHeaderLen])
+	if header.schemaVersion != RulesSchemaVersion {
+		return nil, &SchemaVersionError{Version: int(header.schemaVersion)}
+	}
+	return header, nil
+}
+
+// hasRulesHeader returns whether or not the given data starts with a header.
+// Rules written before headers were introduced don't have one.
+func hasRulesHeader(data []byte) bool {
+	return bytes.HasPrefix(data, rulesHeaderMagic)
+}
+
+// splitRulesHeader returns the header of the given uncompressed rules data,
+// if any, and the encoded rule sets following it, verifying the checksum.
+func splitRulesHeader(data []byte) (*rulesHeader, []byte, error) {
+	if !hasRulesHeader(data) {
+		return nil, data, nil
+	}
+	if len(data) < rulesHeaderLen {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	header, err := parseRulesHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload := data[rulesHeaderLen:]
+	if err := header.verify(sha256.Sum256(payload)); err != nil {
+		return nil, nil, err
+	}
+	return header, payload, nil
+}
+
+// rulesPayload returns the encoded rule sets in the given uncompressed rules
+// data without verifying the checksum.
+func rulesPayload(data []byte) []byte {
+	if hasRulesHeader(data) && len(data) >= rulesHeaderLen {
+		return data[rulesHeaderLen:]
+	}
+	return data
+}
+
+// verify returns a ChecksumError if the given checksum doesn't match the one
+// in the header.
+func (h *rulesHeader) verify(sum [sha256.Size]byte) error {
+	if sum != h.checksum {
+		return &ChecksumError{
+			Expected: hex.EncodeToString(h.checksum[:]),
+			Actual:   hex.EncodeToString(sum[:]),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package httpseverywhere
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const hostMapShards = 64
+
+// hostMap is a concurrent map keyed by host for runtime-mutable layers like
+// overrides. It's split into shards that each have their own lock, so that a
+// high rate of writes for some hosts doesn't contend with lookups for others,
+// and lookups don't take any lock at all while the map is empty, which is the
+// common case on the rewrite path.
+type hostMap struct {
+	size   int64
+	shards [hostMapShards]hostShard
+}
+
+type hostShard struct {
+	mx sync.RWMutex
+	m  map[string]interface{}
+}
+
+func (m *hostMap) shard(host string) *hostShard {
+	// FNV-1a
+	hash := uint32(2166136261)
+	for i := 0; i < len(host); i++ {
+		hash ^= uint32(host[i])
+		hash *= 16777619
+	}
+	return &m.shards[hash%hostMapShards]
+}
+
+// get returns the value for the given host, if any.
+func (m *hostMap) get(host string) (interface{}, bool) {
+	if atomic.LoadInt64(&m.size) == 0 {
+		return nil, false
+	}
+	s := m.shard(host)
+	s.mx.RLock()
+	v, ok := s.m[host]
+	s.mx.RUnlock()
+	return v, ok
+}
+
+// update atomically replaces the value for the given host with the result of
+// calling fn with the current value (nil if there is none). If fn returns nil,
+// the host is removed.
+func (m *hostMap) update(host string, fn func(old interface{}) interface{}) {
+	s := m.shard(host)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	old, existed := s.m[host]
+	updated := fn(old)
+	switch {
+	case updated == nil && existed:
+		delete(s.m, host)
+		atomic.AddInt64(&m.size, -1)
+	case updated != nil:
+		if s.m == nil {
+			s.m = make(map[string]interface{})
+		}
+		s.m[host] = updated
+		if !existed {
+			atomic.AddInt64(&m.size, 1)
+		}
+	}
+}
+
+// len returns the number of hosts in the map.
+func (m *hostMap) len() int {
+	return int(atomic.LoadInt64(&m.size))
+}
+
+// forEach calls fn for each host and value until fn returns false. Each shard
+// is locked only while it is being iterated.
+func (m *hostMap) forEach(fn func(host string, v interface{}) bool) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mx.RLock()
+		for host, v := range s.m {
+			if !fn(host, v) {
+				s.mx.RUnlock()
+				return
+			}
+		}
+		s.mx.RUnlock()
+	}
+}
+
+// hostKey returns the key that runtime-mutable layers like broken paths and
+// exclusion overrides keep the given host under: the host in lowercase,
+// without any port or trailing dot. It doesn't allocate for hosts that are
+// already in that form.
+func hostKey(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if end := strings.IndexByte(host, ']'); end > 0 {
+			host = host[1:end]
+		}
+	} else if i := strings.IndexByte(host, ':'); i >= 0 && strings.LastIndexByte(host, ':') == i {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
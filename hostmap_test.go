@@ -0,0 +1,50 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostMap(t *testing.T) {
+	m := &hostMap{}
+	_, ok := m.get("example.com")
+	assert.False(t, ok)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				host := fmt.Sprintf("host%d.com", j)
+				m.update(host, func(old interface{}) interface{} {
+					if old == nil {
+						return 1
+					}
+					return old.(int) + 1
+				})
+				m.get(host)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 100, m.len())
+	v, ok := m.get("host42.com")
+	assert.True(t, ok)
+	assert.Equal(t, 10, v)
+
+	m.update("host42.com", func(old interface{}) interface{} { return nil })
+	_, ok = m.get("host42.com")
+	assert.False(t, ok)
+
+	count := 0
+	m.forEach(func(host string, v interface{}) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 99, count)
+}
@@ -0,0 +1,133 @@
+package httpseverywhere
+
+import (
+	"strings"
+
+	"github.com/armon/go-radix"
+)
+
+// RulesetInfo identifies a loaded rule set without its rules.
+type RulesetInfo struct {
+	Name string
+	// Targets are all of the rule set's targets. They're shared, so they
+	// must not be modified.
+	Targets []string
+	// File and Source are where the rule set was preprocessed from, as in
+	// Ruleset.
+	File      string
+	Source    string
+	Exclusive bool
+}
+
+func (r *ruleset) info() RulesetInfo {
+	return RulesetInfo{
+		Name:      r.name,
+		Targets:   r.target,
+		File:      r.file,
+		Source:    r.source,
+		Exclusive: r.exclusive,
+	}
+}
+
+// RangeTargets calls fn with each loaded target, plain hosts first and then
+// wildcard patterns like "*.example.com" in index order, along with the rule
+// set it belongs to, until fn returns false. It iterates over the rules loaded
+// when it's called, without building a list of them, for exporting the
+// coverage to DNS prefetching or analytics. Targets only known to a
+// RulesetStore aren't included.
+func (h *Engine) RangeTargets(fn func(target string, rs RulesetInfo) bool) {
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	wildcards := h.wildcardTargets.Load().(*radix.Tree)
+	for host, rs := range plains {
+		if !fn(host, rs.info()) {
+			return
+		}
+	}
+	wildcards.Walk(func(key string, v interface{}) bool {
+		rs := v.(*ruleset)
+		target := wildcardTarget(key, rs)
+		if target == "" {
+			return false
+		}
+		return !fn(target, rs.info())
+	})
+}
+
+// IsCovered returns whether or not any rule set targets the given host, as in
+// a URL's Host, so that Rewrite would evaluate rules for URLs on it. It only
+// consults the indices, without building URLs or evaluating any rules, for
+// callers that only need a hint, like whether to try TLS first. A covered host
+// isn't necessarily upgraded, since its rule sets may not match all of its
+// URLs. Rule sets from a RulesetStore are compiled when first looked up, as
+// they are for Rewrite.
+func (h *Engine) IsCovered(host string) bool {
+	for _, idx := range h.lookupOrder {
+		if lookupHostIn(&h.plainTargets, &h.wildcardTargets, idx, host) != nil {
+			return true
+		}
+	}
+	if h.store != nil {
+		u := hostURL(host)
+		for _, idx := range h.lookupOrder {
+			if h.store.lookup(h, idx, u) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RulesetsForHost returns the rule sets covering the given host through their
+// plain targets or left or right wildcard targets, without rewriting anything,
+// to find out why a site is or isn't upgraded. They're in the order the
+// indices are checked in, most specific target first within each, and include
+// wildcard rule sets shadowed by more specific ones that Rewrite wouldn't get
+// to. Rules and exclusions that didn't compile are left out.
+func (h *Engine) RulesetsForHost(host string) []*Ruleset {
+	host = strings.ToLower(host)
+	var found []*ruleset
+	add := func(rs *ruleset) {
+		if rs != nil && !containsRuleset(found, rs) {
+			found = append(found, rs)
+		}
+	}
+	wildcards := h.wildcardTargets.Load().(*radix.Tree)
+	for _, idx := range h.lookupOrder {
+		switch idx {
+		case PlainIndex:
+			add(h.plainTargets.Load().(map[string]*ruleset)[host])
+		case PrefixIndex, SuffixIndex:
+			search := host
+			if idx == PrefixIndex {
+				search = reverse(host)
+			}
+			var matches []*ruleset
+			wildcards.WalkPath(search, func(key string, v interface{}) bool {
+				rs := v.(*ruleset)
+				if _, target := explainTarget(idx, host, rs); target != "" {
+					matches = append(matches, rs)
+				}
+				return false
+			})
+			// WalkPath visits the shortest keys first.
+			for i := len(matches) - 1; i >= 0; i-- {
+				add(matches[i])
+			}
+		}
+		if h.store != nil {
+			for _, target := range storeTargets(idx, host) {
+				rs, err := h.store.rulesetFor(target)
+				if err != nil {
+					h.log.Errorf("Unable to look up rule sets for %v: %v", target, err)
+					continue
+				}
+				add(rs)
+			}
+		}
+	}
+	rulesets := make([]*Ruleset, 0, len(found))
+	for _, rs := range found {
+		rulesets = append(rulesets, rs.export(true))
+	}
+	return rulesets
+}
@@ -1,131 +1,715 @@
 package httpseverywhere
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/armon/go-radix"
-	"github.com/getlantern/golog"
-	"github.com/getlantern/mtime"
 )
 
 // Rewrite changes an HTTP URL to rewrite.
 type Rewrite func(url *url.URL) (string, bool)
 
-type httpse struct {
-	log             golog.Logger
-	initOnce        sync.Once
+// Engine rewrites HTTP URLs to HTTPS using HTTPS Everywhere rule sets.
+type Engine struct {
+	log              Logger
+	defaultScheme    string
+	maxProgramSize   int
+	quarantine       *quarantine
+	strictTargets    bool
+	maxMatchLength   int
+	longURL          *longURLMode
+	initDeadline     time.Duration
+	matchPolicy      MatchPolicy
+	lookupOrder      []Index
+	earlyExit        bool
+	foldAliases      bool
+	maxChainHops     int
+	matchLimiter     *MatchLimiter
+	keepNotes        bool
+	lazyCompile      bool
+	progressiveBatch int
+	decisions        *decisionCache
+	store            *storeLookup
+	softLaunch       bool
+	validateRewrites bool
+	invalidRewrites  invalidRewrites
+	acceptAdvisories Advisory
+	compileQuota     *compileQuota
+	normalizers      []Normalizer
+	overrides        exclusionOverrides
+	brokenPaths      brokenPaths
+	prefs            PreferencesStore
+	cache            *lookupCache
+	customRulesets   []*Ruleset
+	skipBuiltin      bool
+	clock            Clock
+	compact          bool
+	freeOSMemory     bool
+	tenantsMx        sync.Mutex
+	tenants          map[string]*Tenant
+	targetDomains    []string
+	prefetchOnce     sync.Once
+	prefetchCh       chan string
+	rulesData        []byte
+	statsDisabled    bool
+	asyncInit        bool
+	updateMx         sync.Mutex
+	updater          *updater
+	swapHooks        swapHooks
+	httpClient       *http.Client
+	rulesCacheDir    string
+	baseVersionOnce  sync.Once
+	baseVersion      string
+	baseVersionErr   error
+	expvar           bool
+	domainStats      *domainStats
+	tracer           RewriteTracer
+	decisionLog      *decisionLog
+	statsReporter    *statsReporter
+	updatedData      atomic.Value // []byte
+	generation       int64
+	load             loadStats
+	initOnce         sync.Once
+	ready            *readiness
+	lifetime         context.Context
+	stop             context.CancelFunc
+	closeOnce        sync.Once
+	// releases free resources backing the rules, like memory mapped files,
+	// on Close. While there are any, rulesMx is held for reading while the
+	// rules are used so that they aren't released under a rewrite.
+	releases        []func() error
+	rulesMx         sync.RWMutex
 	wildcardTargets atomic.Value // *radix.Tree
 	plainTargets    atomic.Value // map[string]*ruleset
 	stats           *httpseStats
-	statsCh         chan *timing
 }
 
-type httpseStats struct {
-	runs      int64
-	totalTime int64
-	max       int64
-	maxHost   string
-}
-
-type timing struct {
-	host string
-	dur  time.Duration
-}
-
-// Default returns a lazily-initialized Rewrite using the default rules
+// Default returns a lazily-initialized Rewrite using the default rules. To
+// find out when the rules have loaded, use New with WithAsyncInit and Ready
+// instead.
 func Default() Rewrite {
 	h := newEmpty()
 	h.initAsync()
-	return h.rewrite
+	return h.Rewrite
 }
 
 // Eager returns an eagerly-initialized Rewrite using the default rules
 func Eager() Rewrite {
 	h := newEmpty()
 	h.init()
-	return h.rewrite
+	return h.Rewrite
+}
+
+// New returns an Engine using the default rules and the given options. Unless
+// configured otherwise with WithAsyncInit or WithInitDeadline, the rules are
+// loaded before New returns.
+func New(opts ...Option) *Engine {
+	h := newEmpty(opts...)
+	switch {
+	case h.asyncInit:
+		h.initAsync()
+	case h.initDeadline > 0:
+		h.initWithDeadline()
+	default:
+		h.init()
+	}
+	return h
+}
+
+// NewFromXML returns a Rewrite using only the given rule sets in HTTPS
+// Everywhere's XML format, one per element. It returns an error if any of them
+// can't be used, as determined by ValidateRulesetXML.
+func NewFromXML(rules ...[]byte) (Rewrite, error) {
+	rulesets := make([]*Ruleset, 0, len(rules))
+	for i, b := range rules {
+		rs, issues := ValidateRulesetXML(b)
+		for _, issue := range issues {
+			if issue.Severity == SeverityError {
+				return nil, fmt.Errorf("rule set %d: %v", i, issue)
+			}
+		}
+		rulesets = append(rulesets, rs)
+	}
+	return New(WithoutBuiltinRules(), WithRulesets(rulesets...)).Rewrite, nil
 }
 
-func newEmpty() *httpse {
-	h := &httpse{
-		log:     golog.LoggerFor("httpse"),
-		stats:   &httpseStats{},
-		statsCh: make(chan *timing, 100),
+// NewFromGob returns a new rewrite function that uses the rules read from r
+// instead of the built-in ones. The data is a gob encoded bundle like those
+// written by the preprocessor, optionally gzipped, so that updated or trimmed
+// rules can be shipped alongside a binary without rebuilding this package.
+func NewFromGob(r io.Reader) (Rewrite, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := newDeserializer()
+	d.data = data
+	rulesets, err := d.decode()
+	if err != nil {
+		return nil, fmt.Errorf("decoding rules: %v", err)
+	}
+	if len(rulesets) == 0 {
+		return nil, errors.New("no rule sets in rules data")
+	}
+	return New(WithRulesData(data)).Rewrite, nil
+}
+
+// NewFromRulesFile returns an Engine using the rules in the bundle file at path
+// instead of the built-in ones, along with the given options. The bundle has
+// the same format as the data passed to WithRulesData. Where supported, the
+// file is memory mapped read-only and kept mapped for the life of the Engine,
+// so that proxy worker processes on one machine loading the same file share a
+// single copy of the bundle in the page cache instead of each keeping one on
+// its heap. The indices and compiled regular expressions built from it are
+// still private to each process, as Go can't place them in shared memory. The
+// file must not be modified in place while mapped; replace it by renaming a
+// new file over it instead.
+//
+// The file is unmapped when the Engine is closed.
+func NewFromRulesFile(path string, opts ...Option) (*Engine, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := newDeserializer()
+	d.data = data
+	rulesets, err := d.decode()
+	if err != nil {
+		unmapFile(data)
+		return nil, fmt.Errorf("decoding rules: %v", err)
+	}
+	if len(rulesets) == 0 {
+		unmapFile(data)
+		return nil, errors.New("no rule sets in rules file")
+	}
+	unmap := func() error {
+		return unmapFile(data)
+	}
+	return New(append(opts, WithRulesData(data), withRelease(unmap))...), nil
+}
+
+func newEmpty(opts ...Option) *Engine {
+	h := &Engine{
+		log:           noopLogger{},
+		defaultScheme: "http",
+		lookupOrder:   lookupOrder,
+		clock:         systemClock{},
+		stats:         &httpseStats{},
+		ready:         newReadiness(),
+	}
+	h.lifetime, h.stop = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.stats.since.Store(h.clock.Now())
+	if h.statsReporter != nil {
+		go h.reportStatsPeriodically()
+	}
+	if h.cache != nil && h.cache.path != "" {
+		go h.checkpointCachePeriodically()
+	}
+	if h.store != nil {
+		h.store.d = h.deserializer().lazyCompiler()
+		if h.quarantine != nil {
+			h.store.restore = h.quarantine.restore
+		}
 	}
-	go h.readTimings()
 	h.wildcardTargets.Store(radix.New())
 	h.plainTargets.Store(make(map[string]*ruleset))
+	h.loadBrokenPaths()
+	if h.expvar {
+		publishExpvar(h)
+	}
 	return h
 }
 
-func (h *httpse) init() {
-	d := newDeserializer()
-	plain, wildcard, err := d.newRulesets()
+func (h *Engine) init() {
+	// Don't let an update get swapped in while loading, only to be replaced by
+	// the stale rules.
+	h.updateMx.Lock()
+	defer h.updateMx.Unlock()
+	var err error
+	defer func() {
+		h.ready.done(err)
+	}()
+	if h.isClosed() {
+		err = ErrClosed
+		return
+	}
+	start := h.clock.Now()
+	cached := h.loadCachedRules()
+	err = h.loadRules(cached)
+	if err != nil && cached {
+		// Fall back to the configured rules.
+		h.log.Errorf("Not using cached rules: %v", err)
+		h.updatedData.Store([]byte(nil))
+		err = h.loadRules(false)
+	}
 	if err != nil {
 		return
 	}
-	h.plainTargets.Store(plain)
-	h.wildcardTargets.Store(wildcard)
+	h.afterLoad()
+	if h.cache != nil {
+		h.cache.warm(h)
+	}
+	h.load.addTime(phaseTotal, h.clock.Now().Sub(start))
+	h.log.Debugf("Loaded HTTPS Everywhere in %v", h.clock.Now().Sub(start).String())
+	if h.updater != nil && h.updater.url != "" {
+		go h.updatePeriodically()
+	}
+}
+
+// publish makes the given indices available to Rewrite.
+func (h *Engine) publish(plains map[string]*ruleset, wildcards *radix.Tree, loaded int) {
+	if h.quarantine != nil {
+		h.quarantine.published(plains, wildcards)
+	}
+	h.plainTargets.Store(plains)
+	h.wildcardTargets.Store(wildcards)
+	atomic.StoreInt64(&h.load.loaded, int64(loaded))
+	if h.cache != nil {
+		h.cache.reset()
+	}
+	if h.decisions != nil {
+		h.decisions.invalidate(h)
+	}
+	h.overrides.resolve(h.rulesetFor)
+	h.tenantsMx.Lock()
+	for _, t := range h.tenants {
+		t.overrides.resolve(t.rulesetFor)
+	}
+	h.tenantsMx.Unlock()
+}
+
+// deserializer returns a deserializer configured with this Engine's options.
+func (h *Engine) deserializer() *deserializer {
+	d := newDeserializer()
+	d.maxProgramSize = h.maxProgramSize
+	d.quota = h.compileQuota
+	d.clock = h.clock
+	d.stats = &h.load
+	d.data = h.rulesData
+	d.keepNotes = h.keepNotes
+	d.lazy = h.lazyCompile
+	d.done = h.closed()
+	if data, _ := h.updatedData.Load().([]byte); data != nil {
+		d.data = data
+	}
+	d.log = h.log
+	return d
+}
+
+// loadRules loads and publishes the rules. If cached is set, they're from the
+// rules cache and loading them fails if there aren't any.
+func (h *Engine) loadRules(cached bool) error {
+	h.load.reset()
+	d := h.deserializer()
+	if h.initDeadline > 0 && h.progressiveBatch == 0 {
+		var rulesets []*Ruleset
+		if !h.skipBuiltin {
+			var err error
+			rulesets, err = d.decode()
+			if err != nil {
+				return err
+			}
+		}
+		if cached && len(rulesets) == 0 {
+			return errors.New("no rule sets in cached bundle")
+		}
+		atomic.StoreInt64(&h.load.rulesets, int64(len(rulesets)+len(h.customRulesets)))
+		h.loadSimpleFirst(d, h.filterByTargetDomains(rulesets))
+		return nil
+	}
+	plains, wildcards, decoded, kept, err := h.buildIndices(d, !h.skipBuiltin, true)
+	if err != nil {
+		return err
+	}
+	if cached && decoded == 0 {
+		return errors.New("no rule sets in cached bundle")
+	}
+	atomic.StoreInt64(&h.load.rulesets, int64(decoded+len(h.customRulesets)))
+	atomic.AddInt64(&h.generation, 1)
+	h.publish(plains, wildcards, kept+len(h.customRulesets))
+	return nil
 }
 
-func (h *httpse) initAsync() {
+func (h *Engine) initAsync() {
 	h.initOnce.Do(func() {
 		go h.init()
 	})
 }
 
-func (h *httpse) rewrite(url *url.URL) (string, bool) {
+// Rewrite changes the given HTTP URL to HTTPS if there is a matching rule.
+func (h *Engine) Rewrite(url *url.URL) (string, bool) {
+	return h.RewriteContext(context.Background(), url)
+}
+
+// rewriteOutcome is the outcome of rewriteFor.
+type rewriteOutcome struct {
+	// r is the rewritten URL and ok whether or not the URL was rewritten.
+	r  string
+	ok bool
+	// rs is the ruleset that rewrote the URL or, if none did, the first
+	// candidate that was evaluated for it, if any.
+	rs    *ruleset
+	chain []string
+	// advisories are those of the rewrite, and heldBack is set if soft launch
+	// mode held it back, in which case r is what the URL would have been
+	// rewritten to but ok is false.
+	advisories Advisory
+	heldBack   bool
+}
+
+// rewriteFor rewrites the given URL on behalf of the given tenant, or without
+// any tenant's rule sets and overrides if it's nil.
+func (h *Engine) rewriteFor(url *url.URL, t *Tenant) *rewriteOutcome {
+	if !h.holdRules() {
+		return &rewriteOutcome{}
+	}
+	defer h.unholdRules()
+	o := &rewriteOutcome{}
+	if h.maxChainHops > 0 {
+		o.r, o.ok, o.rs, o.chain = h.rewriteChained(url, t)
+	} else {
+		o.r, o.ok, o.rs = h.rewriteOnce(url, t)
+	}
+	if o.ok {
+		o.advisories = advisories(url, o.r, o.rs)
+		if h.heldBack(o.advisories) {
+			o.ok, o.heldBack = false, true
+		}
+	}
+	if !h.statsDisabled {
+		h.stats.count(o.ok)
+	}
+	if o.ok && h.domainStats != nil {
+		h.domainStats.count(url.Hostname())
+	}
+	if h.decisionLog != nil {
+		h.decisionLog.log(h, url, o.rewritten(), o.ok)
+	}
+	return o
+}
+
+// rewritten returns the rewritten URL, or an empty string if the URL wasn't
+// rewritten.
+func (o *rewriteOutcome) rewritten() string {
+	if !o.ok {
+		return ""
+	}
+	return o.r
+}
+
+// rewriteOnce rewrites the given URL without chaining.
+func (h *Engine) rewriteOnce(url *url.URL, t *Tenant) (string, bool, *ruleset) {
+	if len(h.normalizers) > 0 {
+		return h.rewriteNormalized(url, t)
+	}
+	return h.rewrite(url, t)
+}
+
+// rewrite rewrites the given URL, also returning the ruleset that rewrote it
+// or, if none did, the first candidate that was evaluated for it, if any.
+func (h *Engine) rewrite(url *url.URL, t *Tenant) (string, bool, *ruleset) {
 	if url.Scheme != "http" {
-		return "", false
+		return "", false, nil
 	}
 
-	start := mtime.Now()
-	defer func() {
-		h.statsCh <- &timing{
-			dur:  mtime.Now().Sub(start),
-			host: url.String(),
+	if !h.statsDisabled {
+		defer h.recordTiming(url, h.clock.Now())
+	}
+	if t != nil {
+		if r, hit, rs, exclusive := t.rewrite(url); hit || exclusive {
+			return r, hit, rs
 		}
-	}()
-	if val, ok := h.plainTargets.Load().(map[string]*ruleset)[url.Host]; ok {
-		if r, hit := h.rewriteWithRuleset(url, val); hit {
-			return r, hit
+	}
+	// evaluated is a rule set that was already evaluated without rewriting
+	// the URL, which needn't be evaluated again.
+	var evaluated *ruleset
+	if h.decisions != nil && h.matchPolicy == FirstMatch {
+		r, hit, rs, handled := h.rewriteDecided(url, t)
+		if handled {
+			return r, hit, rs
 		}
+		evaluated = rs
 	}
-	// Check prefixes (with reversing the URL host)
-	if _, val, match := h.wildcardTargets.Load().(*radix.Tree).LongestPrefix(reverse(url.Host)); match {
-		if r, hit := h.rewriteWithRuleset(url, val.(*ruleset)); hit {
-			return r, hit
+	var cached *candidates
+	if h.cache != nil {
+		cached = h.cache.candidates(h, url)
+		if cached.empty() {
+			return h.rewriteAlias(url, t)
 		}
 	}
+	if h.matchPolicy == BestMatch {
+		return h.rewriteBest(url, cached, t)
+	}
+	var first *ruleset
+	for _, idx := range h.lookupOrder {
+		if rs := h.candidate(idx, url, cached); rs != nil {
+			if first == nil {
+				first = rs
+			}
+			var r string
+			var hit bool
+			if rs != evaluated {
+				r, hit = h.rewriteWithRuleset(url, rs, t)
+			}
+			if hit || h.earlyExit || rs.exclusive {
+				return r, hit, decided(rs, hit, first)
+			}
+		}
+	}
+	if first == nil {
+		return h.rewriteAlias(url, t)
+	}
+	return "", false, first
+}
 
-	// Check suffixes last because there are far fewer suffix rules.
-	if _, val, match := h.wildcardTargets.Load().(*radix.Tree).LongestPrefix(url.Host); match {
-		return h.rewriteWithRuleset(url, val.(*ruleset))
+// decided returns the ruleset reported as having decided a rewrite: rs if it
+// rewrote the URL, as indicated by hit, and otherwise the first candidate.
+func decided(rs *ruleset, hit bool, first *ruleset) *ruleset {
+	if hit {
+		return rs
 	}
+	return first
+}
 
-	return "", false
+// Index identifies one of the indices that candidate rulesets for a host are
+// looked up in.
+type Index int
+
+const (
+	// PlainIndex holds rule sets by exact target host.
+	PlainIndex Index = iota
+	// PrefixIndex holds rule sets by left wildcard targets like "*.example.com".
+	PrefixIndex
+	// SuffixIndex holds rule sets by right wildcard targets like "example.*".
+	SuffixIndex
+)
+
+// lookupOrder is the default order in which indices are checked. Suffixes are
+// checked last because there are far fewer suffix rules.
+var lookupOrder = []Index{PlainIndex, PrefixIndex, SuffixIndex}
+
+// candidates holds the candidate ruleset from each index for a host.
+type candidates [3]*ruleset
+
+func (c *candidates) empty() bool {
+	return c[PlainIndex] == nil && c[PrefixIndex] == nil && c[SuffixIndex] == nil
+}
+
+// allCandidates looks up the candidate rulesets for the given URL in all
+// indices.
+func (h *Engine) allCandidates(url *url.URL) *candidates {
+	c := &candidates{}
+	for _, idx := range lookupOrder {
+		c[idx] = h.lookup(idx, url)
+	}
+	return c
+}
+
+// candidate returns the candidate ruleset for the given URL from the given
+// index, using the given cached candidates if available.
+func (h *Engine) candidate(idx Index, url *url.URL, cached *candidates) *ruleset {
+	if cached != nil {
+		return cached[idx]
+	}
+	return h.lookup(idx, url)
+}
+
+// lookup returns the candidate ruleset for the given URL from the given index,
+// if any.
+func (h *Engine) lookup(idx Index, url *url.URL) *ruleset {
+	rs := lookupIn(&h.plainTargets, &h.wildcardTargets, idx, url)
+	if rs == nil && h.store != nil {
+		return h.store.lookup(h, idx, url)
+	}
+	return rs
+}
+
+// lookupIn returns the candidate ruleset for the given URL from the given
+// index in the given plain and wildcard indices, if any.
+func lookupIn(plainTargets *atomic.Value, wildcardTargets *atomic.Value, idx Index, url *url.URL) *ruleset {
+	return lookupHostIn(plainTargets, wildcardTargets, idx, url.Host)
+}
+
+// lookupHostIn is lookupIn for the given host.
+func lookupHostIn(plainTargets *atomic.Value, wildcardTargets *atomic.Value, idx Index, host string) *ruleset {
+	switch idx {
+	case PlainIndex:
+		return plainTargets.Load().(map[string]*ruleset)[host]
+	case PrefixIndex:
+		// Check prefixes (with reversing the URL host)
+		if _, val, match := wildcardTargets.Load().(*radix.Tree).LongestPrefix(reverse(host)); match {
+			return val.(*ruleset)
+		}
+	case SuffixIndex:
+		if _, val, match := wildcardTargets.Load().(*radix.Tree).LongestPrefix(host); match {
+			return val.(*ruleset)
+		}
+	}
+	return nil
+}
+
+// hostURL returns the root HTTP URL for the given host.
+func hostURL(host string) *url.URL {
+	return &url.URL{Scheme: "http", Host: host, Path: "/"}
+}
+
+// RewriteString is like Rewrite but takes a raw URL string. Scheme-relative
+// URLs like "//example.com/path" and bare ones like "example.com/path" are
+// accepted and treated as using the default scheme.
+func (h *Engine) RewriteString(rawURL string) (string, bool) {
+	u, err := h.parseURL(rawURL)
+	if err != nil {
+		return "", false
+	}
+	return h.Rewrite(u)
+}
+
+// parseURL parses the given raw URL, applying the default scheme to
+// scheme-relative and host-only input. Only a "://" before the path, query or
+// fragment counts as a scheme, so that URLs in the query of a bare URL don't.
+func (h *Engine) parseURL(rawURL string) (*url.URL, error) {
+	if strings.HasPrefix(rawURL, "//") {
+		rawURL = h.defaultScheme + ":" + rawURL
+	} else if i := strings.Index(rawURL, "://"); i < 0 || i > strings.IndexAny(rawURL, "/?#") {
+		rawURL = h.defaultScheme + "://" + rawURL
+	}
+	return url.Parse(rawURL)
 }
 
 // rewriteWithRuleset converts the given URL to HTTPS if there is an associated
-// rule for it.
-func (h *httpse) rewriteWithRuleset(fullURL *url.URL, r *ruleset) (string, bool) {
-	url := fullURL.String()
+// rule for it, taking into account the exclusion overrides of the given
+// tenant, if any.
+func (h *Engine) rewriteWithRuleset(fullURL *url.URL, r *ruleset, t *Tenant) (string, bool) {
+	return h.applyRuleset(fullURL, r, t, nil)
+}
+
+// applyRuleset is rewriteWithRuleset, additionally describing the outcome in
+// ex if it's set.
+func (h *Engine) applyRuleset(fullURL *url.URL, r *ruleset, t *Tenant, ex *CandidateExplanation) (string, bool) {
+	if h.strictTargets && !r.matchesHost(fullURL.Hostname()) {
+		ex.setOutcome(OutcomeTargetMismatch)
+		return "", false
+	}
+	if !r.inScope(fullURL) {
+		// None of the rules can match, so don't bother evaluating them.
+		ex.setOutcome(OutcomeOutOfScope)
+		return "", false
+	}
+	if h.matchLimiter != nil {
+		h.matchLimiter.acquire()
+		defer h.matchLimiter.release()
+	}
+	if h.quarantine != nil && h.quarantine.isQuarantined(r) {
+		ex.setOutcome(OutcomeQuarantined)
+		return "", false
+	}
+	if h.pathBroken(fullURL) {
+		ex.setOutcome(OutcomeBrokenPath)
+		return "", false
+	}
+	r.compiled()
+	if h.quarantine != nil {
+		// Only time the evaluation itself, not compiling a lazily compiled
+		// ruleset on first use.
+		start := h.clock.Now()
+		defer func() {
+			end := h.clock.Now()
+			h.quarantine.record(r, end.Sub(start), end)
+		}()
+	}
+	url, tail := h.capMatchString(matchString(fullURL))
 	for _, exclude := range r.exclusion {
-		if exclude.pattern.MatchString(url) {
+		if exclude.pattern.MatchString(url) && !h.exclusionOverridden(fullURL.Host, r, exclude, t) {
+			if ex != nil {
+				ex.Outcome = OutcomeExcluded
+				ex.Exclusion = exclude.pattern.String()
+			}
 			return "", false
 		}
 	}
 	for _, rule := range r.rule {
 		if rule.from.MatchString(url) {
-			return rule.from.ReplaceAllString(url, rule.to), true
+			result := rule.from.ReplaceAllString(url, rule.to) + tail + fragment(fullURL)
+			if ex != nil {
+				ex.Rule = rule.from.String()
+				ex.To = rule.to
+			}
+			if h.validateRewrites && !h.checkRewrite(fullURL, result, r) {
+				ex.setOutcome(OutcomeInvalidRewrite)
+				return "", false
+			}
+			if ex != nil {
+				ex.Outcome = OutcomeRewritten
+				ex.Result = result
+			}
+			return result, true
 		}
 	}
+	ex.setOutcome(OutcomeNoRuleMatched)
 	return "", false
 }
 
+// capMatchString splits the given match string into the part presented to
+// regular expressions, which is at most maxMatchLength bytes long, and the
+// remaining tail that is appended to the result untouched. Since rules are
+// anchored at the start of the URL in practice, this bounds the time spent
+// matching absurdly long URLs without changing the outcome. URLs handled by
+// WithLongURLMode are split as configured there instead.
+func (h *Engine) capMatchString(url string) (string, string) {
+	if h.longURL != nil {
+		if head, tail, ok := h.longURL.split(url); ok {
+			return head, tail
+		}
+	}
+	if h.maxMatchLength <= 0 || len(url) <= h.maxMatchLength {
+		return url, ""
+	}
+	cut := h.maxMatchLength
+	for cut > 0 && !utf8.RuneStart(url[cut]) {
+		cut--
+	}
+	return url[:cut], url[cut:]
+}
+
+// matchString returns the string that rules and exclusions are evaluated
+// against. Like the browser extension, this is the full URL including the
+// query string but without the fragment, which is never sent to the server.
+// Spaces in the query are percent-encoded the way a browser would, while plus
+// signs are left as is.
+func matchString(u *url.URL) string {
+	if u.Fragment == "" && !strings.Contains(u.RawQuery, " ") {
+		return u.String()
+	}
+	stripped := *u
+	stripped.Fragment = ""
+	stripped.RawFragment = ""
+	stripped.RawQuery = strings.Replace(u.RawQuery, " ", "%20", -1)
+	return stripped.String()
+}
+
+// fragment returns the escaped fragment of the given URL, including the
+// leading '#', so that it can be reattached to a rewritten URL.
+func fragment(u *url.URL) string {
+	if u.Fragment == "" {
+		return ""
+	}
+	return "#" + u.EscapedFragment()
+}
+
 func reverse(input string) string {
 	n := 0
 	runes := make([]rune, len(input)+1)
@@ -144,19 +728,3 @@ func reverse(input string) string {
 	// Convert back to UTF-8.
 	return string(runes)
 }
-
-func (h *httpse) readTimings() {
-	for t := range h.statsCh {
-		h.addTiming(t)
-	}
-}
-
-func (h *httpse) addTiming(t *timing) {
-	ms := t.dur.Nanoseconds() / int64(time.Millisecond)
-	h.stats.runs++
-	h.stats.totalTime += ms
-	if ms > h.stats.max {
-		h.stats.max = ms
-		h.stats.maxHost = t.host
-	}
-}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+func hosts(args []string) {
+	flags := flag.NewFlagSet("hosts", flag.ExitOnError)
+	bundle := flags.String("bundle", "", "bundle to export hosts from instead of the built-in rules")
+	format := flags.String("format", "hosts", "format to write, hosts or rpz")
+	addr := flags.String("addr", "0.0.0.0", "address to map hosts to in hosts format")
+	serial := flags.Uint("serial", uint(time.Now().Unix()), "SOA serial in rpz format")
+	flags.Parse(args)
+
+	var opts []httpseverywhere.Option
+	if *bundle != "" {
+		data, err := ioutil.ReadFile(*bundle)
+		if err != nil {
+			log.Fatalf("Unable to read bundle: %v", err)
+		}
+		opts = append(opts, httpseverywhere.WithRulesData(data))
+	}
+	upgraded := httpseverywhere.New(opts...).SimpleUpgradeHosts()
+
+	var err error
+	switch *format {
+	case "hosts":
+		err = httpseverywhere.WriteHostsFile(os.Stdout, upgraded, *addr)
+	case "rpz":
+		err = httpseverywhere.WriteRPZ(os.Stdout, upgraded, uint32(*serial))
+	default:
+		log.Fatalf("Unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,255 @@
+// Command httpse provides tools for working with HTTPS Everywhere rules.
+//
+// The repl subcommand helps with writing a rule set:
+//
+//	httpse repl [-bundle rules.gob] ruleset.xml
+//
+// It loads the given bundle (or the built-in rules) together with the rule
+// set being written, then evaluates the URLs typed at the prompt. Whenever the
+// rule set file changes, it's reloaded and all URLs entered so far are
+// evaluated again.
+//
+// The sync subcommand regenerates a bundle from the upstream rules at a pinned
+// commit:
+//
+//	httpse sync -commit <sha> [-out dir] [-name default] [-tlds com,org]
+//
+// It downloads the rules, preprocesses them into a bundle and manifest in the
+// output directory and then checks the bundle against the test URLs in the
+// rules.
+//
+// The wildcards subcommand reports on the wildcard targets of a bundle:
+//
+//	httpse wildcards [-bundle rules.gob] [-top 20]
+//
+// The hosts subcommand writes the hosts that are simply upgraded to HTTPS on
+// the same host, for DNS level components:
+//
+//	httpse hosts [-bundle rules.gob] [-format hosts|rpz]
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "repl":
+		repl(os.Args[2:])
+	case "sync":
+		syncRules(os.Args[2:])
+	case "wildcards":
+		wildcards(os.Args[2:])
+	case "hosts":
+		hosts(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: httpse repl [-bundle rules.gob] ruleset.xml")
+	fmt.Fprintln(os.Stderr, "       httpse sync -commit <sha> [-out dir] [-name default] [-tlds com,org]")
+	fmt.Fprintln(os.Stderr, "       httpse wildcards [-bundle rules.gob] [-top 20]")
+	fmt.Fprintln(os.Stderr, "       httpse hosts [-bundle rules.gob] [-format hosts|rpz]")
+	os.Exit(2)
+}
+
+func repl(args []string) {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	bundle := flags.String("bundle", "", "bundle to load instead of the built-in rules")
+	poll := flags.Duration("poll", 500*time.Millisecond, "how often to check the rule set file for changes")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	var base []*httpseverywhere.Ruleset
+	if *bundle != "" {
+		var err error
+		base, err = loadBundle(*bundle)
+		if err != nil {
+			log.Fatalf("Unable to load bundle: %v", err)
+		}
+	}
+	r := &session{file: flags.Arg(0), base: base, builtin: *bundle == "", out: os.Stdout}
+	r.reload()
+	go r.watch(*poll)
+	r.run(os.Stdin)
+}
+
+// session is the state of a repl session.
+type session struct {
+	file    string
+	base    []*httpseverywhere.Ruleset
+	builtin bool
+
+	outMx sync.Mutex
+	out   io.Writer
+
+	mx      sync.Mutex
+	modTime time.Time
+	working *httpseverywhere.Ruleset
+	engine  *httpseverywhere.Engine
+	urls    []string
+}
+
+// run evaluates each line read from in until it ends, prompting for them on
+// the session's output.
+func (s *session) run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	s.printf("> ")
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			s.evaluate(line)
+		}
+		s.printf("> ")
+	}
+}
+
+// printf writes to the session's output, which the watcher shares.
+func (s *session) printf(format string, args ...interface{}) {
+	s.outMx.Lock()
+	defer s.outMx.Unlock()
+	fmt.Fprintf(s.out, format, args...)
+}
+
+// watch reloads the rule set file whenever its modification time changes.
+func (s *session) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(s.file)
+		if err != nil {
+			continue
+		}
+		s.mx.Lock()
+		changed := !info.ModTime().Equal(s.modTime)
+		s.mx.Unlock()
+		if changed {
+			s.printf("\n%v changed, reloading\n", s.file)
+			s.reload()
+			s.mx.Lock()
+			urls := s.urls
+			s.mx.Unlock()
+			for _, u := range urls {
+				s.explain(u)
+			}
+			s.printf("> ")
+		}
+	}
+}
+
+// reload reads and validates the rule set file and builds a new engine with
+// it.
+func (s *session) reload() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if info, err := os.Stat(s.file); err == nil {
+		s.modTime = info.ModTime()
+	}
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		s.printf("Unable to read %v: %v\n", s.file, err)
+		return
+	}
+	working, issues := httpseverywhere.ValidateRulesetXML(b)
+	usable := working != nil
+	for _, issue := range issues {
+		s.printf("%v\n", issue)
+		if issue.Severity == httpseverywhere.SeverityError {
+			usable = false
+		}
+	}
+	rulesets := append([]*httpseverywhere.Ruleset{}, s.base...)
+	if usable {
+		rulesets = append(rulesets, working)
+		s.working = working
+	} else {
+		s.printf("Rule set is not usable, evaluating without it\n")
+		s.working = nil
+	}
+	opts := []httpseverywhere.Option{httpseverywhere.WithRulesets(rulesets...)}
+	if !s.builtin {
+		opts = append(opts, httpseverywhere.WithoutBuiltinRules())
+	}
+	s.engine = httpseverywhere.New(opts...)
+}
+
+// evaluate remembers the given URL and explains how it's rewritten.
+func (s *session) evaluate(rawURL string) {
+	s.mx.Lock()
+	s.urls = append(s.urls, rawURL)
+	s.mx.Unlock()
+	s.explain(rawURL)
+}
+
+func (s *session) explain(rawURL string) {
+	s.mx.Lock()
+	engine, working := s.engine, s.working
+	s.mx.Unlock()
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		u, err = url.Parse("http://" + rawURL)
+	}
+	if err != nil {
+		s.printf("%v: invalid URL: %v\n", rawURL, err)
+		return
+	}
+	result := engine.Evaluate(u)
+	if result.Rewritten {
+		s.printf("%v -> %v\n", u, result.URL)
+	} else {
+		s.printf("%v not rewritten\n", u)
+	}
+	if working != nil {
+		s.explainWorking(working, u.String())
+	}
+}
+
+// explainWorking shows which exclusions and rules of the working rule set
+// match the given URL.
+func (s *session) explainWorking(rs *httpseverywhere.Ruleset, u string) {
+	for i, e := range rs.Exclusion {
+		if matches(e.Pattern, u) {
+			s.printf("  exclusion[%d] %v matches\n", i, e.Pattern)
+			return
+		}
+	}
+	for i, r := range rs.Rule {
+		if matches(r.From, u) {
+			s.printf("  rule[%d] %v matches, to %v\n", i, r.From, r.To)
+			return
+		}
+	}
+	s.printf("  no exclusion or rule in the working rule set matches\n")
+}
+
+func matches(pattern string, u string) bool {
+	re, err := regexp.Compile(pattern)
+	return err == nil && re.MatchString(u)
+}
+
+// loadBundle decodes the rule sets in the given bundle file.
+func loadBundle(path string) ([]*httpseverywhere.Ruleset, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return httpseverywhere.DecodeRulesData(data)
+}
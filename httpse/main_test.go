@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestREPL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "Example.xml")
+	err := ioutil.WriteFile(file, []byte(`<ruleset name="Example">
+		<target host="example.com" />
+		<exclusion pattern="^http://example\.com/login" />
+		<rule from="^http://example\.com/" to="https://example.com/" />
+	</ruleset>`), 0644)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var out bytes.Buffer
+	s := &session{file: file, out: &out}
+	s.reload()
+	s.run(strings.NewReader("http://example.com/a\n\nexample.com/login\nhttp://example.org/\n"))
+	assert.Equal(t, `> http://example.com/a -> https://example.com/a
+  rule[0] ^http://example\.com/ matches, to https://example.com/
+> > http://example.com/login not rewritten
+  exclusion[0] ^http://example\.com/login matches
+> http://example.org/ not rewritten
+  no exclusion or rule in the working rule set matches
+> `, out.String())
+	assert.Equal(t, []string{"http://example.com/a", "example.com/login", "http://example.org/"}, s.urls)
+
+	out.Reset()
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`<ruleset name="Example">`), 0644))
+	s.reload()
+	assert.Contains(t, out.String(), "Rule set is not usable")
+	out.Reset()
+	s.run(strings.NewReader("http://example.com/a\n"))
+	assert.Equal(t, "> http://example.com/a not rewritten\n> ", out.String())
+}
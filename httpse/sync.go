@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+// rulesDir is where the rules live in the upstream repository.
+const rulesDir = "src/chrome/content/rules/"
+
+func syncRules(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	repo := flags.String("repo", "EFForg/https-everywhere", "GitHub repository to fetch the rules from")
+	commit := flags.String("commit", "", "commit to fetch the rules at (required)")
+	outDir := flags.String("out", ".", "directory to write the bundle and its manifest to")
+	name := flags.String("name", "default", "name of the bundle")
+	tlds := flags.String("tlds", "", "comma-separated list of TLDs to expand trailing wildcard targets like foo.* into")
+	maxFailures := flags.Int("max-test-failures", -1, "fail if more than this many test URLs aren't rewritten, or -1 for no limit")
+	flags.Parse(args)
+	if *commit == "" {
+		usage()
+	}
+
+	tmpDir, err := ioutil.TempDir("", "httpse-sync")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	source := fmt.Sprintf("https://github.com/%v/tree/%v", *repo, *commit)
+	log.Printf("Fetching rules from %v", source)
+	if err := fetchRules(fmt.Sprintf("https://codeload.github.com/%v/tar.gz/%v", *repo, *commit), tmpDir); err != nil {
+		log.Fatalf("Unable to fetch rules: %v", err)
+	}
+
+	opts := []httpseverywhere.PreprocessOption{httpseverywhere.WithSource(source)}
+	if *tlds != "" {
+		opts = append(opts, httpseverywhere.WithTLDs(strings.Split(*tlds, ",")...))
+	}
+	manifest, err := httpseverywhere.Preprocessor.PreprocessBundles(*outDir, []httpseverywhere.Bundle{{Name: *name, Dirs: []string{tmpDir}}}, opts...)
+	if err != nil {
+		log.Fatalf("Unable to preprocess rules: %v", err)
+	}
+	entry := manifest.Bundles[0]
+	log.Printf("Wrote %v with %v rule sets (%v rejected)", filepath.Join(*outDir, entry.File), entry.Rulesets, entry.Errors)
+
+	rulesets, err := loadBundle(filepath.Join(*outDir, entry.File))
+	if err != nil {
+		log.Fatalf("Unable to load bundle: %v", err)
+	}
+	tests, failures, err := selfTest(tmpDir, rulesets)
+	if err != nil {
+		log.Fatalf("Unable to run self tests: %v", err)
+	}
+	log.Printf("%v of %v test URLs weren't rewritten", failures, tests)
+	if *maxFailures >= 0 && failures > *maxFailures {
+		log.Fatalf("Too many test failures")
+	}
+}
+
+// fetchRules downloads the tarball at the given URL and extracts the rule
+// files in it to dir.
+func fetchRules(tarballURL string, dir string) error {
+	resp, err := http.Get(tarballURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	found := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Entries are prefixed with a top-level directory named after the
+		// repository and commit.
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		if len(parts) != 2 || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := parts[1]
+		if path.Dir(name)+"/" != rulesDir || path.Ext(name) != ".xml" {
+			continue
+		}
+		f, err := os.Create(filepath.Join(dir, path.Base(name)))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		found++
+	}
+	if found == 0 {
+		return fmt.Errorf("no rules found in %v", rulesDir)
+	}
+	return nil
+}
+
+// rulesetTests holds the test URLs of a rule set.
+type rulesetTests struct {
+	Tests []struct {
+		URL string `xml:"url,attr"`
+	} `xml:"test"`
+}
+
+// selfTest checks that each test URL in the rule sets in dir that made it
+// into the bundle is rewritten by an engine using the given rule sets,
+// returning the number of test URLs and how many of them failed.
+func selfTest(dir string, rulesets []*httpseverywhere.Ruleset) (int, int, error) {
+	h := httpseverywhere.New(httpseverywhere.WithoutBuiltinRules(), httpseverywhere.WithRulesets(rulesets...))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var tests, failures int
+	for _, file := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return 0, 0, err
+		}
+		if _, ok := httpseverywhere.Preprocessor.VetRuleSet(b); !ok {
+			// Rejected rule sets aren't in the bundle.
+			continue
+		}
+		var rt rulesetTests
+		if err := xml.Unmarshal(b, &rt); err != nil {
+			continue
+		}
+		for _, test := range rt.Tests {
+			tests++
+			if _, ok := h.RewriteString(test.URL); !ok {
+				failures++
+				log.Printf("%v: %v not rewritten", file.Name(), test.URL)
+			}
+		}
+	}
+	return tests, failures, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+func wildcards(args []string) {
+	flags := flag.NewFlagSet("wildcards", flag.ExitOnError)
+	bundle := flags.String("bundle", "", "bundle to report on instead of the built-in rules")
+	top := flags.Int("top", 20, "number of wildcard targets and overlaps to list")
+	flags.Parse(args)
+
+	var opts []httpseverywhere.Option
+	if *bundle != "" {
+		data, err := ioutil.ReadFile(*bundle)
+		if err != nil {
+			log.Fatalf("Unable to read bundle: %v", err)
+		}
+		opts = append(opts, httpseverywhere.WithRulesData(data))
+	}
+	report := httpseverywhere.New(opts...).WildcardReport()
+
+	fmt.Printf("Prefix wildcard targets: %v\n", report.PrefixKeys)
+	fmt.Printf("Suffix wildcard targets: %v\n", report.SuffixKeys)
+	fmt.Printf("Plain targets also covered by a wildcard: %v\n", report.ShadowedByPlain)
+	fmt.Printf("\nWildcard targets covering the most plain targets:\n")
+	for i, key := range report.Keys {
+		if i >= *top {
+			break
+		}
+		fmt.Printf("  %-50v %v\n", key.Target, key.Hosts)
+	}
+	fmt.Printf("\nHosts covered by both a prefix and a suffix wildcard: %v\n", len(report.Overlaps))
+	for i, o := range report.Overlaps {
+		if i >= *top {
+			break
+		}
+		fmt.Printf("  %v: %v and %v\n", o.Host, o.Prefix, o.Suffix)
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/getlantern/httpseverywhere/httpseotel
+
+go 1.16
+
+require (
+	github.com/getlantern/httpseverywhere v0.0.0
+	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/stretchr/testify v1.8.2
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	golang.org/x/sys v0.7.0 // indirect
+)
+
+replace github.com/getlantern/httpseverywhere => ../
@@ -0,0 +1,81 @@
+// Package httpseotel records the rewrite decisions of an httpseverywhere
+// Engine with OpenTelemetry, either as spans of their own or as events on the
+// span of the request being rewritten:
+//
+//	h := httpseverywhere.New(httpseverywhere.WithRewriteTracer(httpseotel.Spans(otel.GetTracerProvider())))
+//	...
+//	h.RewriteContext(req.Context(), req.URL)
+//
+// It's a separate module so that applications that don't use OpenTelemetry
+// don't depend on it.
+package httpseotel
+
+import (
+	"context"
+
+	"github.com/getlantern/httpseverywhere"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/getlantern/httpseverywhere"
+
+	// SpanName is the name of the spans recorded by Spans and of the events
+	// recorded by Events.
+	SpanName = "httpseverywhere.rewrite"
+
+	// Attributes describing a rewrite decision.
+	URLKey       = attribute.Key("httpseverywhere.url")
+	ResultKey    = attribute.Key("httpseverywhere.result")
+	RewrittenKey = attribute.Key("httpseverywhere.rewritten")
+	RulesetKey   = attribute.Key("httpseverywhere.ruleset.name")
+	TargetsKey   = attribute.Key("httpseverywhere.ruleset.targets")
+	DurationKey  = attribute.Key("httpseverywhere.duration_ns")
+)
+
+// Spans returns a RewriteTracer that records each rewrite decision as a span,
+// a child of the span in the context given to RewriteContext, if any.
+func Spans(tp trace.TracerProvider) httpseverywhere.RewriteTracer {
+	tracer := tp.Tracer(instrumentationName)
+	return func(ctx context.Context, t *httpseverywhere.RewriteTrace) {
+		_, span := tracer.Start(ctx, SpanName,
+			trace.WithTimestamp(t.Start),
+			trace.WithSpanKind(trace.SpanKindInternal),
+			trace.WithAttributes(attributes(t)...))
+		span.End(trace.WithTimestamp(t.Start.Add(t.Duration)))
+	}
+}
+
+// Events returns a RewriteTracer that records each rewrite decision as an
+// event on the span in the context given to RewriteContext. Decisions are only
+// recorded for contexts with a recording span.
+func Events() httpseverywhere.RewriteTracer {
+	return func(ctx context.Context, t *httpseverywhere.RewriteTrace) {
+		span := trace.SpanFromContext(ctx)
+		if !span.IsRecording() {
+			return
+		}
+		span.AddEvent(SpanName,
+			trace.WithTimestamp(t.Start),
+			trace.WithAttributes(attributes(t)...))
+	}
+}
+
+func attributes(t *httpseverywhere.RewriteTrace) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		URLKey.String(t.URL),
+		RewrittenKey.Bool(t.Rewritten),
+		DurationKey.Int64(t.Duration.Nanoseconds()),
+	}
+	if t.Rewritten {
+		attrs = append(attrs, ResultKey.String(t.Result))
+	}
+	if t.Ruleset != "" {
+		attrs = append(attrs, RulesetKey.String(t.Ruleset))
+	}
+	if len(t.Targets) > 0 {
+		attrs = append(attrs, TargetsKey.StringSlice(t.Targets))
+	}
+	return attrs
+}
@@ -0,0 +1,92 @@
+package httpseotel
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/getlantern/httpseverywhere"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newEngine(tracer httpseverywhere.RewriteTracer) *httpseverywhere.Engine {
+	return httpseverywhere.New(
+		httpseverywhere.WithoutBuiltinRules(),
+		httpseverywhere.WithRewriteTracer(tracer),
+		httpseverywhere.WithRulesets(&httpseverywhere.Ruleset{
+			Name:   "Example",
+			Target: []*httpseverywhere.Target{{Host: "example.com"}},
+			Rule:   []*httpseverywhere.Rule{{From: "^http:", To: "https:"}},
+		}),
+	)
+}
+
+func rewrite(ctx context.Context, h *httpseverywhere.Engine, u string) {
+	parsed, _ := url.Parse(u)
+	h.RewriteContext(ctx, parsed)
+}
+
+func TestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	h := newEngine(Spans(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	rewrite(ctx, h, "http://example.com/")
+	parent.End()
+	rewrite(context.Background(), h, "http://example.org/")
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	assert.Equal(t, SpanName, spans[0].Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		URLKey.String("http://example.com/"),
+		RewrittenKey.Bool(true),
+		ResultKey.String("https://example.com/"),
+		RulesetKey.String("Example"),
+		TargetsKey.StringSlice([]string{"example.com"}),
+	}, withoutDuration(spans[0].Attributes()))
+	assert.False(t, spans[2].Parent().IsValid())
+	assert.ElementsMatch(t, []attribute.KeyValue{
+		URLKey.String("http://example.org/"),
+		RewrittenKey.Bool(false),
+	}, withoutDuration(spans[2].Attributes()))
+}
+
+func TestEvents(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	h := newEngine(Events())
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+	rewrite(ctx, h, "http://example.com/")
+	span.End()
+	rewrite(context.Background(), h, "http://example.com/")
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	events := spans[0].Events()
+	if !assert.Len(t, events, 1) {
+		return
+	}
+	assert.Equal(t, SpanName, events[0].Name)
+	assert.Contains(t, events[0].Attributes, RewrittenKey.Bool(true))
+}
+
+func withoutDuration(attrs []attribute.KeyValue) []attribute.KeyValue {
+	var result []attribute.KeyValue
+	for _, attr := range attrs {
+		if attr.Key != DurationKey {
+			result = append(result, attr)
+		}
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+// Package httpseprom exports the stats of an httpseverywhere Engine as
+// Prometheus metrics:
+//
+//	httpseverywhere_requests_total                 URLs given to be rewritten
+//	httpseverywhere_rewritten_total                those of them that were rewritten
+//	httpseverywhere_rewrite_duration_seconds       histogram of the time taken by rewrites
+//	httpseverywhere_domain_rewrites_total{domain}  rewrites by root domain, with WithDomainStats
+//	httpseverywhere_invalid_rewrites_total         rewrites discarded by WithRewriteValidation
+//	httpseverywhere_rulesets                       rule sets in the rules
+//	httpseverywhere_loaded_rulesets                rule sets in use
+//	httpseverywhere_dropped_rulesets               rule sets dropped because none of their rules compiled
+//	httpseverywhere_dropped_rules                  rules dropped because they didn't compile
+//	httpseverywhere_load_duration_seconds          time taken to load the rules
+//	httpseverywhere_generation                     number of times the rules were loaded
+//
+// It's a separate module so that applications that don't use Prometheus don't
+// depend on its client library. Register the collectors with a registry:
+//
+//	prometheus.MustRegister(httpseprom.NewRewriteCollector(h), httpseprom.NewLoadCollector(h))
+package httpseprom
+
+import (
+	"github.com/getlantern/httpseverywhere"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "httpseverywhere"
+
+// RewriteCollector collects the rewrite totals, latency histogram and
+// per-domain rewrite counts of an Engine.
+type RewriteCollector struct {
+	h              *httpseverywhere.Engine
+	requests       *prometheus.Desc
+	rewritten      *prometheus.Desc
+	duration       *prometheus.Desc
+	domainRewrites *prometheus.Desc
+	invalid        *prometheus.Desc
+}
+
+// NewRewriteCollector returns a collector for the rewrite stats of h.
+func NewRewriteCollector(h *httpseverywhere.Engine) *RewriteCollector {
+	return &RewriteCollector{
+		h: h,
+		requests: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "requests_total"),
+			"URLs given to be rewritten.", nil, nil),
+		rewritten: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "rewritten_total"),
+			"URLs that were rewritten.", nil, nil),
+		duration: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "rewrite_duration_seconds"),
+			"Time taken to evaluate the rules for http URLs.", nil, nil),
+		domainRewrites: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "domain_rewrites_total"),
+			"URLs that were rewritten by root domain.", []string{"domain"}, nil),
+		invalid: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "invalid_rewrites_total"),
+			"Rewrites that were discarded for not resulting in valid HTTPS URLs.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *RewriteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+	ch <- c.rewritten
+	ch <- c.duration
+	ch <- c.domainRewrites
+	ch <- c.invalid
+}
+
+// Collect implements prometheus.Collector.
+func (c *RewriteCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.h.Stats()
+	ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(stats.Requests))
+	ch <- prometheus.MustNewConstMetric(c.rewritten, prometheus.CounterValue, float64(stats.Rewritten))
+	var count uint64
+	buckets := make(map[float64]uint64, len(stats.Histogram))
+	for _, b := range stats.Histogram {
+		count += uint64(b.Count)
+		if b.UpperBound > 0 {
+			buckets[b.UpperBound.Seconds()] = count
+		}
+	}
+	ch <- prometheus.MustNewConstHistogram(c.duration, count, stats.Total.Seconds(), buckets)
+	for domain, hits := range c.h.DomainHits() {
+		ch <- prometheus.MustNewConstMetric(c.domainRewrites, prometheus.CounterValue, float64(hits), domain)
+	}
+	ch <- prometheus.MustNewConstMetric(c.invalid, prometheus.CounterValue, float64(stats.InvalidRewrites))
+}
+
+// LoadCollector collects the load stats of an Engine.
+type LoadCollector struct {
+	h               *httpseverywhere.Engine
+	rulesets        *prometheus.Desc
+	loaded          *prometheus.Desc
+	droppedRulesets *prometheus.Desc
+	droppedRules    *prometheus.Desc
+	duration        *prometheus.Desc
+	generation      *prometheus.Desc
+}
+
+// NewLoadCollector returns a collector for the load stats of h.
+func NewLoadCollector(h *httpseverywhere.Engine) *LoadCollector {
+	return &LoadCollector{
+		h: h,
+		rulesets: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "rulesets"),
+			"Rule sets in the rules.", nil, nil),
+		loaded: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "loaded_rulesets"),
+			"Rule sets in use.", nil, nil),
+		droppedRulesets: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "dropped_rulesets"),
+			"Rule sets dropped because none of their rules compiled.", nil, nil),
+		droppedRules: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "dropped_rules"),
+			"Rules dropped because they didn't compile.", nil, nil),
+		duration: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "load_duration_seconds"),
+			"Time taken to load the rules.", nil, nil),
+		generation: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "generation"),
+			"Number of times the rules were loaded.", nil, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *LoadCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rulesets
+	ch <- c.loaded
+	ch <- c.droppedRulesets
+	ch <- c.droppedRules
+	ch <- c.duration
+	ch <- c.generation
+}
+
+// Collect implements prometheus.Collector.
+func (c *LoadCollector) Collect(ch chan<- prometheus.Metric) {
+	load := c.h.LoadStats()
+	gauge := func(desc *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v)
+	}
+	gauge(c.rulesets, float64(load.Rulesets))
+	gauge(c.loaded, float64(load.Loaded))
+	gauge(c.droppedRulesets, float64(load.DroppedRulesets))
+	gauge(c.droppedRules, float64(load.DroppedRules))
+	gauge(c.duration, load.Total.Seconds())
+	gauge(c.generation, float64(c.h.Generation()))
+}
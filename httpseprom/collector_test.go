@@ -0,0 +1,51 @@
+package httpseprom
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/httpseverywhere"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectors(t *testing.T) {
+	h := httpseverywhere.New(
+		httpseverywhere.WithoutBuiltinRules(),
+		httpseverywhere.WithDomainStats(10),
+		httpseverywhere.WithRulesets(&httpseverywhere.Ruleset{
+			Target: []*httpseverywhere.Target{{Host: "*.example.com"}},
+			Rule:   []*httpseverywhere.Rule{{From: "^http:", To: "https:"}},
+		}),
+	)
+	for _, u := range []string{"http://www.example.com/", "http://a.example.com/", "http://example.org/"} {
+		parsed, _ := url.Parse(u)
+		h.Rewrite(parsed)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	assert.NoError(t, registry.Register(NewRewriteCollector(h)))
+	assert.NoError(t, registry.Register(NewLoadCollector(h)))
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP httpseverywhere_requests_total URLs given to be rewritten.
+# TYPE httpseverywhere_requests_total counter
+httpseverywhere_requests_total 3
+# HELP httpseverywhere_rewritten_total URLs that were rewritten.
+# TYPE httpseverywhere_rewritten_total counter
+httpseverywhere_rewritten_total 2
+# HELP httpseverywhere_domain_rewrites_total URLs that were rewritten by root domain.
+# TYPE httpseverywhere_domain_rewrites_total counter
+httpseverywhere_domain_rewrites_total{domain="example.com"} 2
+# HELP httpseverywhere_loaded_rulesets Rule sets in use.
+# TYPE httpseverywhere_loaded_rulesets gauge
+httpseverywhere_loaded_rulesets 1
+`), "httpseverywhere_requests_total", "httpseverywhere_rewritten_total",
+		"httpseverywhere_domain_rewrites_total", "httpseverywhere_loaded_rulesets"))
+
+	count, err := testutil.GatherAndCount(registry, "httpseverywhere_rewrite_duration_seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,14 @@
+module github.com/getlantern/httpseverywhere/httpseprom
+
+go 1.16
+
+require (
+	github.com/getlantern/httpseverywhere v0.0.0
+	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/prometheus/client_golang v1.12.2
+	github.com/stretchr/testify v1.6.1
+	golang.org/x/sys v0.7.0 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
+)
+
+replace github.com/getlantern/httpseverywhere => ../
@@ -0,0 +1,11 @@
+module github.com/getlantern/httpseverywhere/httpsesqlite
+
+go 1.16
+
+require (
+	github.com/getlantern/httpseverywhere v0.0.0
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/stretchr/testify v1.8.2
+)
+
+replace github.com/getlantern/httpseverywhere => ../
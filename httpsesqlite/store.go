@@ -0,0 +1,144 @@
+// Package httpsesqlite provides an httpseverywhere.RulesetStore backed by an
+// SQLite database, for deployments that look rule sets up on demand with
+// httpseverywhere.WithRulesetStore and would rather keep them in a database
+// than in a rules file. The encoded rule sets are kept in one table and their
+// targets in an indexed one:
+//
+//	CREATE TABLE rulesets (id INTEGER PRIMARY KEY, data BLOB);
+//	CREATE TABLE targets (target TEXT, ruleset INTEGER);
+//	CREATE INDEX targets_by_target ON targets (target);
+//
+// It's a separate module so that applications that don't use it don't depend
+// on cgo and the SQLite driver. Fill a database with the rules and use it:
+//
+//	store, err := httpsesqlite.Open("rules.db")
+//	...
+//	err = store.Write(rulesets)
+//	...
+//	h := httpseverywhere.New(httpseverywhere.WithRulesetStore(store, 1000))
+package httpsesqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/getlantern/httpseverywhere"
+
+	// Registers the sqlite3 driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS rulesets (id INTEGER PRIMARY KEY, data BLOB);
+CREATE TABLE IF NOT EXISTS targets (target TEXT, ruleset INTEGER);
+CREATE INDEX IF NOT EXISTS targets_by_target ON targets (target);
+`
+
+const selectRulesets = `
+SELECT rulesets.data FROM targets JOIN rulesets ON rulesets.id = targets.ruleset
+WHERE targets.target = ? ORDER BY rulesets.id`
+
+// Store is an httpseverywhere.RulesetStore backed by an SQLite database. It's
+// safe for concurrent use.
+type Store struct {
+	db     *sql.DB
+	lookup *sql.Stmt
+}
+
+// Open opens the SQLite database at path as a Store, creating it and its
+// tables if necessary.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating tables: %v", err)
+	}
+	lookup, err := db.Prepare(selectRulesets)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, lookup: lookup}, nil
+}
+
+// Write replaces the rule sets in the store with the given ones, in a single
+// transaction so that lookups see either the old rule sets or the new ones.
+// Later rule sets take precedence over earlier ones with the same target.
+func (s *Store) Write(rulesets []*httpseverywhere.Ruleset) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := write(tx, rulesets); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func write(tx *sql.Tx, rulesets []*httpseverywhere.Ruleset) error {
+	if _, err := tx.Exec("DELETE FROM targets"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM rulesets"); err != nil {
+		return err
+	}
+	insertRuleset, err := tx.Prepare("INSERT INTO rulesets (id, data) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insertRuleset.Close()
+	insertTarget, err := tx.Prepare("INSERT INTO targets (target, ruleset) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insertTarget.Close()
+	for i, rs := range rulesets {
+		data, err := json.Marshal(rs)
+		if err != nil {
+			return fmt.Errorf("encoding rule set %v: %v", rs.Name, err)
+		}
+		if _, err := insertRuleset.Exec(i, data); err != nil {
+			return err
+		}
+		for _, target := range rs.Target {
+			if _, err := insertTarget.Exec(target.Host, i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Rulesets implements httpseverywhere.RulesetStore.
+func (s *Store) Rulesets(target string) ([]*httpseverywhere.Ruleset, error) {
+	rows, err := s.lookup.Query(target)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rulesets []*httpseverywhere.Ruleset
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		rs := &httpseverywhere.Ruleset{}
+		if err := json.Unmarshal(data, rs); err != nil {
+			return nil, fmt.Errorf("decoding rule set for %v: %v", target, err)
+		}
+		rulesets = append(rulesets, rs)
+	}
+	return rulesets, rows.Err()
+}
+
+// Close closes the database. An Engine using the Store closes it when it's
+// closed itself.
+func (s *Store) Close() error {
+	s.lookup.Close()
+	return s.db.Close()
+}
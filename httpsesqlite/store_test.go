@@ -0,0 +1,70 @@
+package httpsesqlite
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/httpseverywhere"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpsesqlite")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.db")
+
+	store, err := Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, store.Write([]*httpseverywhere.Ruleset{{
+		Name:   "Stale",
+		Target: []*httpseverywhere.Target{{Host: "stale.example.com"}},
+		Rule:   []*httpseverywhere.Rule{{From: "^http:", To: "https:"}},
+	}}))
+	assert.NoError(t, store.Write([]*httpseverywhere.Ruleset{{
+		Name:   "Example",
+		Target: []*httpseverywhere.Target{{Host: "*.example.com"}, {Host: "example.com"}},
+		Rule:   []*httpseverywhere.Rule{{From: "^http:", To: "https:"}},
+	}, {
+		Name:   "Later",
+		Target: []*httpseverywhere.Target{{Host: "example.com"}},
+		Rule:   []*httpseverywhere.Rule{{From: "^http://example\\.com/", To: "https://www.example.com/"}},
+	}}))
+	assert.NoError(t, store.Close())
+
+	// The rule sets persist.
+	store, err = Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rulesets, err := store.Rulesets("example.com")
+	if assert.NoError(t, err) && assert.Len(t, rulesets, 2) {
+		assert.Equal(t, "Example", rulesets[0].Name)
+		assert.Equal(t, "Later", rulesets[1].Name)
+	}
+	rulesets, err = store.Rulesets("stale.example.com")
+	assert.NoError(t, err)
+	assert.Empty(t, rulesets, "writing should replace the rule sets")
+
+	h := httpseverywhere.New(httpseverywhere.WithRulesetStore(store, 10))
+	for u, expected := range map[string]string{
+		"http://www.example.com/a": "https://www.example.com/a",
+		"http://example.com/a":     "https://www.example.com/a",
+		"http://example.org/":      "",
+	} {
+		parsed, _ := url.Parse(u)
+		r, _ := h.Rewrite(parsed)
+		assert.Equal(t, expected, r, u)
+	}
+
+	h.Close()
+	_, err = store.Rulesets("example.com")
+	assert.Error(t, err, "closing the engine should close the store")
+}
@@ -1,13 +1,34 @@
 package httpseverywhere
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	radix "github.com/armon/go-radix"
+	"github.com/getlantern/golog"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -195,6 +216,1375 @@ func TestExclusions(t *testing.T) {
 	assert.Equal(t, "", r)
 }
 
+func TestQueryStringMatching(t *testing.T) {
+	var testRule = `<ruleset name="Example">
+				<target host="example.com" />
+
+				<exclusion pattern="^http://example\.com/search\?(?:[^#]*&amp;)?action=login(?:&amp;|$)" />
+				<exclusion pattern="^http://example\.com/search\?q=a%20b$" />
+				<exclusion pattern="#" />
+				<rule from="^http:"
+								to="https:" />
+</ruleset>`
+
+	h := newHTTPS(testRule)
+	cases := []struct {
+		url      string
+		expected string
+		modified bool
+	}{
+		{"http://example.com/search?action=login", "", false},
+		{"http://example.com/search?lang=en&action=login", "", false},
+		{"http://example.com/search?action=logout", "https://example.com/search?action=logout", true},
+		{"http://example.com/search?q=a b", "", false},
+		{"http://example.com/search?q=a+b", "https://example.com/search?q=a+b", true},
+		{"http://example.com/search#action=login", "https://example.com/search#action=login", true},
+		{"http://example.com/search?action=logout#frag", "https://example.com/search?action=logout#frag", true},
+	}
+	for _, c := range cases {
+		r, mod := h(toURL(c.url))
+		assert.Equal(t, c.modified, mod, c.url)
+		assert.Equal(t, c.expected, r, c.url)
+	}
+}
+
+func TestTargetDomains(t *testing.T) {
+	for _, c := range []struct {
+		target   string
+		domain   string
+		expected bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "example.com", true},
+		{"*.example.com", "example.com", true},
+		{"*.example.com", "a.example.com", true},
+		{"*.a.example.com", "example.com", true},
+		{"example.*", "example.de", true},
+		{"example.com", "www.example.com", false},
+		{"badexample.com", "example.com", false},
+		{"example.org", "example.com", false},
+	} {
+		assert.Equal(t, c.expected, targetInDomain(c.target, c.domain), "%v in %v", c.target, c.domain)
+	}
+
+	h := newEmpty(WithTargetDomains("preston.gov.uk"))
+	h.init()
+	stats := h.LoadStats()
+	assert.True(t, stats.Loaded > 0)
+	assert.True(t, stats.Loaded < stats.Rulesets/100, "should only have loaded rule sets for preston.gov.uk")
+	_, mod := h.Rewrite(toURL("http://forms.preston.gov.uk/"))
+	assert.True(t, mod)
+	_, mod = h.Rewrite(toURL("http://bundler.io/"))
+	assert.False(t, mod)
+}
+
+func TestLoadPhases(t *testing.T) {
+	var rulesets []*Ruleset
+	for i := 0; i < 100; i++ {
+		rulesets = append(rulesets, &Ruleset{
+			Target:    []*Target{{Host: fmt.Sprintf("www%d.example.com", i)}},
+			Exclusion: []*Exclusion{{Pattern: fmt.Sprintf(`^http://www%d\.example\.com/excluded`, i)}},
+			Rule:      []*Rule{{From: "^http:", To: "https:"}},
+		})
+	}
+	data, err := encodeRulesets(rulesets)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+
+	stats := New(WithRulesData(buf.Bytes())).LoadStats()
+	assert.True(t, stats.AssetRead > 0, "should time reading rules")
+	assert.True(t, stats.Decode > 0, "should time decoding")
+	assert.True(t, stats.Compile > 0, "should time compiling")
+	assert.True(t, stats.Index > 0, "should time indexing")
+	assert.True(t, stats.AssetRead+stats.Decode+stats.Compile+stats.Index <= stats.Total)
+}
+
+// observingClock calls observe whenever the time is read.
+type observingClock struct {
+	systemClock
+	observe func()
+}
+
+func (c *observingClock) Now() time.Time {
+	c.observe()
+	return c.systemClock.Now()
+}
+
+func TestProgressiveLoad(t *testing.T) {
+	var rulesets []*Ruleset
+	for i := 0; i < 10; i++ {
+		rulesets = append(rulesets, &Ruleset{
+			Target: []*Target{{Host: fmt.Sprintf("www%d.example.com", i)}},
+			Rule:   []*Rule{{From: "^http:", To: "https:"}},
+		})
+	}
+	rulesets = append(rulesets, &Ruleset{
+		Target: []*Target{{Host: "*.example.org"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	})
+	data, err := encodeRulesets(rulesets)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var h *Engine
+	published := map[int]bool{}
+	wildcardsEarly := false
+	clock := &observingClock{observe: func() {
+		if h == nil {
+			return
+		}
+		plains := h.plainTargets.Load().(map[string]*ruleset)
+		if len(plains) < len(rulesets)-1 {
+			published[len(plains)] = true
+			wildcardsEarly = wildcardsEarly || h.wildcardTargets.Load().(*radix.Tree).Len() > 0
+		}
+	}}
+	h = newEmpty(WithRulesData(data), WithProgressiveLoad(4), WithCompaction(false), WithStatsDisabled(), WithClock(clock))
+	h.init()
+	assert.Equal(t, map[int]bool{0: true, 4: true, 8: true}, published, "plain rule sets should be published in batches")
+	assert.False(t, wildcardsEarly, "wildcard rule sets should only be published once loaded")
+	assert.Equal(t, 11, h.LoadStats().Loaded)
+	for _, host := range []string{"www9.example.com", "a.example.org"} {
+		_, mod := h.Rewrite(toURL("http://" + host + "/"))
+		assert.True(t, mod, host)
+	}
+}
+
+func TestDroppedLoadStats(t *testing.T) {
+	h := newEmpty(WithoutBuiltinRules(), WithMaxRegexProgramSize(50), WithRulesets(
+		unmarshallRuleset(`<ruleset name="Good">
+			<target host="good.example.com" />
+			<rule from="^http:" to="https:" />
+		</ruleset>`),
+		unmarshallRuleset(`<ruleset name="Bad rule">
+			<target host="badrule.example.com" />
+			<exclusion pattern="^http://badrule\.example\.com/a" />
+			<rule from="^http://badrule\.example\.com/b" to="https://badrule.example.com/b" />
+			<rule from="^http://(?:a|b|c|d|e|f|g|h)\w{1,50}\.example\.com/" to="https://example.com/" />
+		</ruleset>`),
+		unmarshallRuleset(`<ruleset name="Bad exclusion">
+			<target host="badexclusion.example.com" />
+			<exclusion pattern="^http://badexclusion\.example\.com/a(?:a|b|c|d|e|f|g|h)\w{1,50}" />
+			<rule from="^http:" to="https:" />
+		</ruleset>`),
+		unmarshallRuleset(`<ruleset name="Bad rules">
+			<target host="badrules.example.com" />
+			<exclusion pattern="^http://badrules\.example\.com/a" />
+			<rule from="^http://(?:a|b|c|d|e|f|g|h)\w{1,50}\.example\.com/" to="https://example.com/" />
+		</ruleset>`),
+	))
+	h.init()
+	stats := h.LoadStats()
+	assert.Equal(t, 1, stats.DroppedRulesets)
+	assert.Equal(t, 2, stats.DroppedRules)
+	assert.Equal(t, 2, stats.DroppedExclusions)
+
+	for in, expected := range map[string]string{
+		"http://good.example.com/":           "https://good.example.com/",
+		"http://badrule.example.com/b":       "https://badrule.example.com/b",
+		"http://badrule.example.com/a":       "",
+		"http://badexclusion.example.com/":   "https://badexclusion.example.com/",
+		"http://badexclusion.example.com/ab": "",
+		"http://badexclusion.example.com/a":  "",
+		"http://badrules.example.com/":       "",
+	} {
+		r, _ := h.Rewrite(toURL(in))
+		assert.Equal(t, expected, r, in)
+	}
+}
+
+func TestAnchoredLiteralPrefix(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		`^http://example\.com/(?!secure/)`: "http://example.com/",
+		`^http://(www\.)?example\.com/`:    "http://",
+		`^http://example\.com/a?b`:         "http://example.com/",
+		`^http://example\.com/a+`:          "http://example.com/a",
+		`^http://example\.com/\w`:          "http://example.com/",
+		`^http://a\.com/x|^http://b`:       "",
+		`^http://a\.com/(x|y)`:             "http://a.com/",
+		`^http://a\.com/[|]`:               "http://a.com/",
+		`http://example\.com/`:             "",
+	} {
+		assert.Equal(t, expected, anchoredLiteralPrefix(pattern), pattern)
+	}
+}
+
+func TestMaxMatchLength(t *testing.T) {
+	var testRule = `<ruleset name="Example">
+		<target host="example.com" />
+		<exclusion pattern="^http://example\.com/login" />
+		<rule from="^http://example\.com/" to="https://www.example.com/" />
+	</ruleset>`
+
+	h := newEmpty(WithMaxMatchLength(25))
+	addRuleset(testRule, h)
+
+	long := "http://example.com/" + strings.Repeat("a", 1000) + "?q=1#frag"
+	r, mod := h.Rewrite(toURL(long))
+	assert.True(t, mod)
+	assert.Equal(t, "https://www.example.com/"+strings.Repeat("a", 1000)+"?q=1#frag", r)
+
+	_, mod = h.Rewrite(toURL("http://example.com/login/" + strings.Repeat("a", 1000)))
+	assert.False(t, mod, "exclusion within the cap should still apply")
+
+	head, tail := h.capMatchString("http://example.com/x\u00e9\u00e9\u00e9")
+	assert.Equal(t, "http://example.com/x\u00e9\u00e9", head)
+	assert.Equal(t, "\u00e9", tail)
+}
+
+func TestLongURLMode(t *testing.T) {
+	var testRule = `<ruleset name="Example">
+		<target host="example.com" />
+		<exclusion pattern="^http://example\.com/login" />
+		<exclusion pattern="\?nossl" />
+		<rule from="^http://example\.com/" to="https://www.example.com/" />
+	</ruleset>`
+
+	h := newEmpty(WithLongURLMode(100, 40))
+	addRuleset(testRule, h)
+
+	query := "?nossl&data=" + strings.Repeat("a", 1000)
+	r, mod := h.Rewrite(toURL("http://example.com/track" + query + "#frag"))
+	assert.True(t, mod, "query shouldn't be matched for long URLs")
+	assert.Equal(t, "https://www.example.com/track"+query+"#frag", r)
+
+	_, mod = h.Rewrite(toURL("http://example.com/track?nossl"))
+	assert.False(t, mod, "short URLs should be matched in full")
+
+	_, mod = h.Rewrite(toURL("http://example.com/login" + query))
+	assert.False(t, mod, "exclusions on the path should still apply")
+
+	path := "/" + strings.Repeat("b", 100)
+	r, mod = h.Rewrite(toURL("http://example.com" + path))
+	assert.True(t, mod)
+	assert.Equal(t, "https://www.example.com"+path, r)
+
+	head, tail := h.capMatchString("http://example.com/" + strings.Repeat("b", 100))
+	assert.Len(t, head, 40, "path should be cut at the prefix length")
+	assert.Len(t, tail, 79)
+}
+
+func TestRewriteString(t *testing.T) {
+	var testRule = `<ruleset name="Bundler.io">
+		<target host="bundler.io"/>
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+	h := newRawHTTPS(testRule)
+
+	for _, base := range []string{"http://bundler.io/docs", "//bundler.io/docs", "bundler.io/docs"} {
+		r, mod := h.RewriteString(base)
+		assert.True(t, mod, base)
+		assert.Equal(t, "https://bundler.io/docs", r, base)
+	}
+
+	r, mod := h.RewriteString("bundler.io/r?u=http://x")
+	assert.True(t, mod, "a URL in the query isn't a scheme")
+	assert.Equal(t, "https://bundler.io/r?u=http://x", r)
+
+	_, mod = h.RewriteString("https://bundler.io/docs")
+	assert.False(t, mod)
+
+	WithDefaultScheme("https")(h)
+	_, mod = h.RewriteString("bundler.io/docs")
+	assert.False(t, mod, "https is never rewritten")
+}
+
+func TestMaxRegexProgramSize(t *testing.T) {
+	var testRule = `<ruleset name="Example">
+		<target host="example.com" />
+		<target host="*.example.com" />
+		<rule from="^http://(?:a|b|c|d|e|f|g|h)\w{1,50}\.example\.com/" to="https://example.com/" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+
+	h := newRawHTTPS(testRule)
+	r, _ := h.Rewrite(toURL("http://abc.example.com/"))
+	assert.Equal(t, "https://example.com/", r)
+
+	h = newEmpty(WithMaxRegexProgramSize(50))
+	addRuleset(testRule, h)
+	r, _ = h.Rewrite(toURL("http://abc.example.com/"))
+	assert.Equal(t, "https://abc.example.com/", r, "rule with oversized program should have been skipped")
+}
+
+func TestCompileQuota(t *testing.T) {
+	var testRule = `<ruleset name="Example">
+		<target host="example.com" />
+		<exclusion pattern="^http://example\.com/login" />
+		<rule from="^http://example\.com/a" to="https://example.com/a" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+
+	clock := newTestClock()
+	h := newEmpty(WithCompileQuota(2), WithClock(clock))
+	addRuleset(testRule, h)
+	assert.Equal(t, time.Second, clock.slept, "third regex should have waited for the quota")
+
+	_, mod := h.Rewrite(toURL("http://example.com/"))
+	assert.True(t, mod)
+
+	// Lazy compiles are subject to the quota too.
+	clock = newTestClock()
+	h = newEmpty(WithCompileQuota(2), WithClock(clock), WithLazyCompilation())
+	addRuleset(testRule, h)
+	assert.Zero(t, clock.slept)
+	_, mod = h.Rewrite(toURL("http://example.com/login"))
+	assert.False(t, mod, "exclusion should apply")
+	assert.Equal(t, time.Second, clock.slept, "third regex should have waited for the quota")
+}
+
+// testClock is a Clock whose time only moves when something sleeps or waits.
+type testClock struct {
+	mx    sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *testClock) Sleep(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func TestNormalizers(t *testing.T) {
+	stripTracking := func(u *url.URL) *url.URL {
+		q := u.Query()
+		if q.Get("utm_source") == "" {
+			return u
+		}
+		q.Del("utm_source")
+		stripped := *u
+		stripped.RawQuery = q.Encode()
+		return &stripped
+	}
+
+	h := newEmpty(WithNormalizers(stripTracking))
+	addRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<exclusion pattern="utm_source" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, h)
+
+	u := toURL("http://example.com/a?utm_source=feed&b=c")
+	r, mod := h.Rewrite(u)
+	assert.True(t, mod)
+	assert.Equal(t, "https://example.com/a?b=c", r)
+	assert.Equal(t, "http://example.com/a?utm_source=feed&b=c", u.String(), "should not modify original URL")
+
+	r, mod = h.Rewrite(toURL("http://example.org/a?utm_source=feed&b=c"))
+	assert.True(t, mod, "normalized URL should count as rewritten")
+	assert.Equal(t, "http://example.org/a?b=c", r)
+
+	_, mod = h.Rewrite(toURL("http://example.org/a?b=c"))
+	assert.False(t, mod)
+}
+
+func TestExclusionOverrides(t *testing.T) {
+	h := newRawHTTPS(`<ruleset name="SO">
+		<target host="stackoverflow.com" />
+		<target host="www.stackoverflow.com" />
+		<exclusion pattern="^http://(?:www\.)?stackoverflow\.com/users/authenticate/" />
+		<exclusion pattern="^http://(?:www\.)?stackoverflow\.com/login" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+
+	_, mod := h.Rewrite(toURL("http://stackoverflow.com/users/authenticate/"))
+	assert.False(t, mod)
+
+	assert.NoError(t, h.OverrideExclusion(ExclusionOverride{
+		Host:    "stackoverflow.com",
+		Pattern: `^http://(?:www\.)?stackoverflow\.com/users/authenticate/`,
+		By:      "ops",
+		Reason:  "works fine over https",
+	}))
+	r, mod := h.Rewrite(toURL("http://stackoverflow.com/users/authenticate/"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://stackoverflow.com/users/authenticate/", r)
+	_, mod = h.Rewrite(toURL("http://stackoverflow.com/login"))
+	assert.False(t, mod, "other exclusions should still apply")
+	_, mod = h.Rewrite(toURL("http://www.stackoverflow.com/users/authenticate/"))
+	assert.False(t, mod, "other hosts should not be overridden")
+
+	assert.NoError(t, h.OverrideExclusion(ExclusionOverride{Host: "www.stackoverflow.com", Ruleset: true, By: "ops"}))
+	_, mod = h.Rewrite(toURL("http://stackoverflow.com/login"))
+	assert.True(t, mod, "rule set override should apply to all targets")
+	assert.Error(t, h.OverrideExclusion(ExclusionOverride{Host: "example.com", Ruleset: true}))
+
+	overrides := h.ExclusionOverrides()
+	if assert.Len(t, overrides, 2) {
+		assert.Equal(t, "stackoverflow.com", overrides[0].Host)
+		assert.Equal(t, "works fine over https", overrides[0].Reason)
+		assert.False(t, overrides[0].At.IsZero())
+		assert.True(t, overrides[1].Ruleset)
+	}
+
+	h.RemoveExclusionOverrides("stackoverflow.com", true)
+	h.RemoveExclusionOverrides("stackoverflow.com", false)
+	assert.Empty(t, h.ExclusionOverrides())
+	_, mod = h.Rewrite(toURL("http://stackoverflow.com/users/authenticate/"))
+	assert.False(t, mod)
+
+	// Rule set overrides apply to the rule set that rewrites the host rather
+	// than to the first candidate for it, and survive the rule sets being
+	// loaded again.
+	h = New(WithoutBuiltinRules(), WithRulesets(unmarshallRuleset(`<ruleset name="Partial">
+		<target host="www.example.com" />
+		<rule from="^http://www\.example\.com/a" to="https://www.example.com/a" />
+	</ruleset>`), unmarshallRuleset(`<ruleset name="Wildcard">
+		<target host="*.example.com" />
+		<exclusion pattern="^http://www\.example\.com/login" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)))
+	assert.NoError(t, h.OverrideExclusion(ExclusionOverride{Host: "www.example.com", Ruleset: true}))
+	_, mod = h.Rewrite(toURL("http://www.example.com/login"))
+	assert.True(t, mod, "override should apply to the rule set that rewrites the host")
+	assert.NoError(t, <-h.Rebuild())
+	_, mod = h.Rewrite(toURL("http://www.example.com/login"))
+	assert.True(t, mod, "override should survive a rebuild")
+	h.RemoveExclusionOverrides("www.example.com", true)
+	_, mod = h.Rewrite(toURL("http://www.example.com/login"))
+	assert.False(t, mod)
+
+	// Overrides apply to hosts regardless of case and port, which rule sets
+	// looked up in a RulesetStore match.
+	h = New(WithRulesetStore(mapStore{"example.com": {unmarshallRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<exclusion pattern="^http://[^/]+/login" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)}}, 10))
+	_, mod = h.Rewrite(toURL("http://Example.COM:8080/login"))
+	assert.False(t, mod)
+	assert.NoError(t, h.OverrideExclusion(ExclusionOverride{Host: "Example.com."}))
+	assert.Equal(t, "example.com", h.ExclusionOverrides()[0].Host)
+	r, mod = h.Rewrite(toURL("http://Example.COM:8080/login"))
+	assert.True(t, mod, "override should apply regardless of case and port")
+	assert.Equal(t, "https://Example.COM:8080/login", r)
+	h.RemoveExclusionOverrides("EXAMPLE.com", false)
+	assert.Empty(t, h.ExclusionOverrides())
+}
+
+// mapStore is a RulesetStore holding rule sets by target in memory.
+type mapStore map[string][]*Ruleset
+
+func (s mapStore) Rulesets(target string) ([]*Ruleset, error) {
+	return s[target], nil
+}
+
+type memoryPreferences struct {
+	paths []BrokenPath
+	err   error
+}
+
+func (p *memoryPreferences) LoadBrokenPaths() ([]BrokenPath, error) {
+	return p.paths, nil
+}
+
+func (p *memoryPreferences) SaveBrokenPaths(paths []BrokenPath) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.paths = paths
+	return nil
+}
+
+func TestBrokenPaths(t *testing.T) {
+	var rules = `<ruleset name="Example">
+		<target host="example.com" />
+		<target host="www.example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+	prefs := &memoryPreferences{}
+	h := newEmpty(WithPreferencesStore(prefs))
+	addRuleset(rules, h)
+	u := toURL("http://example.com/login")
+	assert.Zero(t, testing.AllocsPerRun(100, func() { h.pathBroken(u) }), "checking an empty registry shouldn't allocate")
+
+	for host, expected := range map[string]string{
+		"example.com":        "example.com",
+		"Example.COM:8080":   "example.com",
+		"example.com.":       "example.com",
+		"[::1]:8080":         "::1",
+		"[::1]":              "::1",
+		"::1":                "::1",
+		"www.example.com:80": "www.example.com",
+	} {
+		assert.Equal(t, expected, hostKey(host), host)
+	}
+
+	assert.NoError(t, h.ReportBrokenPath(BrokenPath{Host: "example.com", Path: "/login", Reason: "redirect loop"}))
+	assert.Error(t, h.ReportBrokenPath(BrokenPath{Host: "example.org", Path: "/"}), "no rule set covers host")
+	_, mod := h.Rewrite(toURL("http://example.com/login/form"))
+	assert.False(t, mod, "broken path shouldn't be upgraded")
+	_, mod = h.Rewrite(toURL("http://example.com/other"))
+	assert.True(t, mod)
+	_, mod = h.Rewrite(toURL("http://www.example.com/login"))
+	assert.True(t, mod, "only the reported host should be excluded")
+
+	prefs.err = errors.New("disk full")
+	assert.Error(t, h.ReportBrokenPath(BrokenPath{Host: "WWW.Example.com.", Path: "/"}))
+	_, mod = h.Rewrite(toURL("http://www.example.com/"))
+	assert.True(t, mod, "paths that couldn't be saved shouldn't be excluded")
+	assert.Error(t, h.RemoveBrokenPaths("example.com"))
+	assert.Len(t, h.BrokenPaths(), 1, "paths should be kept if removing them couldn't be saved")
+	prefs.err = nil
+	assert.NoError(t, h.ReportBrokenPath(BrokenPath{Host: "WWW.Example.com.", Path: "/"}))
+	assert.Equal(t, "www.example.com", h.BrokenPaths()[1].Host, "hosts should be normalized")
+	_, mod = h.Rewrite(toURL("http://www.example.com/"))
+	assert.False(t, mod)
+	assert.NoError(t, h.RemoveBrokenPaths("www.example.com"))
+	if assert.Len(t, prefs.paths, 1) {
+		assert.Equal(t, "redirect loop", prefs.paths[0].Reason)
+		assert.False(t, prefs.paths[0].At.IsZero())
+	}
+
+	h = newEmpty(WithPreferencesStore(prefs))
+	addRuleset(rules, h)
+	assert.Len(t, h.BrokenPaths(), 1, "should load broken paths from store")
+	_, mod = h.Rewrite(toURL("http://example.com/login"))
+	assert.False(t, mod)
+
+	assert.NoError(t, h.RemoveBrokenPaths("example.com"))
+	assert.Empty(t, h.BrokenPaths())
+	assert.Empty(t, prefs.paths)
+	_, mod = h.Rewrite(toURL("http://example.com/login"))
+	assert.True(t, mod)
+
+	// Broken paths apply to hosts regardless of case and port, which rule sets
+	// looked up in a RulesetStore match.
+	h = New(WithRulesetStore(mapStore{"example.com": {unmarshallRuleset(rules)}}, 10))
+	_, mod = h.Rewrite(toURL("http://Example.COM:8080/login"))
+	assert.True(t, mod)
+	assert.NoError(t, h.ReportBrokenPath(BrokenPath{Host: "example.com", Path: "/login"}))
+	_, mod = h.Rewrite(toURL("http://Example.COM:8080/login"))
+	assert.False(t, mod, "case and ports shouldn't matter")
+}
+
+func TestTransport(t *testing.T) {
+	var rules = `<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+	prefs := &memoryPreferences{}
+	h := newEmpty(WithPreferencesStore(prefs))
+	addRuleset(rules, h)
+
+	var httpsErr error
+	var sent []string
+	transport := h.NewTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		sent = append(sent, req.URL.String()+" "+string(body))
+		if req.URL.Scheme == "https" && httpsErr != nil {
+			return nil, httpsErr
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	}))
+	roundTrip := func(u string, err error) error {
+		sent, httpsErr = nil, err
+		req, _ := http.NewRequest(http.MethodPost, u, strings.NewReader("body"))
+		_, err = transport.RoundTrip(req)
+		return err
+	}
+
+	assert.NoError(t, roundTrip("http://example.com/a", nil))
+	assert.Equal(t, []string{"https://example.com/a body"}, sent)
+	assert.NoError(t, roundTrip("http://example.org/a", nil))
+	assert.Equal(t, []string{"http://example.org/a body"}, sent, "hosts without rules shouldn't be upgraded")
+
+	for _, err := range []error{context.DeadlineExceeded, context.Canceled, errors.New("connection reset")} {
+		assert.Equal(t, err, errors.Unwrap(roundTrip("http://example.com/a", &url.Error{Op: "Get", URL: "https://example.com/a", Err: err})))
+		assert.Equal(t, []string{"https://example.com/a body"}, sent, "%v shouldn't fall back", err)
+		assert.Empty(t, h.BrokenPaths(), "%v shouldn't be reported", err)
+	}
+
+	for i, err := range []error{
+		tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"},
+		x509.UnknownAuthorityError{},
+		x509.HostnameError{Certificate: &x509.Certificate{}, Host: "example.com"},
+		&net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")},
+	} {
+		u := fmt.Sprintf("http://example.com/%d", i)
+		assert.NoError(t, roundTrip(u, &url.Error{Op: "Get", URL: u, Err: err}))
+		if assert.Len(t, sent, 2, "%v should fall back", err) {
+			assert.Equal(t, u+" body", sent[1], "the body should be sent again")
+		}
+	}
+	assert.Len(t, h.BrokenPaths(), 4)
+	_, mod := h.Rewrite(toURL("http://example.com/0"))
+	assert.False(t, mod, "broken paths shouldn't be upgraded again")
+}
+
+func TestTenants(t *testing.T) {
+	h := newRawHTTPS(`<ruleset name="Example">
+		<target host="example.com" />
+		<exclusion pattern="^http://example\.com/login" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	a := h.Tenant("a")
+	assert.True(t, a == h.Tenant("a"))
+	b := h.Tenant("b")
+	a.SetRulesets(&Ruleset{
+		Target: []*Target{{Host: "tenant.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	})
+	assert.NoError(t, b.OverrideExclusion(ExclusionOverride{Host: "example.com", By: "b-admin"}))
+
+	rewrite := func(rw Rewrite, in string) string {
+		r, _ := rw(toURL(in))
+		return r
+	}
+	assert.Equal(t, "https://tenant.example/", rewrite(a.Rewrite, "http://tenant.example/"))
+	assert.Equal(t, "", rewrite(b.Rewrite, "http://tenant.example/"), "tenant rule sets shouldn't leak to other tenants")
+	assert.Equal(t, "", rewrite(h.Rewrite, "http://tenant.example/"))
+	assert.Equal(t, "https://example.com/", rewrite(a.Rewrite, "http://example.com/"), "global rule sets should apply to tenants")
+
+	assert.Equal(t, "https://example.com/login", rewrite(b.Rewrite, "http://example.com/login"))
+	assert.Equal(t, "", rewrite(a.Rewrite, "http://example.com/login"), "tenant overrides shouldn't leak to other tenants")
+	assert.Equal(t, "", rewrite(h.Rewrite, "http://example.com/login"))
+	if assert.Len(t, b.ExclusionOverrides(), 1) {
+		assert.Equal(t, "b", b.ExclusionOverrides()[0].Tenant)
+	}
+	assert.Empty(t, h.ExclusionOverrides())
+
+	assert.NoError(t, h.OverrideExclusion(ExclusionOverride{Host: "example.com"}))
+	assert.Equal(t, "https://example.com/login", rewrite(a.Rewrite, "http://example.com/login"), "global overrides should apply to tenants")
+
+	h.RemoveTenant("a")
+	assert.Equal(t, "", rewrite(h.Tenant("a").Rewrite, "http://tenant.example/"))
+}
+
+func TestCompare(t *testing.T) {
+	old := newRawHTTPS(`<ruleset name="Example">
+		<target host="example.com" />
+		<target host="old.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	updated := newRawHTTPS(`<ruleset name="Example">
+		<target host="example.com" />
+		<target host="new.com" />
+		<rule from="^http://example\.com/" to="https://www.example.com/" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+
+	urls := make(chan *url.URL, 10)
+	for _, u := range []string{"http://example.com/", "http://old.com/", "http://new.com/", "http://other.com/", "https://example.com/"} {
+		urls <- toURL(u)
+	}
+	close(urls)
+
+	c := old.Compare(updated.Rewrite, urls)
+	assert.Equal(t, 5, c.Total)
+	assert.Equal(t, 1, c.OnlyThis)
+	assert.Equal(t, 1, c.OnlyOther)
+	assert.Equal(t, 1, c.Different)
+	assert.Equal(t, 3, c.Divergent())
+	assert.Equal(t, []Divergence{
+		{URL: "http://example.com/", This: "https://example.com/", Other: "https://www.example.com/"},
+		{URL: "http://old.com/", This: "https://old.com/"},
+		{URL: "http://new.com/", Other: "https://new.com/"},
+	}, c.Examples)
+}
+
+func TestPrefetch(t *testing.T) {
+	h := newEmpty(WithLookupCache(10, 10))
+	addRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, h)
+	h.publish(h.plainTargets.Load().(map[string]*ruleset), h.wildcardTargets.Load().(*radix.Tree), 1)
+
+	h.Prefetch("example.com")
+	h.Prefetch("example.org")
+	for h.cache.positive.len()+h.cache.negative.len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []string{"example.com"}, h.cache.positive.keys())
+	assert.Equal(t, []string{"example.org"}, h.cache.negative.keys())
+
+	r, _ := h.Rewrite(toURL("http://example.com/"))
+	assert.Equal(t, "https://example.com/", r)
+	assert.EqualValues(t, 1, h.cache.hits, "prefetched host should have been cached")
+
+	// Lazily compiled rule sets are compiled, with or without a lookup cache.
+	h = New(WithoutBuiltinRules(), WithLazyCompilation(), WithRulesets(unmarshallRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)))
+	rs := h.plainTargets.Load().(map[string]*ruleset)["example.com"]
+	assert.Zero(t, atomic.LoadInt32(&rs.lazy.compiledFlag))
+	h.Prefetch("example.com")
+	for atomic.LoadInt32(&rs.lazy.compiledFlag) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDumpDiagnostics(t *testing.T) {
+	h := newEmpty(WithLookupCache(10, 10), WithSlowRulesetQuarantine(time.Hour, 100))
+	addRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<target host="*.example.org" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, h)
+	h.publish(h.plainTargets.Load().(map[string]*ruleset), h.wildcardTargets.Load().(*radix.Tree), 1)
+	for i := 0; i < 3; i++ {
+		h.Rewrite(toURL("http://example.com/"))
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, h.DumpDiagnostics(&buf)) {
+		return
+	}
+	var d Diagnostics
+	if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &d)) {
+		return
+	}
+	assert.Len(t, d.BundleSHA256, 64)
+	assert.Equal(t, 1, d.PlainTargets)
+	assert.Equal(t, 1, d.WildcardKeys)
+	assert.Equal(t, &CacheDiagnostics{Positive: 1, Hits: 2, Misses: 1, HitRate: 2.0 / 3}, d.Cache)
+	if assert.Len(t, d.Slowest, 1) {
+		assert.Equal(t, []string{"example.com", "*.example.org"}, d.Slowest[0].Targets)
+	}
+}
+
+func TestCompactIndices(t *testing.T) {
+	rs := unmarshallRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<target host="*.example.org" />
+		<rule from="^http://example\.com/a" to="https://example.com/a" />
+		<rule from="^http://example\.com/b" to="https://example.com/b" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	plains, wildcards := newDeserializer().index([]*Ruleset{rs})
+	assert.True(t, cap(plains["example.com"].rule) > 3)
+
+	plains, wildcards = compactIndices(plains, wildcards)
+	compacted := plains["example.com"]
+	assert.Equal(t, 3, cap(compacted.rule))
+	assert.Equal(t, 0, cap(compacted.exclusion))
+	_, val, _ := wildcards.LongestPrefix(reverse("www.example.org"))
+	assert.True(t, compacted == val.(*ruleset))
+
+	h := newEmpty()
+	h.publish(plains, wildcards, 1)
+	r, _ := h.Rewrite(toURL("http://www.example.org/"))
+	assert.Equal(t, "https://www.example.org/", r)
+}
+
+func TestStatsAdd(t *testing.T) {
+	s := &httpseStats{}
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.add(toURL(fmt.Sprintf("http://%d.example/", i)), time.Duration(i))
+		}(i)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 100, s.runs)
+	assert.EqualValues(t, 5050, s.totalTime)
+	assert.EqualValues(t, 100, s.max)
+	assert.Equal(t, "http://100.example/", s.maxHost.Load())
+
+	snapshot := s.snapshot()
+	assert.EqualValues(t, 100, snapshot.Runs)
+	assert.EqualValues(t, 50, snapshot.Mean)
+	assert.EqualValues(t, 50, snapshot.P50)
+	assert.EqualValues(t, 99, snapshot.P99)
+	assert.EqualValues(t, 100, snapshot.Max)
+	assert.Equal(t, "http://100.example/", snapshot.MaxHost)
+	assert.Equal(t, StatsSnapshot{}, (&httpseStats{}).snapshot())
+
+	h := newRawHTTPS(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	h.Rewrite(toURL("http://example.com/"))
+	h.Rewrite(toURL("http://example.org/"))
+	assert.EqualValues(t, 2, h.Stats().Runs)
+	assert.EqualValues(t, 2, h.Stats().Requests)
+	assert.EqualValues(t, 1, h.Stats().Rewritten)
+}
+
+func TestResetStats(t *testing.T) {
+	clock := newTestClock()
+	start := clock.Now()
+	h := New(WithoutBuiltinRules(), WithClock(clock), WithRulesets(&Ruleset{
+		Target: []*Target{{Host: "example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}))
+	h.Rewrite(toURL("http://example.com/"))
+	h.Rewrite(toURL("http://example.org/"))
+	clock.Sleep(time.Minute)
+
+	snapshot := h.ResetStats()
+	assert.Equal(t, start, snapshot.Since)
+	assert.EqualValues(t, 2, snapshot.Requests)
+	assert.EqualValues(t, 1, snapshot.Rewritten)
+	assert.EqualValues(t, 2, snapshot.Runs)
+	assert.NotEmpty(t, snapshot.Histogram)
+
+	data, err := json.Marshal(snapshot)
+	if assert.NoError(t, err) {
+		var decoded StatsSnapshot
+		assert.NoError(t, json.Unmarshal(data, &decoded))
+		assert.True(t, snapshot.Since.Equal(decoded.Since))
+		decoded.Since = snapshot.Since
+		assert.Equal(t, snapshot, decoded)
+	}
+
+	assert.Equal(t, StatsSnapshot{Since: start.Add(time.Minute)}, h.Stats())
+	h.Rewrite(toURL("http://example.com/"))
+	assert.EqualValues(t, 1, h.Stats().Rewritten)
+}
+
+func TestStatsReporter(t *testing.T) {
+	reports := make(chan StatsSnapshot)
+	done := make(chan struct{})
+	h := New(WithoutBuiltinRules(), WithClock(newTestClock()), WithStatsReporter(time.Minute, true, func(snapshot StatsSnapshot) {
+		select {
+		case reports <- snapshot:
+		case <-done:
+		}
+	}), WithRulesets(&Ruleset{
+		Target: []*Target{{Host: "example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}))
+	defer h.Close()
+	defer close(done)
+
+	<-reports
+	h.Rewrite(toURL("http://example.com/"))
+	first := <-reports
+	second := <-reports
+	assert.EqualValues(t, 1, first.Rewritten+second.Rewritten, "should count the rewrite in one window")
+	assert.True(t, second.Since.After(first.Since))
+}
+
+func TestDomainStats(t *testing.T) {
+	h := New(WithoutBuiltinRules(), WithDomainStats(2), WithRulesets(&Ruleset{
+		Target: []*Target{{Host: "*.example.com"}, {Host: "*.example.co.uk"}, {Host: "example.org"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}))
+	for _, u := range []string{
+		"http://www.example.com/", "http://a.b.example.com/", "http://www.example.co.uk/",
+		"http://example.org/", "http://example.net/",
+	} {
+		h.Rewrite(toURL(u))
+	}
+	assert.Equal(t, map[string]int64{"example.com": 2, "example.co.uk": 1, OtherDomains: 1}, h.DomainHits())
+	assert.Nil(t, newEmpty().DomainHits())
+
+	assert.Equal(t, "example.com", rootDomain("WWW.Example.com."))
+	assert.Equal(t, "localhost", rootDomain("localhost"))
+	assert.Equal(t, "10.0.0.1", rootDomain("10.0.0.1"))
+}
+
+func TestBuiltinRulesetMetadata(t *testing.T) {
+	rulesets, err := newDeserializer().decode()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var named, scoped, keyed bool
+	for _, rs := range rulesets {
+		named = named || rs.Name != "" && rs.File != "" && rs.Source != ""
+		scoped = scoped || len(rs.PathScope) > 0
+		for _, target := range rs.Target {
+			keyed = keyed || target.Key != ""
+		}
+	}
+	assert.True(t, named, "some built-in rule set should have a name, file and source")
+	assert.True(t, scoped, "some built-in rule set should have a path scope")
+	assert.True(t, keyed, "built-in wildcard targets should have precomputed keys")
+}
+
+func TestRulesetNames(t *testing.T) {
+	rs := unmarshallRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	assert.Equal(t, "Example", rs.Name)
+	for format, data := range map[string][]byte{
+		"proto":   encodeRulesetsProto([]*Ruleset{rs}),
+		"indexed": encodeRulesetsIndexed([]*Ruleset{rs}),
+	} {
+		decoded, err := decodeRulesData(data)
+		if assert.NoError(t, err, format) && assert.Len(t, decoded, 1, format) {
+			assert.Equal(t, "Example", decoded[0].Name, format)
+		}
+	}
+
+	h := New(WithoutBuiltinRules(), WithRulesets(rs))
+	assert.Equal(t, "Example", h.Evaluate(toURL("http://example.com/")).Ruleset)
+	assert.Empty(t, h.Evaluate(toURL("http://example.com/")).RulesetFile)
+	assert.Empty(t, h.Evaluate(toURL("http://example.org/")).Ruleset)
+	ex := h.Explain(toURL("http://example.com/"))
+	if assert.Len(t, ex.Candidates, 1) {
+		assert.Equal(t, "Example", ex.Candidates[0].Ruleset)
+	}
+
+	// The rule set that rewrote the URL is reported, rather than the first
+	// candidate for the host.
+	var traced []string
+	h = New(WithoutBuiltinRules(), WithRewriteTracer(func(ctx context.Context, trace *RewriteTrace) {
+		traced = append(traced, trace.Ruleset)
+	}), WithRulesets(unmarshallRuleset(`<ruleset name="Wildcard">
+		<target host="*.example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`), unmarshallRuleset(`<ruleset name="Partial">
+		<target host="www.example.com" />
+		<rule from="^http://www\.example\.com/a" to="https://www.example.com/a" />
+	</ruleset>`)))
+	for path, expected := range map[string]string{"/a": "Partial", "/b": "Wildcard"} {
+		result := h.Evaluate(toURL("http://www.example.com" + path))
+		assert.True(t, result.Rewritten, path)
+		assert.Equal(t, expected, result.Ruleset, path)
+		traced = nil
+		h.Rewrite(toURL("http://www.example.com" + path))
+		assert.Equal(t, []string{expected}, traced, path)
+	}
+}
+
+func TestRulesetProvenance(t *testing.T) {
+	dir := t.TempDir()
+	for _, format := range []PreprocessOption{WithProtobuf(), WithIndexedFormat(), func(*preprocessOptions) {}} {
+		out := filepath.Join(dir, "rules")
+		Preprocessor.PreprocessTo("test", out, format, WithSource("abc123"), WithSample(1000, "Fabian_Franke.de"))
+		data, err := ioutil.ReadFile(out)
+		if !assert.NoError(t, err) {
+			return
+		}
+		h := New(WithRulesData(data))
+		result := h.Evaluate(toURL("http://fabianfranke.de/"))
+		assert.True(t, result.Rewritten)
+		assert.Equal(t, "Fabian_Franke.de.xml", result.RulesetFile)
+		assert.Equal(t, "abc123", result.RulesetSource)
+		ex := h.Explain(toURL("http://fabianfranke.de/"))
+		if assert.NotEmpty(t, ex.Candidates) {
+			assert.Equal(t, "Fabian_Franke.de.xml", ex.Candidates[0].File)
+			assert.Equal(t, "abc123", ex.Candidates[0].Source)
+		}
+	}
+}
+
+func TestRulesetsForHost(t *testing.T) {
+	h := New(WithoutBuiltinRules(), WithRulesets(&Ruleset{
+		Name:      "Plain",
+		Target:    []*Target{{Host: "www.example.com"}},
+		Exclusion: []*Exclusion{{Pattern: `^http://www\.example\.com/login`}},
+		Rule:      []*Rule{{From: "^http:", To: "https:"}},
+	}, &Ruleset{
+		Name:   "Subdomains",
+		Target: []*Target{{Host: "*.example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}, &Ruleset{
+		Name:   "WWW",
+		Target: []*Target{{Host: "*.www.example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}, &Ruleset{
+		Name:   "TLDs",
+		Target: []*Target{{Host: "www.example.*"}},
+		Rule:   []*Rule{{From: `^http://www\.example\.(\w+)/`, To: "https://www.example.$1/"}},
+	}))
+
+	names := func(host string) []string {
+		var names []string
+		for _, rs := range h.RulesetsForHost(host) {
+			names = append(names, rs.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"Plain", "Subdomains", "TLDs"}, names("WWW.example.com"))
+	assert.Equal(t, []string{"WWW", "Subdomains"}, names("a.www.example.com"))
+	assert.Equal(t, []string{"TLDs"}, names("www.example.org"))
+	assert.Empty(t, names("example.org"))
+
+	assert.True(t, h.IsCovered("www.example.com"))
+	assert.True(t, h.IsCovered("a.b.example.com"))
+	assert.True(t, h.IsCovered("www.example.org"))
+	assert.False(t, h.IsCovered("example.org"))
+	assert.False(t, h.IsCovered("example.com"))
+
+	targets := make(map[string]string)
+	h.RangeTargets(func(target string, rs RulesetInfo) bool {
+		targets[target] = rs.Name
+		return true
+	})
+	assert.Equal(t, map[string]string{
+		"www.example.com":   "Plain",
+		"*.example.com":     "Subdomains",
+		"*.www.example.com": "WWW",
+		"www.example.*":     "TLDs",
+	}, targets)
+	var visited int
+	h.RangeTargets(func(target string, rs RulesetInfo) bool {
+		visited++
+		return visited < 2
+	})
+	assert.Equal(t, 2, visited, "should stop when fn returns false")
+
+	rulesets := h.RulesetsForHost("www.example.com")
+	assert.Equal(t, []*Target{{Host: "www.example.com"}}, rulesets[0].Target)
+	assert.Equal(t, []*Exclusion{{Pattern: `^http://www\.example\.com/login`}}, rulesets[0].Exclusion)
+	assert.Equal(t, []*Rule{{From: "^http:", To: "https:"}}, rulesets[0].Rule)
+}
+
+func TestDump(t *testing.T) {
+	rulesets := []*Ruleset{{
+		Name:      "Example",
+		Target:    []*Target{{Host: "example.com"}, {Host: "*.example.com"}},
+		Exclusion: []*Exclusion{{Pattern: `^http://example\.com/login`}},
+		Rule:      []*Rule{{From: "^http:", To: "https:"}},
+	}, {
+		Name:   "Broken",
+		Target: []*Target{{Host: "broken.example"}},
+		Rule:   []*Rule{{From: "(", To: "https:"}, {From: "^http:", To: "https:"}},
+	}, {
+		Name:   "Off",
+		Off:    "breaks things",
+		Target: []*Target{{Host: "off.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}}
+	expected := []*Ruleset{{
+		Name:   "Broken",
+		Target: []*Target{{Host: "broken.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}, rulesets[0]}
+
+	h := New(WithoutBuiltinRules(), WithRulesets(rulesets...))
+	var buf bytes.Buffer
+	if assert.NoError(t, h.Dump(&buf, FormatXML)) {
+		var library rulesetLibrary
+		assert.NoError(t, xml.Unmarshal(buf.Bytes(), &library))
+		assert.Equal(t, expected, library.Rulesets)
+		assert.Contains(t, buf.String(), `<ruleset name="Example">`)
+	}
+	buf.Reset()
+	if assert.NoError(t, h.Dump(&buf, FormatJSON)) {
+		var dumped []*Ruleset
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &dumped))
+		assert.Equal(t, expected, dumped)
+	}
+	assert.Error(t, h.Dump(&buf, Format(-1)))
+
+	h = New(WithoutBuiltinRules(), WithLazyCompilation(), WithRulesets(rulesets...))
+	buf.Reset()
+	if assert.NoError(t, h.Dump(&buf, FormatJSON)) {
+		var dumped []*Ruleset
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &dumped))
+		if assert.Len(t, dumped, 2) {
+			assert.Len(t, dumped[0].Rule, 2, "should dump uncompiled rules as loaded")
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	h := New(WithoutBuiltinRules(), WithRulesets(&Ruleset{
+		Target:    []*Target{{Host: "www.example.com"}},
+		Exclusion: []*Exclusion{{Pattern: `^http://www\.example\.com/login`}},
+		Rule:      []*Rule{{From: `^http://www\.example\.com/secure/`, To: "https://www.example.com/secure/"}},
+	}, &Ruleset{
+		Target: []*Target{{Host: "example.*"}, {Host: "*.example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}))
+
+	ex := h.Explain(toURL("http://www.example.com/secure/page"))
+	assert.Equal(t, "https://www.example.com/secure/page", ex.Result)
+	assert.True(t, ex.Rewritten)
+	if assert.Len(t, ex.Candidates, 1) {
+		c := ex.Candidates[0]
+		assert.Equal(t, PlainIndex, c.Index)
+		assert.Equal(t, "www.example.com", c.Key)
+		assert.Equal(t, OutcomeRewritten, c.Outcome)
+		assert.Equal(t, `^http://www\.example\.com/secure/`, c.Rule)
+		assert.Equal(t, "https://www.example.com/secure/", c.To)
+		assert.Equal(t, "https://www.example.com/secure/page", c.Result)
+	}
+
+	ex = h.Explain(toURL("http://www.example.com/login"))
+	if assert.Len(t, ex.Candidates, 2) {
+		assert.Equal(t, OutcomeExcluded, ex.Candidates[0].Outcome)
+		assert.Equal(t, `^http://www\.example\.com/login`, ex.Candidates[0].Exclusion)
+		assert.Equal(t, OutcomeRewritten, ex.Candidates[1].Outcome, "should fall through to the wildcard rule set")
+	}
+	assert.Equal(t, "https://www.example.com/login", ex.Result)
+
+	ex = h.Explain(toURL("http://a.example.com/"))
+	if assert.Len(t, ex.Candidates, 1) {
+		c := ex.Candidates[0]
+		assert.Equal(t, PrefixIndex, c.Index)
+		assert.Equal(t, "*.example.com", c.Target)
+		assert.Equal(t, reverse(".example.com"), c.Key)
+		assert.Equal(t, []string{"example.*", "*.example.com"}, c.Targets)
+	}
+
+	ex = h.Explain(toURL("http://example.org/"))
+	if assert.Len(t, ex.Candidates, 1) {
+		assert.Equal(t, SuffixIndex, ex.Candidates[0].Index)
+		assert.Equal(t, "example.*", ex.Candidates[0].Target)
+		assert.Equal(t, "example.", ex.Candidates[0].Key)
+	}
+
+	ex = h.Explain(toURL("http://other.org/"))
+	assert.False(t, ex.Rewritten)
+	assert.Empty(t, ex.Candidates)
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	New(WithoutBuiltinRules(), WithLogger(NewStdLogger(log.New(&buf, "", 0))), WithRulesets(&Ruleset{
+		Target: []*Target{{Host: "example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}, {From: "(", To: "https:"}},
+	}))
+	assert.Contains(t, buf.String(), "DEBUG Compile failed, dropping rule")
+
+	err := NewStdLogger(log.New(&buf, "", 0)).Errorf("Unable to %v", "test")
+	assert.EqualError(t, err, "Unable to test")
+	assert.Contains(t, buf.String(), "ERROR Unable to test\n")
+}
+
+func TestDecisionLogging(t *testing.T) {
+	var buf bytes.Buffer
+	h := New(WithoutBuiltinRules(), WithLogger(NewStdLogger(log.New(&buf, "", 0))), WithDecisionLogging(2), WithRulesets(&Ruleset{
+		Target: []*Target{{Host: "example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}))
+	buf.Reset()
+	for _, u := range []string{"http://example.com/1", "http://example.com/2", "http://example.org/3", "http://example.org/4"} {
+		h.Rewrite(toURL(u))
+	}
+	assert.Equal(t, "DEBUG Rewrote http://example.com/1 to https://example.com/1\nDEBUG Not rewriting http://example.org/3\n", buf.String())
+}
+
+func TestRewriteTracer(t *testing.T) {
+	type ctxKey struct{}
+	var traces []*RewriteTrace
+	var ctxValues []interface{}
+	h := New(WithoutBuiltinRules(), WithRewriteTracer(func(ctx context.Context, trace *RewriteTrace) {
+		traces = append(traces, trace)
+		ctxValues = append(ctxValues, ctx.Value(ctxKey{}))
+	}), WithRulesets(&Ruleset{
+		Target:    []*Target{{Host: "example.com"}},
+		Exclusion: []*Exclusion{{Pattern: `^http://example\.com/login`}},
+		Rule:      []*Rule{{From: "^http:", To: "https:"}},
+	}))
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	h.RewriteContext(ctx, toURL("http://example.com/"))
+	h.Rewrite(toURL("http://example.com/login"))
+	h.Rewrite(toURL("http://example.org/"))
+	if !assert.Len(t, traces, 3) {
+		return
+	}
+	assert.Equal(t, []interface{}{"request", nil, nil}, ctxValues)
+	assert.Equal(t, "http://example.com/", traces[0].URL)
+	assert.Equal(t, "https://example.com/", traces[0].Result)
+	assert.True(t, traces[0].Rewritten)
+	assert.Equal(t, []string{"example.com"}, traces[0].Targets)
+	assert.False(t, traces[0].Start.IsZero())
+	assert.False(t, traces[1].Rewritten)
+	assert.Equal(t, []string{"example.com"}, traces[1].Targets, "should identify the rule set that excluded the URL")
+	assert.Empty(t, traces[2].Targets)
+}
+
+func TestExpvar(t *testing.T) {
+	h := New(WithoutBuiltinRules(), WithExpvar(), WithRulesets(&Ruleset{
+		Target: []*Target{{Host: "example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}))
+	h.Rewrite(toURL("http://example.com/"))
+	h.Rewrite(toURL("http://example.org/"))
+	vars := func() map[string]interface{} {
+		var v map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(expvar.Get(ExpvarName).String()), &v))
+		return v
+	}
+	v := vars()
+	assert.EqualValues(t, 2, v["requests"])
+	assert.EqualValues(t, 1, v["rewritten"])
+	assert.EqualValues(t, 1, v["not_rewritten"])
+	assert.EqualValues(t, 1, v["loaded_rulesets"])
+
+	h.Close()
+	assert.Nil(t, vars()["requests"], "closed engines shouldn't be published")
+}
+
+func TestStatsHistogram(t *testing.T) {
+	s := &httpseStats{}
+	u := toURL("http://example.com/")
+	for i := 0; i < 98; i++ {
+		s.add(u, 3*time.Microsecond)
+	}
+	s.add(u, 150*time.Millisecond)
+	s.add(u, time.Minute)
+
+	snapshot := s.snapshot()
+	assert.Len(t, snapshot.Histogram, len(histogramBounds)+1)
+	assert.EqualValues(t, 98, snapshot.Histogram[bucketFor(5*time.Microsecond)].Count)
+	assert.EqualValues(t, 1, snapshot.Histogram[len(histogramBounds)].Count, "should count durations above all bounds")
+	assert.Equal(t, 5*time.Microsecond, snapshot.Percentile(50))
+	assert.Equal(t, 5*time.Microsecond, snapshot.Percentile(98))
+	assert.Equal(t, 200*time.Millisecond, snapshot.Percentile(99))
+	assert.Equal(t, time.Minute, snapshot.Percentile(100), "should fall back to the maximum")
+	assert.Zero(t, (&httpseStats{}).snapshot().Percentile(99))
+
+	assert.Equal(t, 0, bucketFor(0))
+	assert.Equal(t, 0, bucketFor(time.Microsecond))
+	assert.Equal(t, 1, bucketFor(time.Microsecond+1))
+}
+
+func TestLookupCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	var rule = `<ruleset name="Bundler.io">
+		<target host="bundler.io"/>
+		<target host="*.bundler.io"/>
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+
+	newCached := func() *Engine {
+		return New(WithoutBuiltinRules(), WithRulesets(unmarshallRuleset(rule)), WithLookupCache(2, 2), WithCacheCheckpoint(path, time.Hour))
+	}
+
+	h := newCached()
+	for _, base := range []string{"http://bundler.io/", "http://www.bundler.io/", "http://a.bundler.io/", "http://example.com/", "http://www.bundler.io/a"} {
+		expected, expectedMod := newRawHTTPS(rule).Rewrite(toURL(base))
+		r, mod := h.Rewrite(toURL(base))
+		assert.Equal(t, expectedMod, mod, base)
+		assert.Equal(t, expected, r, base)
+	}
+	assert.Equal(t, []string{"a.bundler.io", "www.bundler.io"}, h.cache.positive.keys())
+	assert.Equal(t, []string{"example.com"}, h.cache.negative.keys())
+	assert.NoError(t, h.CheckpointCache())
+
+	h = newCached()
+	assert.Equal(t, []string{"a.bundler.io", "www.bundler.io"}, h.cache.positive.keys(), "should have warmed cache from checkpoint")
+	assert.Equal(t, []string{"example.com"}, h.cache.negative.keys())
+
+	// The checkpoint is only used at startup, not each time the indices change.
+	assert.NoError(t, <-h.Rebuild())
+	assert.Empty(t, h.cache.positive.keys())
+	assert.Empty(t, h.cache.negative.keys())
+	r, mod := h.Rewrite(toURL("http://www.bundler.io/"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://www.bundler.io/", r)
+
+	// Candidates looked up in indices that were replaced in the meantime aren't
+	// cached.
+	store := &resettingStore{}
+	h = New(WithRulesetStore(store, 10), WithLookupCache(2, 2))
+	store.h = h
+	h.Rewrite(toURL("http://example.com/"))
+	assert.Empty(t, h.cache.negative.keys())
+	h.Rewrite(toURL("http://example.com/"))
+	assert.Equal(t, []string{"example.com"}, h.cache.negative.keys())
+}
+
+// resettingStore is an empty RulesetStore that resets the lookup cache during
+// the first lookup, as if the indices were replaced concurrently.
+type resettingStore struct {
+	h     *Engine
+	reset bool
+}
+
+func (s *resettingStore) Rulesets(target string) ([]*Ruleset, error) {
+	if !s.reset {
+		s.reset = true
+		s.h.cache.reset()
+	}
+	return nil, nil
+}
+
+func TestDecisionCache(t *testing.T) {
+	app := &Ruleset{
+		Target:    []*Target{{Host: "www.example.com"}},
+		Rule:      []*Rule{{From: `^http://www\.example\.com/app/`, To: "https://app.example.com/"}},
+		PathScope: []string{"/app/"},
+	}
+	wildcard := &Ruleset{
+		Target: []*Target{{Host: "*.example.com"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}
+	other := &Ruleset{
+		Target: []*Target{{Host: "other.example.org"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}
+	bundle := func(rulesets ...*Ruleset) []byte {
+		data, err := encodeRulesets(rulesets)
+		assert.NoError(t, err)
+		return data
+	}
+	h := New(WithRulesData(bundle(app, wildcard, other)), WithDecisionCache(100, 1))
+
+	for in, expected := range map[string]string{
+		"http://www.example.com/static/a.js": "https://www.example.com/static/a.js",
+		"http://www.example.com/static/b.js": "https://www.example.com/static/b.js",
+		"http://www.example.com/app/x":       "https://app.example.com/x",
+		"http://www.example.com/app/y":       "https://app.example.com/y",
+		"http://www.example.com/a":           "https://www.example.com/a",
+		"http://other.example.org/":          "https://other.example.org/",
+	} {
+		r, _ := h.Rewrite(toURL(in))
+		assert.Equal(t, expected, r, in)
+	}
+	d := h.Diagnostics().Decisions
+	assert.Equal(t, 4, d.Entries)
+	assert.EqualValues(t, 2, d.Hits)
+
+	assert.Equal(t, "/static/", pathPrefix("/static/a.js", 1))
+	assert.Equal(t, "/a/b/", pathPrefix("/a/b/c.js", 2))
+	assert.Equal(t, "/a", pathPrefix("/a", 2))
+	assert.Equal(t, "/", pathPrefix("/a", 0))
+
+	assert.NoError(t, <-h.UpdateRulesData(bundle(app, other)))
+	assert.Equal(t, 1, h.Diagnostics().Decisions.Entries, "only decisions for unaffected hosts should be kept")
+	_, mod := h.Rewrite(toURL("http://www.example.com/static/a.js"))
+	assert.False(t, mod, "decisions shouldn't outlive the rule sets they were made with")
+	r, _ := h.Rewrite(toURL("http://www.example.com/app/z"))
+	assert.Equal(t, "https://app.example.com/z", r)
+
+	// A decided rule set that doesn't rewrite a URL is only evaluated once
+	// before the other candidates are tried.
+	app.Exclusion = []*Exclusion{{Pattern: `^http://www\.example\.com/app/public/`}}
+	h = New(WithRulesData(bundle(app, wildcard)), WithDecisionCache(100, 1), WithSlowRulesetQuarantine(time.Hour, 1000))
+	for _, in := range []string{"http://www.example.com/app/public/a", "http://www.example.com/app/public/b"} {
+		r, _ = h.Rewrite(toURL(in))
+		assert.Equal(t, strings.Replace(in, "http:", "https:", 1), r)
+	}
+	evaluations := 0
+	for i := range h.quarantine.shards {
+		for rs, timings := range h.quarantine.shards[i].timings {
+			if containsString(rs.target, "www.example.com") {
+				evaluations += len(timings.samples)
+			}
+		}
+	}
+	assert.Equal(t, 2, evaluations, "the decided rule set should be evaluated once per URL")
+}
+
 func TestDefaultOff(t *testing.T) {
 	var testRule = `<ruleset name="RabbitMQ" default_off="just cuz">
         <target host="rabbitmq.com" />
@@ -248,36 +1638,423 @@ func TestMultipleTargets(t *testing.T) {
 	base := "http://rabbitmq.com"
 	r, mod := h(toURL(base))
 
-	assert.True(t, mod, "should have been modified to https")
-	assert.Equal(t, "https://rabbitmq.com", r)
+	assert.True(t, mod, "should have been modified to https")
+	assert.Equal(t, "https://rabbitmq.com", r)
+
+	base = "http://www.rabbitmq.com"
+	r, mod = h(toURL(base))
+
+	assert.True(t, mod, "should have been modified to https")
+	assert.Equal(t, "https://www.rabbitmq.com", r)
+
+	base = "http://rabbitmq.net"
+	r, mod = h(toURL(base))
+
+	assert.True(t, mod, "should have been modified to https")
+	assert.Equal(t, "https://rabbitmq.net", r)
+}
+
+func TestIgnoreMultipleSubdomains(t *testing.T) {
+	var testRule = `<ruleset name="RabbitMQ">
+        <target host="*.b.rabbitmq.com" />
+
+        <rule from="^http:"
+                to="https:" />
+</ruleset>`
+
+	h := newHTTPS(testRule)
+	base := "http://rabbitmq.com"
+	r, mod := h(toURL(base))
+
+	assert.False(t, mod, "should NOT have been modified to https")
+	assert.Equal(t, "", r)
+}
+
+func TestStrictTargets(t *testing.T) {
+	var rule = `<ruleset name="Bundler.io">
+		<target host="bundler.*" />
+		<target host="*.bundler.io" />
+
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+
+	for _, strict := range []bool{false, true} {
+		var opts []Option
+		if strict {
+			opts = append(opts, WithStrictTargets())
+		}
+		h := newEmpty(opts...)
+		addRuleset(rule, h)
+
+		for _, base := range []string{"http://bundler.io", "http://bundler.net", "http://www.bundler.io", "http://a.b.bundler.io"} {
+			_, mod := h.Rewrite(toURL(base))
+			assert.True(t, mod, base)
+		}
+
+		// The suffix lookup matches the "bundler." key for any number of
+		// trailing labels, unlike the extension.
+		_, mod := h.Rewrite(toURL("http://bundler.co.uk"))
+		assert.Equal(t, !strict, mod)
+	}
+
+	assert.True(t, targetMatches("www.example.com", "*.example.com"))
+	assert.False(t, targetMatches("example.com", "*.example.com"))
+	assert.False(t, targetMatches("wwwexample.com", "*.example.com"))
+	assert.True(t, targetMatches("example.de", "example.*"))
+	assert.False(t, targetMatches("example.", "example.*"))
+	assert.False(t, targetMatches("example.co.uk", "example.*"))
+	assert.True(t, targetMatches("example.com", "example.com"))
+}
+
+func TestMatchPolicy(t *testing.T) {
+	var moving = `<ruleset name="Moving">
+		<target host="www.example.com" />
+		<rule from="^http://www\.example\.com/" to="https://secure.example.net/" />
+	</ruleset>`
+	var simple = `<ruleset name="Simple">
+		<target host="*.example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+
+	h := newRawHTTPS(moving)
+	addRuleset(simple, h)
+	r, mod := h.Rewrite(toURL("http://www.example.com/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://secure.example.net/a", r, "first match should use plain target")
+
+	h = newEmpty(WithMatchPolicy(BestMatch))
+	addRuleset(moving, h)
+	addRuleset(simple, h)
+	r, mod = h.Rewrite(toURL("http://www.example.com/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://www.example.com/a", r, "best match should prefer simple upgrade")
+
+	r, mod = h.Rewrite(toURL("http://other.example.com/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://other.example.com/a", r)
+
+	_, mod = h.Rewrite(toURL("http://example.org/a"))
+	assert.False(t, mod)
+}
+
+func TestLookupOrder(t *testing.T) {
+	var plain = `<ruleset name="Plain">
+		<target host="www.example.com" />
+		<rule from="^http://www\.example\.com/plain" to="https://www.example.com/plain" />
+	</ruleset>`
+	var wildcard = `<ruleset name="Wildcard">
+		<target host="*.example.com" />
+		<rule from="^http://[^/]+/" to="https://wildcard.example.com/" />
+	</ruleset>`
+
+	h := newEmpty(WithLookupOrder(PrefixIndex, PlainIndex, PrefixIndex))
+	addRuleset(plain, h)
+	addRuleset(wildcard, h)
+	assert.Equal(t, []Index{PrefixIndex, PlainIndex}, h.lookupOrder)
+	r, mod := h.Rewrite(toURL("http://www.example.com/plain"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://wildcard.example.com/plain", r, "prefix index should be checked first")
+
+	h = newEmpty()
+	addRuleset(plain, h)
+	addRuleset(wildcard, h)
+	r, mod = h.Rewrite(toURL("http://www.example.com/other"))
+	assert.True(t, mod, "should fall through to wildcard rule set")
+	assert.Equal(t, "https://wildcard.example.com/other", r)
+
+	h = newEmpty(WithEarlyExit())
+	addRuleset(plain, h)
+	addRuleset(wildcard, h)
+	_, mod = h.Rewrite(toURL("http://www.example.com/other"))
+	assert.False(t, mod, "should stop after plain index yields a candidate")
+	r, mod = h.Rewrite(toURL("http://www.example.com/plain"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://www.example.com/plain", r)
+	r, mod = h.Rewrite(toURL("http://other.example.com/"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://wildcard.example.com/", r)
+}
+
+func TestExclusiveRulesets(t *testing.T) {
+	var plain = `<ruleset name="Plain" exclusive="true">
+		<target host="www.example.com" />
+		<rule from="^http://www\.example\.com/plain" to="https://www.example.com/plain" />
+	</ruleset>`
+	var wildcard = `<ruleset name="Wildcard">
+		<target host="*.example.com" />
+		<rule from="^http://[^/]+/" to="https://wildcard.example.com/" />
+	</ruleset>`
+	assert.True(t, unmarshallRuleset(plain).Exclusive)
+
+	for _, policy := range []MatchPolicy{FirstMatch, BestMatch} {
+		h := newEmpty(WithMatchPolicy(policy))
+		addRuleset(plain, h)
+		addRuleset(wildcard, h)
+		r, mod := h.Rewrite(toURL("http://www.example.com/plain"))
+		assert.True(t, mod)
+		assert.Equal(t, "https://www.example.com/plain", r)
+		_, mod = h.Rewrite(toURL("http://www.example.com/other"))
+		assert.False(t, mod, "should not fall through from an exclusive rule set")
+		r, mod = h.Rewrite(toURL("http://other.example.com/"))
+		assert.True(t, mod)
+		assert.Equal(t, "https://wildcard.example.com/", r)
+	}
+
+	h := newEmpty()
+	addRuleset(wildcard, h)
+	tenant := h.Tenant("a")
+	tenant.SetRulesets(unmarshallRuleset(plain))
+	_, mod := tenant.Rewrite(toURL("http://www.example.com/other"))
+	assert.False(t, mod, "should not fall through from a tenant's exclusive rule set")
+	_, mod = h.Rewrite(toURL("http://www.example.com/other"))
+	assert.True(t, mod)
+
+	rulesets, err := decodeRulesetsProto(encodeRulesetsProto([]*Ruleset{unmarshallRuleset(plain)}))
+	if assert.NoError(t, err) && assert.Len(t, rulesets, 1) {
+		assert.True(t, rulesets[0].Exclusive, "exclusive should survive the protobuf format")
+	}
+}
+
+func TestAliasFolding(t *testing.T) {
+	var www = `<ruleset name="WWW">
+		<target host="www.example.com" />
+		<rule from="^http://(?:www\.)?example\.com/" to="https://www.example.com/" />
+	</ruleset>`
+	var apex = `<ruleset name="Apex">
+		<target host="example.org" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+
+	h := newEmpty()
+	addRuleset(www, h)
+	_, mod := h.Rewrite(toURL("http://example.com/a"))
+	assert.False(t, mod, "shouldn't fold aliases by default")
+
+	for _, opts := range [][]Option{{WithAliasFolding()}, {WithAliasFolding(), WithLookupCache(10, 10)}, {WithAliasFolding(), WithMatchPolicy(BestMatch)}} {
+		h = newEmpty(opts...)
+		addRuleset(www, h)
+		addRuleset(apex, h)
+		r, mod := h.Rewrite(toURL("http://example.com/a"))
+		assert.True(t, mod)
+		assert.Equal(t, "https://www.example.com/a", r)
+		r, mod = h.Rewrite(toURL("http://www.example.org/a"))
+		assert.True(t, mod)
+		assert.Equal(t, "https://www.example.org/a", r)
+		_, mod = h.Rewrite(toURL("http://sub.example.com/a"))
+		assert.False(t, mod)
+	}
+}
+
+func TestRewriteChaining(t *testing.T) {
+	var redirector = `<ruleset name="Redirector">
+		<target host="go.example.com" />
+		<rule from="^http://go\.example\.com/" to="https://links.example.net/" />
+	</ruleset>`
+	var links = `<ruleset name="Links">
+		<target host="links.example.net" />
+		<rule from="^http://links\.example\.net/" to="https://www.example.org/links/" />
+	</ruleset>`
+	var site = `<ruleset name="Site">
+		<target host="www.example.org" />
+		<rule from="^http://www\.example\.org/" to="https://www.example.org/" />
+	</ruleset>`
 
-	base = "http://www.rabbitmq.com"
-	r, mod = h(toURL(base))
+	h := newEmpty()
+	for _, rs := range []string{redirector, links, site} {
+		addRuleset(rs, h)
+	}
+	r, _ := h.Rewrite(toURL("http://go.example.com/a"))
+	assert.Equal(t, "https://links.example.net/a", r, "shouldn't chain by default")
 
-	assert.True(t, mod, "should have been modified to https")
-	assert.Equal(t, "https://www.rabbitmq.com", r)
+	h = newEmpty(WithRewriteChaining(5))
+	for _, rs := range []string{redirector, links, site} {
+		addRuleset(rs, h)
+	}
+	r, _ = h.Rewrite(toURL("http://go.example.com/a"))
+	assert.Equal(t, "https://www.example.org/links/a", r)
+	result := h.Evaluate(toURL("http://go.example.com/a"))
+	assert.Equal(t, []string{"https://links.example.net/a", "https://www.example.org/links/a"}, result.Chain)
+	assert.Equal(t, "www.example.org", result.Host)
+
+	h = newEmpty(WithRewriteChaining(1))
+	for _, rs := range []string{redirector, links, strings.Replace(site, `to="https://www.`, `to="https://final.`, 1)} {
+		addRuleset(rs, h)
+	}
+	result = h.Evaluate(toURL("http://go.example.com/a"))
+	assert.Equal(t, []string{"https://links.example.net/a", "https://www.example.org/links/a"}, result.Chain, "should stop after max hops")
+
+	h = newEmpty(WithRewriteChaining(5))
+	addRuleset(`<ruleset name="A">
+		<target host="a.example" />
+		<rule from="^http://a\.example/" to="https://b.example/" />
+	</ruleset>`, h)
+	addRuleset(`<ruleset name="B">
+		<target host="b.example" />
+		<rule from="^http://b\.example/" to="https://a.example/" />
+	</ruleset>`, h)
+	result = h.Evaluate(toURL("http://a.example/"))
+	assert.Equal(t, []string{"https://b.example/", "https://a.example/"}, result.Chain, "should stop at loops")
+}
 
-	base = "http://rabbitmq.net"
-	r, mod = h(toURL(base))
+func TestRulesetNotes(t *testing.T) {
+	rs, issues := ValidateRulesetXML([]byte(`<!--
+	Breaks image uploads:
 
-	assert.True(t, mod, "should have been modified to https")
-	assert.Equal(t, "https://rabbitmq.net", r)
+		- upload.example.com
+-->
+<ruleset name="Example" default_off="breaks uploads">
+	<target host="example.com" />
+	<!-- Mixed content on /shop -->
+	<!--  -->
+	<rule from="^http:" to="https:" />
+</ruleset>`))
+	if assert.NotNil(t, rs) {
+		assert.Equal(t, []string{"Breaks image uploads:\n\n\t- upload.example.com", "Mixed content on /shop"}, rs.Notes)
+	}
+	assert.NotEmpty(t, issues, "should still report that the rule set is off")
+
+	rs.Off = ""
+	h := New(WithoutBuiltinRules(), WithRulesets(rs), WithRulesetNotes())
+	assert.Equal(t, rs.Notes, h.RulesetNotes("example.com"))
+	assert.Empty(t, h.RulesetNotes("example.org"))
+	h = New(WithoutBuiltinRules(), WithRulesets(rs))
+	assert.Empty(t, h.RulesetNotes("example.com"), "notes should only be kept when asked to")
 }
 
-func TestIgnoreMultipleSubdomains(t *testing.T) {
-	var testRule = `<ruleset name="RabbitMQ">
-        <target host="*.b.rabbitmq.com" />
+func TestSoftLaunch(t *testing.T) {
+	rulesets := []string{`<ruleset name="Plain">
+		<target host="plain.example" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, `<ruleset name="Excluded">
+		<target host="excluded.example" />
+		<exclusion pattern="^http://excluded\.example/login" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, `<ruleset name="Moved">
+		<target host="*.moved.example" />
+		<rule from="^http://[^/]+/" to="https://cdn.example/" />
+	</ruleset>`}
+	newEngine := func(opts ...Option) *Engine {
+		h := newEmpty(opts...)
+		for _, rs := range rulesets {
+			addRuleset(rs, h)
+		}
+		return h
+	}
 
-        <rule from="^http:"
-                to="https:" />
-</ruleset>`
+	h := newEngine()
+	for in, expected := range map[string]Advisory{
+		"http://plain.example/":      0,
+		"http://excluded.example/":   AdvisoryExclusions,
+		"http://www.moved.example/a": AdvisoryHostMoved | AdvisoryWildcardTarget,
+	} {
+		result := h.Evaluate(toURL(in))
+		assert.True(t, result.Rewritten, in)
+		assert.False(t, result.HeldBack, in)
+		assert.Equal(t, expected, result.Advisories, in)
+	}
+	assert.Equal(t, "host-moved,wildcard-target", (AdvisoryHostMoved | AdvisoryWildcardTarget).String())
 
-	h := newHTTPS(testRule)
-	base := "http://rabbitmq.com"
-	r, mod := h(toURL(base))
+	h = newEngine(WithSoftLaunch(AdvisoryExclusions))
+	_, mod := h.Rewrite(toURL("http://plain.example/"))
+	assert.True(t, mod)
+	_, mod = h.Rewrite(toURL("http://excluded.example/"))
+	assert.True(t, mod, "accepted advisories should be rewritten")
+	_, mod = h.Rewrite(toURL("http://www.moved.example/a"))
+	assert.False(t, mod, "rewrites with other advisories should be held back")
+	result := h.Evaluate(toURL("http://www.moved.example/a"))
+	assert.False(t, result.Rewritten)
+	assert.True(t, result.HeldBack)
+	assert.Equal(t, "https://cdn.example/a", result.URL)
+
+	// The advisories are those of the rule set that rewrote the URL rather
+	// than of the first candidate, and Evaluate counts like Rewrite.
+	rulesets = []string{`<ruleset name="Partial">
+		<target host="www.example.com" />
+		<rule from="^http://www\.example\.com/a" to="https://www.example.com/a" />
+	</ruleset>`, `<ruleset name="Wildcard">
+		<target host="*.example.com" />
+		<exclusion pattern="^http://www\.example\.com/login" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`}
+	h = newEngine()
+	result = h.Evaluate(toURL("http://www.example.com/b"))
+	assert.True(t, result.Rewritten)
+	assert.Equal(t, "Wildcard", result.Ruleset)
+	assert.Equal(t, AdvisoryExclusions|AdvisoryWildcardTarget, result.Advisories)
+	assert.EqualValues(t, 1, h.Stats().Requests)
+	assert.EqualValues(t, 1, h.Stats().Rewritten)
+	h = newEngine(WithSoftLaunch(0))
+	_, mod = h.Rewrite(toURL("http://www.example.com/b"))
+	assert.False(t, mod, "the wildcard rule set's rewrite should be held back")
+	_, mod = h.Rewrite(toURL("http://www.example.com/a"))
+	assert.True(t, mod)
+}
 
-	assert.False(t, mod, "should NOT have been modified to https")
-	assert.Equal(t, "", r)
+func TestMatchLimiter(t *testing.T) {
+	l := NewMatchLimiter(1)
+	h := newEmpty(WithMatchLimiter(l))
+	addRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, h)
+
+	l.acquire()
+	done := make(chan string)
+	go func() {
+		r, _ := h.Rewrite(toURL("http://example.com/"))
+		done <- r
+	}()
+	select {
+	case <-done:
+		assert.Fail(t, "matching should wait for the limiter")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, mod := h.Rewrite(toURL("http://example.org/"))
+	assert.False(t, mod, "misses shouldn't need the limiter")
+	l.release()
+	select {
+	case r := <-done:
+		assert.Equal(t, "https://example.com/", r)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "matching should proceed once the limiter is released")
+	}
+}
+
+func TestRewriteValidation(t *testing.T) {
+	rulesets := `<ruleset name="Broken">
+		<target host="broken.example" />
+		<rule from="^http://broken\.example/" to="https:///" />
+	</ruleset>`
+	h := newEmpty()
+	addRuleset(rulesets, h)
+	r, mod := h.Rewrite(toURL("http://broken.example/a"))
+	assert.True(t, mod, "rewrites shouldn't be validated by default")
+	assert.Equal(t, "https:///a", r)
+
+	h = newEmpty(WithRewriteValidation())
+	addRuleset(rulesets, h)
+	addRuleset(`<ruleset name="Fine">
+		<target host="fine.example" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`, h)
+	_, mod = h.Rewrite(toURL("http://broken.example/a"))
+	assert.False(t, mod, "malformed rewrites should be misses")
+	r, mod = h.Rewrite(toURL("http://fine.example/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://fine.example/a", r)
+
+	d := h.Diagnostics()
+	assert.EqualValues(t, 1, d.InvalidRewrites)
+	if assert.Len(t, d.RecentInvalidRewrites, 1) {
+		ir := d.RecentInvalidRewrites[0]
+		assert.Equal(t, "http://broken.example/a", ir.URL)
+		assert.Equal(t, "https:///a", ir.Result)
+		assert.Equal(t, "host is empty", ir.Reason)
+		assert.Equal(t, []string{"broken.example"}, ir.Targets)
+	}
+
+	assert.Contains(t, invalidRewriteReason("http://example.com/"), "scheme")
+	assert.Equal(t, "", invalidRewriteReason("https://example.com/"))
 }
 
 func TestSimple(t *testing.T) {
@@ -408,7 +2185,7 @@ func TestCNNConflictingRules(t *testing.T) {
 	addRuleset(rule, he)
 	//Preprocessor.AddRuleSet([]byte(rule), hostsToTargets)
 
-	h := he.rewrite
+	h := he.Rewrite
 	base := "http://cnn.com/"
 	_, mod := h(toURL(base))
 
@@ -425,11 +2202,11 @@ func TestMotorTrendFull(t *testing.T) {
 
 // newHTTPS creates a new rewrite instance from a single rule set string.
 func newHTTPS(rules string) Rewrite {
-	return newRawHTTPS(rules).rewrite
+	return newRawHTTPS(rules).Rewrite
 }
 
 // newRawHTTPS creates a new rewrite instance from a single rule set string.
-func newRawHTTPS(rules string) *httpse {
+func newRawHTTPS(rules string) *Engine {
 	//log := golog.LoggerFor("httpseverywhere-test")
 	h := newEmpty()
 
@@ -438,12 +2215,13 @@ func newRawHTTPS(rules string) *httpse {
 	return h
 }
 
-func addRuleset(rules string, h *httpse) {
+// addRuleset adds a single rule set string to the rules already loaded in h.
+func addRuleset(rules string, h *Engine) {
 	rs := unmarshallRuleset(rules)
-	plains := make(map[string]*ruleset)
-	wildcards := radix.New()
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	wildcards := h.wildcardTargets.Load().(*radix.Tree)
 
-	d := newDeserializer()
+	d := h.deserializer()
 	d.addRuleset(rs, plains, wildcards)
 
 	h.plainTargets.Store(plains)
@@ -475,5 +2253,1071 @@ func toURL(urlStr string) *url.URL {
 func newSync() Rewrite {
 	h := newEmpty()
 	h.init()
-	return h.rewrite
+	return h.Rewrite
+}
+
+func TestSlowRulesetQuarantine(t *testing.T) {
+	var testRule = `<ruleset name="Bundler.io">
+		<target host="bundler.io"/>
+		<rule from="^http:" to="https:" />
+	</ruleset>`
+
+	h := newEmpty(WithSlowRulesetQuarantine(time.Hour, 100))
+	addRuleset(testRule, h)
+	for i := 0; i < 200; i++ {
+		_, mod := h.Rewrite(toURL("http://bundler.io"))
+		assert.True(t, mod)
+	}
+	assert.Empty(t, h.Quarantined())
+
+	h = newEmpty(WithSlowRulesetQuarantine(-1, 100))
+	addRuleset(testRule, h)
+	for i := 0; i < 100; i++ {
+		_, mod := h.Rewrite(toURL("http://bundler.io"))
+		assert.True(t, mod)
+	}
+	_, mod := h.Rewrite(toURL("http://bundler.io"))
+	assert.False(t, mod, "slow rule set should have been quarantined")
+	quarantined := h.Quarantined()
+	if assert.Len(t, quarantined, 1) {
+		assert.Equal(t, []string{"bundler.io"}, quarantined[0].Targets)
+		assert.Equal(t, "Bundler.io", quarantined[0].Name)
+	}
+
+	// The quarantine survives rebuilding the indices with new copies of the
+	// rule sets.
+	h = New(WithoutBuiltinRules(), WithRulesets(unmarshallRuleset(testRule)), WithSlowRulesetQuarantine(-1, 100))
+	for i := 0; i < 100; i++ {
+		h.Rewrite(toURL("http://bundler.io"))
+	}
+	assert.Len(t, h.Quarantined(), 1)
+	assert.NoError(t, <-h.Rebuild())
+	h.TrimMemory(TrimAll)
+	_, mod = h.Rewrite(toURL("http://bundler.io"))
+	assert.False(t, mod, "quarantine should survive rebuilds")
+	assert.Len(t, h.Quarantined(), 1)
+
+	// Timings are only kept for a bounded number of rule sets.
+	h = newEmpty(WithSlowRulesetQuarantine(time.Hour, 100))
+	for i := 0; i < quarantineShards*maxTimedPerShard*2; i++ {
+		addRuleset(fmt.Sprintf(`<ruleset name="%d">
+			<target host="%d.example"/>
+			<rule from="^http:" to="https:" />
+		</ruleset>`, i, i), h)
+	}
+	for i := 0; i < quarantineShards*maxTimedPerShard*2; i++ {
+		h.Rewrite(toURL(fmt.Sprintf("http://%d.example/", i)))
+	}
+	timed := 0
+	for i := range h.quarantine.shards {
+		assert.True(t, len(h.quarantine.shards[i].timings) <= maxTimedPerShard)
+		timed += len(h.quarantine.shards[i].timings)
+	}
+	assert.True(t, timed > maxTimedPerShard, "timings should be spread over the shards")
+
+	// A single outlier in a window of 100, like a GC pause, isn't the 99th
+	// percentile, but two are.
+	for outliers, expected := range map[int]bool{1: false, 2: true} {
+		q := newQuarantine(time.Millisecond, 100)
+		r := &ruleset{name: "Outliers", target: []string{"outliers.example"}}
+		for i := 0; i < 100; i++ {
+			dur := time.Microsecond
+			if i < outliers {
+				dur = time.Second
+			}
+			q.record(r, dur, time.Now())
+		}
+		assert.Equal(t, expected, q.isQuarantined(r), "%d outliers", outliers)
+	}
+}
+
+func TestEvaluateHostMovingRule(t *testing.T) {
+	var rule = `<ruleset name="CNN.com (partial)">
+	<target host="*.cnn.com" />
+
+	<rule from="^http://(audience|(?:markets|portfolio)\.money)\.cnn\.com/"
+		to="https://$1.cnn.com/" />
+
+	<rule from="^http://jobsearch\.money\.cnn\.com/(c/|favicon\.ico)"
+		to="https://cnnmoney.jobamatic.com/$1" />
+</ruleset>`
+
+	h := newRawHTTPS(rule)
+
+	result := h.Evaluate(toURL("http://audience.cnn.com/"))
+	assert.True(t, result.Rewritten)
+	assert.Equal(t, "audience.cnn.com", result.Host)
+	assert.False(t, result.HostChanged)
+
+	result = h.Evaluate(toURL("http://jobsearch.money.cnn.com/favicon.ico"))
+	assert.True(t, result.Rewritten)
+	assert.Equal(t, "https://cnnmoney.jobamatic.com/favicon.ico", result.URL)
+	assert.Equal(t, "cnnmoney.jobamatic.com", result.Host)
+	assert.Equal(t, "cnnmoney.jobamatic.com", result.ServerName())
+	assert.True(t, result.HostChanged)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://jobsearch.money.cnn.com/favicon.ico", nil)
+	assert.NoError(t, result.ApplyTo(req))
+	assert.Equal(t, "cnnmoney.jobamatic.com", req.Host)
+	assert.Equal(t, "https://cnnmoney.jobamatic.com/favicon.ico", req.URL.String())
+
+	result = h.Evaluate(toURL("http://cnn.com/"))
+	assert.False(t, result.Rewritten)
+	req, _ = http.NewRequest(http.MethodGet, "http://cnn.com/", nil)
+	assert.NoError(t, result.ApplyTo(req))
+	assert.Equal(t, "cnn.com", req.Host)
+}
+
+func TestNewOptions(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "data.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(data)
+	gz.Close()
+
+	for _, d := range [][]byte{data, gzipped.Bytes()} {
+		h := New(WithRulesData(d), WithLogger(golog.LoggerFor("test")), WithStatsDisabled())
+		assert.Equal(t, 1, h.LoadStats().Loaded)
+		r, _ := h.Rewrite(toURL("http://data.example/"))
+		assert.Equal(t, "https://data.example/", r)
+		_, mod := h.Rewrite(toURL("http://forms.preston.gov.uk/"))
+		assert.False(t, mod, "built-in rules shouldn't have been loaded")
+		assert.Zero(t, h.stats.runs, "stats shouldn't have been collected")
+	}
+
+	h := New(WithAsyncInit(), WithRulesData(data))
+	for h.LoadStats().Loaded == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	r, _ := h.Rewrite(toURL("http://data.example/"))
+	assert.Equal(t, "https://data.example/", r)
+
+	h = New(WithRulesData(data), WithStats(false))
+	h.Rewrite(toURL("http://data.example/"))
+	assert.Zero(t, h.stats.runs)
+}
+
+func TestWildcardReport(t *testing.T) {
+	h := newEmpty(WithoutBuiltinRules(), WithRulesets(
+		unmarshallRuleset(`<ruleset name="Example">
+			<target host="example.com" />
+			<target host="www.example.com" />
+			<target host="a.example.com" />
+			<target host="example.b.example.com" />
+			<target host="*.example.com" />
+			<target host="example.*" />
+			<rule from="^http:" to="https:" />
+		</ruleset>`),
+		unmarshallRuleset(`<ruleset name="Other">
+			<target host="other.org" />
+			<target host="*.other.org" />
+			<rule from="^http:" to="https:" />
+		</ruleset>`)))
+	h.init()
+
+	report := h.WildcardReport()
+	assert.Equal(t, 2, report.PrefixKeys)
+	assert.Equal(t, 1, report.SuffixKeys)
+	assert.Equal(t, []WildcardKeyStats{
+		{Target: "*.example.com", Hosts: 3},
+		{Target: "example.*", Hosts: 2},
+		{Target: "*.other.org", Hosts: 0},
+	}, report.Keys)
+	assert.Equal(t, 4, report.ShadowedByPlain)
+	assert.Equal(t, []WildcardOverlap{{Host: "example.b.example.com", Prefix: "*.example.com", Suffix: "example.*"}}, report.Overlaps)
+}
+
+func TestNewFromXML(t *testing.T) {
+	rewrite, err := NewFromXML([]byte(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http://example\.com/(\w+)" to="https://example.com/$1" />
+	</ruleset>`), []byte(`<ruleset name="Example Org">
+		<target host="*.example.org" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, _ := rewrite(toURL("http://example.com/a"))
+	assert.Equal(t, "https://example.com/a", r)
+	r, _ = rewrite(toURL("http://www.example.org/"))
+	assert.Equal(t, "https://www.example.org/", r)
+	_, mod := rewrite(toURL("http://forms.preston.gov.uk/"))
+	assert.False(t, mod, "built-in rules shouldn't have been loaded")
+
+	_, err = NewFromXML([]byte(`<ruleset name="Lookahead">
+		<target host="example.com" />
+		<rule from="^http://example\.com/(?!a)" to="https://example.com/" />
+	</ruleset>`))
+	assert.Error(t, err)
+	_, err = NewFromXML([]byte(`<ruleset`))
+	assert.Error(t, err)
+}
+
+func TestNewFromGob(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "gob.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	rewrite, err := NewFromGob(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, mod := rewrite(toURL("http://gob.example/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://gob.example/a", r)
+	_, mod = rewrite(toURL("http://forms.preston.gov.uk/"))
+	assert.False(t, mod, "built-in rules shouldn't have been loaded")
+
+	_, err = NewFromGob(strings.NewReader("not a bundle"))
+	assert.Error(t, err)
+	empty, _ := encodeRulesets([]*Ruleset{})
+	_, err = NewFromGob(bytes.NewReader(empty))
+	assert.Error(t, err)
+}
+
+func TestLegacyGobRules(t *testing.T) {
+	// Older preprocessors wrote a single []*Ruleset rather than a stream.
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode([]*Ruleset{{
+		Target: []*Target{{Host: "legacy.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, isStreamRules(buf.Bytes()))
+	rulesets, err := DecodeRulesData(buf.Bytes())
+	if assert.NoError(t, err) && assert.Len(t, rulesets, 1) {
+		assert.Equal(t, "legacy.example", rulesets[0].Target[0].Host)
+	}
+	h := New(WithRulesData(buf.Bytes()))
+	r, mod := h.Rewrite(toURL("http://legacy.example/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://legacy.example/a", r)
+}
+
+func TestOnBundleSwap(t *testing.T) {
+	bundle := func(host string) []byte {
+		data, err := encodeRulesets([]*Ruleset{{
+			Target: []*Target{{Host: host}},
+			Rule:   []*Rule{{From: "^http:", To: "https:"}},
+		}})
+		assert.NoError(t, err)
+		return data
+	}
+	first, second := bundle("first.example"), bundle("second.example")
+	h := New(WithRulesData(first))
+
+	var swaps [][2]BundleInfo
+	unsubscribe := h.OnBundleSwap(func(old, new BundleInfo) {
+		_, mod := h.Rewrite(toURL("http://second.example/"))
+		assert.True(t, mod, "new rules should be in use when notified")
+		swaps = append(swaps, [2]BundleInfo{old, new})
+	})
+	assert.NoError(t, <-h.UpdateRulesData(second))
+	if assert.Len(t, swaps, 1) {
+		assert.Equal(t, BundleInfo{Version: rulesVersion(first), Generation: 1, Rulesets: 1}, swaps[0][0])
+		assert.Equal(t, BundleInfo{Version: rulesVersion(second), Generation: 2, Rulesets: 1}, swaps[0][1])
+	}
+
+	unsubscribe()
+	assert.NoError(t, <-h.UpdateRulesData(first))
+	assert.Len(t, swaps, 1, "unsubscribed functions shouldn't be called")
+}
+
+func TestRebuild(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "bundle.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := New(WithRulesData(data), WithRulesets(&Ruleset{
+		Target: []*Target{{Host: "custom.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}))
+	var swapped bool
+	h.OnBundleSwap(func(old, new BundleInfo) {
+		swapped = true
+	})
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+
+	assert.NoError(t, <-h.Rebuild())
+	assert.EqualValues(t, 2, h.Generation())
+	assert.False(t, swapped, "rebuilding shouldn't count as a bundle swap")
+	rebuilt := h.plainTargets.Load().(map[string]*ruleset)
+	assert.Len(t, rebuilt, 2)
+	assert.False(t, plains["bundle.example"] == rebuilt["bundle.example"], "indices should have been rebuilt")
+	for _, host := range []string{"bundle.example", "custom.example"} {
+		_, mod := h.Rewrite(toURL("http://" + host + "/"))
+		assert.True(t, mod, host)
+	}
+	assert.EqualValues(t, 2, h.Diagnostics().Load.Rulesets)
+}
+
+func TestLazyCompilation(t *testing.T) {
+	upgrade := func(host string) *Ruleset {
+		return &Ruleset{
+			Target:    []*Target{{Host: host}},
+			Exclusion: []*Exclusion{{Pattern: `^http://[^/]+/login`}},
+			Rule:      []*Rule{{From: "^http:", To: "https:"}},
+		}
+	}
+	h := New(WithoutBuiltinRules(), WithLazyCompilation(), WithRulesets(upgrade("used.example"), upgrade("unused.example")))
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	used, unused := plains["used.example"], plains["unused.example"]
+	assert.Empty(t, used.rule, "rules shouldn't be compiled while loading")
+	assert.Empty(t, used.exclusion, "exclusions shouldn't be compiled while loading")
+
+	r, mod := h.Rewrite(toURL("http://used.example/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://used.example/a", r)
+	_, mod = h.Rewrite(toURL("http://used.example/login"))
+	assert.False(t, mod)
+	assert.Len(t, used.rule, 1)
+	assert.Len(t, used.exclusion, 1)
+	assert.Empty(t, unused.rule, "unused rule sets shouldn't be compiled")
+}
+
+func TestRulesHeader(t *testing.T) {
+	payload, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "header.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := withRulesHeader(payload, time.Unix(1, 0))
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(data)
+	gz.Close()
+	for _, d := range [][]byte{data, gzipped.Bytes()} {
+		h := New(WithRulesData(d))
+		_, mod := h.Rewrite(toURL("http://header.example/"))
+		assert.True(t, mod)
+		assert.Equal(t, rulesVersion(payload), h.RulesVersion(), "version shouldn't depend on the header")
+	}
+
+	decode := func(data []byte) error {
+		d := newDeserializer()
+		d.data = data
+		_, err := d.decode()
+		return err
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	var checksumErr *ChecksumError
+	assert.True(t, errors.As(decode(corrupt), &checksumErr), "corrupt rules should fail the checksum")
+	_, err = decodeRulesData(corrupt)
+	assert.True(t, errors.As(err, &checksumErr))
+
+	newer := append([]byte(nil), data...)
+	newer[9]++
+	var schemaErr *SchemaVersionError
+	if assert.True(t, errors.As(decode(newer), &schemaErr), "unknown schema versions should be rejected") {
+		assert.Equal(t, RulesSchemaVersion+1, schemaErr.Version)
+	}
+
+	assert.NoError(t, decode(payload), "rules without a header should still load")
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "compressed.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// A trivial format that just prefixes the data with its magic.
+	magic := []byte("stored\x00")
+	RegisterDecompressor(magic, func(r io.Reader) (io.ReadCloser, error) {
+		if _, err := io.ReadFull(r, make([]byte, len(magic))); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(r), nil
+	})
+	stored := append(append([]byte(nil), magic...), data...)
+
+	h := New(WithRulesData(stored))
+	r, mod := h.Rewrite(toURL("http://compressed.example/a"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://compressed.example/a", r)
+	assert.Equal(t, rulesVersion(data), h.RulesVersion(), "version should be that of the decompressed data")
+}
+
+// countingStore counts the lookups made in a RulesetStore.
+type countingStore struct {
+	RulesetStore
+	lookups int32
+}
+
+func (s *countingStore) Rulesets(target string) ([]*Ruleset, error) {
+	atomic.AddInt32(&s.lookups, 1)
+	return s.RulesetStore.Rulesets(target)
+}
+
+func TestRulesetStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rulesets.idx")
+	data := encodeRulesetsIndexed([]*Ruleset{{
+		Target: []*Target{{Host: "plain.example"}, {Host: "*.prefix.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}, {
+		Target: []*Target{{Host: "suffix.*"}},
+		Rule:   []*Rule{{From: `^http://suffix\.(\w+)/`, To: "https://www.suffix.$1/"}},
+	}, {
+		Off:    "broken",
+		Target: []*Target{{Host: "off.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, ioutil.WriteFile(path, data, 0644)) {
+		return
+	}
+	file, err := OpenRulesetFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
+	assert.Len(t, file.byTarget, 4, "only targets should be indexed up front")
+	store := &countingStore{RulesetStore: file}
+	h := New(WithRulesetStore(store, 100))
+	assert.True(t, h.IsCovered("a.prefix.example"))
+	assert.False(t, h.IsCovered("off.example"))
+
+	tests := map[string]string{
+		"http://plain.example/a":       "https://plain.example/a",
+		"http://a.b.prefix.example/a":  "https://a.b.prefix.example/a",
+		"http://suffix.org/a":          "https://www.suffix.org/a",
+		"http://off.example/a":         "",
+		"http://forms.preston.gov.uk/": "",
+	}
+	for in, expected := range tests {
+		r, _ := h.Rewrite(toURL(in))
+		assert.Equal(t, expected, r, in)
+	}
+
+	lookups := atomic.LoadInt32(&store.lookups)
+	r, _ := h.Rewrite(toURL("http://plain.example/b"))
+	assert.Equal(t, "https://plain.example/b", r)
+	assert.Equal(t, lookups, atomic.LoadInt32(&store.lookups), "compiled rule sets should be cached")
+
+	_, err = OpenRulesetFile(filepath.Join("test", "Facebook.xml"))
+	assert.Error(t, err)
+}
+
+func TestNewFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"good.xml": `<ruleset name="Good">
+			<target host="good.example" />
+			<rule from="^http:" to="https:" />
+		</ruleset>`,
+		"off.xml": `<ruleset name="Off" default_off="broken">
+			<target host="off.example" />
+			<rule from="^http:" to="https:" />
+		</ruleset>`,
+		"broken.xml": `<ruleset`,
+		"README":     "not a rule set",
+	}
+	for name, content := range files {
+		if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)) {
+			return
+		}
+	}
+
+	rewrite, fileErrors, err := NewFromDirectory(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, mod := rewrite(toURL("http://good.example/"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://good.example/", r)
+	_, mod = rewrite(toURL("http://off.example/"))
+	assert.False(t, mod)
+	if assert.Len(t, fileErrors, 2) {
+		assert.Equal(t, filepath.Join(dir, "broken.xml"), fileErrors[0].File)
+		assert.Equal(t, filepath.Join(dir, "off.xml"), fileErrors[1].File)
+		assert.Contains(t, fileErrors[1].Error(), "default_off")
+	}
+
+	_, _, err = NewFromDirectory(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestAutoUpdate(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "updated.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rules.gob" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+	withTestClient := WithHTTPClient(srv.Client())
+
+	updated := make(chan int64, 1)
+	failed := make(chan error, 1)
+	hooks := WithUpdateHooks(func(generation int64) { updated <- generation }, func(err error) { failed <- err })
+	h := New(WithoutBuiltinRules(), WithAutoUpdate(srv.URL+"/rules.gob", time.Hour), withTestClient, hooks)
+	select {
+	case generation := <-updated:
+		assert.EqualValues(t, 2, generation)
+	case err := <-failed:
+		assert.Fail(t, "update failed", err)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "update timed out")
+	}
+	r, mod := h.Rewrite(toURL("http://updated.example/"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://updated.example/", r)
+
+	New(WithoutBuiltinRules(), WithAutoUpdate(srv.URL+"/missing.gob", time.Hour), withTestClient, hooks)
+	select {
+	case err := <-failed:
+		assert.Contains(t, err.Error(), "404")
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "update didn't fail")
+	}
+
+	New(WithoutBuiltinRules(), WithAutoUpdate("http"+strings.TrimPrefix(srv.URL, "https")+"/rules.gob", time.Hour), hooks)
+	select {
+	case err := <-failed:
+		assert.Contains(t, err.Error(), "only https")
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "update didn't fail")
+	}
+}
+
+func TestAutoUpdateInterval(t *testing.T) {
+	var requests int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		atomic.StoreInt32(&requests, 0)
+		failed := make(chan error, 1)
+		h := New(WithoutBuiltinRules(), WithAutoUpdate(srv.URL, interval), WithHTTPClient(srv.Client()),
+			WithUpdateHooks(nil, func(err error) { failed <- err }))
+		assert.Equal(t, minUpdateInterval, h.updater.interval, "interval should be clamped")
+		select {
+		case <-failed:
+		case <-time.After(10 * time.Second):
+			assert.Fail(t, "update didn't run")
+		}
+		time.Sleep(50 * time.Millisecond)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&requests), "rules shouldn't be downloaded in a loop")
+		h.Close()
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	requested := make(chan string, 1)
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested <- req.URL.String()
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})}
+	New(WithoutBuiltinRules(), WithHTTPClient(client), WithAutoUpdate("https://rules.example/rules.gob", time.Hour))
+	select {
+	case u := <-requested:
+		assert.Equal(t, "https://rules.example/rules.gob", u)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "update didn't use client")
+	}
+}
+
+func TestConditionalUpdates(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "updated.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	other, _ := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "other.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	statuses := make(chan int, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			statuses <- http.StatusNotModified
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(data)
+		statuses <- http.StatusOK
+	}))
+	defer srv.Close()
+
+	statePath := filepath.Join(t.TempDir(), "update.json")
+	update := func(rulesData []byte) (*Engine, int) {
+		updated := make(chan int64, 1)
+		h := New(WithRulesData(rulesData), WithAutoUpdate(srv.URL, time.Hour), WithUpdateStateFile(statePath),
+			WithUpdateHooks(func(generation int64) { updated <- generation }, nil), WithHTTPClient(srv.Client()))
+		select {
+		case <-updated:
+		case <-time.After(10 * time.Second):
+			assert.Fail(t, "update timed out")
+		}
+		return h, <-statuses
+	}
+
+	h, status := update(other)
+	assert.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 2, h.Generation())
+	assert.FileExists(t, statePath)
+
+	h, status = update(data)
+	assert.Equal(t, http.StatusNotModified, status, "restart with downloaded rules should send validators")
+	assert.EqualValues(t, 1, h.Generation(), "rules shouldn't be reloaded")
+
+	_, status = update(other)
+	assert.Equal(t, http.StatusOK, status, "validators shouldn't be sent for other rules")
+}
+
+func TestRulesCacheDir(t *testing.T) {
+	bundle := func(host string) []byte {
+		data, err := encodeRulesets([]*Ruleset{{
+			Target: []*Target{{Host: host}},
+			Rule:   []*Rule{{From: "^http:", To: "https:"}},
+		}})
+		assert.NoError(t, err)
+		return data
+	}
+	rewrites := func(h *Engine, host string) bool {
+		_, mod := h.Rewrite(toURL("http://" + host + "/"))
+		return mod
+	}
+	bundles := func(dir string) []string {
+		matches, _ := filepath.Glob(filepath.Join(dir, "rules-*.gob"))
+		return matches
+	}
+	dir := t.TempDir()
+	base := bundle("base.example")
+	other := filepath.Join(dir, "other.gob")
+	assert.NoError(t, ioutil.WriteFile(other, base, 0644))
+
+	h := New(WithRulesData(base), WithRulesCacheDir(dir))
+	assert.True(t, rewrites(h, "base.example"))
+	assert.Empty(t, bundles(dir), "nothing should be cached before an update")
+	for _, host := range []string{"first.example", "second.example", "third.example"} {
+		assert.NoError(t, <-h.UpdateRulesData(bundle(host)))
+	}
+	assert.Len(t, bundles(dir), 2, "older bundles should be evicted")
+	assert.FileExists(t, other, "files not written by the cache shouldn't be evicted")
+
+	h = New(WithRulesData(base), WithRulesCacheDir(dir))
+	assert.True(t, rewrites(h, "third.example"), "should prefer cached rules")
+	assert.False(t, rewrites(h, "base.example"))
+	assert.Equal(t, rulesVersion(bundle("third.example")), h.RulesVersion())
+
+	h = New(WithRulesData(bundle("newer.example")), WithRulesCacheDir(dir))
+	assert.True(t, rewrites(h, "newer.example"), "shouldn't use rules cached for other configured rules")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, bundleFile(rulesVersion(bundle("third.example")))), bundle("corrupt.example"), 0644))
+	h = New(WithRulesData(base), WithRulesCacheDir(dir))
+	assert.True(t, rewrites(h, "base.example"), "shouldn't use corrupt cached rules")
+
+	// A bundle that matches its version but can't be decoded isn't used either.
+	invalid := []byte("not a bundle")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, bundleFile(rulesVersion(invalid))), invalid, 0644))
+	current, err := json.Marshal(&cachedRules{Version: rulesVersion(invalid), Base: rulesVersion(base)})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "current.json"), current, 0644))
+	h = New(WithRulesData(base), WithRulesCacheDir(dir))
+	assert.True(t, rewrites(h, "base.example"), "shouldn't use invalid cached rules")
+	assert.Equal(t, rulesVersion(base), h.RulesVersion())
+
+	// Nor is one without any rule sets.
+	empty, err := encodeRulesets(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, bundleFile(rulesVersion(empty))), empty, 0644))
+	current, err = json.Marshal(&cachedRules{Version: rulesVersion(empty), Base: rulesVersion(base)})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "current.json"), current, 0644))
+	h = New(WithRulesData(base), WithRulesCacheDir(dir))
+	assert.True(t, rewrites(h, "base.example"), "shouldn't use empty cached rules")
+	assert.Equal(t, rulesVersion(base), h.RulesVersion())
+}
+
+func TestRulesDelta(t *testing.T) {
+	upgrade := func(host string) *Ruleset {
+		return &Ruleset{
+			Target: []*Target{{Host: host}},
+			Rule:   []*Rule{{From: "^http:", To: "https:"}},
+		}
+	}
+	var unchanged []*Ruleset
+	for i := 0; i < 100; i++ {
+		unchanged = append(unchanged, upgrade(fmt.Sprintf("unchanged%d.example", i)))
+	}
+	oldRulesets := append([]*Ruleset{upgrade("a.example"), upgrade("b.example"), upgrade("c.example")}, unchanged...)
+	old, err := encodeRulesets(oldRulesets)
+	if !assert.NoError(t, err) {
+		return
+	}
+	changed := upgrade("c.example")
+	changed.Exclusion = []*Exclusion{{Pattern: "^http://c\\.example/excluded"}}
+	updatedRulesets := append([]*Ruleset{upgrade("a.example"), changed}, unchanged...)
+	updated, err := encodeRulesets(append(updatedRulesets, upgrade("e.example")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	delta, err := DiffRulesData(old, updated)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(delta) < len(updated), "delta should be smaller than full rules")
+
+	h := New(WithRulesData(old))
+	assert.Equal(t, rulesVersion(old), h.RulesVersion())
+	assert.NoError(t, <-h.ApplyRulesDelta(delta))
+	assert.Equal(t, rulesVersion(updated), h.RulesVersion())
+	assert.EqualValues(t, 2, h.Generation())
+	for host, expected := range map[string]bool{"a.example": true, "b.example": false, "c.example": true, "unchanged99.example": true, "e.example": true} {
+		_, mod := h.Rewrite(toURL("http://" + host + "/"))
+		assert.Equal(t, expected, mod, host)
+	}
+	_, mod := h.Rewrite(toURL("http://c.example/excluded"))
+	assert.False(t, mod)
+	assert.Error(t, <-h.ApplyRulesDelta(delta), "delta should no longer apply")
+	assert.Error(t, <-h.ApplyRulesDelta([]byte("not a delta")))
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(RulesVersionHeader) == rulesVersion(old) {
+			w.Header().Set("Content-Type", DeltaContentType)
+			w.Write(delta)
+			return
+		}
+		w.Write(updated)
+	}))
+	defer srv.Close()
+	updatedCh := make(chan int64, 1)
+	h = New(WithRulesData(old), WithAutoUpdate(srv.URL, time.Hour), WithUpdateHooks(func(generation int64) { updatedCh <- generation }, nil), WithHTTPClient(srv.Client()))
+	select {
+	case <-updatedCh:
+		assert.Equal(t, rulesVersion(updated), h.RulesVersion())
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "update timed out")
+	}
+}
+
+func TestBenchmarkSelf(t *testing.T) {
+	h := newRawHTTPS(`<ruleset name="Example">
+		<target host="example.com" />
+		<target host="www.example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	report := h.BenchmarkSelf(100)
+	assert.Equal(t, 100, report.Hit.Requests)
+	assert.Equal(t, 100, report.Hit.Rewritten)
+	assert.Equal(t, 100, report.Miss.Requests)
+	assert.Equal(t, 0, report.Miss.Rewritten)
+	for _, result := range []BenchmarkResult{report.Hit, report.Miss} {
+		assert.True(t, result.P50 <= result.P99)
+		assert.True(t, result.P99 <= result.Max)
+		assert.True(t, result.Max <= result.Elapsed)
+	}
+
+	report = newEmpty().BenchmarkSelf(10)
+	assert.Equal(t, 0, report.Hit.Requests, "no hosts to hit")
+	assert.Equal(t, 10, report.Miss.Requests)
+}
+
+func TestNewFromRulesFile(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "mapped.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	path := filepath.Join(t.TempDir(), "rules.gob")
+	if !assert.NoError(t, ioutil.WriteFile(path, data, 0644)) {
+		return
+	}
+	h, err := NewFromRulesFile(path, WithStatsDisabled())
+	if !assert.NoError(t, err) {
+		return
+	}
+	r, mod := h.Rewrite(toURL("http://mapped.example/"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://mapped.example/", r)
+	_, mod = h.Rewrite(toURL("http://forms.preston.gov.uk/"))
+	assert.False(t, mod, "built-in rules shouldn't have been loaded")
+	assert.Len(t, h.releases, 1, "the file should be unmapped on Close")
+	assert.NoError(t, h.Close())
+	_, mod = h.Rewrite(toURL("http://mapped.example/"))
+	assert.False(t, mod)
+	assert.Empty(t, h.RulesVersion(), "the unmapped rules shouldn't be read")
+
+	empty := filepath.Join(t.TempDir(), "empty.gob")
+	assert.NoError(t, ioutil.WriteFile(empty, nil, 0644))
+	_, err = NewFromRulesFile(empty)
+	assert.Error(t, err)
+	_, err = NewFromRulesFile(filepath.Join(t.TempDir(), "missing.gob"))
+	assert.Error(t, err)
+}
+
+func TestUpdateRulesData(t *testing.T) {
+	bundle := func(host string) []byte {
+		data, err := encodeRulesets([]*Ruleset{{
+			Target: []*Target{{Host: host}},
+			Rule:   []*Rule{{From: "^http:", To: "https:"}},
+		}})
+		assert.NoError(t, err)
+		return data
+	}
+	rewrite := func(h *Engine, host string) *RewriteResult {
+		return h.Evaluate(toURL("http://" + host + "/"))
+	}
+
+	h := New(WithRulesData(bundle("old.example")))
+	assert.EqualValues(t, 1, h.Generation())
+	result := rewrite(h, "old.example")
+	assert.True(t, result.Rewritten)
+	assert.EqualValues(t, 1, result.Generation)
+
+	assert.NoError(t, <-h.UpdateRulesData(bundle("new.example")))
+	assert.EqualValues(t, 2, h.Generation())
+	assert.False(t, rewrite(h, "old.example").Rewritten)
+	result = rewrite(h, "new.example")
+	assert.True(t, result.Rewritten)
+	assert.EqualValues(t, 2, result.Generation)
+
+	assert.Error(t, <-h.UpdateRulesData([]byte("not a bundle")))
+	off, _ := encodeRulesets([]*Ruleset{{Off: "broken", Target: []*Target{{Host: "off.example"}}}})
+	assert.Error(t, <-h.UpdateRulesData(off), "bundle without usable rule sets should be rejected")
+	assert.EqualValues(t, 2, h.Generation())
+	assert.True(t, rewrite(h, "new.example").Rewritten, "should keep using the current rules when an update fails")
+}
+
+func TestInitDeadline(t *testing.T) {
+	h := New(WithInitDeadline(time.Nanosecond))
+	stats := h.LoadStats()
+	assert.True(t, stats.LoadedByDeadline < stats.Rulesets || stats.Rulesets == 0, "shouldn't have loaded everything within a nanosecond")
+
+	for h.LoadStats().Loaded == 0 || h.LoadStats().Loaded < h.LoadStats().Rulesets {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r, mod := h.Rewrite(toURL("http://forms.preston.gov.uk/"))
+	assert.True(t, mod)
+	assert.Equal(t, "https://forms.preston.gov.uk/", r)
+
+	h = New(WithInitDeadline(time.Minute))
+	stats = h.LoadStats()
+	assert.True(t, stats.Rulesets > 0)
+	assert.Equal(t, stats.Rulesets, stats.Loaded)
+	assert.Equal(t, stats.Rulesets, stats.LoadedByDeadline)
+}
+
+func TestBatcher(t *testing.T) {
+	h := newRawHTTPS(`<ruleset name="Bundler.io">
+		<target host="bundler.io"/>
+		<target host="*.bundler.io"/>
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+	b := h.NewBatcher(16, time.Millisecond)
+
+	urls := []string{"http://bundler.io/", "http://www.bundler.io/a", "http://example.com/", "https://bundler.io/"}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := toURL(urls[i%len(urls)])
+			expected, expectedOK := h.Rewrite(u)
+			r, ok := b.Rewrite(u)
+			assert.Equal(t, expectedOK, ok)
+			assert.Equal(t, expected, r)
+		}(i)
+	}
+	wg.Wait()
+	b.Close()
+
+	r, ok := b.Rewrite(toURL("http://bundler.io/"))
+	assert.False(t, ok, "URLs shouldn't be rewritten after Close")
+	assert.Empty(t, r)
+	b.Close()
+}
+
+func TestReady(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "data.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := New(WithAsyncInit(), WithRulesData(data), WithStatsDisabled())
+	<-h.Ready()
+	r, _ := h.Rewrite(toURL("http://data.example/"))
+	assert.Equal(t, "https://data.example/", r, "rules should have loaded when ready")
+	assert.NoError(t, h.WaitReady(context.Background()))
+
+	h = New(WithAsyncInit(), WithRulesData([]byte("garbage")), WithStatsDisabled())
+	assert.Error(t, h.WaitReady(context.Background()), "should report failing to load")
+
+	h = newEmpty(WithStatsDisabled())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, h.WaitReady(ctx), "shouldn't be ready before loading")
+}
+
+func TestClose(t *testing.T) {
+	data, err := encodeRulesets([]*Ruleset{{
+		Target: []*Target{{Host: "data.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := New(WithRulesData(data), WithLookupCache(10, 10))
+	_, mod := h.Rewrite(toURL("http://data.example/"))
+	assert.True(t, mod)
+
+	assert.NoError(t, h.Close())
+	assert.NoError(t, h.Close(), "closing again should have no effect")
+	_, mod = h.Rewrite(toURL("http://data.example/"))
+	assert.False(t, mod, "rules should have been released")
+	assert.Equal(t, ErrClosed, <-h.UpdateRulesData(data))
+	assert.Equal(t, ErrClosed, <-h.Rebuild())
+	h.Prefetch("data.example")
+
+	// Closing while loading cancels it.
+	h = New(WithAsyncInit())
+	assert.NoError(t, h.Close())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = h.WaitReady(ctx)
+	assert.True(t, err == nil || err == ErrClosed, "unexpected error %v", err)
+	_, mod = h.Rewrite(toURL("http://forms.preston.gov.uk/"))
+	assert.False(t, mod, "rules shouldn't be used after closing")
+
+	// Closing releases the files the rules are mapped from and stops saving
+	// broken paths.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.gob")
+	indexedPath := filepath.Join(dir, "indexed.gob")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+	assert.NoError(t, ioutil.WriteFile(indexedPath, encodeRulesetsIndexed([]*Ruleset{{
+		Target: []*Target{{Host: "store.example"}},
+		Rule:   []*Rule{{From: "^http:", To: "https:"}},
+	}}), 0644))
+	prefs := &memoryPreferences{}
+	h, err = NewFromRulesFile(path, WithPreferencesStore(prefs))
+	if !assert.NoError(t, err) {
+		return
+	}
+	file, err := OpenRulesetFile(indexedPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stored := New(WithRulesetStore(file, 10))
+	_, mod = h.Rewrite(toURL("http://data.example/"))
+	assert.True(t, mod)
+	_, mod = stored.Rewrite(toURL("http://store.example/"))
+	assert.True(t, mod)
+	assert.NoError(t, h.ReportBrokenPath(BrokenPath{Host: "data.example", Path: "/login"}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.Rewrite(toURL("http://data.example/"))
+				stored.Rewrite(toURL("http://store.example/"))
+			}
+		}()
+	}
+	assert.NoError(t, h.Close())
+	assert.NoError(t, stored.Close())
+	wg.Wait()
+	assert.NoError(t, file.Close(), "closing the store again should have no effect")
+
+	for _, u := range []string{"http://data.example/", "http://store.example/"} {
+		_, mod = h.Rewrite(toURL(u))
+		assert.False(t, mod, u)
+		_, mod = stored.Rewrite(toURL(u))
+		assert.False(t, mod, u)
+		assert.False(t, h.Evaluate(toURL(u)).Rewritten, u)
+		assert.Empty(t, h.Explain(toURL(u)).Candidates, u)
+	}
+	assert.Equal(t, ErrClosed, h.ReportBrokenPath(BrokenPath{Host: "data.example", Path: "/"}))
+	assert.Equal(t, ErrClosed, h.RemoveBrokenPaths("data.example"))
+	assert.Len(t, prefs.paths, 1, "broken paths shouldn't be saved after closing")
+	assert.NoError(t, os.Remove(path))
+	assert.NoError(t, os.Remove(indexedPath))
+}
+
+func TestTrimMemory(t *testing.T) {
+	upgrade := func(host string) *Ruleset {
+		return &Ruleset{
+			Target: []*Target{{Host: host}},
+			Rule:   []*Rule{{From: "^http:", To: "https:"}},
+		}
+	}
+	h := New(WithoutBuiltinRules(), WithLazyCompilation(), WithLookupCache(10, 10),
+		WithRulesets(upgrade("hot.example"), upgrade("cold.example")))
+	rewrite := func(host string) {
+		r, _ := h.Rewrite(toURL("http://" + host + "/"))
+		assert.Equal(t, "https://"+host+"/", r)
+	}
+	rewrite("hot.example")
+	rewrite("cold.example")
+	assert.Equal(t, 2, h.cache.positive.len())
+
+	h.TrimMemory(TrimCaches)
+	assert.Equal(t, 0, h.cache.positive.len(), "caches should have been dropped")
+
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	h.TrimMemory(TrimRules)
+	assert.True(t, plains["cold.example"] == h.plainTargets.Load().(map[string]*ruleset)["cold.example"],
+		"rules used since compiling shouldn't be released")
+	rewrite("hot.example")
+	h.TrimMemory(TrimRules)
+	trimmed := h.plainTargets.Load().(map[string]*ruleset)
+	assert.True(t, plains["hot.example"] == trimmed["hot.example"], "rules used since the last trim should be kept")
+	assert.False(t, plains["cold.example"] == trimmed["cold.example"], "cold rules should have been released")
+	assert.Empty(t, trimmed["cold.example"].rule)
+	rewrite("cold.example")
+	assert.Len(t, trimmed["cold.example"].rule, 1, "released rules should be compiled again")
+
+	h.TrimMemory(TrimAll)
+	rewrite("hot.example")
+	rewrite("cold.example")
 }
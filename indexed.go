@@ -0,0 +1,126 @@
+package httpseverywhere
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// indexedMagic is the header that rules in the indexed format written with
+// WithIndexedFormat start with. It's followed by each rule set as a length
+// prefixed head and a length prefixed body, both Ruleset messages as described
+// by rulesets.proto. The head holds what's needed to index the rule set, the
+// body its rules and exclusions, which loading skips over.
+var indexedMagic = []byte("HTTPSEix")
+
+// encodeRulesetsIndexed serializes the given rule sets in the indexed format.
+func encodeRulesetsIndexed(rules []*Ruleset) []byte {
+	buf := append([]byte(nil), indexedMagic...)
+	for _, rs := range rules {
+		head := encodeRulesetProto(&Ruleset{
+			Name:      rs.Name,
+			Off:       rs.Off,
+			Platform:  rs.Platform,
+			Target:    rs.Target,
+			PathScope: rs.PathScope,
+			Notes:     rs.Notes,
+			Exclusive: rs.Exclusive,
+			File:      rs.File,
+			Source:    rs.Source,
+		})
+		body := encodeRulesetProto(&Ruleset{
+			Exclusion: rs.Exclusion,
+			Rule:      rs.Rule,
+		})
+		buf = appendUvarint(buf, uint64(len(head)))
+		buf = append(buf, head...)
+		buf = appendUvarint(buf, uint64(len(body)))
+		buf = append(buf, body...)
+	}
+	return buf
+}
+
+// isIndexedRules returns whether or not the given data is in the indexed
+// format.
+func isIndexedRules(data []byte) bool {
+	return bytes.HasPrefix(data, indexedMagic)
+}
+
+// decodeRulesetsIndexed decodes the heads of the rule sets in the given
+// indexed data. Unless full is set, their bodies are left undecoded, referring
+// to data, so data must not be modified afterwards.
+func decodeRulesetsIndexed(data []byte, full bool) ([]*Ruleset, error) {
+	rulesets := make([]*Ruleset, 0)
+	err := eachIndexedRuleset(data, func(offset int, head []byte, body []byte) error {
+		rs, err := decodeIndexedRuleset(head, body, full)
+		if err != nil {
+			return err
+		}
+		rulesets = append(rulesets, rs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rulesets, nil
+}
+
+// decodeIndexedRuleset decodes the rule set with the given head and body,
+// leaving the body undecoded unless full is set.
+func decodeIndexedRuleset(head []byte, body []byte, full bool) (*Ruleset, error) {
+	rs := &Ruleset{}
+	if err := decodeRulesetProtoInto(rs, head); err != nil {
+		return nil, err
+	}
+	if !full {
+		rs.body = body
+		return rs, nil
+	}
+	if err := decodeRulesetProtoInto(rs, body); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// eachIndexedRuleset calls fn with the offset in data, head and body of each
+// rule set in the given indexed data.
+func eachIndexedRuleset(data []byte, fn func(offset int, head []byte, body []byte) error) error {
+	if !isIndexedRules(data) {
+		return errors.New("missing indexed rules header")
+	}
+	offset := len(indexedMagic)
+	for offset < len(data) {
+		head, body, next, err := indexedRulesetAt(data, offset)
+		if err != nil {
+			return err
+		}
+		if err := fn(offset, head, body); err != nil {
+			return err
+		}
+		offset = next
+	}
+	return nil
+}
+
+// indexedRulesetAt returns the head and body of the rule set at the given
+// offset in indexed data, along with the offset of the next one.
+func indexedRulesetAt(data []byte, offset int) ([]byte, []byte, int, error) {
+	next := func() ([]byte, error) {
+		length, n := binary.Uvarint(data[offset:])
+		if n <= 0 || uint64(len(data)-offset-n) < length {
+			return nil, errTruncated
+		}
+		start, end := offset+n, offset+n+int(length)
+		offset = end
+		return data[start:end:end], nil
+	}
+	head, err := next()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	body, err := next()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return head, body, offset, nil
+}
@@ -0,0 +1,113 @@
+package httpseverywhere
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// WithLazyCompilation compiles the rules and exclusions of each rule set the
+// first time a URL matches one of its targets rather than while loading. Most
+// rule sets are never used in a given session, so this saves most of the
+// time and memory spent compiling. Rule sets in the indexed format are always
+// compiled lazily. Lazy compiles are subject to the compile quota and fail
+// closed like those while loading, but since they happen after loading, rules
+// that fail to compile aren't included in LoadStats, and a rule set none of
+// whose rules compile stays indexed but never matches.
+func WithLazyCompilation() Option {
+	return func(h *Engine) {
+		h.lazyCompile = true
+	}
+}
+
+// lazyRules holds the rules and exclusions of a ruleset until they're first
+// needed, either decoded or still encoded as a body in the indexed format.
+// Neither changes once set, so they may be read without compiling.
+type lazyRules struct {
+	once  sync.Once
+	rules *Ruleset
+	body  []byte
+	d     *deserializer
+	// undecodable is set if the body couldn't be decoded, so there's nothing
+	// to compile again.
+	undecodable bool
+	// compiledFlag is set to 1 once the rules have been compiled.
+	compiledFlag int32
+	// used is set to 1 whenever the rules are used, and reset by TrimMemory.
+	used int32
+}
+
+// compiled compiles the ruleset's rules and exclusions if that was deferred
+// and hasn't happened yet, and returns the ruleset.
+func (r *ruleset) compiled() *ruleset {
+	if l := r.lazy; l != nil {
+		l.once.Do(func() {
+			l.compile(r)
+			atomic.StoreInt32(&l.compiledFlag, 1)
+		})
+		if atomic.LoadInt32(&l.used) == 0 {
+			atomic.StoreInt32(&l.used, 1)
+		}
+	}
+	return r
+}
+
+func (l *lazyRules) compile(r *ruleset) {
+	rs, err := l.source()
+	if err != nil {
+		// Without rules, the ruleset doesn't match anything.
+		l.d.log.Errorf("Unable to decode rules for %v: %v", r.target, err)
+		l.undecodable = true
+		return
+	}
+	// The rules and body are kept so that the ruleset can be released by
+	// TrimMemory and compiled again.
+	l.d.compileRules(rs, r)
+}
+
+// cold returns whether or not the ruleset's rules were compiled on first use
+// and haven't been used since the last time cold was called, resetting that.
+func (l *lazyRules) cold() bool {
+	if atomic.LoadInt32(&l.compiledFlag) == 0 || l.undecodable {
+		return false
+	}
+	return atomic.SwapInt32(&l.used, 0) == 0
+}
+
+// source returns the uncompiled rules and exclusions, without compiling them.
+func (l *lazyRules) source() (*Ruleset, error) {
+	if l.rules != nil {
+		return l.rules, nil
+	}
+	rs := &Ruleset{}
+	return rs, decodeRulesetProtoInto(rs, l.body)
+}
+
+// uncompiled returns a copy of the given ruleset whose rules and exclusions
+// are compiled again on first use.
+func (r *ruleset) uncompiled() *ruleset {
+	return &ruleset{
+		name:      r.name,
+		file:      r.file,
+		source:    r.source,
+		target:    r.target,
+		exclusion: make([]exclusion, 0),
+		rule:      make([]rule, 0),
+		pathScope: r.pathScope,
+		notes:     r.notes,
+		exclusive: r.exclusive,
+		lazy:      &lazyRules{rules: r.lazy.rules, body: r.lazy.body, d: r.lazy.d},
+	}
+}
+
+// lazyCompiler returns a deserializer for compiling rules on first use. Those
+// compiles are subject to the compile quota but aren't included in the load
+// stats, since they happen after loading.
+func (d *deserializer) lazyCompiler() *deserializer {
+	return &deserializer{
+		log:            d.log,
+		maxProgramSize: d.maxProgramSize,
+		quota:          d.quota,
+		clock:          d.clock,
+		keepNotes:      d.keepNotes,
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+var (
+	logger = httpseverywhere.NewStdLogger(log.Default())
+
+	mx      sync.RWMutex
+	engines = make(map[int]*httpseverywhere.Engine)
+	nextID  int
+)
+
+// initFromFile creates an engine using the bundle at path instead of the
+// built-in rules, along with the given options, and returns its handle, or -1
+// on error.
+func initFromFile(path string, opts ...httpseverywhere.Option) int {
+	h, err := httpseverywhere.NewFromRulesFile(path, append([]httpseverywhere.Option{httpseverywhere.WithLogger(logger)}, opts...)...)
+	if err != nil {
+		logger.Errorf("Unable to load bundle: %v", err)
+		return -1
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	nextID++
+	engines[nextID] = h
+	return nextID
+}
+
+// rewrite rewrites rawURL with the engine with the given handle. Unknown
+// handles don't rewrite anything.
+func rewrite(handle int, rawURL string) (string, bool) {
+	mx.RLock()
+	h := engines[handle]
+	mx.RUnlock()
+	if h == nil {
+		return "", false
+	}
+	return h.RewriteString(rawURL)
+}
+
+// closeEngine closes the engine with the given handle and forgets it. Unknown
+// handles are ignored.
+func closeEngine(handle int) {
+	mx.Lock()
+	h := engines[handle]
+	delete(engines, handle)
+	mx.Unlock()
+	if h != nil {
+		h.Close()
+	}
+}
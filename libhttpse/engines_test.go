@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/httpseverywhere"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBundle(t *testing.T) {
+	dir := t.TempDir()
+	_, err := httpseverywhere.Preprocessor.PreprocessBundles(dir, []httpseverywhere.Bundle{{Name: "test", Dirs: []string{"../test"}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	path := filepath.Join(dir, "test.gob")
+	data, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rulesets, err := httpseverywhere.DecodeRulesData(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, -1, initFromFile(filepath.Join(dir, "missing.gob")))
+	assert.Equal(t, -1, initFromFile(filepath.Join(dir, "manifest.json")))
+	handle := initFromFile(path)
+	if !assert.True(t, handle > 0) {
+		return
+	}
+	r, ok := rewrite(handle, "http://fabianfranke.de/")
+	assert.True(t, ok)
+	assert.Equal(t, "https://fabianfranke.de/", r)
+	_, ok = rewrite(handle, "http://example.com/")
+	assert.False(t, ok)
+
+	mx.RLock()
+	h := engines[handle]
+	mx.RUnlock()
+	assert.Equal(t, len(rulesets), h.LoadStats().Rulesets, "only the bundle's rule sets should be loaded")
+	closeEngine(handle)
+	_, ok = rewrite(handle, "http://fabianfranke.de/")
+	assert.False(t, ok, "closed handles shouldn't rewrite")
+	_, ok = h.RewriteString("http://fabianfranke.de/")
+	assert.False(t, ok, "the engine should have been closed")
+
+	closeEngine(handle)
+	closeEngine(12345)
+	_, ok = rewrite(12345, "http://fabianfranke.de/")
+	assert.False(t, ok, "unknown handles shouldn't rewrite")
+}
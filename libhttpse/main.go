@@ -0,0 +1,51 @@
+// Command libhttpse builds the rule engine as a C shared library so that
+// proxy components written in other languages can use the same rules and
+// bundles. Build it with:
+//
+//	go build -buildmode=c-shared -o libhttpse.so ./libhttpse
+//
+// which also generates libhttpse.h. The C API is:
+//
+//	int httpse_init_from_file(char* path);
+//	char* httpse_rewrite(int handle, char* url);
+//	void httpse_free(char* s);
+//	void httpse_close(int handle);
+//
+// httpse_init_from_file loads a bundle written by the preprocessor instead of
+// the built-in rules and returns a handle to the engine, or -1 on error.
+// httpse_rewrite returns the HTTPS URL for the given URL, or NULL if it isn't
+// rewritten. Strings it returns must be released with httpse_free.
+// httpse_close closes the engine and releases its rules; the handle doesn't
+// rewrite anything afterwards.
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import "unsafe"
+
+//export httpse_init_from_file
+func httpse_init_from_file(path *C.char) C.int {
+	return C.int(initFromFile(C.GoString(path)))
+}
+
+//export httpse_rewrite
+func httpse_rewrite(handle C.int, url *C.char) *C.char {
+	rewritten, ok := rewrite(int(handle), C.GoString(url))
+	if !ok {
+		return nil
+	}
+	return C.CString(rewritten)
+}
+
+//export httpse_free
+func httpse_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+//export httpse_close
+func httpse_close(handle C.int) {
+	closeEngine(int(handle))
+}
+
+func main() {}
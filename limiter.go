@@ -0,0 +1,34 @@
+package httpseverywhere
+
+// MatchLimiter bounds how many URLs are matched against rule sets' regular
+// expressions at once. Under extreme load, matching then queues briefly rather
+// than adding unbounded CPU contention to the request path. A single
+// MatchLimiter can be shared by several Engines to bound them together, for
+// example across the whole process.
+type MatchLimiter struct {
+	sem chan struct{}
+}
+
+// NewMatchLimiter returns a MatchLimiter allowing at most max concurrent
+// matches.
+func NewMatchLimiter(max int) *MatchLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &MatchLimiter{sem: make(chan struct{}, max)}
+}
+
+// WithMatchLimiter bounds concurrent matching with the given MatchLimiter.
+func WithMatchLimiter(l *MatchLimiter) Option {
+	return func(h *Engine) {
+		h.matchLimiter = l
+	}
+}
+
+func (l *MatchLimiter) acquire() {
+	l.sem <- struct{}{}
+}
+
+func (l *MatchLimiter) release() {
+	<-l.sem
+}
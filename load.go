@@ -0,0 +1,215 @@
+package httpseverywhere
+
+import (
+	"sync/atomic"
+	"time"
+
+	radix "github.com/armon/go-radix"
+)
+
+// LoadStats describes how much of the rule corpus has been loaded.
+type LoadStats struct {
+	// Rulesets is the total number of rule sets in the corpus, or 0 if it
+	// hasn't been decoded yet.
+	Rulesets int
+	// Loaded is the number of rule sets that are currently in use.
+	Loaded int
+	// LoadedByDeadline is the number of rule sets that were in use when the
+	// deadline set with WithInitDeadline passed, or the total number of rule
+	// sets if loading finished in time. It's 0 when no deadline was set.
+	LoadedByDeadline int
+	// DroppedRulesets is the number of rule sets that were dropped because
+	// none of their rules could be compiled.
+	DroppedRulesets int
+	// DroppedRules is the number of rules that were dropped because they
+	// couldn't be compiled.
+	DroppedRules int
+	// DroppedExclusions is the number of exclusions that couldn't be compiled
+	// and were replaced with broader ones that exclude at least the same URLs,
+	// plus the exclusions of dropped rule sets.
+	DroppedExclusions int
+	// AssetRead is the time spent opening the rules data.
+	AssetRead time.Duration
+	// Decode is the time spent decoding the rules data, including
+	// decompressing it since that's streamed.
+	Decode time.Duration
+	// Compile is the time spent compiling regular expressions.
+	Compile time.Duration
+	// Index is the time spent building the indices, not counting compiling.
+	Index time.Duration
+	// Total is the time the whole load took, including anything not covered
+	// by the phases above such as waiting for the compile quota.
+	Total time.Duration
+}
+
+type loadStats struct {
+	rulesets          int64
+	loaded            int64
+	loadedByDeadline  int64
+	droppedRulesets   int64
+	droppedRules      int64
+	droppedExclusions int64
+	// phases holds the durations of the load phases in nanoseconds.
+	phases [numPhases]int64
+}
+
+// Timed load phases
+const (
+	phaseAssetRead = iota
+	phaseDecode
+	phaseCompile
+	phaseIndex
+	phaseTotal
+	numPhases
+)
+
+// reset zeroes the stats about dropped rule sets and the load phases at the
+// start of a load.
+func (s *loadStats) reset() {
+	s.storeFrom(&loadStats{})
+}
+
+// storeFrom replaces the stats about dropped rule sets and the load phases
+// with those in other.
+func (s *loadStats) storeFrom(other *loadStats) {
+	atomic.StoreInt64(&s.droppedRulesets, atomic.LoadInt64(&other.droppedRulesets))
+	atomic.StoreInt64(&s.droppedRules, atomic.LoadInt64(&other.droppedRules))
+	atomic.StoreInt64(&s.droppedExclusions, atomic.LoadInt64(&other.droppedExclusions))
+	for i := range s.phases {
+		atomic.StoreInt64(&s.phases[i], atomic.LoadInt64(&other.phases[i]))
+	}
+}
+
+// addTime adds the given duration to the given load phase. It does nothing if
+// s is nil.
+func (s *loadStats) addTime(phase int, d time.Duration) {
+	if s != nil {
+		atomic.AddInt64(&s.phases[phase], int64(d))
+	}
+}
+
+// phase returns the duration of the given load phase.
+func (s *loadStats) phase(phase int) time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.phases[phase]))
+}
+
+// drop records that the given numbers of rule sets, rules and exclusions were
+// dropped.
+func (s *loadStats) drop(rulesets int, rules int, exclusions int) {
+	atomic.AddInt64(&s.droppedRulesets, int64(rulesets))
+	atomic.AddInt64(&s.droppedRules, int64(rules))
+	atomic.AddInt64(&s.droppedExclusions, int64(exclusions))
+}
+
+// LoadStats returns statistics about loading the rules. The dropped counts and
+// phase timings are those of the most recent load, either the initial one or
+// an update.
+func (h *Engine) LoadStats() LoadStats {
+	return LoadStats{
+		Rulesets:          int(atomic.LoadInt64(&h.load.rulesets)),
+		Loaded:            int(atomic.LoadInt64(&h.load.loaded)),
+		LoadedByDeadline:  int(atomic.LoadInt64(&h.load.loadedByDeadline)),
+		DroppedRulesets:   int(atomic.LoadInt64(&h.load.droppedRulesets)),
+		DroppedRules:      int(atomic.LoadInt64(&h.load.droppedRules)),
+		DroppedExclusions: int(atomic.LoadInt64(&h.load.droppedExclusions)),
+		AssetRead:         h.load.phase(phaseAssetRead),
+		Decode:            h.load.phase(phaseDecode),
+		Compile:           h.load.phase(phaseCompile),
+		Index:             h.load.phase(phaseIndex),
+		Total:             h.load.phase(phaseTotal),
+	}
+}
+
+// WithInitDeadline makes New return within the given deadline even if the
+// rules haven't been fully loaded by then. Simple rule sets that only upgrade
+// http to https are loaded first so that they're most likely to be available
+// by the deadline, with the rest loading in the background. How much was
+// loaded by the deadline is reported in LoadStats.
+func WithInitDeadline(d time.Duration) Option {
+	return func(h *Engine) {
+		h.initDeadline = d
+	}
+}
+
+// initWithDeadline initializes in the background, waiting at most until the
+// init deadline for it to finish.
+func (h *Engine) initWithDeadline() {
+	done := make(chan struct{})
+	go func() {
+		h.init()
+		close(done)
+	}()
+	select {
+	case <-done:
+		atomic.StoreInt64(&h.load.loadedByDeadline, atomic.LoadInt64(&h.load.loaded))
+	case <-h.clock.After(h.initDeadline):
+		loaded := atomic.LoadInt64(&h.load.loaded)
+		atomic.StoreInt64(&h.load.loadedByDeadline, loaded)
+		h.log.Debugf("Loaded %v of %v rule sets by init deadline of %v", loaded, atomic.LoadInt64(&h.load.rulesets), h.initDeadline)
+	}
+}
+
+// WithProgressiveLoad makes rule sets with plain targets available in batches
+// of the given size while the rules load, rather than all at once when they're
+// done, so that requests made while loading, like with WithAsyncInit or
+// WithInitDeadline, get partial coverage. Rule sets with wildcard targets and
+// those given with WithRulesets are only available once loading is done.
+// Since each batch publishes a copy of the plain index, batches shouldn't be
+// too small. With WithInitDeadline, this replaces loading simple rule sets
+// first. Updates always swap in the new rules all at once.
+func WithProgressiveLoad(batchSize int) Option {
+	return func(h *Engine) {
+		h.progressiveBatch = batchSize
+	}
+}
+
+// publishPlains publishes a copy of the given plain index, which has the given
+// number of rule sets in it, along with the wildcard index already in use.
+func (h *Engine) publishPlains(plains map[string]*ruleset, loaded int) {
+	snapshot := make(map[string]*ruleset, len(plains))
+	for host, rs := range plains {
+		snapshot[host] = rs
+	}
+	h.publish(snapshot, h.wildcardTargets.Load().(*radix.Tree), loaded)
+}
+
+// loadSimpleFirst publishes the simple rule sets before compiling and
+// publishing the rest. Custom rule sets are always loaded last so that they
+// take precedence over the built-in ones.
+func (h *Engine) loadSimpleFirst(d *deserializer, rulesets []*Ruleset) {
+	simple := make([]*Ruleset, 0, len(rulesets))
+	rest := make([]*Ruleset, 0, len(rulesets))
+	for _, rs := range rulesets {
+		if isSimple(rs) {
+			simple = append(simple, rs)
+		} else {
+			rest = append(rest, rs)
+		}
+	}
+	rest = append(rest, h.customRulesets...)
+
+	plains, wildcards := d.index(simple)
+	atomic.AddInt64(&h.generation, 1)
+	h.publish(plains, wildcards, len(simple))
+
+	// Keep going on copies so that the published indices are never modified.
+	plainsCopy := make(map[string]*ruleset, len(plains))
+	for k, v := range plains {
+		plainsCopy[k] = v
+	}
+	wildcardsCopy := radix.NewFromMap(wildcards.ToMap())
+	if h.isClosed() {
+		return
+	}
+	d.indexInto(rest, plainsCopy, wildcardsCopy)
+	// Compacting doesn't modify the already published simple rule sets since
+	// their slices are allocated to fit.
+	plainsCopy, wildcardsCopy = h.finishLoad(plainsCopy, wildcardsCopy)
+	h.publish(plainsCopy, wildcardsCopy, len(simple)+len(rest))
+}
+
+// isSimple returns whether or not the given rule set simply upgrades http to
+// https without any exclusions.
+func isSimple(rs *Ruleset) bool {
+	return len(rs.Exclusion) == 0 && len(rs.Rule) == 1 && rs.Rule[0].From == "^http:" && rs.Rule[0].To == "https:"
+}
@@ -0,0 +1,44 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"log"
+)
+
+// Logger is what the package logs to. A golog.Logger is one.
+type Logger interface {
+	// Debugf logs progress and details that help with debugging.
+	Debugf(format string, args ...interface{})
+	// Errorf logs an error, returning it.
+	Errorf(format string, args ...interface{}) error
+}
+
+// noopLogger is the default Logger, which doesn't log.
+type noopLogger struct{}
+
+func (noopLogger) Debugf(format string, args ...interface{}) {}
+
+func (noopLogger) Errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(format, args...)
+}
+
+// stdLogger adapts a log.Logger to Logger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger returns a Logger that logs to l, prefixing errors with
+// "ERROR " and debug messages with "DEBUG ".
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l}
+}
+
+func (s *stdLogger) Debugf(format string, args ...interface{}) {
+	s.l.Printf("DEBUG "+format, args...)
+}
+
+func (s *stdLogger) Errorf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	s.l.Print("ERROR ", err)
+	return err
+}
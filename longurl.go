@@ -0,0 +1,50 @@
+package httpseverywhere
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// longURLMode configures how URLs above a size threshold are matched.
+type longURLMode struct {
+	threshold    int
+	prefixLength int
+}
+
+// WithLongURLMode evaluates rules and exclusions against only the scheme, host
+// and path of URLs longer than threshold bytes, like those carrying data URIs
+// or huge analytics payloads in their query strings. The path is further cut
+// so that at most prefixLength bytes are matched, unless prefixLength is 0.
+// The query string and anything else beyond the matched prefix are appended to
+// the rewritten URL untouched, keeping the time spent rewriting such URLs flat
+// regardless of their length. Rules and exclusions that look at the query
+// string don't apply to these URLs. Unlike WithMaxMatchLength, which it takes
+// precedence over for URLs above the threshold, shorter URLs are matched in
+// full.
+func WithLongURLMode(threshold int, prefixLength int) Option {
+	return func(h *Engine) {
+		h.longURL = &longURLMode{
+			threshold:    threshold,
+			prefixLength: prefixLength,
+		}
+	}
+}
+
+// split splits the given match string into the scheme, host and path prefix
+// that's matched and the tail that's carried over, if it's long enough.
+func (m *longURLMode) split(url string) (string, string, bool) {
+	if len(url) <= m.threshold {
+		return "", "", false
+	}
+	cut := len(url)
+	if q := strings.IndexByte(url, '?'); q >= 0 {
+		cut = q
+	}
+	if m.prefixLength > 0 && cut > m.prefixLength {
+		cut = m.prefixLength
+		for cut > 0 && !utf8.RuneStart(url[cut]) {
+			cut--
+		}
+	}
+	return url[:cut], url[cut:], true
+}
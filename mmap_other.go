@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package httpseverywhere
+
+import "io/ioutil"
+
+// mapFile reads the file at path, since memory mapping isn't supported on this
+// platform.
+func mapFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+// unmapFile does nothing since mapFile doesn't map files on this platform.
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,33 @@
+package httpseverywhere
+
+import "net/url"
+
+// Normalizer normalizes a URL before it's matched against rules, for example
+// by stripping tracking parameters or unwrapping AMP URLs. It must not modify
+// the given URL and should return it as is if there's nothing to normalize.
+type Normalizer func(u *url.URL) *url.URL
+
+// WithNormalizers registers normalizers that are applied in order to URLs
+// before they are matched against rules. If normalizing changes a URL, Rewrite
+// reports it as rewritten even if no rule applies, so that URL policies and
+// HTTPS upgrades can be applied in a single pass.
+func WithNormalizers(normalizers ...Normalizer) Option {
+	return func(h *Engine) {
+		h.normalizers = append(h.normalizers, normalizers...)
+	}
+}
+
+func (h *Engine) rewriteNormalized(u *url.URL, t *Tenant) (string, bool, *ruleset) {
+	original := u.String()
+	for _, normalize := range h.normalizers {
+		u = normalize(u)
+	}
+	r, ok, rs := h.rewrite(u, t)
+	if ok {
+		return r, ok, rs
+	}
+	if normalized := u.String(); normalized != original {
+		return normalized, true, nil
+	}
+	return "", false, rs
+}
@@ -0,0 +1,90 @@
+package httpseverywhere
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+// WithRulesetNotes keeps the notes of each loaded rule set in memory so that
+// they can be looked up with RulesetNotes and are included in the list of
+// quarantined rule sets. They're left out by default since they take up a fair
+// amount of memory compared to the rules themselves.
+func WithRulesetNotes() Option {
+	return func(h *Engine) {
+		h.keepNotes = true
+	}
+}
+
+// RulesetNotes returns the notes of the rule set covering the given host, as
+// written by upstream in comments, for example "Breaks image uploads" or the
+// reason a rule set is partial. It's empty if no rule set covers the host, the
+// rule set has no notes, or the Engine wasn't configured with
+// WithRulesetNotes.
+func (h *Engine) RulesetNotes(host string) []string {
+	rs := h.rulesetFor(host)
+	if rs == nil {
+		return nil
+	}
+	return rs.notes
+}
+
+// rulesetNotes returns the comments in the given rule set XML, both those
+// preceding the ruleset element and those inside it, with surrounding
+// whitespace trimmed and empty ones left out.
+func rulesetNotes(b []byte) []string {
+	var notes []string
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return notes
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				return notes
+			}
+		case xml.Comment:
+			if note := trimNote(string(t)); note != "" {
+				notes = append(notes, note)
+			}
+		}
+	}
+}
+
+// trimNote trims trailing whitespace from each line of the given comment as
+// well as any lines that are empty at its start and end, along with the
+// indentation common to all lines.
+func trimNote(comment string) string {
+	lines := strings.Split(comment, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	indent := -1
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= indent && indent > 0 {
+			lines[i] = line[indent:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
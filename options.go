@@ -0,0 +1,101 @@
+package httpseverywhere
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithDefaultScheme sets the scheme assumed for scheme-relative and host-only
+// URLs passed to RewriteString. The default is "http".
+func WithDefaultScheme(scheme string) Option {
+	return func(h *Engine) {
+		h.defaultScheme = scheme
+	}
+}
+
+// WithMaxRegexProgramSize treats any regular expression whose compiled program
+// has more than max instructions as if it couldn't be compiled when loading
+// rules, so that the rule is dropped or the exclusion replaced with a broader
+// one.
+func WithMaxRegexProgramSize(max int) Option {
+	return func(h *Engine) {
+		h.maxProgramSize = max
+	}
+}
+
+// WithStrictTargets only applies a rule set if the URL's host matches one of
+// its targets the way the browser extension matches them, rather than
+// whenever a wildcard lookup finds the rule set. In particular, a left
+// wildcard like "*.example.com" only matches subdomains of example.com and a
+// right wildcard like "example.*" only matches a single trailing label.
+func WithStrictTargets() Option {
+	return func(h *Engine) {
+		h.strictTargets = true
+	}
+}
+
+// WithMaxMatchLength caps the number of bytes of a URL that rules and
+// exclusions are evaluated against. Anything beyond that is carried over to
+// the rewritten URL as is. This bounds worst case matching time for very long
+// URLs, relying on rules being anchored at the start of the URL.
+func WithMaxMatchLength(max int) Option {
+	return func(h *Engine) {
+		h.maxMatchLength = max
+	}
+}
+
+// WithRulesets loads the given rule sets in addition to the built-in ones.
+// They're loaded last, so they take precedence over built-in rule sets with
+// the same targets.
+func WithRulesets(rulesets ...*Ruleset) Option {
+	return func(h *Engine) {
+		h.customRulesets = append(h.customRulesets, rulesets...)
+	}
+}
+
+// WithRulesData loads the given rules instead of the built-in ones. The data
+// is a bundle like those written by the preprocessor, optionally gzipped or
+// compressed in a format registered with RegisterDecompressor.
+func WithRulesData(data []byte) Option {
+	return func(h *Engine) {
+		h.rulesData = data
+	}
+}
+
+// WithLogger makes the Engine log to the given logger, like a golog.Logger or
+// one from NewStdLogger. By default it doesn't log.
+func WithLogger(log Logger) Option {
+	return func(h *Engine) {
+		h.log = log
+	}
+}
+
+// WithStats turns collecting timing stats for rewrites on or off. It's on by
+// default. With it off, rewrites don't read the clock or record timings, so
+// production proxies that don't look at the stats pay nothing for them.
+func WithStats(enabled bool) Option {
+	return func(h *Engine) {
+		h.statsDisabled = !enabled
+	}
+}
+
+// WithStatsDisabled turns off collecting timing stats for rewrites, like
+// WithStats(false).
+func WithStatsDisabled() Option {
+	return WithStats(false)
+}
+
+// WithAsyncInit makes New return right away and load the rules in the
+// background, like Default. URLs aren't rewritten until the rules have loaded,
+// which Ready signals.
+func WithAsyncInit() Option {
+	return func(h *Engine) {
+		h.asyncInit = true
+	}
+}
+
+// WithoutBuiltinRules doesn't load the built-in rule sets, so that only rule
+// sets given with WithRulesets are used.
+func WithoutBuiltinRules() Option {
+	return func(h *Engine) {
+		h.skipBuiltin = true
+	}
+}
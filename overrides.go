@@ -0,0 +1,221 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ExclusionOverride forces URLs to be upgraded even though they match an
+// exclusion, for operators who find upstream exclusions overly conservative.
+type ExclusionOverride struct {
+	// Host is the host the override applies to, regardless of its case or
+	// port. It's stored in lowercase without any port or trailing dot.
+	Host string
+	// Ruleset makes the override apply to every target of the rule set that
+	// covers Host rather than just to Host itself.
+	Ruleset bool
+	// Pattern limits the override to the exclusion with exactly this pattern.
+	// If empty, all exclusions are overridden.
+	Pattern string
+	// Tenant is the ID of the tenant the override is scoped to, or empty if it
+	// applies globally. It's set automatically by Tenant.OverrideExclusion.
+	Tenant string
+	// By records who added the override.
+	By string
+	// Reason records why the override was added.
+	Reason string
+	// At records when the override was added. It's set automatically if zero.
+	At time.Time
+}
+
+// exclusionOverrides holds exclusion overrides keyed by host and by the
+// identity of the ruleset they apply to, so that they outlive the loaded
+// rulesets.
+type exclusionOverrides struct {
+	byHost    hostMap // host -> []*ExclusionOverride
+	mx        sync.RWMutex
+	byRuleset map[string][]*ExclusionOverride
+}
+
+// OverrideExclusion adds the given exclusion override. It returns an error if
+// the override applies to a rule set but no rule set covers its host.
+func (h *Engine) OverrideExclusion(o ExclusionOverride) error {
+	o.Tenant = ""
+	return h.overrides.add(h, &o, h.rulesetFor)
+}
+
+// RemoveExclusionOverrides removes all exclusion overrides for the given host,
+// or for the rule set covering it if ruleset is true.
+func (h *Engine) RemoveExclusionOverrides(host string, ruleset bool) {
+	h.overrides.remove(host, ruleset, h.rulesetFor)
+}
+
+// ExclusionOverrides returns all exclusion overrides in the order they were
+// added.
+func (h *Engine) ExclusionOverrides() []ExclusionOverride {
+	return h.overrides.list()
+}
+
+// exclusionOverridden returns whether or not the given exclusion of the given
+// ruleset is overridden for the given host, either globally or for the given
+// tenant. This is only called once an exclusion has matched, so it's off the
+// common path.
+func (h *Engine) exclusionOverridden(host string, rs *ruleset, e exclusion, t *Tenant) bool {
+	if h.overrides.overridden(host, rs, e) {
+		return true
+	}
+	return t != nil && t.overrides.overridden(host, rs, e)
+}
+
+func (eo *exclusionOverrides) add(h *Engine, o *ExclusionOverride, rulesetFor func(string) *ruleset) error {
+	if o.At.IsZero() {
+		o.At = h.clock.Now()
+	}
+	o.Host = hostKey(o.Host)
+	if !o.Ruleset {
+		eo.byHost.update(o.Host, func(old interface{}) interface{} {
+			existing, _ := old.([]*ExclusionOverride)
+			return append(existing[:len(existing):len(existing)], o)
+		})
+		return nil
+	}
+
+	rs := rulesetFor(o.Host)
+	if rs == nil {
+		return fmt.Errorf("no rule set covers %v", o.Host)
+	}
+	eo.mx.Lock()
+	defer eo.mx.Unlock()
+	if eo.byRuleset == nil {
+		eo.byRuleset = make(map[string][]*ExclusionOverride)
+	}
+	id := rs.identity()
+	eo.byRuleset[id] = append(eo.byRuleset[id], o)
+	return nil
+}
+
+func (eo *exclusionOverrides) remove(host string, ruleset bool, rulesetFor func(string) *ruleset) {
+	host = hostKey(host)
+	if !ruleset {
+		eo.byHost.update(host, func(old interface{}) interface{} { return nil })
+		return
+	}
+	rs := rulesetFor(host)
+	eo.mx.Lock()
+	defer eo.mx.Unlock()
+	if rs != nil {
+		delete(eo.byRuleset, rs.identity())
+	}
+	// Also remove the overrides added for the host whose rule set isn't
+	// currently loaded.
+	for id, overrides := range eo.byRuleset {
+		for _, o := range overrides {
+			if o.Host == host {
+				delete(eo.byRuleset, id)
+				break
+			}
+		}
+	}
+}
+
+// resolve keys the rule set overrides by the rule sets that now cover their
+// hosts, for after the rule sets have changed. Overrides whose hosts aren't
+// covered anymore are kept as they are, in case their rule sets come back.
+func (eo *exclusionOverrides) resolve(rulesetFor func(string) *ruleset) {
+	eo.mx.Lock()
+	defer eo.mx.Unlock()
+	if len(eo.byRuleset) == 0 {
+		return
+	}
+	resolved := make(map[string][]*ExclusionOverride, len(eo.byRuleset))
+	for id, overrides := range eo.byRuleset {
+		for _, o := range overrides {
+			key := id
+			if rs := rulesetFor(o.Host); rs != nil {
+				key = rs.identity()
+			}
+			resolved[key] = append(resolved[key], o)
+		}
+	}
+	eo.byRuleset = resolved
+}
+
+func (eo *exclusionOverrides) list() []ExclusionOverride {
+	var result []ExclusionOverride
+	eo.byHost.forEach(func(host string, v interface{}) bool {
+		for _, o := range v.([]*ExclusionOverride) {
+			result = append(result, *o)
+		}
+		return true
+	})
+	eo.mx.RLock()
+	for _, overrides := range eo.byRuleset {
+		for _, o := range overrides {
+			result = append(result, *o)
+		}
+	}
+	eo.mx.RUnlock()
+	sort.SliceStable(result, func(i, j int) bool { return result[i].At.Before(result[j].At) })
+	return result
+}
+
+func (eo *exclusionOverrides) overridden(host string, rs *ruleset, e exclusion) bool {
+	if eo.byHost.len() > 0 {
+		if v, ok := eo.byHost.get(hostKey(host)); ok && overrides(v.([]*ExclusionOverride), e) {
+			return true
+		}
+	}
+	eo.mx.RLock()
+	defer eo.mx.RUnlock()
+	if len(eo.byRuleset) == 0 {
+		return false
+	}
+	return overrides(eo.byRuleset[rs.identity()], e)
+}
+
+func overrides(os []*ExclusionOverride, e exclusion) bool {
+	for _, o := range os {
+		if o.Pattern == "" || o.Pattern == e.pattern.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// rulesetFor returns the ruleset covering the given host, if any.
+func (h *Engine) rulesetFor(host string) *ruleset {
+	return matchingRuleset(host, h.candidatesFor(host))
+}
+
+// candidatesFor returns the candidate rulesets for the given host, in order.
+func (h *Engine) candidatesFor(host string) []*ruleset {
+	u := hostURL(host)
+	var candidates []*ruleset
+	for _, idx := range h.lookupOrder {
+		if rs := h.lookup(idx, u); rs != nil && !containsRuleset(candidates, rs) {
+			candidates = append(candidates, rs)
+		}
+	}
+	return candidates
+}
+
+// matchingRuleset returns the first of the given candidates for the given host
+// that rewrites its root or, if none do, the first one whose targets match the
+// host at all, since the indices may return candidates that don't.
+func matchingRuleset(host string, candidates []*ruleset) *ruleset {
+	var matching *ruleset
+	for _, rs := range candidates {
+		if !rs.matchesHost(host) {
+			continue
+		}
+		if _, ok := rs.apply(hostURL(host)); ok {
+			return rs
+		}
+		if matching == nil {
+			matching = rs
+		}
+	}
+	return matching
+}
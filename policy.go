@@ -0,0 +1,120 @@
+package httpseverywhere
+
+import "net/url"
+
+// MatchPolicy controls which rewrite is used when more than one candidate rule
+// set applies to a URL.
+type MatchPolicy int
+
+const (
+	// FirstMatch applies the first candidate rule set that rewrites the URL,
+	// which is compatible with the browser extension. This is the default.
+	FirstMatch MatchPolicy = iota
+	// BestMatch evaluates all candidate rule sets and prefers simple upgrades
+	// that only change the scheme, then rewrites that stay on the same host,
+	// over rewrites that move the request to a different host.
+	BestMatch
+)
+
+// WithMatchPolicy sets the policy used to pick between candidate rule sets.
+func WithMatchPolicy(policy MatchPolicy) Option {
+	return func(h *Engine) {
+		h.matchPolicy = policy
+	}
+}
+
+// WithLookupOrder sets the order in which indices are checked for candidate
+// rule sets. Indices that are left out aren't checked at all and repeated
+// indices are only checked once. The default is PlainIndex, PrefixIndex,
+// SuffixIndex.
+func WithLookupOrder(order ...Index) Option {
+	return func(h *Engine) {
+		h.lookupOrder = nil
+		for _, idx := range order {
+			if idx < PlainIndex || idx > SuffixIndex || containsIndex(h.lookupOrder, idx) {
+				continue
+			}
+			h.lookupOrder = append(h.lookupOrder, idx)
+		}
+	}
+}
+
+// WithEarlyExit stops looking for candidate rule sets after the first index
+// that yields one, even if that rule set doesn't rewrite the URL, rather than
+// trying the remaining indices too. This saves lookups at the cost of missing
+// rewrites from less specific targets.
+func WithEarlyExit() Option {
+	return func(h *Engine) {
+		h.earlyExit = true
+	}
+}
+
+// rewriteBest rewrites the given URL using the best of all candidate rulesets.
+func (h *Engine) rewriteBest(u *url.URL, cached *candidates, t *Tenant) (string, bool, *ruleset) {
+	best, bestScore := "", -1
+	var bestRuleset *ruleset
+	var seen []*ruleset
+	for _, idx := range h.lookupOrder {
+		rs := h.candidate(idx, u, cached)
+		if rs == nil || containsRuleset(seen, rs) {
+			continue
+		}
+		seen = append(seen, rs)
+		r, hit := h.rewriteWithRuleset(u, rs, t)
+		if !hit {
+			if h.earlyExit || rs.exclusive {
+				break
+			}
+			continue
+		}
+		score := rewriteScore(u, r)
+		if bestScore < 0 || score < bestScore {
+			best, bestScore, bestRuleset = r, score, rs
+		}
+		if score == 0 || rs.exclusive {
+			// Can't do any better than a simple upgrade, and later candidates
+			// don't apply to an exclusive rule set's targets.
+			break
+		}
+	}
+	if len(seen) == 0 {
+		return h.rewriteAlias(u, t)
+	}
+	if bestRuleset == nil {
+		return "", false, seen[0]
+	}
+	return best, true, bestRuleset
+}
+
+// rewriteScore ranks a rewrite of the given URL, lower being better: 0 for
+// simple upgrades, 1 for rewrites that stay on the same host and 2 for
+// rewrites that move to a different host.
+func rewriteScore(u *url.URL, rewritten string) int {
+	r, err := url.Parse(rewritten)
+	switch {
+	case err != nil || r.Host != u.Host:
+		return 2
+	case r.EscapedPath() != u.EscapedPath() || r.RawQuery != u.RawQuery:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func containsIndex(order []Index, idx Index) bool {
+	for _, candidate := range order {
+		if candidate == idx {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRuleset(rulesets []*ruleset, rs *ruleset) bool {
+	for _, candidate := range rulesets {
+		if candidate == rs {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package httpseverywhere
+
+// prefetchQueueSize is how many prefetch hints can be queued before further
+// hints are dropped.
+const prefetchQueueSize = 1000
+
+// Prefetch hints that a request for the given host is likely to arrive soon,
+// for example because a DNS query for it was just seen, so that the state
+// needed to rewrite URLs for it can be warmed in the background: the
+// candidate rule sets for the host are looked up, and cached if the Engine was
+// configured with WithLookupCache, and their rules are compiled if they're
+// compiled lazily. Prefetch never blocks; hints are dropped if too many are
+// already queued.
+func (h *Engine) Prefetch(host string) {
+	h.prefetchOnce.Do(func() {
+		h.prefetchCh = make(chan string, prefetchQueueSize)
+		go h.prefetch()
+	})
+	select {
+	case h.prefetchCh <- host:
+	default:
+	}
+}
+
+func (h *Engine) prefetch() {
+	for {
+		select {
+		case host := <-h.prefetchCh:
+			h.warm(host)
+		case <-h.closed():
+			return
+		}
+	}
+}
+
+// warm looks up the candidate rulesets for the given host and compiles them.
+func (h *Engine) warm(host string) {
+	if !h.holdRules() {
+		return
+	}
+	defer h.unholdRules()
+	var c *candidates
+	if h.cache != nil {
+		c = h.cache.candidates(h, hostURL(host))
+	} else {
+		c = h.allCandidates(hostURL(host))
+	}
+	for _, rs := range c {
+		if rs != nil {
+			rs.compiled()
+		}
+	}
+}
@@ -1,7 +1,77 @@
 package main
 
-import "github.com/getlantern/httpseverywhere"
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+var (
+	tlds     = flag.String("tlds", "", "comma-separated list of TLDs to expand trailing wildcard targets like foo.* into")
+	outDir   = flag.String("out", ".", "directory to write bundles and their manifest to when using -bundle")
+	rulesDir = flag.String("rules", "./https-everywhere/src/chrome/content/rules/", "directory of rule set files to preprocess when not using -bundle")
+	outFile  = flag.String("o", "rulesets.gob", "file to write the rules to when not using -bundle")
+	sample   = flag.Int("sample", 0, "only keep every nth rule set file, for writing small test fixtures")
+	include  = flag.String("include", "", "comma-separated list of rule set files to keep in addition to those sampled with -sample")
+	format   = flag.String("format", "gob", "format to write the rules in, gob, proto or indexed")
+	source   = flag.String("source", "", "where the rules came from, like an upstream commit, to record in each rule set")
+	bundles  bundleFlags
+)
+
+// bundleFlags collects repeated -bundle name=dir1,dir2 flags.
+type bundleFlags []httpseverywhere.Bundle
+
+func (b *bundleFlags) String() string {
+	names := make([]string, 0, len(*b))
+	for _, bundle := range *b {
+		names = append(names, bundle.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (b *bundleFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return flag.ErrHelp
+	}
+	*b = append(*b, httpseverywhere.Bundle{Name: parts[0], Dirs: strings.Split(parts[1], ",")})
+	return nil
+}
 
 func main() {
-	httpseverywhere.Preprocessor.Preprocess("./https-everywhere/src/chrome/content/rules/")
+	flag.Var(&bundles, "bundle", "bundle to write as name=dir1,dir2 (may be repeated)")
+	flag.Parse()
+
+	opts := []httpseverywhere.PreprocessOption{httpseverywhere.WithPreprocessLogger(httpseverywhere.NewStdLogger(log.Default()))}
+	if *source != "" {
+		opts = append(opts, httpseverywhere.WithSource(*source))
+	}
+	if *tlds != "" {
+		opts = append(opts, httpseverywhere.WithTLDs(strings.Split(*tlds, ",")...))
+	}
+	switch *format {
+	case "gob":
+	case "proto":
+		opts = append(opts, httpseverywhere.WithProtobuf())
+	case "indexed":
+		opts = append(opts, httpseverywhere.WithIndexedFormat())
+	default:
+		log.Fatalf("unknown format %q", *format)
+	}
+	if *sample > 0 {
+		var names []string
+		if *include != "" {
+			names = strings.Split(*include, ",")
+		}
+		opts = append(opts, httpseverywhere.WithSample(*sample, names...))
+	}
+	if len(bundles) == 0 {
+		httpseverywhere.Preprocessor.PreprocessTo(*rulesDir, *outFile, opts...)
+		return
+	}
+	if _, err := httpseverywhere.Preprocessor.PreprocessBundles(*outDir, bundles, opts...); err != nil {
+		log.Fatal(err)
+	}
 }
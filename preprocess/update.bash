@@ -11,7 +11,6 @@ rm -rf https-everywhere
 git clone --depth 1 -b release https://github.com/EFForg/https-everywhere.git || die "Could not clone https everywhere?"
 
 go build || die "Could not build"
-./preprocess || die "Error preprocessing?"
+./preprocess -source "$(git -C https-everywhere rev-parse HEAD)" || die "Error preprocessing?"
 
-go get -u github.com/getlantern/go-bindata/...
-go-bindata -pkg httpseverywhere -o ../gobrulesets.go ./rulesets.gob
+gzip -9 -c rulesets.gob > ../rulesets.gob.gz || die "Could not compress rules?"
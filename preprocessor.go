@@ -1,112 +1,308 @@
 package httpseverywhere
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/xml"
 	"io/ioutil"
+	"log"
 	"path/filepath"
-	"regexp"
-
-	"github.com/getlantern/golog"
+	"strings"
+	"time"
 )
 
 // Preprocessor is a struct for preprocessing rules into a GOB file.
-var Preprocessor = &preprocessor{
-	log: golog.LoggerFor("httpseverywhere-preprocessor"),
+var Preprocessor = &preprocessor{}
+
+type preprocessor struct{}
+
+// PreprocessOption configures a preprocessing run.
+type PreprocessOption func(*preprocessOptions)
+
+type preprocessOptions struct {
+	tlds           []string
+	maxProgramSize int
+	source         string
+	sampleEvery    int
+	include        map[string]bool
+	format         rulesFormat
+	log            Logger
+	generatedAt    time.Time
+}
+
+// rulesFormat is a format the preprocessor can write rules in.
+type rulesFormat int
+
+const (
+	formatGob rulesFormat = iota
+	formatProtobuf
+	formatIndexed
+)
+
+// WithTLDs expands trailing wildcard targets like "foo.*" into explicit
+// targets for each of the given TLDs (for example "com" or "co.uk"), so that
+// they end up as plain targets instead of being matched by suffix at runtime.
+func WithTLDs(tlds ...string) PreprocessOption {
+	return func(opts *preprocessOptions) {
+		for _, tld := range tlds {
+			opts.tlds = append(opts.tlds, strings.TrimPrefix(tld, "."))
+		}
+	}
+}
+
+// WithMaxProgramSize rejects any rule set containing a regular expression
+// whose compiled program has more than max instructions.
+func WithMaxProgramSize(max int) PreprocessOption {
+	return func(opts *preprocessOptions) {
+		opts.maxProgramSize = max
+	}
 }
 
-type preprocessor struct {
-	log golog.Logger
+// WithSource records where the rules came from, for example an upstream
+// commit, in each rule set and in the manifest written by PreprocessBundles.
+func WithSource(source string) PreprocessOption {
+	return func(opts *preprocessOptions) {
+		opts.source = source
+	}
+}
+
+// WithSample down-samples the rules to every nth rule set file, in file name
+// order starting with the first, plus the files with the given names (with or
+// without the .xml extension). The result is deterministic, which makes for
+// small but representative bundles to use in tests.
+func WithSample(n int, include ...string) PreprocessOption {
+	return func(opts *preprocessOptions) {
+		opts.sampleEvery = n
+		if opts.include == nil {
+			opts.include = make(map[string]bool, len(include))
+		}
+		for _, name := range include {
+			opts.include[strings.TrimSuffix(name, ".xml")] = true
+		}
+	}
+}
+
+// WithProtobuf writes the rules in the protobuf format described by
+// rulesets.proto instead of Go's gob encoding, so that clients not written in
+// Go can load them too. The Engine loads either format.
+func WithProtobuf() PreprocessOption {
+	return func(opts *preprocessOptions) {
+		opts.format = formatProtobuf
+	}
+}
+
+// WithIndexedFormat writes the rules in a layout that the Engine can start
+// using without decoding and compiling all of them up front. Each rule set's
+// targets are stored apart from its rules and exclusions, so loading only reads
+// the targets to build the indices, and the rules and exclusions of a rule set
+// are decoded and compiled the first time a URL needs them. This cuts startup
+// time to a fraction, particularly when the file is loaded uncompressed with
+// NewFromRulesFile, at the cost of the first rewrite on each covered host
+// taking longer. The Engine loads this format like any other.
+func WithIndexedFormat() PreprocessOption {
+	return func(opts *preprocessOptions) {
+		opts.format = formatIndexed
+	}
+}
+
+// WithGeneratedAt records the given time as when the rules were generated
+// instead of the current time, for reproducible output.
+func WithGeneratedAt(t time.Time) PreprocessOption {
+	return func(opts *preprocessOptions) {
+		opts.generatedAt = t
+	}
+}
+
+// WithPreprocessLogger makes preprocessing log to the given logger. By default
+// it doesn't log.
+func WithPreprocessLogger(log Logger) PreprocessOption {
+	return func(opts *preprocessOptions) {
+		opts.log = log
+	}
+}
+
+// logger returns the logger to log to.
+func (opts *preprocessOptions) logger() Logger {
+	if opts.log == nil {
+		return noopLogger{}
+	}
+	return opts.log
+}
+
+// sampled returns whether or not the file with the given name and position in
+// file name order is part of the sample, if any.
+func (opts *preprocessOptions) sampled(name string, i int) bool {
+	if opts.sampleEvery <= 0 {
+		return true
+	}
+	return i%opts.sampleEvery == 0 || opts.include[strings.TrimSuffix(name, ".xml")]
 }
 
 // Preprocess adds all of the rules in the specified directory.
-func (p *preprocessor) Preprocess(dir string) {
-	p.preprocess(dir, gobrules)
+func (p *preprocessor) Preprocess(dir string, opts ...PreprocessOption) {
+	p.preprocess(dir, gobrules, opts...)
+}
+
+// PreprocessTo adds all of the rules in the specified directory and writes
+// them to outFile instead of the default rulesets.gob.
+func (p *preprocessor) PreprocessTo(dir string, outFile string, opts ...PreprocessOption) {
+	p.preprocess(dir, outFile, opts...)
 }
 
 // preprocess adds all of the rules in the specified directory and writes to
 // the specified file.
-func (p *preprocessor) preprocess(dir string, outFile string) {
+func (p *preprocessor) preprocess(dir string, outFile string, opts ...PreprocessOption) {
+	options := newPreprocessOptions(opts)
+	rules, errors, err := p.loadDir(dir, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options.logger().Debugf("Loaded rules with %v rulesets and %v errors", len(rules), errors)
+
+	data, err := options.encode(rules)
+	if err != nil {
+		log.Fatalf("encode error: %v", err)
+	}
+	ioutil.WriteFile(outFile, data, 0644)
+}
+
+func newPreprocessOptions(opts []PreprocessOption) *preprocessOptions {
+	options := &preprocessOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// loadDir vets all of the rule set files in the specified directory, returning
+// the rule sets that passed and the number that didn't.
+func (p *preprocessor) loadDir(dir string, options *preprocessOptions) ([]*Ruleset, int, error) {
 	rules := make([]*Ruleset, 0)
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		p.log.Fatal(err)
+		return nil, 0, err
 	}
 
 	var num int
 	var errors int
-	for _, file := range files {
+	for i, file := range files {
+		if !options.sampled(file.Name(), i) {
+			continue
+		}
 		b, errr := ioutil.ReadFile(filepath.Join(dir, file.Name()))
 		if errr != nil {
 			//log.Errorf("Error reading file: %v", err)
 		} else {
-			rs, processed := p.VetRuleSet(b)
+			rs, processed := p.vetRuleSet(b, options)
 			if !processed {
 				errors++
 			} else {
+				if len(options.tlds) > 0 {
+					expandSuffixTargets(rs, options.tlds)
+				}
+				precomputeKeys(rs)
+				rs.PathScope = pathScope(rs.Rule)
+				rs.File = file.Name()
+				rs.Source = options.source
 				rules = append(rules, rs)
 			}
 		}
 		num++
 	}
 
-	p.log.Debugf("Total rule set files: %v", num)
-	p.log.Debugf("Loaded rules with %v rulesets and %v errors", len(rules), errors)
+	options.logger().Debugf("Total rule set files in %v: %v", dir, num)
+	return rules, errors, nil
+}
+
+// encode serializes the given rule sets in the configured format, preceded by
+// a header with the schema version, generation time and checksum.
+func (opts *preprocessOptions) encode(rules []*Ruleset) ([]byte, error) {
+	var payload []byte
+	switch opts.format {
+	case formatProtobuf:
+		payload = encodeRulesetsProto(rules)
+	case formatIndexed:
+		payload = encodeRulesetsIndexed(rules)
+	default:
+		var err error
+		if payload, err = encodeRulesets(rules); err != nil {
+			return nil, err
+		}
+	}
+	generated := opts.generatedAt
+	if generated.IsZero() {
+		generated = time.Now()
+	}
+	return withRulesHeader(payload, generated), nil
+}
 
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	// Encode (send) the value.
-	err = enc.Encode(rules)
-	if err != nil {
-		p.log.Fatalf("encode error: %v", err)
+// extension returns the file extension for rules in the configured format.
+func (opts *preprocessOptions) extension() string {
+	switch opts.format {
+	case formatProtobuf:
+		return ".pb"
+	case formatIndexed:
+		return ".idx"
 	}
-	ioutil.WriteFile(outFile, buf.Bytes(), 0644)
+	return ".gob"
 }
 
 // VetRuleSet just checks to make sure all the regular expressions compile for
 // a given rule set. If any fail, we just ignore it.
 func (p *preprocessor) VetRuleSet(rules []byte) (*Ruleset, bool) {
-	var ruleset Ruleset
-	xml.Unmarshal(rules, &ruleset)
+	return p.vetRuleSet(rules, &preprocessOptions{})
+}
 
-	// If the rule is turned off, ignore it.
-	if len(ruleset.Off) > 0 {
-		return nil, false
+func (p *preprocessor) vetRuleSet(rules []byte, options *preprocessOptions) (*Ruleset, bool) {
+	ruleset, issues := p.validate(rules, options)
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			options.logger().Debugf("Rejecting rule set: %v", issue)
+			return nil, false
+		}
 	}
+	return ruleset, true
+}
 
-	// We don't run on any platforms (aka Tor) that support mixed content, so
-	// ignore any rule that is mixedcontent-only.
-	if ruleset.Platform == "mixedcontent" {
-		return nil, false
+// expandSuffixTargets replaces each trailing wildcard target in the given
+// ruleset with one explicit target per TLD, in the order given and skipping
+// any hosts the ruleset already targets.
+func expandSuffixTargets(rs *Ruleset, tlds []string) {
+	existing := make(map[string]bool, len(rs.Target))
+	for _, target := range rs.Target {
+		existing[target.Host] = true
 	}
-
-	for _, rule := range ruleset.Rule {
-		_, err := regexp.Compile(rule.From)
-		if err != nil {
-			p.log.Debugf("Could not compile From rule %v - got error %v", rule.From, err)
-			return nil, false
+	targets := make([]*Target, 0, len(rs.Target))
+	for _, target := range rs.Target {
+		if !isSuffixTarget(target) {
+			targets = append(targets, target)
+			continue
+		}
+		base := strings.TrimSuffix(target.Host, "*")
+		for _, tld := range tlds {
+			host := base + tld
+			if !existing[host] {
+				existing[host] = true
+				targets = append(targets, &Target{Host: host})
+			}
 		}
-		rule.To = p.normalizeTo(rule.To)
 	}
+	rs.Target = targets
+}
 
-	for _, e := range ruleset.Exclusion {
-		_, err := regexp.Compile(e.Pattern)
-		if err != nil {
-			p.log.Debugf("Could not compile Exclusion pattern %v - got error %v", e.Pattern, err)
-			return nil, false
+// precomputeKeys stores the index key of each wildcard target in the given
+// ruleset so that it doesn't have to be computed when loading.
+func precomputeKeys(rs *Ruleset) {
+	for _, target := range rs.Target {
+		if isSuffixTarget(target) || isPrefixTarget(target) {
+			target.Key = indexKey(target.Host)
 		}
 	}
-
-	return &ruleset, true
 }
 
 func (p *preprocessor) normalizeTo(to string) string {
 	// Go handles references to matching groups in the replacement text
-	// differently from PCRE. PCRE considers $1xxx to be the first match
-	// followed by xxx, whereas in Go that's considered to be the named group
-	// "$1xxx".
+	// differently from the browser extension. The extension considers $1xxx
+	// to be the first match followed by xxx, whereas in Go that's considered
+	// to be the named group "$1xxx". See normalizeTemplate for the details.
 	// See: https://golang.org/pkg/regexp/#Regexp.Expand
-	re := regexp.MustCompile("\\$(\\d+)")
-	return re.ReplaceAllString(to, "${$1}")
+	normalized, _ := normalizeTemplate(to, nil)
+	return normalized
 }
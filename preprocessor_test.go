@@ -2,10 +2,13 @@ package httpseverywhere
 
 import (
 	"bytes"
-	"encoding/gob"
+	"encoding/json"
 	"io/ioutil"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,25 +23,196 @@ func TestNormalizeTo(t *testing.T) {
 	assert.Equal(t, expected, Preprocessor.normalizeTo(to))
 }
 
+func TestNormalizeTemplate(t *testing.T) {
+	tests := []struct {
+		from, to, url, expected string
+	}{
+		{`^http://(www\.)?example\.com/`, "https://$1example.com/", "http://www.example.com/", "https://www.example.com/"},
+		{`^http://(\w+)\.example\.com/`, "https://$1a.example.com/", "http://foo.example.com/", "https://fooa.example.com/"},
+		{`^http://(\w+)\.example\.com/`, "https://example.com/$10", "http://foo.example.com/", "https://example.com/foo0"},
+		{`^http://(\w+)\.example\.com/`, "https://example.com/$2", "http://foo.example.com/", "https://example.com/$2"},
+		{`^http://(\w+)\.example\.com/`, "https://example.com/$0", "http://foo.example.com/", "https://example.com/$0"},
+		{`^http://(a)(b)(c)(d)(e)(f)(g)(h)(i)(j)(k)\.example\.com/`, "https://$11.example.com/", "http://abcdefghijk.example.com/", "https://k.example.com/"},
+		{`^http://(\w+)\.example\.com/`, "https://example.com/$$1", "http://foo.example.com/", "https://example.com/$1"},
+		{`^http://(\w+)\.example\.com/`, "https://example.com/$$$1", "http://foo.example.com/", "https://example.com/$foo"},
+		{`^http://(\w+)\.example\.com/`, "https://example.com/$foo/${1}/$", "http://foo.example.com/", "https://example.com/$foo/${1}/$"},
+		{`^http://example\.com/`, "https://example.com/?u=$&", "http://example.com/", "https://example.com/?u=http://example.com/"},
+		{`^http://(?P<sub>\w+)\.example\.com/`, "https://$<sub>.example.com/$<other>", "http://foo.example.com/", "https://foo.example.com/"},
+		{`^http://(\w+)\.example\.com/`, "https://$<sub>.example.com/", "http://foo.example.com/", "https://$<sub>.example.com/"},
+	}
+	for _, test := range tests {
+		re := regexp.MustCompile(test.from)
+		to, ok := normalizeTemplate(test.to, re)
+		assert.True(t, ok, test.to)
+		assert.Equal(t, test.expected, re.ReplaceAllString(test.url, to), "%v normalized to %v", test.to, to)
+	}
+
+	_, ok := normalizeTemplate("https://example.com/$'", regexp.MustCompile(`^http://example\.com/`))
+	assert.False(t, ok)
+
+	to, ok := normalizeTemplate("https://$1.example.com/$0/$12", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "https://${1}.example.com/$$0/${12}", to, "without a pattern, $0 should stay literal")
+	_, issues := ValidateRulesetXML([]byte(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http://example\.com/" to="https://example.com/$` + "`" + `" />
+	</ruleset>`))
+	if assert.Len(t, issues, 1) {
+		assert.Equal(t, SeverityError, issues[0].Severity)
+		assert.Equal(t, "rule[0].to", issues[0].Field)
+	}
+}
+
+func TestPreprocessSample(t *testing.T) {
+	files, err := ioutil.ReadDir("test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	sample := func(opts ...PreprocessOption) []byte {
+		out := filepath.Join(t.TempDir(), "sample.gob")
+		Preprocessor.PreprocessTo("test", out, append(opts, WithGeneratedAt(time.Unix(1, 0)))...)
+		data, err := ioutil.ReadFile(out)
+		assert.NoError(t, err)
+		return data
+	}
+	data := sample(WithSample(10, "Facebook.xml", "Fabricatorz"))
+	assert.Equal(t, data, sample(WithSample(10, "Facebook.xml", "Fabricatorz")), "sample should be deterministic")
+
+	var expected []string
+	for i, file := range files {
+		if i%10 == 0 || file.Name() == "Facebook.xml" || file.Name() == "Fabricatorz.xml" {
+			expected = append(expected, file.Name())
+		}
+	}
+	rulesets, err := decodeRulesData(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(rulesets) <= len(expected), "should have at most %d rule sets, got %d", len(expected), len(rulesets))
+	assert.True(t, len(rulesets) > 0)
+	hosts := make(map[string]bool)
+	for _, rs := range rulesets {
+		for _, target := range rs.Target {
+			hosts[target.Host] = true
+		}
+	}
+	assert.True(t, hosts["facebook.com"], "should include Facebook.xml")
+	assert.True(t, hosts["fabricatorz.com"], "should include Fabricatorz.xml")
+}
+
+func TestPreprocessProtobuf(t *testing.T) {
+	dir := t.TempDir()
+	preprocess := func(name string, opts ...PreprocessOption) []byte {
+		out := filepath.Join(dir, name)
+		Preprocessor.PreprocessTo("test", out, append(opts, WithSample(10))...)
+		data, err := ioutil.ReadFile(out)
+		assert.NoError(t, err)
+		return data
+	}
+	gobData := preprocess("rulesets.gob")
+	protoData := preprocess("rulesets.pb", WithProtobuf())
+	assert.True(t, isProtoRules(rulesPayload(protoData)))
+
+	expected, err := decodeRulesData(gobData)
+	if !assert.NoError(t, err) {
+		return
+	}
+	actual, err := decodeRulesData(protoData)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, expected, actual, "protobuf should round trip the same rule sets as gob")
+
+	d := newDeserializer()
+	d.data = protoData
+	loaded, err := d.decode()
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, loaded, "engine should load protobuf rules")
+	}
+
+	_, err = decodeRulesetsProto(rulesPayload(protoData)[:len(rulesPayload(protoData))-1])
+	assert.Error(t, err, "truncated data should fail to decode")
+}
+
+func TestPreprocessIndexed(t *testing.T) {
+	dir := t.TempDir()
+	gobFile := filepath.Join(dir, "rulesets.gob")
+	indexedFile := filepath.Join(dir, "rulesets.idx")
+	Preprocessor.PreprocessTo("test", gobFile)
+	Preprocessor.PreprocessTo("test", indexedFile, WithIndexedFormat())
+	gobData, err := ioutil.ReadFile(gobFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rulesets, err := decodeRulesData(gobData)
+	if !assert.NoError(t, err) {
+		return
+	}
+	indexedData, err := ioutil.ReadFile(indexedFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	decoded, err := decodeRulesData(indexedData)
+	if assert.NoError(t, err) {
+		assert.Equal(t, rulesets, decoded, "indexed format should round trip the same rule sets as gob")
+	}
+
+	expected := New(WithRulesData(gobData))
+	h, err := NewFromRulesFile(indexedFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rs := h.plainTargets.Load().(map[string]*ruleset)["facebook.com"]
+	if assert.NotNil(t, rs) {
+		assert.Empty(t, rs.rule, "rules should only be compiled on first use")
+	}
+	for _, r := range rulesets {
+		for _, target := range r.Target {
+			u := toURL("http://" + strings.Replace(target.Host, "*", "x", -1) + "/path?q=1")
+			e, eok := expected.Rewrite(u)
+			a, aok := h.Rewrite(u)
+			assert.Equal(t, eok, aok, target.Host)
+			assert.Equal(t, e, a, target.Host)
+		}
+	}
+	if rs != nil {
+		assert.NotEmpty(t, rs.rule, "rules should be compiled once used")
+	}
+}
+
 func TestPreprocessor(t *testing.T) {
 	// We serialize and deserialize here to make sure that process is working and
 	// also that preprocessing operations like correcting the To matching rules
 	// are working correctly.
-	Preprocessor.preprocess("test", "test/test-gob.gob")
-
-	data, _ := ioutil.ReadFile("test/test-gob.gob")
-	buf := bytes.NewBuffer(data)
+	out := filepath.Join(t.TempDir(), "test-gob.gob")
+	Preprocessor.preprocess("test", out)
 
-	dec := gob.NewDecoder(buf)
+	data, _ := ioutil.ReadFile(out)
+	header, payload, err := splitRulesHeader(data)
+	if !assert.NoError(t, err) || !assert.NotNil(t, header, "preprocessed rules should have a header") {
+		return
+	}
+	assert.True(t, isStreamRules(payload), "rule sets should be written as a stream")
 	rulesets := make([]*Ruleset, 0)
-	err := dec.Decode(&rulesets)
+	err = decodeRulesetsStream(bytes.NewReader(payload), func(rs *Ruleset) {
+		rulesets = append(rulesets, rs)
+	})
 	assert.Nil(t, err)
 
 	assert.True(t, len(rulesets) > 50)
 
 	correctTos := 0
 	badTos := 0
+	wildcards := 0
 	for _, rs := range rulesets {
+		for _, target := range rs.Target {
+			if isPrefixTarget(target) || isSuffixTarget(target) {
+				wildcards++
+				assert.Equal(t, indexKey(target.Host), target.Key, "should have precomputed key for %v", target.Host)
+			} else {
+				assert.Empty(t, target.Key)
+			}
+		}
 		for _, r := range rs.Rule {
 			if strings.Contains(r.To, "${1}") {
 				correctTos++
@@ -49,7 +223,165 @@ func TestPreprocessor(t *testing.T) {
 		}
 	}
 
-	Preprocessor.log.Debugf("Correct tos: %v", correctTos)
+	t.Logf("Correct tos: %v", correctTos)
 	assert.True(t, correctTos > 0)
 	assert.Equal(t, 0, badTos)
+	assert.True(t, wildcards > 0)
+}
+
+func TestExpandSuffixTargets(t *testing.T) {
+	rs := unmarshallRuleset(`<ruleset name="RabbitMQ">
+		<target host="rabbitmq.com" />
+		<target host="rabbitmq.*" />
+		<target host="*.rabbitmq.org" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+
+	expandSuffixTargets(rs, []string{"com", "co.uk", "de"})
+
+	hosts := make([]string, 0, len(rs.Target))
+	for _, target := range rs.Target {
+		hosts = append(hosts, target.Host)
+	}
+	assert.Equal(t, []string{"rabbitmq.com", "rabbitmq.co.uk", "rabbitmq.de", "*.rabbitmq.org"}, hosts)
+}
+
+func TestPathScope(t *testing.T) {
+	scope := func(froms ...string) []string {
+		rules := make([]*Rule, 0, len(froms))
+		for _, from := range froms {
+			rules = append(rules, &Rule{From: from, To: "https:"})
+		}
+		return pathScope(rules)
+	}
+	assert.Equal(t, []string{"/news/", "/"}, scope(`^http://money\.cnn\.com/news/`, `^http://edition\.cnn\.com/`))
+	assert.Equal(t, []string{"/a"}, scope(`^http://example\.com/a(b|c)`))
+	assert.Nil(t, scope(`^http://example\.com/a`, `^http:`))
+	assert.Nil(t, scope(`^http://(www\.)?example\.com/a`))
+	assert.Nil(t, scope(`http://example\.com/a`))
+	assert.Nil(t, scope(`(?i)^http://example\.com/a`))
+	assert.Nil(t, scope())
+
+	rs := unmarshallRuleset(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http://example\.com/secure/" to="https://example.com/secure/" />
+	</ruleset>`)
+	rs.PathScope = pathScope(rs.Rule)
+	h := newEmpty()
+	plains, wildcards := newDeserializer().index([]*Ruleset{rs})
+	h.publish(plains, wildcards, 1)
+	for in, expected := range map[string]string{
+		"http://example.com/secure/a": "https://example.com/secure/a",
+		"http://example.com/other":    "",
+		"http://example.com":          "",
+	} {
+		r, _ := h.Rewrite(toURL(in))
+		assert.Equal(t, expected, r, in)
+	}
+}
+
+func TestPreviewTargets(t *testing.T) {
+	rs := unmarshallRuleset(`<ruleset name="RabbitMQ">
+		<target host="rabbitmq.com" />
+		<target host="rabbitmq.*" />
+		<target host="*.rabbitmq.org" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`)
+
+	hosts := PreviewTargets(rs, []string{"www", "a.b."}, []string{"com", ".de"})
+	assert.Equal(t, []string{"rabbitmq.com", "rabbitmq.de", "www.rabbitmq.org", "a.b.rabbitmq.org"}, hosts)
+}
+
+func TestMaxProgramSize(t *testing.T) {
+	rules := []byte(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http://(?:a|b|c|d|e|f|g|h)\w{1,50}\.example\.com/" to="https://example.com/" />
+	</ruleset>`)
+
+	_, processed := Preprocessor.VetRuleSet(rules)
+	assert.True(t, processed)
+
+	_, processed = Preprocessor.vetRuleSet(rules, &preprocessOptions{maxProgramSize: 50})
+	assert.False(t, processed, "rule set with oversized program should have been rejected")
+
+	size, err := programSize(`^http:`)
+	assert.Nil(t, err)
+	_, processed = Preprocessor.vetRuleSet(rules, &preprocessOptions{maxProgramSize: 10000})
+	assert.True(t, processed)
+	assert.True(t, size < 10)
+}
+
+func TestPreprocessBundles(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := Preprocessor.PreprocessBundles(dir, []Bundle{
+		{Name: "eff", Dirs: []string{"test"}},
+		{Name: "corp", Dirs: []string{"testrules"}},
+	}, WithSource("test"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Len(t, manifest.Bundles, 2) {
+		return
+	}
+	assert.Equal(t, "test", manifest.Source)
+	assert.Equal(t, "eff.gob", manifest.Bundles[0].File)
+	assert.Equal(t, "corp.gob", manifest.Bundles[1].File)
+
+	written, err := ioutil.ReadFile(filepath.Join(dir, ManifestFile))
+	assert.NoError(t, err)
+	var read Manifest
+	assert.NoError(t, json.Unmarshal(written, &read))
+	assert.Equal(t, *manifest, read)
+
+	for _, entry := range manifest.Bundles {
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.File))
+		assert.NoError(t, err)
+		rulesets, err := decodeRulesData(data)
+		assert.NoError(t, err)
+		assert.Equal(t, entry.Rulesets, len(rulesets))
+		assert.True(t, entry.Rulesets > 0)
+	}
+
+	_, err = Preprocessor.PreprocessBundles(dir, []Bundle{{Name: "eff"}, {Name: "eff"}})
+	assert.Error(t, err, "duplicate bundle names should be rejected")
+
+	for _, name := range []string{"", "..", "../eff", "eff/corp", `eff\corp`} {
+		_, err = Preprocessor.PreprocessBundles(dir, []Bundle{{Name: name}})
+		assert.Error(t, err, "bundle name %q should be rejected", name)
+	}
+}
+
+func TestValidateRulesetXML(t *testing.T) {
+	rs, issues := ValidateRulesetXML([]byte(`<ruleset name="Example">
+		<target host="example.com" />
+		<target host="*.example.*" />
+		<target host="Example.org" />
+		<exclusion pattern="^http://example\.com/(?!login)" />
+		<rule from="^http://(www\.)?example\.com/" to="https://$1example.com/" />
+	</ruleset>`))
+	if !assert.NotNil(t, rs) {
+		return
+	}
+	assert.Equal(t, "https://${1}example.com/", rs.Rule[0].To)
+
+	fields := make(map[string]Severity)
+	for _, issue := range issues {
+		fields[issue.Field] = issue.Severity
+	}
+	assert.Equal(t, map[string]Severity{
+		"target[1].host":       SeverityWarning,
+		"target[2].host":       SeverityWarning,
+		"exclusion[0].pattern": SeverityError,
+		"rule[0].to":           SeverityWarning,
+	}, fields)
+
+	rs, issues = ValidateRulesetXML([]byte(`<ruleset name="Example">`))
+	assert.Nil(t, rs)
+	assert.Len(t, issues, 1)
+
+	_, issues = ValidateRulesetXML([]byte(`<ruleset name="Example">
+		<target host="example.com" />
+		<rule from="^http:" to="https:" />
+	</ruleset>`))
+	assert.Empty(t, issues)
 }
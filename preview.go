@@ -0,0 +1,38 @@
+package httpseverywhere
+
+import "strings"
+
+// PreviewTargets enumerates example hosts covered by the targets of the given
+// rule set, to show how far a rule set reaches before enabling it. Plain
+// targets are returned as is, leading wildcards like "*.example.com" are
+// expanded with each of the given subdomains and trailing wildcards like
+// "example.*" with each of the given TLDs. Hosts are returned in target order
+// without duplicates.
+func PreviewTargets(rs *Ruleset, subdomains []string, tlds []string) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(host string) {
+		host = strings.ToLower(host)
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	for _, target := range rs.Target {
+		switch {
+		case isPrefixTarget(target):
+			base := strings.TrimPrefix(target.Host, "*")
+			for _, sub := range subdomains {
+				add(strings.Trim(sub, ".") + base)
+			}
+		case isSuffixTarget(target):
+			base := strings.TrimSuffix(target.Host, "*")
+			for _, tld := range tlds {
+				add(base + strings.Trim(tld, "."))
+			}
+		default:
+			add(target.Host)
+		}
+	}
+	return hosts
+}
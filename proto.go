@@ -0,0 +1,223 @@
+package httpseverywhere
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// protoMagic is the header that rules in the protobuf format start with, so
+// that they can be told apart from gob encoded ones. The message itself is
+// described by rulesets.proto.
+var protoMagic = []byte("HTTPSEpb")
+
+// Protobuf wire types used by the schema.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// encodeRulesetsProto serializes the given rule sets as a Rulesets message
+// preceded by protoMagic. The encoding is written by hand, since the schema
+// only has strings, nested messages and a bool, to avoid depending on a
+// protobuf library.
+func encodeRulesetsProto(rules []*Ruleset) []byte {
+	buf := append([]byte(nil), protoMagic...)
+	for _, rs := range rules {
+		buf = appendBytesField(buf, 1, encodeRulesetProto(rs))
+	}
+	return buf
+}
+
+func encodeRulesetProto(rs *Ruleset) []byte {
+	var buf []byte
+	buf = appendStringField(buf, 1, rs.Off)
+	buf = appendStringField(buf, 2, rs.Platform)
+	for _, t := range rs.Target {
+		var msg []byte
+		msg = appendStringField(msg, 1, t.Host)
+		msg = appendStringField(msg, 2, t.Key)
+		buf = appendBytesField(buf, 3, msg)
+	}
+	for _, e := range rs.Exclusion {
+		buf = appendBytesField(buf, 4, appendStringField(nil, 1, e.Pattern))
+	}
+	for _, r := range rs.Rule {
+		var msg []byte
+		msg = appendStringField(msg, 1, r.From)
+		msg = appendStringField(msg, 2, r.To)
+		buf = appendBytesField(buf, 5, msg)
+	}
+	for _, prefix := range rs.PathScope {
+		// Repeated strings are always written, even if empty.
+		buf = appendBytesField(buf, 6, []byte(prefix))
+	}
+	for _, note := range rs.Notes {
+		buf = appendBytesField(buf, 7, []byte(note))
+	}
+	if rs.Exclusive {
+		buf = appendUvarint(buf, 8<<3|wireVarint)
+		buf = appendUvarint(buf, 1)
+	}
+	buf = appendStringField(buf, 9, rs.Name)
+	buf = appendStringField(buf, 10, rs.File)
+	buf = appendStringField(buf, 11, rs.Source)
+	return buf
+}
+
+// appendStringField appends a string field, leaving it out if it's empty as
+// proto3 does.
+func appendStringField(buf []byte, field int, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	return appendBytesField(buf, field, []byte(s))
+}
+
+func appendBytesField(buf []byte, field int, b []byte) []byte {
+	buf = appendUvarint(buf, uint64(field)<<3|wireBytes)
+	buf = appendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	return append(buf, b[:n]...)
+}
+
+// isProtoRules returns whether or not the given data is in the protobuf
+// format.
+func isProtoRules(data []byte) bool {
+	return bytes.HasPrefix(data, protoMagic)
+}
+
+// decodeRulesetsProto decodes rule sets encoded by encodeRulesetsProto. Fields
+// it doesn't know are skipped, so that the schema can be extended.
+func decodeRulesetsProto(data []byte) ([]*Ruleset, error) {
+	if !isProtoRules(data) {
+		return nil, errors.New("missing protobuf rules header")
+	}
+	rulesets := make([]*Ruleset, 0)
+	err := eachField(data[len(protoMagic):], func(field int, b []byte) error {
+		if field != 1 {
+			return nil
+		}
+		rs, err := decodeRulesetProto(b)
+		if err != nil {
+			return err
+		}
+		rulesets = append(rulesets, rs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rulesets, nil
+}
+
+func decodeRulesetProto(data []byte) (*Ruleset, error) {
+	rs := &Ruleset{}
+	return rs, decodeRulesetProtoInto(rs, data)
+}
+
+// decodeRulesetProtoInto decodes the fields of the given Ruleset message into
+// rs, appending to any repeated fields it already has.
+func decodeRulesetProtoInto(rs *Ruleset, data []byte) error {
+	return eachField(data, func(field int, b []byte) error {
+		switch field {
+		case 1:
+			rs.Off = string(b)
+		case 2:
+			rs.Platform = string(b)
+		case 3:
+			t := &Target{}
+			rs.Target = append(rs.Target, t)
+			return eachField(b, func(field int, b []byte) error {
+				switch field {
+				case 1:
+					t.Host = string(b)
+				case 2:
+					t.Key = string(b)
+				}
+				return nil
+			})
+		case 4:
+			e := &Exclusion{}
+			rs.Exclusion = append(rs.Exclusion, e)
+			return eachField(b, func(field int, b []byte) error {
+				if field == 1 {
+					e.Pattern = string(b)
+				}
+				return nil
+			})
+		case 5:
+			r := &Rule{}
+			rs.Rule = append(rs.Rule, r)
+			return eachField(b, func(field int, b []byte) error {
+				switch field {
+				case 1:
+					r.From = string(b)
+				case 2:
+					r.To = string(b)
+				}
+				return nil
+			})
+		case 6:
+			rs.PathScope = append(rs.PathScope, string(b))
+		case 7:
+			rs.Notes = append(rs.Notes, string(b))
+		case 8:
+			v, _ := binary.Uvarint(b)
+			rs.Exclusive = v != 0
+		case 9:
+			rs.Name = string(b)
+		case 10:
+			rs.File = string(b)
+		case 11:
+			rs.Source = string(b)
+		}
+		return nil
+	})
+}
+
+// eachField calls fn with the number and contents of each field in the given
+// message, which are the encoded varint for varint fields. Any other wire type
+// is an error since the schema doesn't use them.
+func eachField(data []byte, fn func(field int, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), key&7
+		switch wireType {
+		case wireVarint:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			b := data[:n]
+			data = data[n:]
+			if err := fn(field, b); err != nil {
+				return err
+			}
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			b := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if err := fn(field, b); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d for field %d", wireType, field)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package httpseverywhere
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-radix"
+)
+
+// QuarantinedRuleset describes a rule set that was automatically disabled
+// because evaluating it was too slow.
+type QuarantinedRuleset struct {
+	// Name is the name of the rule set.
+	Name string
+	// Targets are the target hosts of the rule set.
+	Targets []string
+	// P99 is the 99th percentile evaluation time over the window that caused
+	// the rule set to be quarantined.
+	P99 time.Duration
+	// Since is when the rule set was quarantined.
+	Since time.Time
+	// Notes are the rule set's notes if the Engine was configured with
+	// WithRulesetNotes.
+	Notes []string
+}
+
+// quarantine tracks per-ruleset evaluation times and disables rulesets whose
+// 99th percentile evaluation time exceeds maxP99 over a window of samples.
+// Timings are recorded in shards so that concurrent evaluations of different
+// rulesets rarely contend. Quarantined rulesets are remembered by identity so
+// that they stay disabled when the indices are rebuilt.
+type quarantine struct {
+	maxP99 time.Duration
+	window int
+	shards [quarantineShards]quarantineShard
+	// mx guards quarantined and byIdentity.
+	mx          sync.Mutex
+	quarantined []*QuarantinedRuleset
+	byIdentity  map[string]bool
+}
+
+// quarantineShards is the number of shards timings are recorded in.
+const quarantineShards = 16
+
+// maxTimedPerShard is the number of rulesets whose timings each shard keeps,
+// evicting an arbitrary one to make room for more.
+const maxTimedPerShard = 256
+
+type quarantineShard struct {
+	mx      sync.Mutex
+	timings map[*ruleset]*rulesetTimings
+}
+
+type rulesetTimings struct {
+	// samples holds the current window, growing up to its size.
+	samples []time.Duration
+}
+
+func newQuarantine(maxP99 time.Duration, window int) *quarantine {
+	if window < 100 {
+		// We need at least 100 samples for a meaningful 99th percentile.
+		window = 100
+	}
+	q := &quarantine{
+		maxP99:     maxP99,
+		window:     window,
+		byIdentity: make(map[string]bool),
+	}
+	for i := range q.shards {
+		q.shards[i].timings = make(map[*ruleset]*rulesetTimings)
+	}
+	return q
+}
+
+// shard returns the shard that the timings of the given ruleset are recorded
+// in, spreading rulesets by their first target.
+func (q *quarantine) shard(r *ruleset) *quarantineShard {
+	var hash uint32 = 2166136261
+	if len(r.target) > 0 {
+		for i := 0; i < len(r.target[0]); i++ {
+			hash ^= uint32(r.target[0][i])
+			hash *= 16777619
+		}
+	}
+	return &q.shards[hash%quarantineShards]
+}
+
+// isQuarantined returns whether or not the given ruleset has been disabled.
+func (q *quarantine) isQuarantined(r *ruleset) bool {
+	return atomic.LoadInt32(&r.quarantined) == 1
+}
+
+// record records a single evaluation of the given ruleset, quarantining it if
+// this fills a window whose 99th percentile is over the limit.
+func (q *quarantine) record(r *ruleset, dur time.Duration, now time.Time) {
+	shard := q.shard(r)
+	shard.mx.Lock()
+	t := shard.timings[r]
+	if t == nil {
+		if len(shard.timings) >= maxTimedPerShard {
+			for evicted := range shard.timings {
+				delete(shard.timings, evicted)
+				break
+			}
+		}
+		t = &rulesetTimings{}
+		shard.timings[r] = t
+	}
+	t.samples = append(t.samples, dur)
+	if len(t.samples) < q.window {
+		shard.mx.Unlock()
+		return
+	}
+
+	// We've filled a window, check it and start a new one.
+	sorted := make([]time.Duration, len(t.samples))
+	copy(sorted, t.samples)
+	t.samples = t.samples[:0]
+	shard.mx.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p99 := sorted[percentileIndex(len(sorted), 99)]
+	if p99 <= q.maxP99 {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&r.quarantined, 0, 1) {
+		shard.mx.Lock()
+		delete(shard.timings, r)
+		shard.mx.Unlock()
+		q.mx.Lock()
+		defer q.mx.Unlock()
+		identity := r.identity()
+		if q.byIdentity[identity] {
+			return
+		}
+		q.byIdentity[identity] = true
+		q.quarantined = append(q.quarantined, &QuarantinedRuleset{
+			Name:    r.name,
+			Targets: r.target,
+			P99:     p99,
+			Since:   now,
+			Notes:   r.notes,
+		})
+	}
+}
+
+// percentileIndex returns the index of the given percentile in n sorted
+// samples, using the nearest-rank method so that with 100 samples the 99th
+// percentile is the second slowest rather than the slowest, which a single GC
+// pause could make arbitrarily slow.
+func percentileIndex(n int, percentile int) int {
+	return (n*percentile+99)/100 - 1
+}
+
+// restore quarantines the given ruleset if one with the same identity was
+// quarantined before, such as when the indices are rebuilt with new copies of
+// the rulesets.
+func (q *quarantine) restore(r *ruleset) {
+	if r == nil || atomic.LoadInt32(&r.quarantined) == 1 {
+		return
+	}
+	q.mx.Lock()
+	quarantined := q.byIdentity[r.identity()]
+	q.mx.Unlock()
+	if quarantined {
+		atomic.StoreInt32(&r.quarantined, 1)
+	}
+}
+
+// published carries the quarantine over to the rulesets in the given indices
+// before they're published and drops the timings of the rulesets they
+// replace.
+func (q *quarantine) published(plains map[string]*ruleset, wildcards *radix.Tree) {
+	for i := range q.shards {
+		shard := &q.shards[i]
+		shard.mx.Lock()
+		shard.timings = make(map[*ruleset]*rulesetTimings)
+		shard.mx.Unlock()
+	}
+	q.mx.Lock()
+	quarantined := make([]*QuarantinedRuleset, len(q.quarantined))
+	copy(quarantined, q.quarantined)
+	q.mx.Unlock()
+	for _, qr := range quarantined {
+		for _, target := range qr.Targets {
+			q.restore(indexedRuleset(plains, wildcards, target))
+		}
+	}
+}
+
+// list returns copies of all quarantined rulesets.
+func (q *quarantine) list() []QuarantinedRuleset {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	result := make([]QuarantinedRuleset, 0, len(q.quarantined))
+	for _, qr := range q.quarantined {
+		result = append(result, *qr)
+	}
+	return result
+}
+
+// slowest returns up to n of the rule sets with the slowest evaluation time in
+// their current window, slowest first.
+func (q *quarantine) slowest(n int) []SlowRuleset {
+	var result []SlowRuleset
+	for i := range q.shards {
+		shard := &q.shards[i]
+		shard.mx.Lock()
+		for r, t := range shard.timings {
+			var max time.Duration
+			for _, sample := range t.samples {
+				if sample > max {
+					max = sample
+				}
+			}
+			result = append(result, SlowRuleset{Targets: r.target, Max: max})
+		}
+		shard.mx.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Max > result[j].Max })
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// WithSlowRulesetQuarantine automatically disables rule sets whose 99th
+// percentile evaluation time over a window of the given number of evaluations
+// exceeds maxP99. Quarantined rule sets are available from Quarantined, and
+// stay disabled when the rules are updated or the indices are rebuilt as long
+// as their name and targets are unchanged.
+func WithSlowRulesetQuarantine(maxP99 time.Duration, window int) Option {
+	return func(h *Engine) {
+		h.quarantine = newQuarantine(maxP99, window)
+	}
+}
+
+// Quarantined returns the rule sets that have been automatically disabled for
+// being too slow. It is always empty unless the Engine was configured with
+// WithSlowRulesetQuarantine.
+func (h *Engine) Quarantined() []QuarantinedRuleset {
+	if h.quarantine == nil {
+		return nil
+	}
+	return h.quarantine.list()
+}
@@ -0,0 +1,50 @@
+package httpseverywhere
+
+import (
+	"sync"
+	"time"
+)
+
+// compileQuota limits how many regular expressions are compiled per second,
+// so that loading or reloading a large number of rulesets at once doesn't
+// cause CPU spikes.
+type compileQuota struct {
+	perSecond   int
+	mx          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+func newCompileQuota(perSecond int) *compileQuota {
+	return &compileQuota{perSecond: perSecond}
+}
+
+// wait blocks until compiling another regular expression is within quota.
+func (q *compileQuota) wait(clock Clock) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	now := clock.Now()
+	if now.Sub(q.windowStart) >= time.Second {
+		q.windowStart = now
+		q.count = 0
+	}
+	if q.count >= q.perSecond {
+		// Holding the lock while sleeping makes everyone else wait their turn.
+		clock.Sleep(q.windowStart.Add(time.Second).Sub(now))
+		q.windowStart = clock.Now()
+		q.count = 0
+	}
+	q.count++
+}
+
+// WithCompileQuota limits how many regular expressions may be compiled per
+// second when loading rules or compiling them on first use with
+// WithLazyCompilation, smoothing out CPU usage when a lot of rule sets are
+// compiled at once at the cost of taking longer to compile them.
+func WithCompileQuota(perSecond int) Option {
+	return func(h *Engine) {
+		if perSecond > 0 {
+			h.compileQuota = newCompileQuota(perSecond)
+		}
+	}
+}
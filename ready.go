@@ -0,0 +1,46 @@
+package httpseverywhere
+
+import (
+	"context"
+	"sync"
+)
+
+// readiness signals when the rules have first loaded.
+type readiness struct {
+	once sync.Once
+	ch   chan struct{}
+	err  error
+}
+
+func newReadiness() *readiness {
+	return &readiness{ch: make(chan struct{})}
+}
+
+// done marks the rules as loaded, or as having failed to load with the given
+// error. Only the first call has any effect.
+func (r *readiness) done(err error) {
+	r.once.Do(func() {
+		r.err = err
+		close(r.ch)
+	})
+}
+
+// Ready returns a channel that's closed once loading the rules has finished,
+// whether or not it succeeded. Until then, with WithAsyncInit or
+// WithInitDeadline, URLs may go unrewritten, so proxies can use it to hold
+// traffic until the rules are in place or to measure how long they weren't.
+func (h *Engine) Ready() <-chan struct{} {
+	return h.ready.ch
+}
+
+// WaitReady waits for loading the rules to finish or for ctx to be done. It
+// returns the error loading failed with, if any, or ctx's error if it was done
+// first.
+func (h *Engine) WaitReady(ctx context.Context) error {
+	select {
+	case <-h.ready.ch:
+		return h.ready.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
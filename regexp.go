@@ -0,0 +1,117 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// compileRegexp compiles the given pattern, rejecting it if its compiled
+// program has more than max instructions. A max of 0 means no limit.
+func compileRegexp(pattern string, max int) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil || max <= 0 {
+		return re, err
+	}
+	size, err := programSize(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if size > max {
+		return nil, fmt.Errorf("program size %d of %v exceeds maximum of %d", size, pattern, max)
+	}
+	return re, nil
+}
+
+// programSize returns the number of instructions in the compiled program for
+// the given pattern, which is a reasonable proxy for both the memory it uses
+// and the worst case time it takes to match.
+func programSize(pattern string) (int, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return 0, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0, err
+	}
+	return len(prog.Inst), nil
+}
+
+// failClosedExclusion returns an exclusion pattern that matches at least
+// every URL the given pattern would match, for use in its place when it can't
+// be compiled. If the pattern is anchored to a literal prefix, like the
+// "^http://example\.com/" of "^http://example\.com/(?!secure/)", that's
+// every URL with the prefix, otherwise it's every URL.
+func failClosedExclusion(pattern string) string {
+	return "^" + regexp.QuoteMeta(anchoredLiteralPrefix(pattern))
+}
+
+// anchoredLiteralPrefix returns the literal text that any match of the given
+// pattern must start with, as best as can be determined without parsing it.
+// It's empty unless the pattern starts with '^' and has no alternation
+// outside of groups, which could otherwise allow matches without the prefix.
+func anchoredLiteralPrefix(pattern string) string {
+	if len(pattern) == 0 || pattern[0] != '^' || hasTopLevelAlternation(pattern) {
+		return ""
+	}
+	var prefix []byte
+	for i := 1; i < len(pattern); {
+		c := pattern[i]
+		size := 1
+		switch {
+		case c == '\\':
+			if i+1 >= len(pattern) || !isASCIIPunct(pattern[i+1]) {
+				// Character classes like \w and anything else we don't know.
+				return string(prefix)
+			}
+			c = pattern[i+1]
+			size = 2
+		case strings.IndexByte(".[]()*+?{}|^$", c) >= 0:
+			// A metacharacter.
+			return string(prefix)
+		}
+		i += size
+		if i < len(pattern) && (pattern[i] == '*' || pattern[i] == '?' || pattern[i] == '{') {
+			// The character is optional or repeated.
+			return string(prefix)
+		}
+		prefix = append(prefix, c)
+	}
+	return string(prefix)
+}
+
+// hasTopLevelAlternation returns whether or not the given pattern contains a
+// '|' that isn't escaped or inside of a group or character class.
+func hasTopLevelAlternation(pattern string) bool {
+	depth := 0
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				// A leading ']' is literal.
+				i++
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '|' && depth <= 0:
+			return true
+		}
+	}
+	return false
+}
+
+func isASCIIPunct(c byte) bool {
+	return c < 0x80 && (c >= '!' && c <= '/' || c >= ':' && c <= '@' || c >= '[' && c <= '`' || c >= '{' && c <= '~')
+}
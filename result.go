@@ -0,0 +1,100 @@
+package httpseverywhere
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RewriteResult describes the outcome of rewriting a URL.
+type RewriteResult struct {
+	// URL is the rewritten URL, or empty if the URL wasn't rewritten.
+	URL string
+	// Rewritten indicates whether or not the URL was rewritten.
+	Rewritten bool
+	// Host is the host (including any port) of the rewritten URL, which is the
+	// authoritative host for the request after rewriting.
+	Host string
+	// Ruleset is the name of the rule set that rewrote the URL, which with
+	// WithRewriteChaining is the one that rewrote it first. It's empty if the
+	// URL wasn't rewritten or was only changed by a Normalizer.
+	Ruleset string
+	// RulesetFile and RulesetSource are the file and source the rule set was
+	// preprocessed from, as recorded in Ruleset.File and Ruleset.Source, for
+	// tracing a bad rewrite back to the upstream rule set file.
+	RulesetFile   string
+	RulesetSource string
+	// HostChanged indicates that the rule moved the request to a different
+	// host, for example jobsearch.money.cnn.com to cnnmoney.jobamatic.com.
+	HostChanged bool
+	// Generation is the generation of the rules that were in use, as returned
+	// by Engine.Generation.
+	Generation int64
+	// Chain lists each successive rewrite of the URL when rewrites are chained
+	// with WithRewriteChaining, ending with URL. It's empty otherwise.
+	Chain []string
+	// Advisories flags reasons the rewrite is less certain to work than a
+	// plain upgrade.
+	Advisories Advisory
+	// HeldBack is set if the URL would have been rewritten to URL but
+	// WithSoftLaunch held the rewrite back because of its advisories. Rewritten
+	// is false then.
+	HeldBack bool
+}
+
+// Evaluate is like Rewrite but returns a RewriteResult describing the
+// rewrite, including the host the rewritten URL points to. It counts towards
+// the stats, decision log and tracing like Rewrite.
+func (h *Engine) Evaluate(u *url.URL) *RewriteResult {
+	generation := h.Generation()
+	o := h.rewriteTraced(context.Background(), u)
+	if !o.ok && !o.heldBack {
+		return &RewriteResult{Generation: generation}
+	}
+	result := &RewriteResult{
+		URL:        o.r,
+		Rewritten:  o.ok,
+		Generation: generation,
+		Chain:      o.chain,
+		Advisories: o.advisories,
+		HeldBack:   o.heldBack,
+	}
+	if o.rs != nil {
+		result.Ruleset = o.rs.name
+		result.RulesetFile = o.rs.file
+		result.RulesetSource = o.rs.source
+	}
+	if rewritten, err := url.Parse(o.r); err == nil {
+		result.Host = rewritten.Host
+		result.HostChanged = !strings.EqualFold(rewritten.Hostname(), u.Hostname())
+	}
+	return result
+}
+
+// ServerName returns the name to use for SNI when connecting to the rewritten
+// URL, which is its host without any port.
+func (r *RewriteResult) ServerName() string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+// ApplyTo points the given request at the rewritten URL. Since proxies
+// typically forward the Host header as is, this also sets the request's Host
+// to the new host so that host-moving rewrites reach the right virtual host.
+// ApplyTo does nothing if the URL wasn't rewritten.
+func (r *RewriteResult) ApplyTo(req *http.Request) error {
+	if !r.Rewritten {
+		return nil
+	}
+	rewritten, err := url.Parse(r.URL)
+	if err != nil {
+		return err
+	}
+	req.URL = rewritten
+	req.Host = rewritten.Host
+	return nil
+}
@@ -0,0 +1,241 @@
+package httpseverywhere
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keepCachedBundles is the number of bundles kept in the rules cache,
+// including the current one.
+const keepCachedBundles = 2
+
+// cachedRules describes the current bundle in the rules cache.
+type cachedRules struct {
+	// Version is the version of the cached bundle.
+	Version string `json:"version"`
+	// Base is the version of the rules the Engine was configured with, either
+	// the built-in ones or those given with WithRulesData, when the bundle was
+	// cached. The bundle is only used while the configured rules are the same,
+	// since otherwise the configured ones are likely newer.
+	Base    string    `json:"base"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// DefaultRulesCacheDir returns the directory WithRulesCache uses, which is
+// "httpseverywhere" in the user's cache directory, as given by
+// $XDG_CACHE_HOME on Linux for example.
+func DefaultRulesCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "httpseverywhere"), nil
+}
+
+// WithRulesCache is like WithRulesCacheDir using DefaultRulesCacheDir. It has
+// no effect if there is no user cache directory.
+func WithRulesCache() Option {
+	return func(h *Engine) {
+		dir, err := DefaultRulesCacheDir()
+		if err != nil {
+			h.log.Errorf("Not caching rules: %v", err)
+			return
+		}
+		h.rulesCacheDir = dir
+	}
+}
+
+// WithRulesCacheDir stores rules swapped in by updates in dir and loads the
+// most recent ones from there on startup instead of the configured rules, as
+// long as those haven't changed since, like when the application has been
+// upgraded with newer built-in rules. Cached bundles are checked against their
+// version and decoded before use, falling back to the configured rules if
+// they're invalid, and older ones are evicted. Compiled regular expressions
+// can't be serialized, so only the bundles themselves are cached. Unless
+// WithUpdateStateFile is given, the validators for conditional downloads are
+// kept there too.
+func WithRulesCacheDir(dir string) Option {
+	return func(h *Engine) {
+		h.rulesCacheDir = dir
+	}
+}
+
+// rulesCacheFile returns the path of the given file in the rules cache.
+func (h *Engine) rulesCacheFile(name string) string {
+	return filepath.Join(h.rulesCacheDir, name)
+}
+
+// cachedBundlePrefix starts the names of the bundles in the rules cache, so
+// that evicting them leaves other files in the directory alone.
+const cachedBundlePrefix = "rules-"
+
+// bundleFile returns the name of the bundle with the given version.
+func bundleFile(version string) string {
+	return cachedBundlePrefix + version + ".gob"
+}
+
+// isBundleFile returns whether or not the file with the given name is a bundle
+// written to the rules cache.
+func isBundleFile(name string) bool {
+	if !strings.HasPrefix(name, cachedBundlePrefix) || !strings.HasSuffix(name, ".gob") {
+		return false
+	}
+	version := name[len(cachedBundlePrefix) : len(name)-len(".gob")]
+	_, err := hex.DecodeString(version)
+	return err == nil && len(version) == hex.EncodedLen(sha256.Size)
+}
+
+// loadCachedRules makes the Engine use the current bundle in the rules cache
+// if it's intact and was cached for the configured rules, returning whether or
+// not it does, and otherwise leaves the configured rules in place. The bundle
+// is only decoded when it's loaded, which falls back to the configured rules
+// if that fails. The caller must hold h.updateMx.
+func (h *Engine) loadCachedRules() bool {
+	if h.rulesCacheDir == "" || h.skipBuiltin {
+		return false
+	}
+	data, err := h.cachedRules()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.log.Errorf("Not using cached rules: %v", err)
+		}
+		return false
+	}
+	h.updatedData.Store(data)
+	return true
+}
+
+// cachedRules returns the current bundle in the rules cache if it can be used.
+func (h *Engine) cachedRules() ([]byte, error) {
+	b, err := ioutil.ReadFile(h.rulesCacheFile("current.json"))
+	if err != nil {
+		return nil, err
+	}
+	var current cachedRules
+	if err := json.Unmarshal(b, &current); err != nil {
+		return nil, err
+	}
+	base, err := h.baseRulesVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current.Base != base {
+		return nil, fmt.Errorf("cached for rules %v but configured with %v", current.Base, base)
+	}
+	data, err := ioutil.ReadFile(h.rulesCacheFile(bundleFile(current.Version)))
+	if err != nil {
+		return nil, err
+	}
+	uncompressed, err := decompressed(data)
+	if err != nil {
+		return nil, err
+	}
+	if version := rulesVersion(uncompressed); version != current.Version {
+		return nil, fmt.Errorf("cached bundle is corrupt, expected version %v but got %v", current.Version, version)
+	}
+	return data, nil
+}
+
+// cacheRules stores the given rules data as the current bundle in the rules
+// cache, if any, and evicts old bundles.
+func (h *Engine) cacheRules(data []byte) {
+	if h.rulesCacheDir == "" {
+		return
+	}
+	if err := h.storeCachedRules(data); err != nil {
+		h.log.Errorf("Unable to cache rules: %v", err)
+	}
+}
+
+func (h *Engine) storeCachedRules(data []byte) error {
+	uncompressed, err := decompressed(data)
+	if err != nil {
+		return err
+	}
+	base, err := h.baseRulesVersion()
+	if err != nil {
+		return err
+	}
+	current := &cachedRules{
+		Version: rulesVersion(uncompressed),
+		Base:    base,
+		SavedAt: h.clock.Now(),
+	}
+	if err := os.MkdirAll(h.rulesCacheDir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomically(h.rulesCacheFile(bundleFile(current.Version)), data); err != nil {
+		return err
+	}
+	b, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(h.rulesCacheFile("current.json"), b); err != nil {
+		return err
+	}
+	return h.evictCachedRules(current.Version)
+}
+
+// baseRulesVersion returns the version of the rules the Engine was configured
+// with, regardless of any updates. It's only computed once, since those never
+// change.
+func (h *Engine) baseRulesVersion() (string, error) {
+	h.baseVersionOnce.Do(func() {
+		d := newDeserializer()
+		d.data = h.rulesData
+		data, err := d.rulesData()
+		if err != nil {
+			h.baseVersionErr = err
+			return
+		}
+		h.baseVersion = rulesVersion(data)
+	})
+	return h.baseVersion, h.baseVersionErr
+}
+
+// evictCachedRules removes all but the most recently modified bundles from the
+// rules cache, always keeping the current one. Only files named like bundles
+// written by the cache are considered.
+func (h *Engine) evictCachedRules(current string) error {
+	files, err := ioutil.ReadDir(h.rulesCacheDir)
+	if err != nil {
+		return err
+	}
+	var bundles []os.FileInfo
+	for _, file := range files {
+		if isBundleFile(file.Name()) && file.Name() != bundleFile(current) {
+			bundles = append(bundles, file)
+		}
+	}
+	sort.Slice(bundles, func(i, j int) bool {
+		return bundles[i].ModTime().After(bundles[j].ModTime())
+	})
+	for i, file := range bundles {
+		if i < keepCachedBundles-1 {
+			continue
+		}
+		if err := os.Remove(h.rulesCacheFile(file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomically writes data to a temporary file and renames it to path,
+// so that readers never see a partially written file.
+func writeFileAtomically(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -1,31 +1,66 @@
 package httpseverywhere
 
-import "regexp"
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/armon/go-radix"
+)
 
 // Target is the target host for a given rule.
 type Target struct {
-	Host string `xml:"host,attr"`
+	Host string `xml:"host,attr" json:"host"`
+	// Key is the precomputed key the target is indexed under, set by the
+	// preprocessor for wildcard targets so that loading doesn't have to derive
+	// it. It's computed at load time if empty.
+	Key string `xml:"-" json:"-"`
 }
 
 // Exclusion is a RE pattern to ignore when processing a rule set.
 type Exclusion struct {
-	Pattern string `xml:"pattern,attr"`
+	Pattern string `xml:"pattern,attr" json:"pattern"`
 }
 
 // Rule is a rule to apply when processing a URL.
 type Rule struct {
-	From string `xml:"from,attr"`
-	To   string `xml:"to,attr"`
+	From string `xml:"from,attr" json:"from"`
+	To   string `xml:"to,attr" json:"to"`
 }
 
 // Ruleset is a set of rules to apply to a set of targets with flags for things
 // like whether or not the set is active, targets, rules, exclusions, etc.
 type Ruleset struct {
-	Off       string       `xml:"default_off,attr"`
-	Platform  string       `xml:"platform,attr"`
-	Target    []*Target    `xml:"target"`
-	Exclusion []*Exclusion `xml:"exclusion"`
-	Rule      []*Rule      `xml:"rule"`
+	// Name is the rule set's name, like "EFF".
+	Name      string       `xml:"name,attr" json:"name"`
+	Off       string       `xml:"default_off,attr,omitempty" json:"default_off,omitempty"`
+	Platform  string       `xml:"platform,attr,omitempty" json:"platform,omitempty"`
+	Target    []*Target    `xml:"target" json:"target"`
+	Exclusion []*Exclusion `xml:"exclusion" json:"exclusion,omitempty"`
+	Rule      []*Rule      `xml:"rule" json:"rule"`
+	// PathScope lists path prefixes at least one of which a URL's path must
+	// start with for any of the rules to match, as derived by the
+	// preprocessor. It's empty if the rules may match any path.
+	PathScope []string `xml:"-" json:"path_scope,omitempty"`
+	// Notes are upstream's comments in the rule set file, like the reason it's
+	// off by default or which parts of the site break over HTTPS.
+	Notes []string `xml:"-" json:"notes,omitempty"`
+	// Exclusive declares that this rule set alone handles its targets, so that
+	// candidate rule sets from indices checked after it aren't evaluated for
+	// them even if it doesn't rewrite the URL. Rule sets checked before it,
+	// which have more specific targets with the default lookup order, still
+	// apply. It's never set by upstream but may be set on custom rule sets,
+	// including with an exclusive="true" attribute in XML.
+	Exclusive bool `xml:"exclusive,attr,omitempty" json:"exclusive,omitempty"`
+	// File is the name of the rule set file the preprocessor read the rule
+	// set from, like "EFF.xml", and Source where the rules came from, like an
+	// upstream commit, as given with WithSource.
+	File   string `xml:"-" json:"file,omitempty"`
+	Source string `xml:"-" json:"source,omitempty"`
+	// body holds the encoded rules and exclusions of a rule set decoded from
+	// the indexed format, which are only decoded when first needed.
+	body []byte
 }
 
 // The below types are simplified in-memory representations for what we
@@ -45,6 +80,164 @@ type rule struct {
 // ruleset is a set of rules to apply to a set of targets with flags for things
 // like whether or not the set is active, targets, rules, exclusions, etc.
 type ruleset struct {
+	name      string
+	file      string
+	source    string
+	target    []string
 	exclusion []exclusion
 	rule      []rule
+	pathScope []string
+	notes     []string
+	exclusive bool
+	// quarantined is set to 1 when the ruleset has been disabled for being
+	// too slow.
+	quarantined int32
+	// lazy, if set, holds the rules and exclusions to compile on first use.
+	lazy *lazyRules
+}
+
+// inScope returns whether or not the given URL's path is within the
+// ruleset's path scope, if it has one.
+func (r *ruleset) inScope(u *url.URL) bool {
+	if len(r.pathScope) == 0 {
+		return true
+	}
+	path := u.EscapedPath()
+	for _, prefix := range r.pathScope {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathScope derives the path prefixes that a URL has to start with for any of
+// the given rules to match, or nil if they may match any path. This is the
+// case when every rule is anchored to a literal prefix that includes the
+// start of the path, like "^http://example\.com/news/".
+func pathScope(rules []*Rule) []string {
+	if len(rules) == 0 {
+		return nil
+	}
+	scope := make([]string, 0, len(rules))
+	for _, r := range rules {
+		if !strings.HasPrefix(r.From, "^") {
+			return nil
+		}
+		re, err := regexp.Compile(r.From)
+		if err != nil {
+			return nil
+		}
+		literal, _ := re.LiteralPrefix()
+		if !strings.HasPrefix(literal, "http://") {
+			return nil
+		}
+		slash := strings.Index(literal[len("http://"):], "/")
+		if slash < 0 {
+			return nil
+		}
+		scope = append(scope, literal[len("http://")+slash:])
+	}
+	return scope
+}
+
+// export returns the ruleset as a Ruleset. Rules and exclusions that didn't
+// compile are missing from it. Those of rulesets compiled on first use are
+// compiled if compile is set, or else taken as loaded if they haven't been
+// compiled yet, including any that won't compile.
+func (r *ruleset) export(compile bool) *Ruleset {
+	rs := &Ruleset{
+		Name:      r.name,
+		File:      r.file,
+		Source:    r.source,
+		PathScope: r.pathScope,
+		Notes:     r.notes,
+		Exclusive: r.exclusive,
+	}
+	for _, target := range r.target {
+		rs.Target = append(rs.Target, &Target{Host: target})
+	}
+	if l := r.lazy; l != nil && !compile && atomic.LoadInt32(&l.compiledFlag) == 0 {
+		if src, err := l.source(); err == nil {
+			rs.Exclusion, rs.Rule = src.Exclusion, src.Rule
+		}
+		return rs
+	}
+	r.compiled()
+	for _, e := range r.exclusion {
+		rs.Exclusion = append(rs.Exclusion, &Exclusion{Pattern: e.pattern.String()})
+	}
+	for _, rule := range r.rule {
+		rs.Rule = append(rs.Rule, &Rule{From: rule.from.String(), To: rule.to})
+	}
+	return rs
+}
+
+// identity returns a key identifying the ruleset by its name and targets,
+// which stays the same when the ruleset is loaded again, like when the
+// indices are rebuilt or the rules are updated.
+func (r *ruleset) identity() string {
+	return r.name + "\x00" + strings.Join(r.target, "\x00")
+}
+
+// indexedRuleset returns the ruleset indexed under the given target in the
+// given indices, if any.
+func indexedRuleset(plains map[string]*ruleset, wildcards *radix.Tree, target string) *ruleset {
+	if !strings.HasPrefix(target, "*") && !strings.HasSuffix(target, "*") {
+		return plains[target]
+	}
+	if v, ok := wildcards.Get(indexKey(target)); ok {
+		return v.(*ruleset)
+	}
+	return nil
+}
+
+// apply rewrites the given URL with the ruleset's own path scope, exclusions
+// and rules alone, without any of the Engine's overrides, limits, quarantine
+// or bookkeeping.
+func (r *ruleset) apply(u *url.URL) (string, bool) {
+	if !r.inScope(u) {
+		return "", false
+	}
+	r.compiled()
+	s := matchString(u)
+	for _, exclude := range r.exclusion {
+		if exclude.pattern.MatchString(s) {
+			return "", false
+		}
+	}
+	for _, rule := range r.rule {
+		if rule.from.MatchString(s) {
+			return rule.from.ReplaceAllString(s, rule.to) + fragment(u), true
+		}
+	}
+	return "", false
+}
+
+// matchesHost returns whether or not the given host matches any of the
+// ruleset's targets.
+func (r *ruleset) matchesHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, target := range r.target {
+		if targetMatches(host, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetMatches returns whether or not the given host matches the given
+// target, which may have a wildcard either as its first or last label.
+func targetMatches(host string, target string) bool {
+	switch {
+	case strings.HasPrefix(target, "*."):
+		suffix := target[1:]
+		return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+	case strings.HasSuffix(target, ".*"):
+		prefix := target[:len(target)-1]
+		tld := strings.TrimPrefix(host, prefix)
+		return len(tld) < len(host) && tld != "" && !strings.Contains(tld, ".")
+	default:
+		return host == target
+	}
 }
@@ -0,0 +1,329 @@
+package httpseverywhere
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// httpseStats accumulates timing stats for rewrites. All fields are accessed
+// atomically, so that concurrent rewrites never wait on each other to record
+// their timings.
+type httpseStats struct {
+	runs int64
+	// totalTime and max are in nanoseconds.
+	totalTime int64
+	max       int64
+	maxHost   atomic.Value // string
+	// requests counts the URLs given to be rewritten, and rewritten those of
+	// them that were.
+	requests  int64
+	rewritten int64
+	// updateFailures counts failed automatic updates.
+	updateFailures int64
+	// recent holds the durations of the most recent rewrites in nanoseconds,
+	// with next counting the rewrites recorded in it.
+	recent [recentSamples]int64
+	next   uint64
+	// histogram counts the rewrites by duration, in the buckets bounded by
+	// histogramBounds, with the last one counting those above all of them.
+	histogram [len(histogramBounds) + 1]int64
+	// since is when the stats started being collected, or were last reset.
+	since atomic.Value // time.Time
+}
+
+// histogramBounds are the inclusive upper bounds of the latency histogram's
+// buckets, following a 1-2-5 series from a microsecond to ten seconds so that
+// a fixed number of buckets covers both typical and pathological rewrites.
+var histogramBounds = [...]time.Duration{
+	1 * time.Microsecond, 2 * time.Microsecond, 5 * time.Microsecond,
+	10 * time.Microsecond, 20 * time.Microsecond, 50 * time.Microsecond,
+	100 * time.Microsecond, 200 * time.Microsecond, 500 * time.Microsecond,
+	1 * time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second, 2 * time.Second, 5 * time.Second,
+	10 * time.Second,
+}
+
+// HistogramBucket counts the rewrites that took at most UpperBound but longer
+// than the previous bucket's bound. The last bucket has no upper bound, which
+// is reported as 0.
+type HistogramBucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      int64         `json:"count"`
+}
+
+// recentSamples is the number of recent rewrite durations that percentiles are
+// computed from.
+const recentSamples = 1024
+
+// StatsSnapshot summarizes the time taken by rewrites, as collected unless
+// turned off with WithStats(false).
+type StatsSnapshot struct {
+	// Since is when the stats started being collected, or were last reset
+	// with ResetStats.
+	Since time.Time `json:"since"`
+	// Requests is the number of URLs given to be rewritten, and Rewritten the
+	// number of those that were.
+	Requests  int64 `json:"requests"`
+	Rewritten int64 `json:"rewritten"`
+	// InvalidRewrites is the number of rewrites discarded by
+	// WithRewriteValidation.
+	InvalidRewrites int64 `json:"invalid_rewrites"`
+	// Runs is the number of times rules were evaluated for http URLs, which
+	// the rest of the stats are about.
+	Runs int64 `json:"runs"`
+	// Total is the total time taken by rewrites, and Mean the average.
+	Total time.Duration `json:"total"`
+	Mean  time.Duration `json:"mean"`
+	// P50 and P99 are the median and 99th percentile of the time taken by the
+	// most recent rewrites.
+	P50 time.Duration `json:"p50"`
+	P99 time.Duration `json:"p99"`
+	// Histogram counts all rewrites by how long they took, from which
+	// Percentile estimates percentiles over all of them.
+	Histogram []HistogramBucket `json:"histogram,omitempty"`
+	// Max is the longest time taken by a rewrite, and MaxHost the URL it was
+	// for.
+	Max     time.Duration `json:"max"`
+	MaxHost string        `json:"max_host,omitempty"`
+}
+
+// Stats returns a snapshot of the timing stats for rewrites, so that they can
+// be surfaced in dashboards. It marshals to JSON for reporting elsewhere.
+func (h *Engine) Stats() StatsSnapshot {
+	snapshot := h.stats.snapshot()
+	snapshot.InvalidRewrites = atomic.LoadInt64(&h.invalidRewrites.count)
+	return snapshot
+}
+
+func (s *httpseStats) snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		Requests:  atomic.LoadInt64(&s.requests),
+		Rewritten: atomic.LoadInt64(&s.rewritten),
+		Runs:      atomic.LoadInt64(&s.runs),
+		Total:     time.Duration(atomic.LoadInt64(&s.totalTime)),
+		Max:       time.Duration(atomic.LoadInt64(&s.max)),
+	}
+	if snapshot.Runs > 0 {
+		snapshot.Mean = snapshot.Total / time.Duration(snapshot.Runs)
+	}
+	snapshot.MaxHost, _ = s.maxHost.Load().(string)
+	snapshot.Since, _ = s.since.Load().(time.Time)
+	s.summarize(&snapshot, atomic.LoadUint64(&s.next), atomic.LoadInt64)
+	return snapshot
+}
+
+// summarize fills in the percentiles and histogram of the snapshot from the
+// first n recent durations and the histogram buckets, read with load.
+func (s *httpseStats) summarize(snapshot *StatsSnapshot, n uint64, load func(*int64) int64) {
+	if n > recentSamples {
+		n = recentSamples
+	}
+	samples := make([]time.Duration, n)
+	for i := range samples {
+		samples[i] = time.Duration(atomic.LoadInt64(&s.recent[i]))
+	}
+	dist := NewLatencyDistribution(samples)
+	snapshot.P50 = dist.P50
+	snapshot.P99 = dist.P99
+	if snapshot.Runs > 0 {
+		snapshot.Histogram = make([]HistogramBucket, len(s.histogram))
+		for i := range s.histogram {
+			snapshot.Histogram[i].Count = load(&s.histogram[i])
+			if i < len(histogramBounds) {
+				snapshot.Histogram[i].UpperBound = histogramBounds[i]
+			}
+		}
+	}
+}
+
+// ResetStats starts collecting the rewrite stats afresh, returning a snapshot
+// of those collected until then, so that long-lived applications can report
+// them in windows. Rewrites happening during the reset are counted in either
+// the returned snapshot or the next one, though not necessarily in all of the
+// stats of the same one.
+func (h *Engine) ResetStats() StatsSnapshot {
+	snapshot := h.stats.reset(h.clock.Now())
+	snapshot.InvalidRewrites = atomic.SwapInt64(&h.invalidRewrites.count, 0)
+	return snapshot
+}
+
+// reset resets the stats as of now, returning a snapshot of them from before.
+func (s *httpseStats) reset(now time.Time) StatsSnapshot {
+	swap := func(addr *int64) int64 {
+		return atomic.SwapInt64(addr, 0)
+	}
+	snapshot := StatsSnapshot{
+		Requests:  swap(&s.requests),
+		Rewritten: swap(&s.rewritten),
+		Runs:      swap(&s.runs),
+		Total:     time.Duration(swap(&s.totalTime)),
+	}
+	if snapshot.Runs > 0 {
+		snapshot.Mean = snapshot.Total / time.Duration(snapshot.Runs)
+	}
+	snapshot.MaxHost, _ = s.maxHost.Load().(string)
+	snapshot.Max = time.Duration(swap(&s.max))
+	s.maxHost.Store("")
+	snapshot.Since, _ = s.since.Load().(time.Time)
+	s.since.Store(now)
+	s.summarize(&snapshot, atomic.SwapUint64(&s.next, 0), swap)
+	return snapshot
+}
+
+// Percentile estimates the given percentile, like 99.9, of the time taken by
+// all rewrites from the histogram. The estimate is the upper bound of the
+// bucket the percentile falls into, capped at Max, so it's never below the
+// actual value and at most 2.5 times of it for durations covered by the
+// histogram. It's 0 if there were no rewrites.
+func (s StatsSnapshot) Percentile(p float64) time.Duration {
+	var total int64
+	for _, b := range s.Histogram {
+		total += b.Count
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p / 100 * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for _, b := range s.Histogram {
+		seen += b.Count
+		if seen >= rank {
+			if b.UpperBound == 0 || b.UpperBound > s.Max {
+				return s.Max
+			}
+			return b.UpperBound
+		}
+	}
+	return s.Max
+}
+
+// bucketFor returns the index of the histogram bucket for the given duration.
+func bucketFor(dur time.Duration) int {
+	return sort.Search(len(histogramBounds), func(i int) bool {
+		return histogramBounds[i] >= dur
+	})
+}
+
+// recordTiming records the time taken to rewrite the given URL since start.
+func (h *Engine) recordTiming(u *url.URL, start time.Time) {
+	h.stats.add(u, h.clock.Now().Sub(start))
+}
+
+// count counts a URL given to be rewritten and whether or not it was.
+func (s *httpseStats) count(rewritten bool) {
+	atomic.AddInt64(&s.requests, 1)
+	if rewritten {
+		atomic.AddInt64(&s.rewritten, 1)
+	}
+}
+
+// add records a rewrite of the given URL that took dur. The URL is only
+// formatted if the rewrite was the slowest so far.
+func (s *httpseStats) add(u *url.URL, dur time.Duration) {
+	ns := int64(dur)
+	atomic.AddInt64(&s.runs, 1)
+	atomic.AddInt64(&s.totalTime, ns)
+	i := atomic.AddUint64(&s.next, 1) - 1
+	atomic.StoreInt64(&s.recent[i%recentSamples], ns)
+	atomic.AddInt64(&s.histogram[bucketFor(dur)], 1)
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if ns <= max {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&s.max, max, ns) {
+			// A concurrent new maximum may store its host first, in which
+			// case the host doesn't match the maximum until the next one.
+			s.maxHost.Store(u.String())
+			return
+		}
+	}
+}
+
+// LatencyDistribution summarizes a set of latency samples.
+type LatencyDistribution struct {
+	Samples int           `json:"samples"`
+	Mean    time.Duration `json:"mean"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+}
+
+// NewLatencyDistribution summarizes the given samples.
+func NewLatencyDistribution(samples []time.Duration) LatencyDistribution {
+	dist := LatencyDistribution{Samples: len(samples)}
+	if len(samples) == 0 {
+		return dist
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, s := range sorted {
+		total += s
+	}
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	dist.Mean = total / time.Duration(len(sorted))
+	dist.P50 = percentile(50)
+	dist.P90 = percentile(90)
+	dist.P99 = percentile(99)
+	dist.Max = sorted[len(sorted)-1]
+	return dist
+}
+
+// Regression is a latency metric that got worse compared to a baseline.
+type Regression struct {
+	Metric   string
+	Baseline time.Duration
+	Current  time.Duration
+}
+
+// CompareBaseline compares the given latency distribution with the baseline
+// recorded in the file at path, returning the metrics that are more than
+// tolerance (for example 0.1 for 10%) slower than the baseline. If there is
+// no baseline yet, current is recorded as the baseline and no regressions are
+// returned.
+func CompareBaseline(path string, current LatencyDistribution, tolerance float64) ([]Regression, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = json.MarshalIndent(current, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return nil, ioutil.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var baseline LatencyDistribution
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, err
+	}
+
+	var regressions []Regression
+	compare := func(metric string, b, c time.Duration) {
+		if float64(c) > float64(b)*(1+tolerance) {
+			regressions = append(regressions, Regression{Metric: metric, Baseline: b, Current: c})
+		}
+	}
+	compare("mean", baseline.Mean, current.Mean)
+	compare("p50", baseline.P50, current.P50)
+	compare("p90", baseline.P90, current.P90)
+	compare("p99", baseline.P99, current.P99)
+	compare("max", baseline.Max, current.Max)
+	return regressions, nil
+}
@@ -0,0 +1,41 @@
+package httpseverywhere
+
+import "time"
+
+// statsReporter reports the rewrite stats periodically.
+type statsReporter struct {
+	interval time.Duration
+	reset    bool
+	report   func(StatsSnapshot)
+}
+
+// WithStatsReporter calls report with a snapshot of the rewrite stats every
+// interval until the Engine is closed, so that they can be persisted or sent
+// upstream. With reset, the stats are reset each time as with ResetStats, so
+// that each snapshot covers one interval. report is called on its own
+// goroutine, one snapshot at a time.
+func WithStatsReporter(interval time.Duration, reset bool, report func(StatsSnapshot)) Option {
+	return func(h *Engine) {
+		h.statsReporter = &statsReporter{
+			interval: interval,
+			reset:    reset,
+			report:   report,
+		}
+	}
+}
+
+func (h *Engine) reportStatsPeriodically() {
+	r := h.statsReporter
+	for {
+		select {
+		case <-h.clock.After(r.interval):
+		case <-h.closed():
+			return
+		}
+		if r.reset {
+			r.report(h.ResetStats())
+		} else {
+			r.report(h.Stats())
+		}
+	}
+}
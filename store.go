@@ -0,0 +1,194 @@
+package httpseverywhere
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// RulesetStore is a storage backend holding rule sets outside of memory, for
+// deployments that can't afford to keep all of them compiled. The Engine looks
+// rule sets up in the store by target as hosts are rewritten and keeps only the
+// most recently used ones compiled.
+//
+// OpenRulesetFile provides a store backed by a file in the indexed format
+// written with WithIndexedFormat, which needs no dependencies. The httpsesqlite
+// module provides one backed by an SQLite database.
+type RulesetStore interface {
+	// Rulesets returns the rule sets that have the given target, exactly as
+	// written in the rule set, so either a host or a wildcard target like
+	// "*.example.com" or "example.*". Later rule sets take precedence.
+	Rulesets(target string) ([]*Ruleset, error)
+}
+
+// WithRulesetStore looks rule sets up in the given store instead of loading
+// the built-in rules, keeping up to cacheSize targets' compiled rule sets in
+// memory. Rule sets given with WithRulesets are still held in memory and take
+// precedence. Features that list all loaded rule sets, like HostMappings or
+// WildcardReport, only see those held in memory. If the store implements
+// io.Closer, like RulesetFile, it's closed when the Engine is.
+func WithRulesetStore(store RulesetStore, cacheSize int) Option {
+	return func(h *Engine) {
+		h.store = &storeLookup{store: store, compiled: newLRU(cacheSize)}
+		h.skipBuiltin = true
+		if closer, ok := store.(io.Closer); ok {
+			withRelease(closer.Close)(h)
+		}
+	}
+}
+
+// storeLookup looks up rulesets in a RulesetStore, caching the compiled ones
+// by target.
+type storeLookup struct {
+	store    RulesetStore
+	compiled *lru // target -> *ruleset, nil if there are none
+	d        *deserializer
+	// restore, if set, restores the state kept for rulesets by identity, like
+	// the quarantine, to newly compiled ones.
+	restore func(*ruleset)
+}
+
+// lookup returns the candidate ruleset for the given URL from the store for
+// the given index, if any.
+func (s *storeLookup) lookup(h *Engine, idx Index, u *url.URL) *ruleset {
+	for _, target := range storeTargets(idx, strings.ToLower(u.Hostname())) {
+		rs, err := s.rulesetFor(target)
+		if err != nil {
+			h.log.Errorf("Unable to look up rule sets for %v: %v", target, err)
+			return nil
+		}
+		if rs != nil {
+			return rs
+		}
+	}
+	return nil
+}
+
+// rulesetFor returns the compiled ruleset with the given target, if any.
+func (s *storeLookup) rulesetFor(target string) (*ruleset, error) {
+	if v, ok := s.compiled.get(target); ok {
+		return v.(*ruleset), nil
+	}
+	rulesets, err := s.store.Rulesets(target)
+	if err != nil {
+		return nil, err
+	}
+	var rs *ruleset
+	for i := len(rulesets) - 1; i >= 0 && rs == nil; i-- {
+		rs = s.d.newRuleset(rulesets[i])
+	}
+	if rs != nil && s.restore != nil {
+		s.restore(rs)
+	}
+	s.compiled.add(target, rs)
+	return rs, nil
+}
+
+// storeTargets returns the targets that the given host may be covered by in
+// the given index, most specific first, the same way the in-memory indices
+// prefer the longest match.
+func storeTargets(idx Index, host string) []string {
+	var targets []string
+	switch idx {
+	case PlainIndex:
+		targets = append(targets, host)
+	case PrefixIndex:
+		for i := 0; i < len(host); i++ {
+			if host[i] == '.' {
+				targets = append(targets, "*"+host[i:])
+			}
+		}
+	case SuffixIndex:
+		for i := len(host) - 1; i >= 0; i-- {
+			if host[i] == '.' {
+				targets = append(targets, host[:i+1]+"*")
+			}
+		}
+	}
+	return targets
+}
+
+// RulesetFile is a RulesetStore backed by a rules file in the indexed format.
+// Only an index from target to the offsets of the rule sets in the file is
+// held on the heap. The file itself is memory mapped where supported, so the
+// operating system pages rule data in and out as needed, and processes on one
+// host using the same file share its pages.
+type RulesetFile struct {
+	mapped   []byte
+	data     []byte
+	byTarget map[string][]int
+	close    sync.Once
+}
+
+// OpenRulesetFile opens the file at path as a RulesetFile. It must be in the
+// indexed format written with WithIndexedFormat and not be compressed.
+func OpenRulesetFile(path string) (*RulesetFile, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &RulesetFile{mapped: data, data: data, byTarget: make(map[string][]int)}
+	_, payload, err := splitRulesHeader(data)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !isIndexedRules(payload) {
+		f.Close()
+		return nil, errors.New("not an uncompressed rules file in the indexed format")
+	}
+	f.data = payload
+	err = eachIndexedRuleset(payload, func(offset int, head []byte, body []byte) error {
+		return eachField(head, func(field int, b []byte) error {
+			if field != 3 {
+				return nil
+			}
+			// Only the host of each target is needed.
+			return eachField(b, func(field int, b []byte) error {
+				if field == 1 {
+					f.byTarget[string(b)] = append(f.byTarget[string(b)], offset)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decoding rules: %v", err)
+	}
+	return f, nil
+}
+
+// Rulesets implements RulesetStore. The rules and exclusions of the returned
+// rule sets are only decoded when they're first needed.
+func (f *RulesetFile) Rulesets(target string) ([]*Ruleset, error) {
+	offsets := f.byTarget[target]
+	rulesets := make([]*Ruleset, 0, len(offsets))
+	for _, offset := range offsets {
+		head, body, _, err := indexedRulesetAt(f.data, offset)
+		if err != nil {
+			return nil, err
+		}
+		rs, err := decodeIndexedRuleset(head, body, false)
+		if err != nil {
+			return nil, err
+		}
+		rulesets = append(rulesets, rs)
+	}
+	return rulesets, nil
+}
+
+// Close unmaps the file. The Engine using the RulesetFile, along with any
+// rule sets returned by it, must not be used anymore afterwards, except that
+// closing the Engine closes the RulesetFile itself. Closing it more than once
+// has no effect.
+func (f *RulesetFile) Close() error {
+	var err error
+	f.close.Do(func() {
+		err = unmapFile(f.mapped)
+	})
+	return err
+}
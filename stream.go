@@ -0,0 +1,71 @@
+package httpseverywhere
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+)
+
+// streamMagic is the header that gob encoded rules written by the
+// preprocessor start with. It's followed by a gob stream of individual Ruleset
+// values rather than a single []*Ruleset, so that rule sets can be indexed as
+// they're decoded without holding all of them in memory at once. Gob encoded
+// rules without it are a single []*Ruleset, as written by older versions.
+var streamMagic = []byte("HTTPSEgs")
+
+// encodeRulesets serializes the given rule sets in Go's gob encoding, as a
+// stream of records preceded by streamMagic.
+func encodeRulesets(rules []*Ruleset) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(streamMagic)
+	enc := gob.NewEncoder(&buf)
+	for _, rs := range rules {
+		if err := enc.Encode(rs); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// isStreamRules returns whether or not the given data is a gob stream of
+// rule sets.
+func isStreamRules(data []byte) bool {
+	return bytes.HasPrefix(data, streamMagic)
+}
+
+// decodeRulesetsStream decodes the gob stream of rule sets read from r,
+// which must start with streamMagic, calling fn with each as it's decoded.
+func decodeRulesetsStream(r io.Reader, fn func(*Ruleset)) error {
+	magic := make([]byte, len(streamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(r)
+	for {
+		rs := &Ruleset{}
+		if err := dec.Decode(rs); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		fn(rs)
+	}
+}
+
+// decodeGob decodes gob encoded rule sets read from r, whether they're a
+// stream or a single []*Ruleset, calling fn with each.
+func decodeGob(r *bufio.Reader, fn func(*Ruleset)) error {
+	if magic, _ := r.Peek(len(streamMagic)); isStreamRules(magic) {
+		return decodeRulesetsStream(r, fn)
+	}
+	rulesets := make([]*Ruleset, 0)
+	if err := gob.NewDecoder(r).Decode(&rulesets); err != nil {
+		return err
+	}
+	for _, rs := range rulesets {
+		fn(rs)
+	}
+	return nil
+}
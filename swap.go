@@ -0,0 +1,70 @@
+package httpseverywhere
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// BundleInfo describes the rules in use at some point.
+type BundleInfo struct {
+	// Version is the version of the rules data, as returned by RulesVersion.
+	Version string
+	// Generation is the generation of the rules, as returned by Generation.
+	Generation int64
+	// Rulesets is the number of rule sets that were loaded.
+	Rulesets int64
+}
+
+// swapHooks holds the functions subscribed with OnBundleSwap.
+type swapHooks struct {
+	mx    sync.Mutex
+	next  int
+	hooks map[int]func(old, new BundleInfo)
+}
+
+// OnBundleSwap calls fn whenever new rules have been swapped in, whether by
+// UpdateRulesData, ApplyRulesDelta or an automatic update, with what was in
+// use before and what's in use now. It's called right after Rewrite starts
+// using the new rules, so that caches of rewrite decisions kept by the
+// application can be invalidated at the same moment. Calls happen on the
+// goroutine that swapped the rules, one at a time, and the rules can't be
+// updated again until fn returns, so it must not update them itself. The
+// returned function unsubscribes fn.
+func (h *Engine) OnBundleSwap(fn func(old, new BundleInfo)) func() {
+	s := &h.swapHooks
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.hooks == nil {
+		s.hooks = make(map[int]func(old, new BundleInfo))
+	}
+	id := s.next
+	s.next++
+	s.hooks[id] = fn
+	return func() {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		delete(s.hooks, id)
+	}
+}
+
+// subscribed returns the functions currently subscribed with OnBundleSwap.
+func (s *swapHooks) subscribed() []func(old, new BundleInfo) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	hooks := make([]func(old, new BundleInfo), 0, len(s.hooks))
+	for _, fn := range s.hooks {
+		hooks = append(hooks, fn)
+	}
+	return hooks
+}
+
+// bundleInfo describes the rules currently in use. It's only called when
+// there are subscribers, since determining the version reads all of the rules
+// data.
+func (h *Engine) bundleInfo() BundleInfo {
+	return BundleInfo{
+		Version:    h.RulesVersion(),
+		Generation: h.Generation(),
+		Rulesets:   atomic.LoadInt64(&h.load.loaded),
+	}
+}
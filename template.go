@@ -0,0 +1,127 @@
+package httpseverywhere
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// normalizeTemplate converts a replacement template written for the browser
+// extension, which expands it like JavaScript's String.prototype.replace, to
+// the syntax of Go's regexp.Expand for rules whose From pattern is re. In
+// particular:
+//
+//   - "$$" and any "$" that doesn't start a reference are literal dollar signs,
+//     which Go needs escaped as "$$" so that "$foo" or "${" aren't expanded.
+//   - "$n" and "$nn" refer to a group only if the pattern has that many groups,
+//     so "$10" is group 1 followed by "0" if there are fewer than 10. Go would
+//     take all the digits, and letters too, so references are braced.
+//   - "$0" is literal while "$&" is the whole match.
+//   - "$<name>" refers to a named group if the pattern has any.
+//
+// If re is nil, the number of groups isn't known, so "$n" takes all of the
+// digits as the group number, except that "$0" is still literal.
+//
+// The result is false if the template uses "$`" or "$'", which insert the text
+// before or after the match and can't be expressed in Go.
+func normalizeTemplate(to string, re *regexp.Regexp) (string, bool) {
+	groups := -1
+	var names []string
+	if re != nil {
+		groups = re.NumSubexp()
+		names = re.SubexpNames()
+	}
+
+	var b strings.Builder
+	ok := true
+	for i := 0; i < len(to); i++ {
+		if to[i] != '$' {
+			b.WriteByte(to[i])
+			continue
+		}
+		if i+1 == len(to) {
+			b.WriteString("$$")
+			continue
+		}
+		switch next := to[i+1]; {
+		case next == '$':
+			b.WriteString("$$")
+			i++
+		case next == '&':
+			b.WriteString("${0}")
+			i++
+		case next == '`' || next == '\'':
+			ok = false
+			b.WriteString("$$")
+		case next == '<' && hasNamedGroups(names):
+			end := strings.IndexByte(to[i+2:], '>')
+			if end < 0 {
+				b.WriteString("$$")
+				continue
+			}
+			name := to[i+2 : i+2+end]
+			if containsString(names, name) {
+				b.WriteString("${" + name + "}")
+			}
+			// As in JavaScript, unknown names expand to nothing.
+			i += end + 2
+		case next >= '0' && next <= '9':
+			n, width := groupRef(to[i+1:], groups)
+			if width == 0 {
+				b.WriteString("$$")
+				continue
+			}
+			b.WriteString("${" + strconv.Itoa(n) + "}")
+			i += width
+		default:
+			b.WriteString("$$")
+		}
+	}
+	return b.String(), ok
+}
+
+// groupRef parses the group number at the start of s, which starts with a
+// digit, for a pattern with the given number of groups, returning the number
+// and how many digits it took or a width of 0 if there's no such group. If the
+// number of groups is negative, all the digits are taken, as long as they
+// don't refer to group 0.
+func groupRef(s string, groups int) (int, int) {
+	if groups < 0 {
+		width := 1
+		for width < len(s) && s[width] >= '0' && s[width] <= '9' {
+			width++
+		}
+		n, _ := strconv.Atoi(s[:width])
+		if n == 0 {
+			return 0, 0
+		}
+		return n, width
+	}
+	if len(s) > 1 && s[1] >= '0' && s[1] <= '9' {
+		if n := int(s[0]-'0')*10 + int(s[1]-'0'); n >= 1 && n <= groups {
+			return n, 2
+		}
+	}
+	if n := int(s[0] - '0'); n >= 1 && n <= groups {
+		return n, 1
+	}
+	return 0, 0
+}
+
+func hasNamedGroups(names []string) bool {
+	for _, name := range names {
+		if name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
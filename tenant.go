@@ -0,0 +1,117 @@
+package httpseverywhere
+
+import (
+	"net/url"
+	"sync/atomic"
+
+	"github.com/armon/go-radix"
+)
+
+// Tenant scopes rule sets and exclusion overrides to one of several customers
+// sharing an Engine, so that they can have their own configuration without
+// each loading the full set of rules. Rewrites for a tenant use its own rule
+// sets first, then the Engine's, and apply both the Engine's exclusion
+// overrides and the tenant's.
+type Tenant struct {
+	h               *Engine
+	id              string
+	wildcardTargets atomic.Value // *radix.Tree
+	plainTargets    atomic.Value // map[string]*ruleset
+	overrides       exclusionOverrides
+}
+
+// Tenant returns the tenant with the given ID, creating it if necessary.
+func (h *Engine) Tenant(id string) *Tenant {
+	h.tenantsMx.Lock()
+	defer h.tenantsMx.Unlock()
+	if t := h.tenants[id]; t != nil {
+		return t
+	}
+	t := &Tenant{h: h, id: id}
+	t.wildcardTargets.Store(radix.New())
+	t.plainTargets.Store(make(map[string]*ruleset))
+	if h.tenants == nil {
+		h.tenants = make(map[string]*Tenant)
+	}
+	h.tenants[id] = t
+	return t
+}
+
+// RemoveTenant forgets the tenant with the given ID along with its rule sets
+// and overrides.
+func (h *Engine) RemoveTenant(id string) {
+	h.tenantsMx.Lock()
+	delete(h.tenants, id)
+	h.tenantsMx.Unlock()
+}
+
+// ID returns the tenant's ID.
+func (t *Tenant) ID() string {
+	return t.id
+}
+
+// SetRulesets replaces the tenant's rule sets with the given ones.
+func (t *Tenant) SetRulesets(rulesets ...*Ruleset) {
+	d := t.h.deserializer()
+	// Only the Engine's own rule sets count towards its load stats.
+	d.stats = nil
+	plains, wildcards := d.index(rulesets)
+	t.plainTargets.Store(plains)
+	t.wildcardTargets.Store(wildcards)
+	t.overrides.resolve(t.rulesetFor)
+}
+
+// Rewrite is like Engine.Rewrite but on behalf of this tenant.
+func (t *Tenant) Rewrite(u *url.URL) (string, bool) {
+	o := t.h.rewriteFor(u, t)
+	return o.rewritten(), o.ok
+}
+
+// OverrideExclusion is like Engine.OverrideExclusion but only applies to
+// rewrites for this tenant. Rule set overrides may refer to the tenant's own
+// rule sets.
+func (t *Tenant) OverrideExclusion(o ExclusionOverride) error {
+	o.Tenant = t.id
+	return t.overrides.add(t.h, &o, t.rulesetFor)
+}
+
+// RemoveExclusionOverrides is like Engine.RemoveExclusionOverrides for the
+// tenant's own overrides.
+func (t *Tenant) RemoveExclusionOverrides(host string, ruleset bool) {
+	t.overrides.remove(host, ruleset, t.rulesetFor)
+}
+
+// ExclusionOverrides returns the tenant's own exclusion overrides in the order
+// they were added.
+func (t *Tenant) ExclusionOverrides() []ExclusionOverride {
+	return t.overrides.list()
+}
+
+// rewrite rewrites the given URL using only the tenant's own rule sets. It
+// also returns whether or not an exclusive rule set was a candidate, in which
+// case the Engine's rule sets mustn't be tried.
+func (t *Tenant) rewrite(u *url.URL) (string, bool, *ruleset, bool) {
+	for _, idx := range t.h.lookupOrder {
+		if rs := lookupIn(&t.plainTargets, &t.wildcardTargets, idx, u); rs != nil {
+			if r, hit := t.h.rewriteWithRuleset(u, rs, t); hit || rs.exclusive {
+				return r, hit, rs, rs.exclusive
+			}
+		}
+	}
+	return "", false, nil, false
+}
+
+// rulesetFor returns the ruleset covering the given host from the tenant's
+// own rule sets or else the Engine's.
+func (t *Tenant) rulesetFor(host string) *ruleset {
+	var candidates []*ruleset
+	for _, idx := range t.h.lookupOrder {
+		if rs := lookupHostIn(&t.plainTargets, &t.wildcardTargets, idx, host); rs != nil && !containsRuleset(candidates, rs) {
+			candidates = append(candidates, rs)
+		}
+	}
+	if rs := matchingRuleset(host, candidates); rs != nil {
+		return rs
+	}
+	return t.h.rulesetFor(host)
+}
@@ -0,0 +1,80 @@
+// Package testsupport provides a tiny deterministic set of rules for unit
+// tests of code that uses httpseverywhere, so that those tests don't have to
+// load the full set of built-in rules.
+package testsupport
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/getlantern/httpseverywhere"
+)
+
+// Case is a URL along with what the rules returned by Rulesets rewrite it to,
+// or an empty string if they don't rewrite it.
+type Case struct {
+	URL      string
+	Expected string
+}
+
+// Cases covers each kind of rule in Rulesets.
+var Cases = []Case{
+	{"http://plain.test/a?b=c", "https://plain.test/a?b=c"},
+	{"http://www.wildcard.test/", "https://www.wildcard.test/"},
+	{"http://wildcard.test/", ""},
+	{"http://suffix.example/", "https://suffix.example/"},
+	{"http://excluded.test/", "https://excluded.test/"},
+	{"http://excluded.test/insecure/page", ""},
+	{"http://cdn.test/static/app.js", "https://secure.cdn.test/static/app.js"},
+	{"http://unknown.test/", ""},
+	{"https://plain.test/", ""},
+}
+
+// Rulesets returns a handful of synthetic rule sets covering plain, prefix
+// wildcard and suffix wildcard targets, exclusions and replacement templates.
+// It returns new values every time, so callers are free to modify them.
+func Rulesets() []*httpseverywhere.Ruleset {
+	return []*httpseverywhere.Ruleset{
+		ruleset([]string{"plain.test"}, "^http:", "https:"),
+		ruleset([]string{"*.wildcard.test"}, "^http:", "https:"),
+		ruleset([]string{"suffix.*"}, "^http:", "https:"),
+		withExclusion(ruleset([]string{"excluded.test"}, "^http:", "https:"), "^http://excluded\\.test/insecure/"),
+		ruleset([]string{"cdn.test"}, "^http://cdn\\.test/(.*)", "https://secure.cdn.test/${1}"),
+	}
+}
+
+// Bundle returns Rulesets encoded the same way as the bundles written by the
+// preprocessor.
+func Bundle() []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(Rulesets()); err != nil {
+		// Encoding known values into memory can't fail.
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// NewEngine returns an Engine that uses only Rulesets, configured with the
+// given additional options.
+func NewEngine(opts ...httpseverywhere.Option) *httpseverywhere.Engine {
+	opts = append([]httpseverywhere.Option{
+		httpseverywhere.WithoutBuiltinRules(),
+		httpseverywhere.WithRulesets(Rulesets()...),
+	}, opts...)
+	return httpseverywhere.New(opts...)
+}
+
+func ruleset(targets []string, from string, to string) *httpseverywhere.Ruleset {
+	rs := &httpseverywhere.Ruleset{
+		Rule: []*httpseverywhere.Rule{{From: from, To: to}},
+	}
+	for _, target := range targets {
+		rs.Target = append(rs.Target, &httpseverywhere.Target{Host: target})
+	}
+	return rs
+}
+
+func withExclusion(rs *httpseverywhere.Ruleset, pattern string) *httpseverywhere.Ruleset {
+	rs.Exclusion = append(rs.Exclusion, &httpseverywhere.Exclusion{Pattern: pattern})
+	return rs
+}
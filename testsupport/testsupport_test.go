@@ -0,0 +1,27 @@
+package testsupport
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/getlantern/httpseverywhere"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEngine(t *testing.T) {
+	h := NewEngine()
+	assert.Equal(t, len(Rulesets()), h.LoadStats().Loaded)
+	for _, c := range Cases {
+		r, _ := h.RewriteString(c.URL)
+		assert.Equal(t, c.Expected, r, c.URL)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	assert.Equal(t, Bundle(), Bundle(), "bundle should be deterministic")
+	var rulesets []*httpseverywhere.Ruleset
+	if assert.NoError(t, gob.NewDecoder(bytes.NewReader(Bundle())).Decode(&rulesets)) {
+		assert.Equal(t, Rulesets(), rulesets)
+	}
+}
@@ -1,45 +1,49 @@
 package httpseverywhere
 
 import (
+	"flag"
 	"math"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/stretchr/testify/assert"
 )
 
 const concurrency = 10000
 
+var baseline = flag.String("baseline", "", "file to record rewrite latencies to and compare subsequent runs against")
+
 type accumulator struct {
-	log   golog.Logger
-	stats *httpseStats
-	mx    sync.Mutex
+	log       golog.Logger
+	runs      int64
+	totalTime int64
+	max       int64
+	maxHost   string
+	mx        sync.Mutex
 }
 
 func (h *accumulator) addTimingLocked(host string, dur time.Duration) {
 	h.mx.Lock()
 	ms := dur.Nanoseconds() / int64(time.Millisecond)
-	h.stats.runs++
-	h.stats.totalTime += ms
-	if ms > h.stats.max {
-		h.stats.max = ms
-		h.stats.maxHost = host
+	h.runs++
+	h.totalTime += ms
+	if ms > h.max {
+		h.max = ms
+		h.maxHost = host
 	}
-	runs, totalTime, max, maxHost := h.stats.runs, h.stats.totalTime, h.stats.max, h.stats.maxHost
+	runs, totalTime, max, maxHost := h.runs, h.totalTime, h.max, h.maxHost
 	h.mx.Unlock()
 
 	h.log.Debugf("Average running time: %vms", float64(totalTime/runs))
 	h.log.Debugf("Max running time: %vms for host: %v", max, maxHost)
 }
 
-func BenchmarkChannel(b *testing.B) {
-	ch := make(chan *timing)
-	go func() {
-		for {
-			<-ch
-		}
-	}()
+func BenchmarkAtomic(b *testing.B) {
+	s := &httpseStats{}
+	u := toURL("http://myhost/")
 	dur := time.Duration(10)
 	var wg sync.WaitGroup
 	wg.Add(concurrency)
@@ -48,7 +52,7 @@ func BenchmarkChannel(b *testing.B) {
 	for i := 0; i < concurrency; i++ {
 		go func() {
 			for j := 0; j < int(math.Ceil(float64(b.N)/concurrency)); j++ {
-				ch <- &timing{host: "myhost", dur: dur}
+				s.add(u, dur)
 			}
 			wg.Done()
 		}()
@@ -57,7 +61,7 @@ func BenchmarkChannel(b *testing.B) {
 }
 
 func BenchmarkLock(b *testing.B) {
-	h := &accumulator{log: golog.LoggerFor("channel"), stats: &httpseStats{}}
+	h := &accumulator{log: golog.LoggerFor("lock")}
 
 	dur := time.Duration(10)
 	var wg sync.WaitGroup
@@ -74,3 +78,52 @@ func BenchmarkLock(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestCompareBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	samples := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	regressions, err := CompareBaseline(path, NewLatencyDistribution(samples), 0.1)
+	assert.NoError(t, err)
+	assert.Empty(t, regressions, "first run should just record the baseline")
+
+	regressions, err = CompareBaseline(path, NewLatencyDistribution(samples), 0.1)
+	assert.NoError(t, err)
+	assert.Empty(t, regressions)
+
+	samples[9] = 100
+	regressions, err = CompareBaseline(path, NewLatencyDistribution(samples), 0.1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Regression{
+		{Metric: "mean", Baseline: 5, Current: 14},
+		{Metric: "max", Baseline: 10, Current: 100},
+	}, regressions)
+}
+
+// TestRewriteLatencyBaseline records rewrite latencies against the embedded
+// rules and compares them with the baseline given with -baseline.
+func TestRewriteLatencyBaseline(t *testing.T) {
+	if *baseline == "" {
+		t.Skip("no -baseline given")
+	}
+	h := newSync()
+	urls := []string{
+		"http://forms.preston.gov.uk/",
+		"http://test.googlevideo.com/",
+		"http://www.samknows.com/",
+		"http://unknowndomainthatshouldnotmatch.com/",
+	}
+	samples := make([]time.Duration, 0, 10000)
+	for i := 0; i < cap(samples); i++ {
+		u := toURL(urls[i%len(urls)])
+		start := time.Now()
+		h(u)
+		samples = append(samples, time.Since(start))
+	}
+	regressions, err := CompareBaseline(*baseline, NewLatencyDistribution(samples), 0.2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, r := range regressions {
+		t.Errorf("%v regressed from %v to %v", r.Metric, r.Baseline, r.Current)
+	}
+}
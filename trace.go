@@ -0,0 +1,72 @@
+package httpseverywhere
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// RewriteTrace describes a rewrite decision for a RewriteTracer.
+type RewriteTrace struct {
+	// URL is the URL that was given to be rewritten.
+	URL string
+	// Result is the rewritten URL, or empty if it wasn't rewritten.
+	Result string
+	// Rewritten indicates whether or not the URL was rewritten.
+	Rewritten bool
+	// Ruleset and Targets are the name and targets of the rule set that
+	// rewrote the URL or, if none did, of the first candidate rule set that was
+	// evaluated for it, like one whose exclusion matched. They're empty if
+	// there were no candidates.
+	Ruleset string
+	Targets []string
+	// Start is when the rewrite started and Duration how long it took.
+	Start    time.Time
+	Duration time.Duration
+}
+
+// RewriteTracer is called with the context given to RewriteContext, or the
+// background context for Rewrite, after each rewrite decision. It's called on
+// the rewriting goroutine, so it must be quick.
+type RewriteTracer func(ctx context.Context, trace *RewriteTrace)
+
+// WithRewriteTracer calls tracer after each rewrite decision made by Rewrite
+// and RewriteContext, so that the decisions can be recorded, for example as
+// OpenTelemetry spans with the httpseotel module, to find out why specific
+// requests were or weren't upgraded.
+func WithRewriteTracer(tracer RewriteTracer) Option {
+	return func(h *Engine) {
+		h.tracer = tracer
+	}
+}
+
+// RewriteContext is like Rewrite but passes ctx on to the RewriteTracer set
+// with WithRewriteTracer, so that the rewrite can be traced as part of the
+// request it's for.
+func (h *Engine) RewriteContext(ctx context.Context, url *url.URL) (string, bool) {
+	o := h.rewriteTraced(ctx, url)
+	return o.rewritten(), o.ok
+}
+
+// rewriteTraced rewrites the given URL, calling the RewriteTracer if there is
+// one.
+func (h *Engine) rewriteTraced(ctx context.Context, url *url.URL) *rewriteOutcome {
+	if h.tracer == nil {
+		return h.rewriteFor(url, nil)
+	}
+	start := h.clock.Now()
+	o := h.rewriteFor(url, nil)
+	trace := &RewriteTrace{
+		URL:       url.String(),
+		Result:    o.rewritten(),
+		Rewritten: o.ok,
+		Start:     start,
+		Duration:  h.clock.Now().Sub(start),
+	}
+	if o.rs != nil {
+		trace.Ruleset = o.rs.name
+		trace.Targets = o.rs.target
+	}
+	h.tracer(ctx, trace)
+	return o
+}
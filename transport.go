@@ -0,0 +1,104 @@
+package httpseverywhere
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper that sends plain HTTP requests to the
+// HTTPS URLs the rules rewrite them to. If an upgraded request fails because
+// of TLS, for example because the site's certificate is invalid or it doesn't
+// speak TLS at all, the path is reported broken with ReportBrokenPath so that
+// it isn't upgraded again, and the request is sent to the original URL
+// instead. Other errors, like timeouts and canceled requests, say nothing
+// about the site's HTTPS support and are returned as they are.
+//
+// Falling back requires sending the request body again, so requests with a
+// body are only retried if they have GetBody, as those created with
+// http.NewRequest from common body types do.
+type Transport struct {
+	h    *Engine
+	base http.RoundTripper
+}
+
+// NewTransport returns a Transport that upgrades requests with h and sends
+// them with base, or with http.DefaultTransport if base is nil.
+func (h *Engine) NewTransport(base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{h: h, base: base}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return t.base.RoundTrip(req)
+	}
+	result := t.h.Evaluate(req.URL)
+	if !result.Rewritten {
+		return t.base.RoundTrip(req)
+	}
+	upgraded := req.Clone(req.Context())
+	if err := result.ApplyTo(upgraded); err != nil {
+		return t.base.RoundTrip(req)
+	}
+	resp, err := t.base.RoundTrip(upgraded)
+	if err == nil || !isTLSError(err) {
+		return resp, err
+	}
+	reportErr := t.h.ReportBrokenPath(BrokenPath{
+		Host:   req.URL.Host,
+		Path:   req.URL.EscapedPath(),
+		Reason: err.Error(),
+	})
+	if reportErr != nil {
+		t.h.log.Errorf("Unable to report %v as broken: %v", req.URL, reportErr)
+	}
+	fallback := req
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		fallback = req.Clone(req.Context())
+		fallback.Body = body
+	}
+	return t.base.RoundTrip(fallback)
+}
+
+// isTLSError reports whether err is a failure to establish a TLS connection
+// with the site, as opposed to say a timeout.
+func isTLSError(err error) bool {
+	var (
+		recordHeader  tls.RecordHeaderError
+		unknownAuth   x509.UnknownAuthorityError
+		hostname      x509.HostnameError
+		invalid       x509.CertificateInvalidError
+		insecureAlg   x509.InsecureAlgorithmError
+		constraint    x509.ConstraintViolationError
+		unhandledCrit x509.UnhandledCriticalExtension
+		opErr         *net.OpError
+	)
+	switch {
+	case errors.As(err, &recordHeader),
+		errors.As(err, &unknownAuth),
+		errors.As(err, &hostname),
+		errors.As(err, &invalid),
+		errors.As(err, &insecureAlg),
+		errors.As(err, &constraint),
+		errors.As(err, &unhandledCrit):
+		return true
+	case errors.As(err, &opErr):
+		// crypto/tls reports alerts sent by the site, like a handshake
+		// failure, as remote errors.
+		return opErr.Op == "remote error"
+	}
+	return false
+}
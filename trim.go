@@ -0,0 +1,105 @@
+package httpseverywhere
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/armon/go-radix"
+)
+
+// Levels for TrimMemory, from least to most memory released. Host apps map the
+// memory pressure levels reported by the OS onto these, for example Android's
+// TRIM_MEMORY_RUNNING_LOW onto TrimCaches and TRIM_MEMORY_COMPLETE or iOS'
+// memory warnings onto TrimAll.
+const (
+	// TrimCaches drops the lookup and decision caches.
+	TrimCaches = 1
+	// TrimRules also releases the compiled rules of rule sets that were
+	// compiled on first use but haven't been used since the previous
+	// TrimMemory call. They're compiled again when next used.
+	TrimRules = 2
+	// TrimAll also resizes the indices to fit and returns freed memory to the
+	// OS right away.
+	TrimAll = 3
+)
+
+// TrimMemory releases memory in response to memory pressure, more of it the
+// higher the given level, as described for TrimCaches, TrimRules and TrimAll.
+// Levels above TrimAll are treated like TrimAll. Rewriting keeps working
+// throughout, if more slowly until the caches are warm again. Compiled rules
+// are only released for rule sets that are compiled on first use, with
+// WithLazyCompilation or the indexed format, since other rule sets can't be
+// compiled again.
+func (h *Engine) TrimMemory(level int) {
+	if level < TrimCaches {
+		return
+	}
+	if level >= TrimRules {
+		h.updateMx.Lock()
+		plains := h.plainTargets.Load().(map[string]*ruleset)
+		wildcards := h.wildcardTargets.Load().(*radix.Tree)
+		released := make(map[*ruleset]*ruleset)
+		if hasColdRules(plains, wildcards, released) || level >= TrimAll {
+			plains, wildcards = releaseRules(plains, wildcards, released)
+			h.publish(plains, wildcards, int(atomic.LoadInt64(&h.load.loaded)))
+		}
+		h.updateMx.Unlock()
+	}
+	// Publishing already dropped the caches, but it may not have happened.
+	if h.cache != nil {
+		h.cache.positive.clear()
+		h.cache.negative.clear()
+	}
+	if h.decisions != nil {
+		h.decisions.entries.clear()
+	}
+	if level >= TrimAll {
+		debug.FreeOSMemory()
+	}
+}
+
+// hasColdRules finds the rule sets in the given indices whose compiled rules
+// are cold, adding uncompiled copies of them to released. It returns whether
+// or not any were found.
+func hasColdRules(plains map[string]*ruleset, wildcards *radix.Tree, released map[*ruleset]*ruleset) bool {
+	seen := make(map[*ruleset]bool)
+	check := func(rs *ruleset) {
+		if rs.lazy == nil || seen[rs] {
+			return
+		}
+		seen[rs] = true
+		if rs.lazy.cold() {
+			released[rs] = rs.uncompiled()
+		}
+	}
+	for _, rs := range plains {
+		check(rs)
+	}
+	wildcards.Walk(func(key string, rs interface{}) bool {
+		check(rs.(*ruleset))
+		return false
+	})
+	return len(released) > 0
+}
+
+// releaseRules returns copies of the given indices, sized to fit, in which the
+// rule sets in released are replaced by their uncompiled copies. The given
+// indices are left as they are since they may be in use.
+func releaseRules(plains map[string]*ruleset, wildcards *radix.Tree, released map[*ruleset]*ruleset) (map[string]*ruleset, *radix.Tree) {
+	replace := func(rs *ruleset) *ruleset {
+		if r, ok := released[rs]; ok {
+			return r
+		}
+		return rs
+	}
+	newPlains := make(map[string]*ruleset, len(plains))
+	for host, rs := range plains {
+		newPlains[host] = replace(rs)
+	}
+	newWildcards := radix.New()
+	wildcards.Walk(func(key string, rs interface{}) bool {
+		newWildcards.Insert(key, replace(rs.(*ruleset)))
+		return false
+	})
+	return newPlains, newWildcards
+}
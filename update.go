@@ -0,0 +1,155 @@
+package httpseverywhere
+
+import (
+	"errors"
+	"sync/atomic"
+
+	radix "github.com/armon/go-radix"
+)
+
+// UpdateRulesData replaces the rules with the given ones, in the same format
+// as for WithRulesData. The new rules are decoded, compiled and checked in the
+// background while the current ones keep being used, and are only swapped in
+// if that succeeded. The returned channel receives the outcome. Each swap
+// increments the generation reported by Generation and in RewriteResult.
+func (h *Engine) UpdateRulesData(data []byte) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.updateRulesData(data)
+	}()
+	return errCh
+}
+
+// Generation returns the number of times rules have been loaded, starting at 1
+// for the initial rules, or 0 if they haven't been loaded yet.
+func (h *Engine) Generation() int64 {
+	return atomic.LoadInt64(&h.generation)
+}
+
+func (h *Engine) updateRulesData(data []byte) error {
+	h.updateMx.Lock()
+	defer h.updateMx.Unlock()
+	return h.swapRulesData(data)
+}
+
+// swapRulesData loads the given rules and swaps them in. The caller must hold
+// h.updateMx.
+func (h *Engine) swapRulesData(data []byte) error {
+	start := h.clock.Now()
+	var stats loadStats
+	d := h.deserializer()
+	d.data = data
+	d.stats = &stats
+	plains, wildcards, decoded, kept, err := h.buildIndices(d, true, false)
+	if err != nil {
+		return err
+	}
+	if decoded == 0 {
+		return errors.New("no rule sets in rules data")
+	}
+	total := decoded + len(h.customRulesets)
+	if len(plains) == 0 && wildcards.Len() == 0 {
+		return errors.New("no usable rule sets in rules data")
+	}
+
+	hooks := h.swapHooks.subscribed()
+	var old BundleInfo
+	if len(hooks) > 0 {
+		old = h.bundleInfo()
+	}
+	h.updatedData.Store(data)
+	atomic.StoreInt64(&h.load.rulesets, int64(total))
+	atomic.AddInt64(&h.generation, 1)
+	h.publish(plains, wildcards, kept+len(h.customRulesets))
+	if len(hooks) > 0 {
+		current := h.bundleInfo()
+		for _, fn := range hooks {
+			fn(old, current)
+		}
+	}
+	h.afterLoad()
+	stats.addTime(phaseTotal, h.clock.Now().Sub(start))
+	h.load.storeFrom(&stats)
+	h.cacheRules(data)
+	return nil
+}
+
+// Rebuild reconstructs the indices from the rules currently in use and the
+// rule sets given with WithRulesets in the background, and swaps them in once
+// done, while the current ones keep being used. This gives the indices
+// restarting would: rules compiled on first use are released until they're
+// used again, the indices are compacted if WithCompaction was given and the
+// lookup cache starts out empty. The returned channel receives the outcome.
+// Like an update, a rebuild increments the generation, but since the rules
+// don't change it doesn't notify OnBundleSwap subscribers.
+func (h *Engine) Rebuild() <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.rebuild()
+	}()
+	return errCh
+}
+
+func (h *Engine) rebuild() error {
+	h.updateMx.Lock()
+	defer h.updateMx.Unlock()
+	if h.isClosed() {
+		return ErrClosed
+	}
+	start := h.clock.Now()
+	var stats loadStats
+	d := h.deserializer()
+	d.stats = &stats
+	plains, wildcards, decoded, kept, err := h.buildIndices(d, !h.skipBuiltin, false)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&h.load.rulesets, int64(decoded+len(h.customRulesets)))
+	atomic.AddInt64(&h.generation, 1)
+	h.publish(plains, wildcards, kept+len(h.customRulesets))
+	h.afterLoad()
+	stats.addTime(phaseTotal, h.clock.Now().Sub(start))
+	h.load.storeFrom(&stats)
+	h.log.Debugf("Rebuilt indices in %v", h.clock.Now().Sub(start))
+	return nil
+}
+
+// buildIndices indexes the rule sets decoded by d, if builtin is set, followed
+// by the custom ones so that they take precedence. The built-in rule sets are
+// indexed as they're decoded so that they're never all in memory at once. If
+// progressive is set, they're also published in batches as configured with
+// WithProgressiveLoad. It returns the indices along with the number of rule
+// sets decoded and the number of those indexed.
+func (h *Engine) buildIndices(d *deserializer, builtin bool, progressive bool) (map[string]*ruleset, *radix.Tree, int, int, error) {
+	plains := make(map[string]*ruleset)
+	wildcards := radix.New()
+	decoded, kept := 0, 0
+	published := false
+	var indexed func(int)
+	if progressive && h.progressiveBatch > 0 {
+		indexed = func(kept int) {
+			if kept%h.progressiveBatch == 0 {
+				h.publishPlains(plains, kept)
+				published = true
+			}
+		}
+	}
+	if builtin {
+		var err error
+		decoded, kept, err = d.decodeInto(h.inTargetDomains, indexed, plains, wildcards)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+	}
+	if h.isClosed() {
+		return nil, nil, 0, 0, ErrClosed
+	}
+	d.indexInto(h.customRulesets, plains, wildcards)
+	if published && h.compact {
+		// Rule sets that are already in use mustn't be modified.
+		plains, wildcards = resizeIndices(plains, wildcards)
+	} else {
+		plains, wildcards = h.finishLoad(plains, wildcards)
+	}
+	return plains, wildcards, decoded, kept, nil
+}
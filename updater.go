@@ -0,0 +1,246 @@
+package httpseverywhere
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// updater periodically downloads rules data and swaps it into the Engine.
+type updater struct {
+	url       string
+	interval  time.Duration
+	onSuccess func(generation int64)
+	onFailure func(err error)
+	statePath string
+	// state holds the validators of the last download.
+	state updateState
+}
+
+// updateState holds the validators of the last download, for making
+// conditional requests.
+type updateState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Version is the version of the rules that were downloaded, so that the
+	// validators are only used while those rules are in use.
+	Version string `json:"version"`
+}
+
+// updates returns the Engine's updater, creating it if necessary.
+func (h *Engine) updates() *updater {
+	if h.updater == nil {
+		h.updater = &updater{}
+	}
+	return h.updater
+}
+
+// defaultHTTPClient is used for network requests unless WithHTTPClient is
+// given.
+var defaultHTTPClient = &http.Client{Timeout: 5 * time.Minute}
+
+// WithHTTPClient makes the Engine send all of its network requests, such as
+// those for automatic updates, with the given client, for example one using a
+// custom transport or proxy. To only customize the transport, pass a client
+// whose Transport is set.
+func WithHTTPClient(client *http.Client) Option {
+	return func(h *Engine) {
+		h.httpClient = client
+	}
+}
+
+// client returns the client to send network requests with.
+func (h *Engine) client() *http.Client {
+	if h.httpClient != nil {
+		return h.httpClient
+	}
+	return defaultHTTPClient
+}
+
+// minUpdateInterval is the shortest interval WithAutoUpdate checks for updates
+// at, so that a zero or negative interval doesn't download rules in a loop.
+const minUpdateInterval = time.Minute
+
+// WithAutoUpdate downloads a rules bundle from the HTTPS URL rawURL once the
+// initial rules have loaded and then every interval, which is at least a
+// minute, and swaps it in like UpdateRulesData does. The bundle has the same
+// format as the data passed to WithRulesData. The request includes the version
+// of the current rules in the RulesVersionHeader header, and if the response
+// has the DeltaContentType content type, it's applied as a delta like
+// ApplyRulesDelta does. Failed downloads leave the current rules in place.
+func WithAutoUpdate(rawURL string, interval time.Duration) Option {
+	return func(h *Engine) {
+		u := h.updates()
+		u.url = rawURL
+		u.interval = interval
+		if u.interval < minUpdateInterval {
+			u.interval = minUpdateInterval
+		}
+	}
+}
+
+// WithUpdateHooks calls onSuccess with the rules generation after each
+// successful automatic update, which is unchanged if the rules were already up
+// to date, and onFailure with the error after each failed one. Either may be
+// nil. Hooks are called on the updating goroutine, so they shouldn't block for
+// long.
+func WithUpdateHooks(onSuccess func(generation int64), onFailure func(err error)) Option {
+	return func(h *Engine) {
+		u := h.updates()
+		u.onSuccess = onSuccess
+		u.onFailure = onFailure
+	}
+}
+
+// WithUpdateStateFile saves the ETag and Last-Modified validators of the last
+// rules downloaded by WithAutoUpdate to the file at path and loads them from
+// there on startup, so that a restarted client doesn't download the same rules
+// again. The validators are only sent while the rules they were received with
+// are in use.
+func WithUpdateStateFile(path string) Option {
+	return func(h *Engine) {
+		h.updates().statePath = path
+	}
+}
+
+// updatePeriodically updates the rules right away and then every update
+// interval.
+func (h *Engine) updatePeriodically() {
+	h.loadUpdateState()
+	for {
+		h.autoUpdate()
+		select {
+		case <-h.clock.After(h.updater.interval):
+		case <-h.closed():
+			return
+		}
+	}
+}
+
+// autoUpdate downloads and swaps in the rules and calls the update hooks.
+func (h *Engine) autoUpdate() {
+	u := h.updater
+	err := h.downloadUpdate()
+	if err != nil {
+		h.log.Errorf("Unable to update rules from %v: %v", u.url, err)
+		atomic.AddInt64(&h.stats.updateFailures, 1)
+		if u.onFailure != nil {
+			u.onFailure(err)
+		}
+		return
+	}
+	h.log.Debugf("Updated rules from %v to generation %v", u.url, h.Generation())
+	if u.onSuccess != nil {
+		u.onSuccess(h.Generation())
+	}
+}
+
+// downloadUpdate downloads the rules from the update URL and swaps them in.
+func (h *Engine) downloadUpdate() error {
+	u := h.updater
+	parsed, err := url.Parse(u.url)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" {
+		return fmt.Errorf("refusing to update rules over %q, only https is allowed", parsed.Scheme)
+	}
+	req, err := http.NewRequestWithContext(h.lifetime, http.MethodGet, u.url, nil)
+	if err != nil {
+		return err
+	}
+	version := h.RulesVersion()
+	if version != "" {
+		req.Header.Set(RulesVersionHeader, version)
+	}
+	if u.state.URL == u.url && u.state.Version == version {
+		if u.state.ETag != "" {
+			req.Header.Set("If-None-Match", u.state.ETag)
+		}
+		if u.state.LastModified != "" {
+			req.Header.Set("If-Modified-Since", u.state.LastModified)
+		}
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		h.log.Debugf("Rules from %v are up to date", u.url)
+		return nil
+	default:
+		return fmt.Errorf("unexpected response status %v", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.Header.Get("Content-Type") == DeltaContentType {
+		err = h.applyRulesDelta(data)
+	} else {
+		err = h.updateRulesData(data)
+	}
+	if err != nil {
+		return err
+	}
+	u.state = updateState{
+		URL:          u.url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Version:      h.RulesVersion(),
+	}
+	h.saveUpdateState()
+	return nil
+}
+
+// updateStatePath returns the path of the update state file, if any.
+func (h *Engine) updateStatePath() string {
+	if h.updater.statePath == "" && h.rulesCacheDir != "" {
+		return h.rulesCacheFile("update.json")
+	}
+	return h.updater.statePath
+}
+
+// loadUpdateState loads the validators saved in the update state file, if any.
+func (h *Engine) loadUpdateState() {
+	u := h.updater
+	path := h.updateStatePath()
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.log.Errorf("Unable to read update state: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &u.state); err != nil {
+		h.log.Errorf("Unable to parse update state: %v", err)
+	}
+}
+
+// saveUpdateState saves the validators to the update state file, if any.
+func (h *Engine) saveUpdateState() {
+	u := h.updater
+	path := h.updateStatePath()
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(&u.state)
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		h.log.Errorf("Unable to save update state: %v", err)
+	}
+}
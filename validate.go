@@ -0,0 +1,140 @@
+package httpseverywhere
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// Severity is the severity of a ValidationIssue.
+type Severity int
+
+const (
+	// SeverityWarning marks an issue that doesn't prevent the rule set from
+	// being used but that likely doesn't do what the author intended.
+	SeverityWarning Severity = iota
+	// SeverityError marks an issue that causes the rule set to be rejected.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// ValidationIssue is a problem found while validating a rule set.
+type ValidationIssue struct {
+	Severity Severity
+	// Field identifies the offending part of the rule set, for example
+	// "rule[1].from", or is empty for issues with the rule set as a whole.
+	Field   string
+	Message string
+}
+
+func (i ValidationIssue) String() string {
+	if i.Field == "" {
+		return fmt.Sprintf("%v: %v", i.Severity, i.Message)
+	}
+	return fmt.Sprintf("%v: %v: %v", i.Severity, i.Field, i.Message)
+}
+
+// ValidateRulesetXML validates a single rule set in HTTPS Everywhere's XML
+// format the same way the preprocessor does, so that rule authors can check a
+// candidate rule set before adding it to a live engine. It returns the rule
+// set as the preprocessor would store it (with replacement templates
+// normalized for Go), or nil if the XML couldn't be parsed, along with any
+// issues found. The rule set is usable if none of the issues are errors.
+func ValidateRulesetXML(b []byte) (*Ruleset, []ValidationIssue) {
+	return Preprocessor.validate(b, &preprocessOptions{})
+}
+
+func (p *preprocessor) validate(rules []byte, options *preprocessOptions) (*Ruleset, []ValidationIssue) {
+	var issues []ValidationIssue
+	issue := func(severity Severity, field string, msg string, args ...interface{}) {
+		issues = append(issues, ValidationIssue{
+			Severity: severity,
+			Field:    field,
+			Message:  fmt.Sprintf(msg, args...),
+		})
+	}
+
+	var ruleset Ruleset
+	if err := xml.Unmarshal(rules, &ruleset); err != nil {
+		issue(SeverityError, "", "Could not parse XML - got error %v", err)
+		return nil, issues
+	}
+	ruleset.Notes = rulesetNotes(rules)
+
+	// If the rule is turned off, ignore it.
+	if len(ruleset.Off) > 0 {
+		issue(SeverityError, "default_off", "Rule set is turned off: %v", ruleset.Off)
+	}
+
+	// We don't run on any platforms (aka Tor) that support mixed content, so
+	// ignore any rule that is mixedcontent-only.
+	if ruleset.Platform == "mixedcontent" {
+		issue(SeverityError, "platform", "Rule set is mixedcontent-only")
+	}
+
+	if len(ruleset.Target) == 0 {
+		issue(SeverityWarning, "", "Rule set has no targets")
+	}
+	for i, target := range ruleset.Target {
+		if msg := checkTarget(target.Host); msg != "" {
+			issue(SeverityWarning, fmt.Sprintf("target[%d].host", i), "%v: %q", msg, target.Host)
+		}
+	}
+
+	if len(ruleset.Rule) == 0 {
+		issue(SeverityWarning, "", "Rule set has no rules")
+	}
+	for i, rule := range ruleset.Rule {
+		from, err := compileRegexp(rule.From, options.maxProgramSize)
+		if err != nil {
+			issue(SeverityError, fmt.Sprintf("rule[%d].from", i), "Could not compile From rule %v - got error %v", rule.From, err)
+		}
+		normalized, ok := normalizeTemplate(rule.To, from)
+		if !ok {
+			issue(SeverityError, fmt.Sprintf("rule[%d].to", i), "Replacement %v inserts text around the match with $` or $', which Go can't expand", rule.To)
+		} else if normalized != rule.To {
+			issue(SeverityWarning, fmt.Sprintf("rule[%d].to", i), "Normalized %v to %v", rule.To, normalized)
+			rule.To = normalized
+		}
+	}
+
+	for i, e := range ruleset.Exclusion {
+		_, err := compileRegexp(e.Pattern, options.maxProgramSize)
+		if err != nil {
+			issue(SeverityError, fmt.Sprintf("exclusion[%d].pattern", i), "Could not compile Exclusion pattern %v - got error %v", e.Pattern, err)
+		}
+	}
+
+	return &ruleset, issues
+}
+
+// checkTarget returns a description of what's wrong with the given target
+// host, or an empty string if it looks sane.
+func checkTarget(host string) string {
+	switch {
+	case host == "":
+		return "Empty target host"
+	case strings.ContainsAny(host, ":/?# "):
+		return "Target host should not contain a scheme, port or path"
+	case host != strings.ToLower(host):
+		return "Target host should be lower case"
+	}
+	wildcards := strings.Count(host, "*")
+	switch {
+	case wildcards == 0:
+		return ""
+	case wildcards > 1:
+		return "Target host may contain at most one wildcard"
+	case host == "*":
+		return "Target host can't be only a wildcard"
+	case !strings.HasPrefix(host, "*.") && !strings.HasSuffix(host, ".*"):
+		return "Wildcard must be the first or last label of the target host"
+	}
+	return ""
+}
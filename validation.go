@@ -0,0 +1,97 @@
+package httpseverywhere
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recentInvalidRewrites is the number of invalid rewrites kept for
+// diagnostics.
+const recentInvalidRewrites = 10
+
+// InvalidRewrite is a rewrite that was discarded by WithRewriteValidation.
+type InvalidRewrite struct {
+	// URL is the URL that was being rewritten.
+	URL string `json:"url"`
+	// Result is what the rule produced.
+	Result string `json:"result"`
+	// Reason is why the result was discarded.
+	Reason string `json:"reason"`
+	// Ruleset and Targets are the name and targets of the rule set whose rule
+	// produced the result.
+	Ruleset string    `json:"ruleset,omitempty"`
+	Targets []string  `json:"targets"`
+	At      time.Time `json:"at"`
+}
+
+// invalidRewrites tracks the rewrites discarded by validation.
+type invalidRewrites struct {
+	count  int64
+	mx     sync.Mutex
+	recent []InvalidRewrite
+}
+
+// WithRewriteValidation parses every rewritten URL before returning it and
+// treats the rewrite as a miss if it isn't a valid HTTPS URL with a host, so
+// that a broken rule can't corrupt requests. Discarded rewrites are logged
+// and included in Diagnostics.
+func WithRewriteValidation() Option {
+	return func(h *Engine) {
+		h.validateRewrites = true
+	}
+}
+
+// checkRewrite returns whether or not the given result of rewriting u with
+// the given ruleset is valid, recording it if it isn't.
+func (h *Engine) checkRewrite(u *url.URL, result string, r *ruleset) bool {
+	reason := invalidRewriteReason(result)
+	if reason == "" {
+		return true
+	}
+	h.log.Errorf("Discarding rewrite of %v to %v by rule set for %v: %v", u, result, r.target, reason)
+	ir := &h.invalidRewrites
+	atomic.AddInt64(&ir.count, 1)
+	ir.mx.Lock()
+	defer ir.mx.Unlock()
+	if len(ir.recent) == recentInvalidRewrites {
+		copy(ir.recent, ir.recent[1:])
+		ir.recent = ir.recent[:len(ir.recent)-1]
+	}
+	ir.recent = append(ir.recent, InvalidRewrite{
+		URL:     u.String(),
+		Result:  result,
+		Reason:  reason,
+		Ruleset: r.name,
+		Targets: r.target,
+		At:      h.clock.Now(),
+	})
+	return false
+}
+
+// invalidRewriteReason returns why the given rewritten URL is invalid, or an
+// empty string if it's valid.
+func invalidRewriteReason(result string) string {
+	parsed, err := url.Parse(result)
+	switch {
+	case err != nil:
+		return err.Error()
+	case parsed.Scheme != "https":
+		return fmt.Sprintf("scheme is %q instead of https", parsed.Scheme)
+	case parsed.Hostname() == "":
+		return "host is empty"
+	}
+	return ""
+}
+
+// list returns copies of the most recent invalid rewrites, oldest first.
+func (ir *invalidRewrites) list() []InvalidRewrite {
+	ir.mx.Lock()
+	defer ir.mx.Unlock()
+	if len(ir.recent) == 0 {
+		return nil
+	}
+	return append([]InvalidRewrite(nil), ir.recent...)
+}
@@ -0,0 +1,118 @@
+package httpseverywhere
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/armon/go-radix"
+)
+
+// WildcardReport describes the wildcard targets of the loaded rules, to help
+// understand how they interact with each other and with the order in which
+// indices are checked.
+type WildcardReport struct {
+	// PrefixKeys is the number of distinct leading wildcard targets like
+	// "*.example.com".
+	PrefixKeys int
+	// SuffixKeys is the number of distinct trailing wildcard targets like
+	// "example.*".
+	SuffixKeys int
+	// Keys describes each wildcard target, those covering the most known hosts
+	// first.
+	Keys []WildcardKeyStats
+	// ShadowedByPlain is the number of plain targets that are also covered by
+	// a wildcard target, which never applies to them since plain targets are
+	// checked first.
+	ShadowedByPlain int
+	// Overlaps lists the known hosts covered by both a leading and a trailing
+	// wildcard target, for which the order of the indices determines the rule
+	// set that applies.
+	Overlaps []WildcardOverlap
+}
+
+// WildcardKeyStats describes a single wildcard target.
+type WildcardKeyStats struct {
+	Target string
+	// Hosts is the number of plain targets that the wildcard target covers,
+	// as an estimate of how many hosts it plausibly covers in practice.
+	Hosts int
+}
+
+// WildcardOverlap is a host covered by both a leading and a trailing wildcard
+// target.
+type WildcardOverlap struct {
+	Host   string
+	Prefix string
+	Suffix string
+}
+
+// WildcardReport reports on the wildcard targets of the loaded rules.
+func (h *Engine) WildcardReport() *WildcardReport {
+	plains := h.plainTargets.Load().(map[string]*ruleset)
+	wildcards := h.wildcardTargets.Load().(*radix.Tree)
+
+	report := &WildcardReport{}
+	stats := make(map[string]*WildcardKeyStats)
+	wildcards.Walk(func(key string, v interface{}) bool {
+		target := wildcardTarget(key, v.(*ruleset))
+		if target == "" {
+			return false
+		}
+		if target[0] == '*' {
+			report.PrefixKeys++
+		} else {
+			report.SuffixKeys++
+		}
+		stats[key] = &WildcardKeyStats{Target: target}
+		return false
+	})
+
+	match := func(key string) *WildcardKeyStats {
+		if k, _, ok := wildcards.LongestPrefix(key); ok {
+			return stats[k]
+		}
+		return nil
+	}
+	for host := range plains {
+		prefix, suffix := match(reverse(host)), match(host)
+		if prefix != nil {
+			prefix.Hosts++
+		}
+		if suffix != nil {
+			suffix.Hosts++
+		}
+		if prefix != nil || suffix != nil {
+			report.ShadowedByPlain++
+		}
+		if prefix != nil && suffix != nil {
+			report.Overlaps = append(report.Overlaps, WildcardOverlap{
+				Host:   host,
+				Prefix: prefix.Target,
+				Suffix: suffix.Target,
+			})
+		}
+	}
+
+	for _, s := range stats {
+		report.Keys = append(report.Keys, *s)
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		if report.Keys[i].Hosts != report.Keys[j].Hosts {
+			return report.Keys[i].Hosts > report.Keys[j].Hosts
+		}
+		return report.Keys[i].Target < report.Keys[j].Target
+	})
+	sort.Slice(report.Overlaps, func(i, j int) bool { return report.Overlaps[i].Host < report.Overlaps[j].Host })
+	return report
+}
+
+// wildcardTarget returns the target of the given ruleset that is indexed
+// under the given key, or an empty string if there is none.
+func wildcardTarget(key string, rs *ruleset) string {
+	for _, target := range rs.target {
+		if strings.Contains(target, "*") && indexKey(target) == key {
+			return target
+		}
+	}
+	return ""
+}